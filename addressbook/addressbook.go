@@ -0,0 +1,209 @@
+// Package addressbook collects email addresses from several sources, for
+// completing recipients.
+//
+// A source that fails keeps the contacts it had last time, so one source
+// being down never empties the address book.
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long until sending an email counts for half when ranking contacts.
+const scoreHalfLife = 30 * 24 * time.Hour
+
+// Contact is one email address.
+type Contact struct {
+	Name  string
+	Email string
+	Count int       // Times sent to, if known.
+	Last  time.Time // Last sent to, if known.
+}
+
+// String returns the contact the way it's written in a To header.
+func (c *Contact) String() string {
+	return FormatAddress(c.Name, c.Email)
+}
+
+// FormatAddress returns an address the way it's written in a To header in
+// the editor. The name is only quoted if it has to be, and never encoded.
+func FormatAddress(name, email string) string {
+	switch {
+	case name == "":
+		return email
+	case strings.ContainsAny(name, `()<>[]:;@\,."`):
+		// Needs quoting.
+		return fmt.Sprintf(`"%s" <%s>`, quoteReplacer.Replace(name), email)
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+var quoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Source is somewhere contacts come from.
+type Source interface {
+	// Name is used in logs and errors.
+	Name() string
+
+	// Contacts returns all contacts in the source.
+	Contacts() ([]Contact, error)
+}
+
+// sourceState is the last contacts successfully gotten from a source.
+type sourceState struct {
+	src      Source
+	contacts []Contact
+	updated  time.Time // Zero if never successfully updated.
+}
+
+// Book is an address book with contacts from many sources.
+type Book struct {
+	refresh time.Duration
+
+	updateMu sync.Mutex // Only one update at a time.
+
+	mu      sync.Mutex
+	sources []*sourceState
+}
+
+// New creates an address book. Sources are updated at most every refresh.
+// Earlier sources take precedence when they have different names for the
+// same address.
+func New(refresh time.Duration, sources ...Source) *Book {
+	b := &Book{refresh: refresh}
+	for _, s := range sources {
+		b.sources = append(b.sources, &sourceState{src: s})
+	}
+	return b
+}
+
+// Update gets contacts from sources not updated within the refresh time,
+// and returns the errors from those that failed. They're retried next time.
+func (b *Book) Update() []error {
+	b.updateMu.Lock()
+	defer b.updateMu.Unlock()
+	b.mu.Lock()
+	states := append([]*sourceState(nil), b.sources...)
+	b.mu.Unlock()
+
+	var errs []error
+	for _, s := range states {
+		b.mu.Lock()
+		fresh := !s.updated.IsZero() && time.Since(s.updated) < b.refresh
+		b.mu.Unlock()
+		if fresh {
+			continue
+		}
+		st := time.Now()
+		cs, err := s.src.Contacts()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", s.src.Name(), err))
+			continue
+		}
+		log.Printf("Got %d contacts from %s in %v", len(cs), s.src.Name(), time.Since(st))
+		b.mu.Lock()
+		s.contacts = cs
+		s.updated = time.Now()
+		b.mu.Unlock()
+	}
+	return errs
+}
+
+// Contacts returns the contacts from all sources, one per address, best
+// ranked first. See score.
+func (b *Book) Contacts() []Contact {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ret []Contact
+	index := make(map[string]int)
+	for _, s := range b.sources {
+		for _, c := range s.contacts {
+			if c.Email == "" {
+				continue
+			}
+			key := strings.ToLower(c.Email)
+			n, found := index[key]
+			if !found {
+				index[key] = len(ret)
+				ret = append(ret, c)
+				continue
+			}
+			m := &ret[n]
+			if m.Name == "" {
+				m.Name = c.Name
+			}
+			m.Count += c.Count
+			if c.Last.After(m.Last) {
+				m.Last = c.Last
+			}
+		}
+	}
+	now := time.Now()
+	ranked := make(byScore, len(ret))
+	for n, c := range ret {
+		ranked[n] = rankedContact{Contact: c, score: c.score(now)}
+	}
+	sort.Stable(ranked)
+	for n := range ranked {
+		ret[n] = ranked[n].Contact
+	}
+	return ret
+}
+
+// Addresses returns all contacts as strings for a To header.
+func (b *Book) Addresses() []string {
+	var ret []string
+	for _, c := range b.Contacts() {
+		ret = append(ret, c.String())
+	}
+	return ret
+}
+
+// score ranks a contact by how often and how recently it's been sent to.
+// Every email sent counts as one, but less the older the last one is,
+// halving every scoreHalfLife.
+func (c *Contact) score(now time.Time) float64 {
+	if c.Count == 0 {
+		return 0
+	}
+	age := now.Sub(c.Last)
+	if age < 0 {
+		age = 0
+	}
+	return float64(c.Count) * math.Pow(0.5, float64(age)/float64(scoreHalfLife))
+}
+
+type rankedContact struct {
+	Contact
+	score float64
+}
+
+type byScore []rankedContact
+
+func (a byScore) Len() int           { return len(a) }
+func (a byScore) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byScore) Less(i, j int) bool { return a[i].score > a[j].score }
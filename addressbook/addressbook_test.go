@@ -0,0 +1,282 @@
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+	"github.com/ThomasHabets/cmdg/scheduler"
+)
+
+func TestFormatAddress(t *testing.T) {
+	for _, test := range []struct {
+		name, email, want string
+	}{
+		{"", "bob@example.com", "bob@example.com"},
+		{"Bob Smith", "bob@example.com", "Bob Smith <bob@example.com>"},
+		{"Smith, Bob", "bob@example.com", `"Smith, Bob" <bob@example.com>`},
+		{`Bob "the" \ Smith`, "bob@example.com", `"Bob \"the\" \\ Smith" <bob@example.com>`},
+		{"Åsa Öberg", "asa@example.com", "Åsa Öberg <asa@example.com>"},
+		{"Öberg, Åsa", "asa@example.com", `"Öberg, Åsa" <asa@example.com>`},
+	} {
+		if got := FormatAddress(test.name, test.email); got != test.want {
+			t.Errorf("%q %q: got %q, want %q", test.name, test.email, got, test.want)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	got, err := NewAliases("testdata/aliases").Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Contact{
+		{Name: "Bob Smith", Email: "bob@example.com"},
+		{Name: "alice", Email: "alice@example.com"},
+		{Name: "Doe, Jane", Email: "jane@example.com"},
+		{Name: "team", Email: "carl@example.com"},
+		{Name: "team", Email: "dave@example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := NewAliases("testdata/nonexistent").Contacts(); err == nil {
+		t.Errorf("want error for missing file")
+	}
+}
+
+func TestVCard(t *testing.T) {
+	want := []Contact{
+		{Name: "Erin Example", Email: "erin@example.com"},
+		{Name: "Erin Example", Email: "erin.home@example.com"},
+		{Name: "Fred Frank", Email: "fred@example.com"},
+	}
+	for _, p := range []string{"testdata/contacts.vcf", "testdata"} {
+		got, err := NewVCard([]string{p}).Contacts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", p, got, want)
+		}
+	}
+}
+
+func TestPeople(t *testing.T) {
+	f := fakegmail.New("me@example.com")
+	defer f.Close()
+	for n := 0; n < peoplePageSize+1; n++ {
+		f.AddContact(fmt.Sprintf("Person %d", n), fmt.Sprintf("p%d@example.com", n))
+	}
+	f.AddContact("", "noname@example.com", "noname2@example.com")
+	got, err := NewPeople(func() *http.Client { return http.DefaultClient }, f.URL()+"/v1/people/me/connections").Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(got), peoplePageSize+3; got != want {
+		t.Fatalf("got %d contacts, want %d", got, want)
+	}
+	if got, want := got[0], (Contact{Name: "Person 0", Email: "p0@example.com"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := got[len(got)-1], (Contact{Email: "noname2@example.com"}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := f.Requests("GET", "people/"), 2; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+
+	f.InjectError("", "people/", http.StatusForbidden, 1)
+	if _, err := NewPeople(func() *http.Client { return http.DefaultClient }, f.URL()+"/v1/people/me/connections").Contacts(); err == nil {
+		t.Errorf("want error")
+	}
+}
+
+func TestSent(t *testing.T) {
+	f := fakegmail.New("me@example.com")
+	defer f.Close()
+	for n, to := range []string{
+		"Bob <bob@example.com>",
+		"bob@example.com, Carl <carl@example.com>",
+		"Bobby <BOB@example.com>",
+	} {
+		if _, err := f.AddMessage(fmt.Sprintf("From: me@example.com\r\nTo: %s\r\nDate: Mon, %d Jan 2016 15:04:05 +0000\r\nSubject: %d\r\n\r\nHi\r\n", to, n+1, n), cmdglib.Sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.AddMessage("From: other@example.com\r\nTo: me@example.com\r\nCc: dave@example.com\r\nSubject: Not sent\r\n\r\nHi\r\n", cmdglib.Inbox); err != nil {
+		t.Fatal(err)
+	}
+	g, err := f.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.NewGmail(g, "me", nil)
+	sched := scheduler.New(1)
+	got, err := NewSent(func() backend.Backend { return b }, sched, 10).Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Contact{
+		"bob@example.com":  {Name: "Bobby", Email: "BOB@example.com", Count: 3, Last: time.Date(2016, 1, 3, 15, 4, 5, 0, time.UTC)},
+		"carl@example.com": {Name: "Carl", Email: "carl@example.com", Count: 1, Last: time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for _, c := range got {
+		w := want[strings.ToLower(c.Email)]
+		if c.Email != w.Email || c.Name != w.Name || c.Count != w.Count || !c.Last.Equal(w.Last) {
+			t.Errorf("got %+v, want %+v", c, w)
+		}
+	}
+
+	// Limited to the newest.
+	got, err = NewSent(func() backend.Backend { return b }, sched, 1).Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Count != 1 {
+		t.Errorf("got %+v, want one contact from one email", got)
+	}
+
+	// Emails that can't be gotten are skipped.
+	f.InjectError("GET", "messages/", http.StatusBadRequest, 1)
+	got, err = NewSent(func() backend.Backend { return b }, sched, 10).Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, c := range got {
+		count += c.Count
+	}
+	// Emails are fetched in parallel, so any one of them may be the one
+	// that fails. The second one has two addresses, the others one.
+	if count != 2 && count != 3 {
+		t.Errorf("got %+v, want the addresses of two emails", got)
+	}
+
+	// Unless it's all of them.
+	f.InjectError("GET", "messages/", http.StatusBadRequest, 3)
+	if _, err := NewSent(func() backend.Backend { return b }, sched, 10).Contacts(); err == nil {
+		t.Errorf("want error when no email can be gotten")
+	}
+}
+
+// fakeSource returns contacts, or an error if err is set.
+type fakeSource struct {
+	contacts []Contact
+	err      error
+	calls    int
+}
+
+func (f *fakeSource) Name() string { return "fake" }
+func (f *fakeSource) Contacts() ([]Contact, error) {
+	f.calls++
+	return f.contacts, f.err
+}
+
+func TestBook(t *testing.T) {
+	s1 := &fakeSource{contacts: []Contact{
+		{Name: "Bob", Email: "bob@example.com"},
+		{Email: "carl@example.com"},
+		{Name: "Smith, Alice", Email: "alice@example.com"},
+	}}
+	now := time.Now()
+	s2 := &fakeSource{contacts: []Contact{
+		// Often, but long ago.
+		{Name: "Robert", Email: "BOB@example.com", Count: 3, Last: now.Add(-3 * scoreHalfLife)},
+		// Once, just now.
+		{Name: "Carl", Email: "carl@example.com", Count: 1, Last: now},
+		// Often and recently.
+		{Name: "Dave", Email: "dave@example.com", Count: 2, Last: now.Add(-time.Hour)},
+	}}
+	b := New(time.Hour, s1, s2)
+	if errs := b.Update(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	want := []string{
+		"Dave <dave@example.com>",
+		"Carl <carl@example.com>",
+		"Bob <bob@example.com>",
+		`"Smith, Alice" <alice@example.com>`,
+	}
+	if got := b.Addresses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Not updated again until refresh time.
+	b.Update()
+	if s1.calls != 1 || s2.calls != 1 {
+		t.Errorf("got %d and %d calls, want 1", s1.calls, s2.calls)
+	}
+
+	// Failing source keeps its old contacts, and is retried.
+	b.refresh = 0
+	s1.err = errors.New("down")
+	s1.contacts = nil
+	if errs := b.Update(); len(errs) != 1 {
+		t.Errorf("got errors %v, want one", errs)
+	}
+	if got := b.Addresses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after failure got %q, want %q", got, want)
+	}
+	s1.err = nil
+	if errs := b.Update(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if got, want := len(b.Contacts()), 3; got != want {
+		t.Errorf("got %d contacts, want %d", got, want)
+	}
+}
+
+func TestSentBcc(t *testing.T) {
+	f := fakegmail.New("me@example.com")
+	defer f.Close()
+	if _, err := f.AddMessage("From: me@example.com\r\nTo: bob@example.com\r\nBcc: Eve <eve@example.com>\r\nDate: Mon, 1 Jan 2016 15:04:05 +0000\r\nSubject: Hi\r\n\r\nHi\r\n", cmdglib.Sent); err != nil {
+		t.Fatal(err)
+	}
+	g, err := f.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.NewGmail(g, "me", nil)
+	got, err := NewSent(func() backend.Backend { return b }, scheduler.New(1), 10).Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, c := range got {
+		emails = append(emails, c.Email)
+	}
+	sort.Strings(emails)
+	if want := []string{"bob@example.com", "eve@example.com"}; !reflect.DeepEqual(emails, want) {
+		t.Errorf("got %q, want %q", emails, want)
+	}
+}
@@ -0,0 +1,118 @@
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bufio"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+type aliases struct {
+	fn string
+}
+
+// NewAliases returns a source that reads a mutt style alias file, with
+// lines like "alias key Name <address>, other@example.com". Addresses
+// without a name get the alias key as their name.
+func NewAliases(fn string) Source {
+	return &aliases{fn: fn}
+}
+
+// Name implements Source.
+func (a *aliases) Name() string {
+	return "alias file " + a.fn
+}
+
+// Contacts implements Source.
+func (a *aliases) Contacts() ([]Contact, error) {
+	f, err := os.Open(a.fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ret []Contact
+	s := bufio.NewScanner(f)
+	var line string
+	for s.Scan() {
+		line += s.Text()
+		if strings.HasSuffix(line, `\`) {
+			// Continued on next line.
+			line = strings.TrimSuffix(line, `\`)
+			continue
+		}
+		ret = append(ret, parseAlias(line)...)
+		line = ""
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return append(ret, parseAlias(line)...), nil
+}
+
+// parseAlias parses one line of an alias file.
+func parseAlias(line string) []Contact {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "alias") {
+		return nil
+	}
+	rest := strings.TrimSpace(line[len("alias"):])
+	var key string
+	for {
+		var w string
+		w, rest = nextWord(rest)
+		if w == "-group" {
+			_, rest = nextWord(rest)
+			continue
+		}
+		key = w
+		break
+	}
+	if key == "" || rest == "" {
+		return nil
+	}
+	addrs, err := mail.ParseAddressList(rest)
+	if err != nil {
+		// Try one at a time, keeping the ones that parse.
+		for _, a := range strings.Split(rest, ",") {
+			if p, err := mail.ParseAddress(strings.TrimSpace(a)); err == nil {
+				addrs = append(addrs, p)
+			}
+		}
+	}
+	var ret []Contact
+	for _, a := range addrs {
+		c := Contact{Name: a.Name, Email: a.Address}
+		if c.Name == "" {
+			c.Name = key
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// nextWord returns the first whitespace separated word, and the rest.
+func nextWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if n := strings.IndexAny(s, " \t"); n >= 0 {
+		return s[:n], strings.TrimSpace(s[n:])
+	}
+	return s, ""
+}
@@ -0,0 +1,102 @@
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// PeopleURL is where the Google People API lists the user's contacts.
+const PeopleURL = "https://people.googleapis.com/v1/people/me/connections"
+
+const peoplePageSize = 1000
+
+type people struct {
+	client func() *http.Client
+	url    string
+}
+
+// NewPeople returns a source that gets contacts from the Google People
+// API at u, normally PeopleURL. client returns an authenticated client.
+func NewPeople(client func() *http.Client, u string) Source {
+	return &people{client: client, url: u}
+}
+
+// Name implements Source.
+func (p *people) Name() string {
+	return "Google contacts"
+}
+
+// Parts of the People API response that are used.
+type peopleResponse struct {
+	Connections []struct {
+		Names []struct {
+			DisplayName string `json:"displayName"`
+		} `json:"names"`
+		EmailAddresses []struct {
+			Value string `json:"value"`
+		} `json:"emailAddresses"`
+	} `json:"connections"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// Contacts implements Source.
+func (p *people) Contacts() ([]Contact, error) {
+	var ret []Contact
+	for page := ""; ; {
+		q := url.Values{}
+		q.Set("personFields", "names,emailAddresses")
+		q.Set("pageSize", fmt.Sprint(peoplePageSize))
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+		resp, err := p.client().Get(p.url + "?" + q.Encode())
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("HTTP status %q", resp.Status)
+		}
+		var r peopleResponse
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, fmt.Errorf("decoding: %v", err)
+		}
+		for _, c := range r.Connections {
+			var name string
+			if len(c.Names) > 0 {
+				name = c.Names[0].DisplayName
+			}
+			for _, e := range c.EmailAddresses {
+				ret = append(ret, Contact{Name: name, Email: e.Value})
+			}
+		}
+		if page = r.NextPageToken; page == "" {
+			return ret, nil
+		}
+	}
+}
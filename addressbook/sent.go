@@ -0,0 +1,155 @@
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/scheduler"
+)
+
+const (
+	sentPageSize = 500
+
+	// Fetch priority. Lower runs first, so this is after anything that's
+	// being looked at.
+	sentPriority = 10000
+)
+
+type sent struct {
+	b   func() backend.Backend
+	s   *scheduler.Scheduler
+	max int
+}
+
+// NewSent returns a source with the addresses the newest max sent emails
+// were sent to, with how many times and when last. The emails are fetched
+// through s.
+func NewSent(b func() backend.Backend, s *scheduler.Scheduler, max int) Source {
+	return &sent{b: b, s: s, max: max}
+}
+
+// Name implements Source.
+func (s *sent) Name() string {
+	return "sent email"
+}
+
+// Contacts implements Source.
+func (s *sent) Contacts() ([]Contact, error) {
+	b := s.b()
+	var ids []string
+	for page := ""; len(ids) < s.max; {
+		n := s.max - len(ids)
+		if n > sentPageSize {
+			n = sentPageSize
+		}
+		r, err := b.ListMessages(cmdglib.Sent, "", page, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range r.Messages {
+			ids = append(ids, m.Id)
+		}
+		if page = r.NextPageToken; page == "" {
+			break
+		}
+	}
+	if len(ids) > s.max {
+		ids = ids[:s.max]
+	}
+
+	// Emails that can't be gotten are skipped, unless it's all of them.
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for n := range ids {
+		wg.Add(1)
+		n := n
+		go func() {
+			defer wg.Done()
+			errs[n] = s.s.Do(context.Background(), sentPriority+n, func() error {
+				var err error
+				msgs[n], err = b.GetMessage(ids[n], "metadata")
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	var got []*gmail.Message
+	for n, err := range errs {
+		if err != nil {
+			log.Printf("Getting sent email %q for contacts: %v", ids[n], err)
+			continue
+		}
+		got = append(got, msgs[n])
+	}
+	if len(got) == 0 && len(ids) > 0 {
+		return nil, errs[0]
+	}
+	return sentContacts(got), nil
+}
+
+// sentContacts counts the recipients of sent messages.
+func sentContacts(msgs []*gmail.Message) []Contact {
+	var ret []Contact
+	index := make(map[string]int)
+	for _, m := range msgs {
+		t := time.Unix(m.InternalDate/1000, 0)
+		for _, h := range []string{"To", "Cc", "Bcc"} {
+			v := cmdglib.GetHeader(m, h)
+			if v == "" {
+				continue
+			}
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				key := strings.ToLower(a.Address)
+				n, found := index[key]
+				if !found {
+					index[key] = len(ret)
+					ret = append(ret, Contact{Name: a.Name, Email: a.Address, Count: 1, Last: t})
+					continue
+				}
+				c := &ret[n]
+				c.Count++
+				if t.After(c.Last) {
+					c.Last = t
+					if a.Name != "" {
+						c.Name = a.Name
+					}
+				}
+				if c.Name == "" {
+					c.Name = a.Name
+				}
+			}
+		}
+	}
+	return ret
+}
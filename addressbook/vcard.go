@@ -0,0 +1,153 @@
+package addressbook
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type vcards struct {
+	paths []string
+}
+
+// NewVCard returns a source that reads vCard files. paths are .vcf
+// files, or directories with .vcf files.
+func NewVCard(paths []string) Source {
+	return &vcards{paths: paths}
+}
+
+// Name implements Source.
+func (v *vcards) Name() string {
+	return "vCard " + strings.Join(v.paths, ",")
+}
+
+// Contacts implements Source.
+func (v *vcards) Contacts() ([]Contact, error) {
+	var ret []Contact
+	for _, p := range v.paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		fns := []string{p}
+		if fi.IsDir() {
+			fns = nil
+			fis, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range fis {
+				if !f.IsDir() && strings.HasSuffix(strings.ToLower(f.Name()), ".vcf") {
+					fns = append(fns, path.Join(p, f.Name()))
+				}
+			}
+		}
+		for _, fn := range fns {
+			cs, err := readVCardFile(fn)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, cs...)
+		}
+	}
+	return ret, nil
+}
+
+func readVCardFile(fn string) ([]Contact, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseVCard(f)
+}
+
+// vcardLines returns the lines of a vCard file, unfolded.
+func vcardLines(r io.Reader) ([]string, error) {
+	var ret []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimRight(s.Text(), "\r")
+		if (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && len(ret) > 0 {
+			ret[len(ret)-1] += l[1:]
+			continue
+		}
+		ret = append(ret, l)
+	}
+	return ret, s.Err()
+}
+
+var vcardUnescaper = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`)
+
+// parseVCard returns one contact per email address in the vCards.
+func parseVCard(r io.Reader) ([]Contact, error) {
+	lines, err := vcardLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Contact
+	var name, structured string
+	var emails []string
+	for _, l := range lines {
+		n := strings.Index(l, ":")
+		if n < 0 {
+			continue
+		}
+		prop, value := strings.ToUpper(l[:n]), l[n+1:]
+		if n := strings.Index(prop, ";"); n >= 0 {
+			prop = prop[:n]
+		}
+		if n := strings.LastIndex(prop, "."); n >= 0 {
+			// Group, like "item1.EMAIL".
+			prop = prop[n+1:]
+		}
+		switch prop {
+		case "BEGIN":
+			name, structured, emails = "", "", nil
+		case "FN":
+			name = vcardUnescaper.Replace(value)
+		case "N":
+			// Family;Given;Additional;Prefix;Suffix
+			f := strings.Split(value, ";")
+			if len(f) > 1 {
+				structured = strings.TrimSpace(vcardUnescaper.Replace(f[1]) + " " + vcardUnescaper.Replace(f[0]))
+			} else {
+				structured = vcardUnescaper.Replace(f[0])
+			}
+		case "EMAIL":
+			if e := strings.TrimSpace(value); e != "" {
+				emails = append(emails, strings.TrimPrefix(e, "mailto:"))
+			}
+		case "END":
+			if name == "" {
+				name = structured
+			}
+			for _, e := range emails {
+				ret = append(ret, Contact{Name: strings.TrimSpace(name), Email: e})
+			}
+			name, structured, emails = "", "", nil
+		}
+	}
+	return ret, nil
+}
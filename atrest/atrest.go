@@ -0,0 +1,311 @@
+// Package atrest encrypts mail data that cmdg keeps on disk, so that a
+// stolen laptop or backup doesn't expose it.
+//
+// All files are encrypted with AES-256-GCM using one random data key. The
+// data key is stored in the config directory, itself encrypted either with
+// GPG to a recipient, or with a key derived from a passphrase. That way
+// GPG or the slow key derivation only runs once, at startup.
+//
+// Data written before encryption was turned on doesn't start with the
+// magic string, and is returned as-is when read.
+package atrest
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+)
+
+const (
+	// Start of all encrypted data.
+	magic = "cmdg-atrest-v1\n"
+
+	keySize  = 32
+	saltSize = 16
+
+	keyFileMode os.FileMode = 0600
+
+	// Relative to the config directory.
+	GPGKeyFile        = "atrest-key.gpg"
+	PassphraseKeyFile = "atrest-key.json"
+)
+
+var (
+	// PBKDF2 iterations for new passphrase key files.
+	newIterations = 600000
+
+	// ErrNoKey is returned when reading encrypted data without a key.
+	ErrNoKey = errors.New("data is encrypted, but no key configured")
+
+	// ErrWrongPassphrase is returned when the passphrase doesn't decrypt the key file.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// Key encrypts and decrypts data. A nil *Key doesn't encrypt.
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKey returns a key that encrypts with k, which must be 32 bytes.
+func NewKey(k []byte) (*Key, error) {
+	if len(k) != keySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(k), keySize)
+	}
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead}, nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsEncrypted returns true if data was encrypted by Seal.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Seal encrypts data. If k is nil the data is returned as-is.
+func (k *Key) Seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	nonce, err := randomBytes(k.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	ret := append([]byte(magic), nonce...)
+	return k.aead.Seal(ret, nonce, plain, []byte(magic)), nil
+}
+
+// Open decrypts data encrypted by Seal. Data that isn't encrypted is
+// returned as-is, even if k is nil.
+func (k *Key) Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, ErrNoKey
+	}
+	data = data[len(magic):]
+	ns := k.aead.NonceSize()
+	if len(data) < ns {
+		return nil, errors.New("encrypted data truncated")
+	}
+	plain, err := k.aead.Open(nil, data[:ns], data[ns:], []byte(magic))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %v", err)
+	}
+	return plain, nil
+}
+
+// writeKeyFile writes a key file, failing if it already exists.
+func writeKeyFile(fn string, data []byte) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, keyFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(fn)
+		return err
+	}
+	return nil
+}
+
+// GPG returns the key in dir, encrypted with GPG. If there isn't one, a
+// new key is created and encrypted to recipient. Decrypting may ask for
+// the GPG passphrase, so it must be done before the UI starts.
+func GPG(dir, gpg, recipient string) (*Key, error) {
+	fn := path.Join(dir, GPGKeyFile)
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		k, err := randomBytes(keySize)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command(gpg, "--batch", "--no-tty", "--encrypt", "--recipient", recipient)
+		cmd.Stdin = bytes.NewReader(k)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		enc, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("encrypting key to %q: %v: %s", recipient, err, stderr.String())
+		}
+		if err := writeKeyFile(fn, enc); err != nil {
+			return nil, err
+		}
+		return NewKey(k)
+	}
+	cmd := exec.Command(gpg, "--batch", "--quiet", "--decrypt", fn)
+	cmd.Stderr = os.Stderr
+	k, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("decrypting key %q: %v", fn, err)
+	}
+	return NewKey(k)
+}
+
+// passphraseKeyFile is the key, encrypted with a key derived from a passphrase.
+type passphraseKeyFile struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Key        []byte `json:"key"` // Sealed with the derived key.
+}
+
+// Passphrase returns the key in dir, encrypted with a key derived from
+// passphrase. If there isn't one, a new key is created.
+func Passphrase(dir string, passphrase []byte) (*Key, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	fn := path.Join(dir, PassphraseKeyFile)
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return newPassphrase(fn, passphrase, newIterations)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var kf passphraseKeyFile
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("parsing key file %q: %v", fn, err)
+	}
+	if kf.Iterations < 1 {
+		return nil, fmt.Errorf("key file %q has bad iteration count %d", fn, kf.Iterations)
+	}
+	wrap, err := NewKey(pbkdf2SHA256(passphrase, kf.Salt, kf.Iterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	k, err := wrap.Open(kf.Key)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return NewKey(k)
+}
+
+// FromFlags returns the key in dir, given the -gpg, -encrypt_to and
+// -encrypt_passphrase_cmd flags. If neither recipient nor passCmd is set
+// it returns nil, meaning no encryption.
+func FromFlags(dir, gpg, recipient, passCmd string) (*Key, error) {
+	switch {
+	case recipient != "" && passCmd != "":
+		return nil, fmt.Errorf("-encrypt_to and -encrypt_passphrase_cmd can't both be used")
+	case recipient != "":
+		return GPG(dir, gpg, recipient)
+	case passCmd != "":
+		cmd := exec.Command(passCmd)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run %q: %v", passCmd, err)
+		}
+		return Passphrase(dir, bytes.TrimRight(out, "\r\n"))
+	}
+	return nil, nil
+}
+
+func newPassphrase(fn string, passphrase []byte, iterations int) (*Key, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	k, err := randomBytes(keySize)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := NewKey(pbkdf2SHA256(passphrase, salt, iterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := wrap.Seal(k)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&passphraseKeyFile{
+		Salt:       salt,
+		Iterations: iterations,
+		Key:        sealed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(fn, b); err != nil {
+		return nil, err
+	}
+	return NewKey(k)
+}
+
+// pbkdf2SHA256 derives a key from a password, as in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var ret []byte
+	for block := uint32(1); len(ret) < keyLen; block++ {
+		ret = append(ret, pbkdf2Block(prf, salt, iter, block)...)
+	}
+	return ret[:keyLen]
+}
+
+func pbkdf2Block(prf hash.Hash, salt []byte, iter int, block uint32) []byte {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], block)
+	prf.Reset()
+	prf.Write(salt)
+	prf.Write(n[:])
+	u := prf.Sum(nil)
+	t := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range t {
+			t[j] ^= u[j]
+		}
+	}
+	return t
+}
@@ -0,0 +1,205 @@
+package atrest
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cmdg-atrest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestPBKDF2(t *testing.T) {
+	// From RFC 7914.
+	for _, test := range []struct {
+		password, salt string
+		iter           int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iter, 64)); got != test.want {
+			t.Errorf("%q/%q/%d: got %s, want %s", test.password, test.salt, test.iter, got, test.want)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k, err := NewKey(bytes.Repeat([]byte{1}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("Subject: secret\n\nUnsent email.\n")
+	enc, err := k.Seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(enc) || bytes.Contains(enc, []byte("secret")) {
+		t.Errorf("not encrypted: %q", enc)
+	}
+	if got, err := k.Open(enc); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("got %q, %v, want %q", got, err, plain)
+	}
+
+	// Tampering is detected.
+	bad := append([]byte(nil), enc...)
+	bad[len(bad)-1] ^= 1
+	if _, err := k.Open(bad); err == nil {
+		t.Errorf("tampered data opened")
+	}
+
+	// Other key.
+	k2, err := NewKey(bytes.Repeat([]byte{2}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k2.Open(enc); err == nil {
+		t.Errorf("opened with wrong key")
+	}
+
+	// Unencrypted data, with or without key.
+	var nk *Key
+	for _, key := range []*Key{k, nk} {
+		if got, err := key.Open(plain); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("plaintext: got %q, %v, want %q", got, err, plain)
+		}
+	}
+	if got, err := nk.Seal(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("nil key sealed: got %q, %v", got, err)
+	}
+	if _, err := nk.Open(enc); err != ErrNoKey {
+		t.Errorf("got %v, want %v", err, ErrNoKey)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	old := newIterations
+	defer func() { newIterations = old }()
+	newIterations = 1000
+
+	k, err := Passphrase(dir, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := k.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path.Join(dir, PassphraseKeyFile)); err != nil || fi.Mode() != keyFileMode {
+		t.Errorf("key file: %v, %v", fi, err)
+	}
+
+	// Same key next time.
+	k2, err := Passphrase(dir, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k2.Open(enc); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+
+	if _, err := Passphrase(dir, []byte("hunter3")); err != ErrWrongPassphrase {
+		t.Errorf("got %v, want %v", err, ErrWrongPassphrase)
+	}
+	if _, err := Passphrase(dir, nil); err == nil {
+		t.Errorf("empty passphrase accepted")
+	}
+}
+
+func TestGPG(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	gpg := "testdata/gpg.sh"
+
+	if _, err := GPG(dir, gpg, "nokey@example.com"); err == nil {
+		t.Fatalf("want error with no public key")
+	}
+	if _, err := os.Stat(path.Join(dir, GPGKeyFile)); !os.IsNotExist(err) {
+		t.Errorf("key file written after failure: %v", err)
+	}
+
+	k, err := GPG(dir, gpg, "foo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := k.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := GPG(dir, gpg, "foo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k2.Open(enc); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+}
+
+func TestFromFlags(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	old := newIterations
+	defer func() { newIterations = old }()
+	newIterations = 1000
+
+	if k, err := FromFlags(dir, "gpg", "", ""); k != nil || err != nil {
+		t.Errorf("no flags: got %v, %v, want nil key", k, err)
+	}
+	if _, err := FromFlags(dir, "gpg", "foo@example.com", "cat"); err == nil {
+		t.Errorf("both -encrypt_to and -encrypt_passphrase_cmd accepted")
+	}
+
+	cmd := path.Join(dir, "pass.sh")
+	if err := ioutil.WriteFile(cmd, []byte("#!/bin/sh\necho hunter2\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	k, err := FromFlags(dir, "gpg", "", cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := k.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The trailing newline is not part of the passphrase.
+	k2, err := Passphrase(dir, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k2.Open(enc); err != nil || string(got) != "hello" {
+		t.Errorf("got %q, %v, want hello", got, err)
+	}
+
+	if _, err := FromFlags(dir, "gpg", "", path.Join(dir, "missing")); err == nil {
+		t.Errorf("failing passphrase command accepted")
+	}
+}
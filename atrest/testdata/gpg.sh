@@ -0,0 +1,25 @@
+#!/bin/sh
+# Fake gpg that "encrypts" by base64 encoding.
+set -e
+for a in "$@"; do
+	case "$a" in
+	--encrypt) mode=encrypt ;;
+	--decrypt) mode=decrypt ;;
+	--recipient) ;;
+	-*) ;;
+	*) last="$a" ;;
+	esac
+done
+case "$mode" in
+encrypt)
+	if [ "$last" = "nokey@example.com" ]; then
+		echo "gpg: $last: skipped: No public key" >&2
+		exit 2
+	fi
+	printf 'FAKEGPG\n'
+	base64
+	;;
+decrypt)
+	tail -n +2 "$last" | base64 -d
+	;;
+esac
@@ -0,0 +1,136 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ThomasHabets/cmdg/ncwrap"
+)
+
+// How much of a file http.DetectContentType looks at.
+const sniffLength = 512
+
+// attachment is a local file to be attached to an outgoing email.
+type attachment struct {
+	name        string // File name, without directory.
+	contentType string
+	data        []byte
+}
+
+// loadAttachment reads a file to attach.
+func loadAttachment(fn string) (*attachment, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(fn)
+	return &attachment{
+		name:        name,
+		contentType: detectContentType(name, data),
+		data:        data,
+	}, nil
+}
+
+// detectContentType guesses the MIME type from the file extension, or
+// failing that the content.
+func detectContentType(name string, data []byte) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	if len(data) > sniffLength {
+		data = data[:sniffLength]
+	}
+	return http.DetectContentType(data)
+}
+
+// mediaType formats a Content-Type with extra parameters added.
+func mediaType(t string, extra map[string]string) string {
+	mt, params, err := mime.ParseMediaType(t)
+	if err != nil {
+		mt, params = "application/octet-stream", make(map[string]string)
+	}
+	for k, v := range extra {
+		params[k] = v
+	}
+	return mime.FormatMediaType(mt, params)
+}
+
+// String returns a one line description of the attachment.
+func (a *attachment) String() string {
+	return fmt.Sprintf("%s (%s, %s)", a.name, a.contentType, sizeString(len(a.data)))
+}
+
+func sizeString(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// composeSummary returns what to show about an email before sending it.
+func composeSummary(msg string, atts []*attachment) []string {
+	headers, _ := splitMessage(msg)
+	var ret []string
+	for _, h := range headers {
+		lh := strings.ToLower(h)
+		for _, want := range []string{"to:", "cc:", "bcc:", "subject:"} {
+			if strings.HasPrefix(lh, want) {
+				ret = append(ret, strings.Replace(h, "\n", "", -1))
+			}
+		}
+	}
+	if len(atts) == 0 {
+		return append(ret, "Attachments: none")
+	}
+	ret = append(ret, "Attachments:")
+	for n, a := range atts {
+		ret = append(ret, fmt.Sprintf("  %d. %s", n+1, a))
+	}
+	return ret
+}
+
+// attachFileDialog asks the user for a file, and loads it. Returns nil if
+// aborted or failed.
+func attachFileDialog() *attachment {
+	defer nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	fn, err := loadFileDialog()
+	if err == errCancel {
+		return nil
+	}
+	if err != nil {
+		nc.Status("[red]Choosing file: %v", err)
+		return nil
+	}
+	a, err := loadAttachment(fn)
+	if err != nil {
+		nc.Status("[red]Reading %q: %v", fn, err)
+		return nil
+	}
+	nc.Status("[green]Attached %s", a)
+	return a
+}
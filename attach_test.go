@@ -0,0 +1,206 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+func TestDetectContentType(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"foo.pdf", "", "application/pdf"},
+		{"foo.PNG", "", "image/png"},
+		{"noext", "%PDF-1.4\n", "application/pdf"},
+		{"noext", "hello world\n", "text/plain; charset=utf-8"},
+		{"noext", "\x00\x01\x02\x03", "application/octet-stream"},
+	} {
+		if got := detectContentType(test.name, []byte(test.data)); got != test.want {
+			t.Errorf("%q %q: got %q, want %q", test.name, test.data, got, test.want)
+		}
+	}
+}
+
+// parseAttachments parses a multipart/mixed message, and returns the
+// body and the attachments.
+func parseAttachments(t *testing.T, raw string) (*mail.Message, string, []*attachment) {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mt, "multipart/mixed"; got != want {
+		t.Fatalf("got Content-Type %q, want %q", got, want)
+	}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	var body string
+	var atts []*attachment
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.FileName() == "" {
+			body = string(data)
+			continue
+		}
+		if got, want := p.Header.Get("Content-Transfer-Encoding"), "base64"; got != want {
+			t.Errorf("got encoding %q, want %q", got, want)
+		}
+		for _, l := range strings.Split(string(data), "\r\n") {
+			if len(l) > base64LineLength {
+				t.Errorf("base64 line too long: %d", len(l))
+			}
+		}
+		dec, err := base64.StdEncoding.DecodeString(strings.Replace(string(data), "\r\n", "", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		atts = append(atts, &attachment{name: p.FileName(), contentType: ct, data: dec})
+	}
+	return m, body, atts
+}
+
+func TestComposeAttachments(t *testing.T) {
+	msg := "To: foo@example.com\nSubject: Files\n\nSee attached.\n"
+	big := strings.Repeat("0123456789", 100)
+	raw, err := composeMessage(msg, []*attachment{
+		{name: "notes.txt", contentType: "text/plain; charset=utf-8", data: []byte(big)},
+		{name: "smörgås.pdf", contentType: "application/pdf", data: []byte("%PDF-1.4\x00\xff")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, body, atts := parseAttachments(t, raw)
+	if got, want := m.Header.Get("Subject"), "Files"; got != want {
+		t.Errorf("got subject %q, want %q", got, want)
+	}
+	if got, want := body, "See attached.\r\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if got, want := len(atts), 2; got != want {
+		t.Fatalf("got %d attachments, want %d", got, want)
+	}
+	for n, want := range []attachment{
+		{name: "notes.txt", contentType: "text/plain", data: []byte(big)},
+		{name: "smörgås.pdf", contentType: "application/pdf", data: []byte("%PDF-1.4\x00\xff")},
+	} {
+		got := atts[n]
+		if got.name != want.name || got.contentType != want.contentType || string(got.data) != string(want.data) {
+			t.Errorf("attachment %d: got %q %q %q, want %q %q %q", n, got.name, got.contentType, got.data, want.name, want.contentType, want.data)
+		}
+	}
+}
+
+func TestCreateSendAttachment(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "cmdg-attach-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "report.csv"), []byte("a,b\n1,2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	s := startHeadless(t)
+	defer stopHeadless()
+	// Attach: ".", "..", then the file. Then remove it, attach again, and send.
+	for _, k := range []gc.Key{'t', 'n', 'n', '\n', 'T', gc.KEY_DOWN, '\n', 't', 'n', 'n', '\n'} {
+		nc.Input <- k
+	}
+	done := make(chan error)
+	go func() { done <- createSend("", "To: foo@example.com\nSubject: Report\n\nHere.\n") }()
+	if !s.WaitFor("1. report.csv (text/csv", 5*time.Second) {
+		t.Fatalf("attachment not in summary. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 's'
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := mailBackend.ListMessages(cmdglib.Sent, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Fatalf("got %d sent, want %d", got, want)
+	}
+	m, err := mailBackend.GetMessage(res.Messages[0].Id, "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := mimeDecode(m.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, atts := parseAttachments(t, raw)
+	if got, want := body, "Here.\r\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if got, want := len(atts), 1; got != want {
+		t.Fatalf("got %d attachments, want %d", got, want)
+	}
+	if got, want := atts[0].name, "report.csv"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if got, want := string(atts[0].data), "a,b\n1,2\n"; got != want {
+		t.Errorf("got data %q, want %q", got, want)
+	}
+}
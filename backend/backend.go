@@ -0,0 +1,106 @@
+// Package backend abstracts the mail store that cmdg talks to.
+package backend
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"net/http"
+
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// MetadataHeaders are the headers fetched with format "metadata". They're
+// the ones needed to show a message in a list, and to collect addresses
+// from sent email.
+var MetadataHeaders = []string{"From", "To", "Cc", "Bcc", "Subject", "Date"}
+
+// MaxBatch is the most messages that can be changed in one batch call.
+const MaxBatch = 1000
+
+// Backend is a mail store. The Gmail API data types are used as the
+// common data model, since that's what the rest of cmdg speaks.
+type Backend interface {
+	// ListMessages lists message stubs (ID and thread ID only).
+	// label is the label ID ("" means all mail).
+	// search is the search query ("" means match all).
+	ListMessages(label, search, pageToken string, nres int64) (*gmail.ListMessagesResponse, error)
+
+	// GetMessage gets one message. format is "full", "metadata", "minimal" or "raw".
+	// With "metadata" only MetadataHeaders are included.
+	GetMessage(id, format string) (*gmail.Message, error)
+
+	// ModifyMessage adds and removes label IDs on one message.
+	ModifyMessage(id string, add, remove []string) error
+
+	// TrashMessage moves a message to the trash.
+	TrashMessage(id string) error
+
+	// BatchModifyMessages adds and removes label IDs on up to MaxBatch messages.
+	BatchModifyMessages(ids []string, add, remove []string) error
+
+	// BatchTrashMessages moves up to MaxBatch messages to the trash.
+	BatchTrashMessages(ids []string) error
+
+	// SendMessage sends a message with the Raw field set.
+	SendMessage(m *gmail.Message) (*gmail.Message, error)
+
+	// GetAttachment downloads an attachment of a message.
+	GetAttachment(msgID, id string) (*gmail.MessagePartBody, error)
+
+	// ListThreads lists thread stubs. Arguments like ListMessages.
+	ListThreads(label, search, pageToken string, nres int64) (*gmail.ListThreadsResponse, error)
+
+	// GetThread gets one thread, including its messages.
+	GetThread(id, format string) (*gmail.Thread, error)
+
+	// ListDrafts lists draft stubs.
+	ListDrafts(pageToken string, nres int64) (*gmail.ListDraftsResponse, error)
+
+	// CreateDraft creates a new draft.
+	CreateDraft(d *gmail.Draft) (*gmail.Draft, error)
+
+	// UpdateDraft replaces the content of an existing draft.
+	UpdateDraft(id string, d *gmail.Draft) (*gmail.Draft, error)
+
+	// SendDraft sends an existing draft, which is then deleted.
+	SendDraft(id string) (*gmail.Message, error)
+
+	// DeleteDraft permanently deletes a draft.
+	DeleteDraft(id string) error
+
+	// ListLabels lists all labels.
+	ListLabels() ([]*gmail.Label, error)
+
+	// ListHistory lists changes since a history ID.
+	ListHistory(startHistoryID uint64, pageToken string, nres int64) (*gmail.ListHistoryResponse, error)
+
+	// GetProfile gets the profile of the logged in user.
+	GetProfile() (*gmail.Profile, error)
+
+	// ListSendAs lists the addresses the user can send as, including the primary one.
+	ListSendAs() ([]*gmail.SendAs, error)
+}
+
+// IsNotFound returns true if err is the server saying that the requested
+// object doesn't exist. For History that means the start ID is too old.
+func IsNotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
@@ -0,0 +1,509 @@
+package backend
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+const (
+	cacheDirMode  os.FileMode = 0700
+	cacheFileMode os.FileMode = 0600
+
+	// Relative to the cache directory.
+	cacheStateFile   = "state.json"
+	cacheLabelsFile  = "labels.json"
+	cacheSendAsFile  = "sendas.json"
+	cacheMessagesDir = "messages"
+	cacheThreadsDir  = "threads"
+	cacheListsDir    = "lists"
+
+	historyPageSize = 500
+)
+
+var (
+	// Formats that messages and threads can be cached in.
+	cacheFormats = []string{"full", "metadata", "minimal", "raw"}
+
+	// IDs that are safe to use as file names.
+	cacheIDRE = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+)
+
+// Cache is a Backend that keeps messages, threads and labels on disk, so
+// that they only need to be fetched once. Sync keeps the cache up to date
+// by applying changes from the History API.
+//
+// Nothing is cached until the first Sync, since before that there's no
+// history ID to sync from.
+type Cache struct {
+	Backend
+	dir string
+	key *atrest.Key // Encrypts files, if not nil.
+
+	mu        sync.Mutex
+	historyID uint64 // History ID that the cache is in sync with.
+}
+
+type cacheState struct {
+	HistoryID uint64 `json:"historyId,string"`
+}
+
+// NewCache creates a Cache in dir, in front of b. If key is not nil the
+// files are encrypted with it. A cache written with other encryption
+// settings is cleared.
+func NewCache(b Backend, dir string, key *atrest.Key) (*Cache, error) {
+	for _, d := range []string{cacheMessagesDir, cacheThreadsDir, cacheListsDir} {
+		if err := os.MkdirAll(path.Join(dir, d), cacheDirMode); err != nil {
+			return nil, err
+		}
+	}
+	c := &Cache{
+		Backend: b,
+		dir:     dir,
+		key:     key,
+	}
+	if b, err := ioutil.ReadFile(path.Join(dir, cacheStateFile)); err == nil && atrest.IsEncrypted(b) != (key != nil) {
+		log.Printf("Cache encryption changed, clearing cache")
+		if err := c.clear(); err != nil {
+			return nil, fmt.Errorf("clearing cache: %v", err)
+		}
+	}
+	var st cacheState
+	if err := c.read(cacheStateFile, &st); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading cache state: %v", err)
+	}
+	c.historyID = st.HistoryID
+	return c, nil
+}
+
+// HistoryID returns the history ID that the cache is in sync with.
+func (c *Cache) HistoryID() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.historyID
+}
+
+// read reads a JSON file in the cache directory.
+func (c *Cache) read(fn string, v interface{}) error {
+	b, err := ioutil.ReadFile(path.Join(c.dir, fn))
+	if err != nil {
+		return err
+	}
+	if b, err = c.key.Open(b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// write atomically writes a JSON file in the cache directory.
+func (c *Cache) write(fn string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if b, err = c.key.Seal(b); err != nil {
+		return err
+	}
+	full := path.Join(c.dir, fn)
+	tmp := full + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, cacheFileMode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, full)
+}
+
+// remove removes a file in the cache directory, if it exists.
+func (c *Cache) remove(fn string) {
+	if err := os.Remove(path.Join(c.dir, fn)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Removing cache file %q: %v", fn, err)
+	}
+}
+
+// messageFile returns the cache file name of a message. The API takes the
+// format in any case, but only cacheFormats are updated when things
+// change.
+func messageFile(id, format string) string {
+	return path.Join(cacheMessagesDir, id+"."+strings.ToLower(format))
+}
+
+func threadFile(id, format string) string {
+	return path.Join(cacheThreadsDir, id+"."+strings.ToLower(format))
+}
+
+func listFile(label, search string) string {
+	return path.Join(cacheListsDir, fmt.Sprintf("%x", sha1.Sum([]byte(label+"\x00"+search))))
+}
+
+// store writes an object to the cache, unless the cache was synced while
+// it was being fetched, in which case it may already be out of date.
+// h is the history ID from before the fetch started.
+func (c *Cache) store(h uint64, fn string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h == 0 || h != c.historyID {
+		return
+	}
+	if err := c.write(fn, v); err != nil {
+		log.Printf("Writing cache file %q: %v", fn, err)
+	}
+}
+
+// lookup reads a cached object, returning the history ID it must be
+// stored with if it wasn't cached.
+func (c *Cache) lookup(fn string, v interface{}) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.read(fn, v)
+	if err == nil {
+		return 0, true
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("Reading cache file %q: %v", fn, err)
+	}
+	return c.historyID, false
+}
+
+// GetMessage implements Backend.
+func (c *Cache) GetMessage(id, format string) (*gmail.Message, error) {
+	if !cacheIDRE.MatchString(id) {
+		return c.Backend.GetMessage(id, format)
+	}
+	fn := messageFile(id, format)
+	var m gmail.Message
+	h, found := c.lookup(fn, &m)
+	if found {
+		return &m, nil
+	}
+	msg, err := c.Backend.GetMessage(id, format)
+	if err != nil {
+		return nil, err
+	}
+	c.store(h, fn, msg)
+	return msg, nil
+}
+
+// GetThread implements Backend.
+func (c *Cache) GetThread(id, format string) (*gmail.Thread, error) {
+	if !cacheIDRE.MatchString(id) {
+		return c.Backend.GetThread(id, format)
+	}
+	fn := threadFile(id, format)
+	var t gmail.Thread
+	h, found := c.lookup(fn, &t)
+	if found {
+		return &t, nil
+	}
+	thread, err := c.Backend.GetThread(id, format)
+	if err != nil {
+		return nil, err
+	}
+	c.store(h, fn, thread)
+	return thread, nil
+}
+
+// ListMessages implements Backend. The first page is saved for CachedMessages.
+func (c *Cache) ListMessages(label, search, pageToken string, nres int64) (*gmail.ListMessagesResponse, error) {
+	res, err := c.Backend.ListMessages(label, search, pageToken, nres)
+	if err != nil {
+		return nil, err
+	}
+	if pageToken == "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.write(listFile(label, search), res.Messages); err != nil {
+			log.Printf("Writing cached list: %v", err)
+		}
+	}
+	return res, nil
+}
+
+// CachedMessages returns the messages that were in the first page of the
+// last list of the label and search, as far as they are still cached.
+// It never talks to the server.
+func (c *Cache) CachedMessages(label, search string) []*gmail.Message {
+	var stubs []*gmail.Message
+	if _, found := c.lookup(listFile(label, search), &stubs); !found {
+		return nil
+	}
+	var ret []*gmail.Message
+	for _, s := range stubs {
+		if !cacheIDRE.MatchString(s.Id) {
+			continue
+		}
+		for _, f := range []string{"metadata", "full"} {
+			var m gmail.Message
+			if _, found := c.lookup(messageFile(s.Id, f), &m); found {
+				ret = append(ret, &m)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// ListLabels implements Backend. If the server can't be reached the
+// last known labels are returned.
+func (c *Cache) ListLabels() ([]*gmail.Label, error) {
+	ls, err := c.Backend.ListLabels()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		var cached []*gmail.Label
+		if err2 := c.read(cacheLabelsFile, &cached); err2 != nil {
+			return nil, err
+		}
+		log.Printf("Listing labels failed, using cached labels: %v", err)
+		return cached, nil
+	}
+	if err := c.write(cacheLabelsFile, ls); err != nil {
+		log.Printf("Writing cached labels: %v", err)
+	}
+	return ls, nil
+}
+
+// ListSendAs implements Backend. If the server can't be reached the
+// last known addresses are returned.
+func (c *Cache) ListSendAs() ([]*gmail.SendAs, error) {
+	sas, err := c.Backend.ListSendAs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		var cached []*gmail.SendAs
+		if err2 := c.read(cacheSendAsFile, &cached); err2 != nil {
+			return nil, err
+		}
+		log.Printf("Listing send-as addresses failed, using cached ones: %v", err)
+		return cached, nil
+	}
+	if err := c.write(cacheSendAsFile, sas); err != nil {
+		log.Printf("Writing cached send-as addresses: %v", err)
+	}
+	return sas, nil
+}
+
+// ModifyMessage implements Backend.
+func (c *Cache) ModifyMessage(id string, add, remove []string) error {
+	if err := c.Backend.ModifyMessage(id, add, remove); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateLabels(&gmail.Message{Id: id}, add, remove)
+	return nil
+}
+
+// TrashMessage implements Backend.
+func (c *Cache) TrashMessage(id string) error {
+	if err := c.Backend.TrashMessage(id); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget(&gmail.Message{Id: id})
+	return nil
+}
+
+// BatchModifyMessages implements Backend.
+func (c *Cache) BatchModifyMessages(ids []string, add, remove []string) error {
+	if err := c.Backend.BatchModifyMessages(ids, add, remove); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.updateLabels(&gmail.Message{Id: id}, add, remove)
+	}
+	return nil
+}
+
+// BatchTrashMessages implements Backend.
+func (c *Cache) BatchTrashMessages(ids []string) error {
+	if err := c.Backend.BatchTrashMessages(ids); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.forget(&gmail.Message{Id: id})
+	}
+	return nil
+}
+
+// Sync brings the cache up to date with changes on the server. If the
+// cache is too old to be synced, it's cleared.
+func (c *Cache) Sync() error {
+	h := c.HistoryID()
+	if h == 0 {
+		return c.reset()
+	}
+	var hs []*gmail.History
+	newID := h
+	for pageToken := ""; ; {
+		res, err := c.Backend.ListHistory(h, pageToken, historyPageSize)
+		if IsNotFound(err) {
+			log.Printf("Cache history ID %d too old, clearing cache", h)
+			return c.reset()
+		}
+		if err != nil {
+			return err
+		}
+		hs = append(hs, res.History...)
+		newID = res.HistoryId
+		pageToken = res.NextPageToken
+		if pageToken == "" {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.historyID != h {
+		// Someone else synced while we were fetching.
+		return nil
+	}
+	for _, e := range hs {
+		c.apply(e)
+	}
+	return c.setHistoryID(newID)
+}
+
+// reset clears the cache, and makes it start over from the current history ID.
+func (c *Cache) reset() error {
+	p, err := c.Backend.GetProfile()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range []string{cacheMessagesDir, cacheThreadsDir} {
+		fs, err := ioutil.ReadDir(path.Join(c.dir, d))
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			c.remove(path.Join(d, f.Name()))
+		}
+	}
+	return c.setHistoryID(p.HistoryId)
+}
+
+// clear removes all cached data.
+func (c *Cache) clear() error {
+	for _, d := range []string{cacheMessagesDir, cacheThreadsDir, cacheListsDir} {
+		fs, err := ioutil.ReadDir(path.Join(c.dir, d))
+		if err != nil {
+			return err
+		}
+		for _, f := range fs {
+			c.remove(path.Join(d, f.Name()))
+		}
+	}
+	for _, fn := range []string{cacheStateFile, cacheLabelsFile, cacheSendAsFile} {
+		c.remove(fn)
+	}
+	return nil
+}
+
+// setHistoryID must be called with the lock held.
+func (c *Cache) setHistoryID(h uint64) error {
+	if err := c.write(cacheStateFile, &cacheState{HistoryID: h}); err != nil {
+		return err
+	}
+	c.historyID = h
+	return nil
+}
+
+// apply applies one history record. Must be called with the lock held.
+func (c *Cache) apply(h *gmail.History) {
+	for _, m := range h.MessagesAdded {
+		c.forgetThread(m.Message.ThreadId)
+	}
+	for _, m := range h.MessagesDeleted {
+		c.forget(m.Message)
+	}
+	for _, l := range h.LabelsAdded {
+		c.updateLabels(l.Message, l.LabelIds, nil)
+	}
+	for _, l := range h.LabelsRemoved {
+		c.updateLabels(l.Message, nil, l.LabelIds)
+	}
+}
+
+// updateLabels changes labels on all cached copies of a message, and
+// forgets the thread it's in. Must be called with the lock held.
+func (c *Cache) updateLabels(msg *gmail.Message, add, remove []string) {
+	if !cacheIDRE.MatchString(msg.Id) {
+		return
+	}
+	c.forgetThread(msg.ThreadId)
+	for _, f := range cacheFormats {
+		fn := messageFile(msg.Id, f)
+		var m gmail.Message
+		if err := c.read(fn, &m); err != nil {
+			continue
+		}
+		c.forgetThread(m.ThreadId)
+		m.LabelIds = cmdglib.ChangeLabels(m.LabelIds, add, remove)
+		if err := c.write(fn, &m); err != nil {
+			log.Printf("Writing cache file %q: %v", fn, err)
+			c.remove(fn)
+		}
+	}
+}
+
+// forget removes all cached copies of a message, and the thread it's
+// in. Must be called with the lock held.
+func (c *Cache) forget(msg *gmail.Message) {
+	if !cacheIDRE.MatchString(msg.Id) {
+		return
+	}
+	c.forgetThread(msg.ThreadId)
+	for _, f := range cacheFormats {
+		fn := messageFile(msg.Id, f)
+		var m gmail.Message
+		if err := c.read(fn, &m); err == nil {
+			c.forgetThread(m.ThreadId)
+		}
+		c.remove(fn)
+	}
+}
+
+// forgetThread must be called with the lock held.
+func (c *Cache) forgetThread(id string) {
+	if !cacheIDRE.MatchString(id) {
+		return
+	}
+	for _, f := range cacheFormats {
+		c.remove(threadFile(id, f))
+	}
+}
@@ -0,0 +1,313 @@
+package backend
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+)
+
+func newTestCache(t *testing.T) (*fakegmail.Server, Backend, *Cache, func()) {
+	f, err := fakegmail.NewFixture("cmdg-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewGmail(f.Service, "me", nil)
+	c, err := NewCache(b, f.Dir, nil)
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f.Server, b, c, f.Close
+}
+
+func addMessage(t *testing.T, f *fakegmail.Server, n int, labels ...string) string {
+	id, err := f.AddTestMessage(n, labels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCacheGetMessage(t *testing.T) {
+	f, b, c, cleanup := newTestCache(t)
+	defer cleanup()
+	id := addMessage(t, f, 1, cmdglib.Inbox)
+
+	// Not synced yet, so nothing is cached.
+	for n := 1; n <= 2; n++ {
+		if _, err := c.GetMessage(id, "full"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := f.Requests("GET", "messages/"), n; got != want {
+			t.Errorf("got %d gets, want %d", got, want)
+		}
+	}
+
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		m, err := c.GetMessage(id, "full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cmdglib.GetHeader(m, "Subject"), "Message 1"; got != want {
+			t.Errorf("got subject %q, want %q", got, want)
+		}
+		if got, want := f.Requests("GET", "messages/"), 3; got != want {
+			t.Errorf("got %d gets, want %d", got, want)
+		}
+	}
+
+	// Other formats are cached separately.
+	if _, err := c.GetMessage(id, "raw"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("GET", "messages/"), 4; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+
+	// Format is case insensitive, and label changes update the same file.
+	if err := c.ModifyMessage(id, []string{cmdglib.Starred}, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.GetMessage(id, "RAW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("GET", "messages/"), 4; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+	if !cmdglib.HasLabel(m.LabelIds, cmdglib.Starred) {
+		t.Errorf("got labels %q, want starred", m.LabelIds)
+	}
+
+	// Survives restart.
+	c2, err := NewCache(b, c.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.GetMessage(id, "full"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("GET", "messages/"), 4; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+}
+
+func TestCacheSync(t *testing.T) {
+	f, b, c, cleanup := newTestCache(t)
+	defer cleanup()
+	id1 := addMessage(t, f, 1, cmdglib.Inbox, cmdglib.Unread)
+	id2 := addMessage(t, f, 2, cmdglib.Inbox)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{id1, id2} {
+		if _, err := c.GetMessage(id, "full"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change through the cache.
+	if err := c.ModifyMessage(id1, nil, []string{cmdglib.Unread}); err != nil {
+		t.Fatal(err)
+	}
+	// Change behind its back.
+	if err := b.ModifyMessage(id2, []string{cmdglib.Unread}, []string{cmdglib.Inbox}); err != nil {
+		t.Fatal(err)
+	}
+
+	gets := f.Requests("GET", "messages/")
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.HistoryID(), f.HistoryID(); got != want {
+		t.Errorf("history ID: got %d, want %d", got, want)
+	}
+	for _, test := range []struct {
+		id   string
+		want []string
+	}{
+		{id1, []string{cmdglib.Inbox}},
+		{id2, []string{cmdglib.Unread}},
+	} {
+		m, err := c.GetMessage(test.id, "full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.LabelIds, test.want) {
+			t.Errorf("labels of %q: got %q, want %q", test.id, m.LabelIds, test.want)
+		}
+	}
+	if got, want := f.Requests("GET", "messages/"), gets; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+
+	// Trashed messages are refetched.
+	if err := c.TrashMessage(id2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMessage(id2, "full"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("GET", "messages/"), gets+1; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+}
+
+func TestCacheExpired(t *testing.T) {
+	f, b, c, cleanup := newTestCache(t)
+	defer cleanup()
+	id := addMessage(t, f, 1, cmdglib.Inbox)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMessage(id, "full"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ModifyMessage(id, []string{cmdglib.Unread}, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.ExpireHistory()
+
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.GetMessage(id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmdglib.HasLabel(m.LabelIds, cmdglib.Unread) {
+		t.Errorf("cache not cleared. Labels: %q", m.LabelIds)
+	}
+	if got, want := f.Requests("GET", "messages/"), 2; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+}
+
+func TestCacheCachedMessages(t *testing.T) {
+	f, _, c, cleanup := newTestCache(t)
+	defer cleanup()
+	for n := 1; n <= 3; n++ {
+		addMessage(t, f, n, cmdglib.Inbox)
+	}
+	if got := c.CachedMessages(cmdglib.Inbox, ""); len(got) != 0 {
+		t.Errorf("got %d cached messages before listing, want 0", len(got))
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.ListMessages(cmdglib.Inbox, "", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only fetch two of them.
+	for _, m := range res.Messages[:2] {
+		if _, err := c.GetMessage(m.Id, "full"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := c.CachedMessages(cmdglib.Inbox, "")
+	if len(got) != 2 {
+		t.Fatalf("got %d cached messages, want 2", len(got))
+	}
+	for n, m := range got {
+		if got, want := m.Id, res.Messages[n].Id; got != want {
+			t.Errorf("message %d: got %q, want %q", n, got, want)
+		}
+	}
+	if got := c.CachedMessages(cmdglib.Inbox, "foo"); len(got) != 0 {
+		t.Errorf("got %d cached messages for other search, want 0", len(got))
+	}
+}
+
+func TestCacheEncrypted(t *testing.T) {
+	f, b, c, cleanup := newTestCache(t)
+	defer cleanup()
+	id := addMessage(t, f, 1, cmdglib.Inbox)
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMessage(id, "full"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning on encryption clears the plaintext cache.
+	key, err := atrest.NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewCache(b, c.dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(c.dir, messageFile(id, "full"))); !os.IsNotExist(err) {
+		t.Errorf("plaintext cache not cleared: %v", err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		m, err := c.GetMessage(id, "full")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := cmdglib.GetHeader(m, "Subject"), "Message 1"; got != want {
+			t.Errorf("got subject %q, want %q", got, want)
+		}
+	}
+	if got, want := f.Requests("GET", "messages/"), 2; got != want {
+		t.Errorf("got %d gets, want %d", got, want)
+	}
+	data, err := ioutil.ReadFile(path.Join(c.dir, messageFile(id, "full")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !atrest.IsEncrypted(data) || bytes.Contains(data, []byte("Message 1")) {
+		t.Errorf("cache file not encrypted: %q", data)
+	}
+
+	// Survives restart with the same key.
+	c, err = NewCache(b, c.dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMessage(id, "full"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("GET", "messages/"), 2; got != want {
+		t.Errorf("got %d gets after restart, want %d", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package backend
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+// Gmail is a Backend talking to the Gmail API.
+type Gmail struct {
+	g          *gmail.Service
+	email      string
+	profileAPI func(op string, d time.Duration)
+}
+
+// NewGmail creates a new Gmail backend.
+// email is the user ID, usually "me".
+// profileAPI is called with the time taken by each successful API call, and may be nil.
+func NewGmail(g *gmail.Service, email string, profileAPI func(op string, d time.Duration)) *Gmail {
+	if profileAPI == nil {
+		profileAPI = func(string, time.Duration) {}
+	}
+	return &Gmail{
+		g:          g,
+		email:      email,
+		profileAPI: profileAPI,
+	}
+}
+
+// ListMessages implements Backend.
+func (b *Gmail) ListMessages(label, search, pageToken string, nres int64) (*gmail.ListMessagesResponse, error) {
+	st := time.Now()
+	q := b.g.Users.Messages.List(b.email).
+		PageToken(pageToken).
+		MaxResults(nres).
+		Fields("messages,nextPageToken,resultSizeEstimate")
+	if label != "" {
+		q = q.LabelIds(label)
+	}
+	if search != "" {
+		q = q.Q(search)
+	}
+	res, err := q.Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Messages.List", time.Since(st))
+	return res, nil
+}
+
+// GetMessage implements Backend.
+func (b *Gmail) GetMessage(id, format string) (*gmail.Message, error) {
+	st := time.Now()
+	q := b.g.Users.Messages.Get(b.email, id).Format(format)
+	if format == "metadata" {
+		q = q.MetadataHeaders(MetadataHeaders...)
+	}
+	m, err := q.Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Messages.Get", time.Since(st))
+	return m, nil
+}
+
+// ModifyMessage implements Backend.
+func (b *Gmail) ModifyMessage(id string, add, remove []string) error {
+	st := time.Now()
+	if _, err := b.g.Users.Messages.Modify(b.email, id, &gmail.ModifyMessageRequest{
+		AddLabelIds:    add,
+		RemoveLabelIds: remove,
+	}).Do(); err != nil {
+		return err
+	}
+	b.profileAPI("Users.Messages.Modify", time.Since(st))
+	return nil
+}
+
+// TrashMessage implements Backend.
+func (b *Gmail) TrashMessage(id string) error {
+	st := time.Now()
+	if _, err := b.g.Users.Messages.Trash(b.email, id).Do(); err != nil {
+		return err
+	}
+	b.profileAPI("Users.Messages.Trash", time.Since(st))
+	return nil
+}
+
+// BatchModifyMessages implements Backend.
+func (b *Gmail) BatchModifyMessages(ids []string, add, remove []string) error {
+	st := time.Now()
+	if err := b.g.Users.Messages.BatchModify(b.email, &gmail.BatchModifyMessagesRequest{
+		Ids:            ids,
+		AddLabelIds:    add,
+		RemoveLabelIds: remove,
+	}).Do(); err != nil {
+		return err
+	}
+	b.profileAPI("Users.Messages.BatchModify", time.Since(st))
+	return nil
+}
+
+// BatchTrashMessages implements Backend.
+// There's no batch trash call, but adding the TRASH label does the same thing.
+func (b *Gmail) BatchTrashMessages(ids []string) error {
+	return b.BatchModifyMessages(ids, []string{cmdglib.Trash}, nil)
+}
+
+// SendMessage implements Backend.
+func (b *Gmail) SendMessage(m *gmail.Message) (*gmail.Message, error) {
+	st := time.Now()
+	ret, err := b.g.Users.Messages.Send(b.email, m).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Messages.Send", time.Since(st))
+	return ret, nil
+}
+
+// GetAttachment implements Backend.
+func (b *Gmail) GetAttachment(msgID, id string) (*gmail.MessagePartBody, error) {
+	st := time.Now()
+	body, err := b.g.Users.Messages.Attachments.Get(b.email, msgID, id).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Messages.Attachments.Get", time.Since(st))
+	return body, nil
+}
+
+// ListThreads implements Backend.
+func (b *Gmail) ListThreads(label, search, pageToken string, nres int64) (*gmail.ListThreadsResponse, error) {
+	st := time.Now()
+	q := b.g.Users.Threads.List(b.email).
+		PageToken(pageToken).
+		MaxResults(nres).
+		Fields("threads,nextPageToken,resultSizeEstimate")
+	if label != "" {
+		q = q.LabelIds(label)
+	}
+	if search != "" {
+		q = q.Q(search)
+	}
+	res, err := q.Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Threads.List", time.Since(st))
+	return res, nil
+}
+
+// GetThread implements Backend.
+func (b *Gmail) GetThread(id, format string) (*gmail.Thread, error) {
+	st := time.Now()
+	t, err := b.g.Users.Threads.Get(b.email, id).Format(format).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Threads.Get", time.Since(st))
+	return t, nil
+}
+
+// ListDrafts implements Backend.
+func (b *Gmail) ListDrafts(pageToken string, nres int64) (*gmail.ListDraftsResponse, error) {
+	st := time.Now()
+	res, err := b.g.Users.Drafts.List(b.email).MaxResults(nres).PageToken(pageToken).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Drafts.List", time.Since(st))
+	return res, nil
+}
+
+// CreateDraft implements Backend.
+func (b *Gmail) CreateDraft(d *gmail.Draft) (*gmail.Draft, error) {
+	st := time.Now()
+	ret, err := b.g.Users.Drafts.Create(b.email, d).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Drafts.Create", time.Since(st))
+	return ret, nil
+}
+
+// UpdateDraft implements Backend.
+func (b *Gmail) UpdateDraft(id string, d *gmail.Draft) (*gmail.Draft, error) {
+	st := time.Now()
+	ret, err := b.g.Users.Drafts.Update(b.email, id, d).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Drafts.Update", time.Since(st))
+	return ret, nil
+}
+
+// SendDraft implements Backend.
+func (b *Gmail) SendDraft(id string) (*gmail.Message, error) {
+	st := time.Now()
+	ret, err := b.g.Users.Drafts.Send(b.email, &gmail.Draft{Id: id}).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Drafts.Send", time.Since(st))
+	return ret, nil
+}
+
+// DeleteDraft implements Backend.
+func (b *Gmail) DeleteDraft(id string) error {
+	st := time.Now()
+	if err := b.g.Users.Drafts.Delete(b.email, id).Do(); err != nil {
+		return err
+	}
+	b.profileAPI("Users.Drafts.Delete", time.Since(st))
+	return nil
+}
+
+// ListLabels implements Backend.
+func (b *Gmail) ListLabels() ([]*gmail.Label, error) {
+	st := time.Now()
+	res, err := b.g.Users.Labels.List(b.email).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Labels.List", time.Since(st))
+	return res.Labels, nil
+}
+
+// ListHistory implements Backend.
+func (b *Gmail) ListHistory(startHistoryID uint64, pageToken string, nres int64) (*gmail.ListHistoryResponse, error) {
+	st := time.Now()
+	res, err := b.g.Users.History.List(b.email).
+		StartHistoryId(startHistoryID).
+		PageToken(pageToken).
+		MaxResults(nres).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.History.List", time.Since(st))
+	return res, nil
+}
+
+// GetProfile implements Backend.
+func (b *Gmail) GetProfile() (*gmail.Profile, error) {
+	st := time.Now()
+	p, err := b.g.Users.GetProfile(b.email).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.GetProfile", time.Since(st))
+	return p, nil
+}
+
+// ListSendAs implements Backend.
+func (b *Gmail) ListSendAs() ([]*gmail.SendAs, error) {
+	st := time.Now()
+	res, err := b.g.Users.Settings.SendAs.List(b.email).Do()
+	if err != nil {
+		return nil, err
+	}
+	b.profileAPI("Users.Settings.SendAs.List", time.Since(st))
+	return res.SendAs, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	// Max number of full messages to keep in memory.
+	maxBodies = 200
+
+	// Fetch priorities. Lower runs first. List rows use their index.
+	openPriority     = -1   // Message being opened.
+	prefetchPriority = 1000 // Neighbours of the cursor.
+)
+
+// bodyStore keeps full messages, so that lists can be loaded with just
+// the metadata, and bodies fetched when needed.
+type bodyStore struct {
+	mu       sync.Mutex
+	msgs     map[string]*gmail.Message
+	order    []string                 // Oldest first, for eviction.
+	fetching map[string]chan struct{} // Closed when fetch is done.
+}
+
+var bodies = newBodyStore()
+
+func newBodyStore() *bodyStore {
+	return &bodyStore{
+		msgs:     make(map[string]*gmail.Message),
+		fetching: make(map[string]chan struct{}),
+	}
+}
+
+// get returns the full message, fetching it if needed. If it's already
+// being fetched, it waits for that fetch instead of starting another.
+func (b *bodyStore) get(ctx context.Context, prio int, id string) (*gmail.Message, error) {
+	for {
+		b.mu.Lock()
+		if m, found := b.msgs[id]; found {
+			b.mu.Unlock()
+			return m, nil
+		}
+		ch, found := b.fetching[id]
+		if !found {
+			break
+		}
+		b.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ch := make(chan struct{})
+	b.fetching[id] = ch
+	b.mu.Unlock()
+
+	var m *gmail.Message
+	err := fetchRetry(ctx, prio, func() error {
+		var err error
+		m, err = mailBackend.GetMessage(id, "full")
+		return err
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.fetching, id)
+	close(ch)
+	if err != nil {
+		return nil, err
+	}
+	b.add(m)
+	return m, nil
+}
+
+// add must be called with the lock held.
+func (b *bodyStore) add(m *gmail.Message) {
+	if _, found := b.msgs[m.Id]; !found {
+		b.order = append(b.order, m.Id)
+	}
+	b.msgs[m.Id] = m
+	for len(b.order) > maxBodies {
+		delete(b.msgs, b.order[0])
+		b.order = b.order[1:]
+	}
+}
+
+// prefetch fetches full messages in the background, if not already done.
+// Fetching stops if ctx is cancelled.
+func (b *bodyStore) prefetch(ctx context.Context, ids ...string) {
+	for _, id := range ids {
+		b.mu.Lock()
+		_, found := b.msgs[id]
+		_, fetching := b.fetching[id]
+		b.mu.Unlock()
+		if found || fetching {
+			continue
+		}
+		id := id
+		go func() {
+			if _, err := b.get(ctx, prefetchPriority, id); err != nil && ctx.Err() == nil {
+				log.Printf("Prefetching message %q: %v", id, err)
+			}
+		}()
+	}
+}
+
+// fullMessage returns the message with the full body. The labels are
+// kept from m, since the list is kept more up to date than the bodies.
+func fullMessage(ctx context.Context, m *gmail.Message) (*gmail.Message, error) {
+	full, err := bodies.get(ctx, openPriority, m.Id)
+	if err != nil {
+		return nil, err
+	}
+	ret := *full
+	ret.LabelIds = m.LabelIds
+	return &ret, nil
+}
+
+// prefetchAround prefetches the full messages at and next to index n, until
+// ctx is cancelled.
+func prefetchAround(ctx context.Context, ids []string, n int) {
+	var p []string
+	for _, i := range []int{n, n + 1, n - 1} {
+		if i >= 0 && i < len(ids) {
+			p = append(p, ids[i])
+		}
+	}
+	bodies.prefetch(ctx, p...)
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+func TestFullMessage(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	bodies = newBodyStore()
+	stub, err := f.AddMessage(fakeMessage(1, ""), cmdglib.Inbox, cmdglib.Unread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, l, more, errs := list(context.Background(), cmdglib.Inbox, "", "", 10)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	var meta *gmail.Message
+	for m := range more {
+		meta = m.msg
+	}
+	if got, want := len(l), 1; got != want || meta == nil {
+		t.Fatalf("got %d messages, want %d", got, want)
+	}
+	if got := getBody(meta); strings.Contains(got, "Body of message 1") {
+		t.Errorf("list has the body: %q", got)
+	}
+	if got, want := cmdglib.GetHeader(meta, "Subject"), "Message 1"; got != want {
+		t.Errorf("list subject: got %q, want %q", got, want)
+	}
+
+	// Labels are kept from the list copy.
+	meta.LabelIds = []string{cmdglib.Inbox}
+	before := f.Requests("GET", "messages/"+stub.Id)
+	var wg sync.WaitGroup
+	for n := 0; n < 5; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := fullMessage(context.Background(), meta)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got, want := getBody(m), "Body of message 1"; !strings.Contains(got, want) {
+				t.Errorf("got body %q, want %q", got, want)
+			}
+			if got, want := m.LabelIds, meta.LabelIds; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got labels %q, want %q", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := f.Requests("GET", "messages/"+stub.Id)-before, 1; got != want {
+		t.Errorf("got %d fetches of full message, want %d", got, want)
+	}
+}
+
+func TestBodyStoreEviction(t *testing.T) {
+	b := newBodyStore()
+	for n := 0; n < maxBodies+10; n++ {
+		b.add(&gmail.Message{Id: fmt.Sprintf("%d", n)})
+	}
+	if got, want := len(b.msgs), maxBodies; got != want {
+		t.Errorf("got %d stored, want %d", got, want)
+	}
+	if _, found := b.msgs["0"]; found {
+		t.Errorf("oldest not evicted")
+	}
+	if _, found := b.msgs[fmt.Sprintf("%d", maxBodies+9)]; !found {
+		t.Errorf("newest evicted")
+	}
+}
@@ -24,6 +24,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"flag"
@@ -43,8 +44,13 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
 	"github.com/ThomasHabets/cmdg/cmdglib"
 	"github.com/ThomasHabets/cmdg/ncwrap"
+	"github.com/ThomasHabets/cmdg/opqueue"
+	"github.com/ThomasHabets/cmdg/scheduler"
+	"github.com/ThomasHabets/cmdg/sendlater"
 	"github.com/ThomasHabets/drive-du/lib"
 	gc "github.com/rthornton128/goncurses"
 	gmail "google.golang.org/api/gmail/v1"
@@ -59,10 +65,14 @@ const (
 	maxRetries  = 20
 	maxTimeout  = 5 * time.Second
 
+	defaultParallel = 20 // Messages to fetch at the same time.
+
 	configDirMode os.FileMode = 0700
 
 	// Relative to configDir.
 	configFileName = "cmdg.conf"
+	cacheDirName   = "cache"
+	queueDirName   = "queue"
 
 	// Relative to $HOME.
 	defaultConfigDir     = ".cmdg"
@@ -70,37 +80,50 @@ const (
 )
 
 var (
-	license       = flag.Bool("license", false, "Show program license.")
-	help          = flag.Bool("help", false, "Show usage text and exit.")
-	help2         = flag.Bool("h", false, "Show usage text and exit.")
-	configDir     = flag.String("config_dir", "", "Config directory. If empty will default to ~/"+defaultConfigDir)
-	configure     = flag.Bool("configure", false, "Configure OAuth and write config file.")
-	readonly      = flag.Bool("readonly", false, "When configuring, only acquire readonly permission.")
-	gpg           = flag.String("gpg", "/usr/bin/gpg", "Path to GnuPG.")
-	replyRegex    = flag.String("reply_regexp", `(?i)^(Re|Sv|Aw|AW): `, "If subject matches, there's no need to add a Re: prefix.")
-	replyPrefix   = flag.String("reply_prefix", "Re: ", "String to prepend to subject in replies.")
-	forwardRegex  = flag.String("forward_regexp", `(?i)^(Fwd): `, "If subject matches, there's no need to add a Fwd: prefix.")
-	forwardPrefix = flag.String("forward_prefix", "Fwd: ", "String to prepend to subject in forwards.")
-	signature     = flag.String("signature", "", "File containing end of all emails. Defaults to ~/"+defaultSignatureFile)
-	logFile       = flag.String("log", "/dev/null", "Log non-sensitive data to this file.")
-	waitingLabel  = flag.String("waiting_label", "", "Label used for 'awaiting reply'. If empty disables feature.")
-	threadView    = flag.Bool("thread", false, "Use thread view.")
-	lynx          = flag.String("lynx", "lynx", "Path to 'lynx' browser. Used to render HTML email.")
-	preConfig     = flag.String("preconfig", "", "Command to run before reading config. Used if config is generated.")
-	enableHistory = flag.Bool("history", true, "Enable history API to optimize network use. Seems to be a bit unreliable on the server side.")
-	openBinary    = flag.String("open", "xdg-open", "Command to open attachments with.")
-	openWait      = flag.Bool("open_wait", false, "Wait after opening attachment. If using X, then makes sense to say no.")
+	license         = flag.Bool("license", false, "Show program license.")
+	help            = flag.Bool("help", false, "Show usage text and exit.")
+	help2           = flag.Bool("h", false, "Show usage text and exit.")
+	configDir       = flag.String("config_dir", "", "Config directory. If empty will default to ~/"+defaultConfigDir)
+	configure       = flag.Bool("configure", false, "Configure OAuth and write config file.")
+	readonly        = flag.Bool("readonly", false, "When configuring, only acquire readonly permission.")
+	gpg             = flag.String("gpg", "/usr/bin/gpg", "Path to GnuPG.")
+	replyRegex      = flag.String("reply_regexp", `(?i)^(Re|Sv|Aw|AW): `, "If subject matches, there's no need to add a Re: prefix.")
+	replyPrefix     = flag.String("reply_prefix", "Re: ", "String to prepend to subject in replies.")
+	forwardRegex    = flag.String("forward_regexp", `(?i)^(Fwd): `, "If subject matches, there's no need to add a Fwd: prefix.")
+	forwardPrefix   = flag.String("forward_prefix", "Fwd: ", "String to prepend to subject in forwards.")
+	signature       = flag.String("signature", "", "File containing end of emails, for identities without their own signature in <config_dir>/"+signaturesDir+"/<address>. Defaults to ~/"+defaultSignatureFile)
+	logFile         = flag.String("log", "/dev/null", "Log non-sensitive data to this file.")
+	waitingLabel    = flag.String("waiting_label", "", "Label used for 'awaiting reply'. If empty disables feature.")
+	threadView      = flag.Bool("thread", false, "Use thread view.")
+	lynx            = flag.String("lynx", "lynx", "Path to 'lynx' browser. Used to render HTML email.")
+	preConfig       = flag.String("preconfig", "", "Command to run before reading config. Used if config is generated.")
+	enableHistory   = flag.Bool("history", true, "Enable history API to optimize network use. Seems to be a bit unreliable on the server side.")
+	openBinary      = flag.String("open", "xdg-open", "Command to open attachments with.")
+	openWait        = flag.Bool("open_wait", false, "Wait after opening attachment. If using X, then makes sense to say no.")
+	useCache        = flag.Bool("cache", true, "Cache messages on disk in the config directory.")
+	maxParallel     = flag.Int("parallel", defaultParallel, "Max number of messages to fetch at the same time.")
+	encryptTo       = flag.String("encrypt_to", "", "GPG key to encrypt mail data kept on disk (saved unsent email, cache, offline queue) to.")
+	passphraseCmd   = flag.String("encrypt_passphrase_cmd", "", "Command that prints a passphrase to encrypt mail data kept on disk with, if not using -encrypt_to.")
+	contactsGoogle  = flag.Bool("contacts_google", true, "Get contacts from Google contacts.")
+	contactsAliases = flag.String("contacts_aliases", "", "Mutt style alias file to get contacts from.")
+	contactsVCard   = flag.String("contacts_vcard", "", "Comma separated vCard files, or directories with them, to get contacts from.")
+	contactsSent    = flag.Int("contacts_sent", 200, "Get contacts from this many of the newest sent emails. 0 disables.")
+	undoSend        = flag.Duration("undo_send", 0, "Time to wait before sending, during which sending can be undone. 0 sends right away.")
+	preSendHooks    = flag.String("presend_hooks", "", "Comma separated commands to check emails with before sending. They get the email on stdin, and exit 1 to warn or 2 to refuse sending, with the reason on stdout.")
 
 	authedClient *http.Client
-	gmailService *gmail.Service
-	scope        string // OAuth scope
+	mailBackend  backend.Backend
+	msgCache     *backend.Cache   // nil if caching is disabled.
+	opQueue      *opqueue.Queue   // Operations waiting to be done when back online.
+	localKey     *atrest.Key      // Encrypts mail data on disk. nil if not encrypted.
+	scheduled    *sendlater.Store // Emails to send later.
+	scope        string           // OAuth scope
 
 	nc *ncwrap.NCWrap
 
 	// State keepers.
 	labels       = make(map[string]string) // From name to ID.
 	labelIDs     = make(map[string]string) // From ID to name.
-	contacts     contactsT
 	emailAddress string
 
 	logRedirected bool // Don't write API measurements to log until it's been redirected.
@@ -111,15 +134,16 @@ var (
 	replyRE   *regexp.Regexp
 	forwardRE *regexp.Regexp
 
-	errNoHistory = errors.New("nothing new since last check")
+	sleep = sleepContext // Replaced in tests.
 
-	sleep = time.Sleep
+	// Limits how many messages are fetched at the same time.
+	fetcher = scheduler.New(defaultParallel)
 )
 
 const (
 	// Scopes. Gmail and contacts.
 	scopeReadonly = "https://www.googleapis.com/auth/gmail.readonly https://www.googleapis.com/auth/contacts.readonly"
-	scopeModify   = "https://www.googleapis.com/auth/gmail.modify https://www.google.com/m8/feeds"
+	scopeModify   = "https://www.googleapis.com/auth/gmail.modify https://www.googleapis.com/auth/contacts.readonly"
 	accessType    = "offline"
 	email         = "me"
 
@@ -170,76 +194,58 @@ func backoff(n int) (time.Duration, bool) {
 	return time.Duration(ns), done
 }
 
-// list returns some initial message stubs, with the full message coming later on the returned channel.
-// label is the label ID ("" means all mail).
-// search is the search query ("" means match all).
-func list(label, search, pageToken string, nres int, historyID uint64) (uint64, []listEntry, <-chan listEntry, []error) {
-	log.Printf("Listing label %q, search %q. HistoryID %v", label, search, historyID)
-	syncP := parallel{} // Run the parts that can't wait in parallel.
-
-	var newHistoryID uint64
-	if *enableHistory && historyID > 0 {
-		st := time.Now()
-		res, err := gmailService.Users.History.List(email).MaxResults(1).StartHistoryId(historyID).Do()
-		if err == nil {
-			profileAPI("History.List", time.Since(st))
+// fetchRetry runs f through the fetch scheduler, retrying with backoff.
+// Lower prio runs first. Gives up if ctx is cancelled, or if what's being
+// fetched doesn't exist.
+func fetchRetry(ctx context.Context, prio int, f func() error) error {
+	for bo := 0; ; bo++ {
+		err := fetcher.Do(ctx, prio, f)
+		if err == nil || ctx.Err() != nil || backend.IsNotFound(err) {
+			return err
 		}
-		if err != nil {
-			log.Printf("Failed to check history: %v", err)
-		} else if len(res.History) == 0 {
-			return res.HistoryId, nil, nil, []error{errNoHistory}
-		} else {
-			newHistoryID = res.HistoryId
-			log.Printf("New history ID: %v", newHistoryID)
+		s, done := backoff(bo)
+		if done {
+			log.Printf("Fetch failed, backoff expired, giving up: %v", err)
+			return err
+		}
+		log.Printf("Fetch failed, retrying after %v: %v", s, err)
+		if err := sleep(ctx, s); err != nil {
+			return err
 		}
 	}
+}
 
-	var funcErr []error
-	// List messages.
-	var res *gmail.ListMessagesResponse
-	syncP.add(func(ch chan<- func()) {
-		defer close(ch)
-		var err error
-		st := time.Now()
-		q := gmailService.Users.Messages.List(email).
-			PageToken(pageToken).
-			MaxResults(int64(nres)).
-			//Fields("messages(id,payload,snippet,raw,sizeEstimate),resultSizeEstimate").
-			Fields("messages,resultSizeEstimate")
-		if label != "" {
-			q = q.LabelIds(label)
-		}
-		if search != "" {
-			q = q.Q(search)
-		}
-		res, err = q.Do()
-		if err != nil {
-			ch <- func() {
-				funcErr = append(funcErr, fmt.Errorf("Users.Messages.List: %v", err))
-			}
-			return
-		}
-		profileAPI("Users.Messages.List", time.Since(st))
-	})
+// sleepContext sleeps for d, or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
 
-	// Get Profile to update status line.
-	var profile *gmail.Profile
-	syncP.add(func(ch chan<- func()) {
-		defer close(ch)
-		st := time.Now()
-		p, err := gmailService.Users.GetProfile(email).Do()
-		if err != nil {
-			ch <- func() {
-				funcErr = append(funcErr, fmt.Errorf("Users.GetProfile: %v", err))
-			}
-			return
-		}
-		profile = p
-		profileAPI("Users.GetProfile", time.Since(st))
-	})
-	syncP.run()
-	if len(funcErr) != 0 {
-		return 0, nil, nil, funcErr
+// list returns some initial message stubs, with the message metadata coming later on the returned channel.
+// Use fullMessage() to get the body.
+// label is the label ID ("" means all mail).
+// search is the search query ("" means match all).
+// The returned history ID is from before the list was fetched, so it's safe to sync from it.
+// The returned page token is for the next page, or "" if this was the last.
+// Fetching the full messages stops if ctx is cancelled.
+func list(ctx context.Context, label, search, pageToken string, nres int) (uint64, string, []listEntry, <-chan listEntry, []error) {
+	log.Printf("Listing label %q, search %q", label, search)
+
+	// Get Profile to update status line, and for the history ID.
+	// Must be done before listing, or changes in between could be missed.
+	profile, err := mailBackend.GetProfile()
+	if err != nil {
+		return 0, "", nil, nil, []error{fmt.Errorf("Users.GetProfile: %v", err)}
+	}
+
+	// List messages.
+	res, err := mailBackend.ListMessages(label, search, pageToken, int64(nres))
+	if err != nil {
+		return 0, "", nil, nil, []error{fmt.Errorf("Users.Messages.List: %v", err)}
 	}
 
 	nc.Status("Total number of messages in folder: %d", res.ResultSizeEstimate)
@@ -247,31 +253,24 @@ func list(label, search, pageToken string, nres int, historyID uint64) (uint64,
 	msgChan := make(chan listEntry, len(res.Messages))
 	var wg sync.WaitGroup
 	{
-		// Load message bodies async and in parallel.
-		for _, m := range res.Messages {
+		// Load message bodies async and in parallel, top of the list first.
+		for n, m := range res.Messages {
 			wg.Add(1)
-			m2 := m
+			n, m2 := n, m
 			go func() {
 				defer wg.Done()
-				st := time.Now()
-				for bo := 0; ; bo++ {
-					mres, err := gmailService.Users.Messages.Get(email, m2.Id).Format("full").Do()
-					if err != nil {
-						s, done := backoff(bo)
-						if done {
-							log.Printf("Get message failed, backoff expired, giving up: %v", err)
-							return
-						}
-						sleep(s)
-						log.Printf("Get message failed, retrying: %v", err)
-						continue
-					}
-					profileAPI("Users.Messages.Get", time.Since(st))
-					msgChan <- listEntry{
-						msg: mres,
-					}
+				var mres *gmail.Message
+				if err := fetchRetry(ctx, n, func() error {
+					var err error
+					mres, err = mailBackend.GetMessage(m2.Id, "metadata")
+					return err
+				}); err != nil {
+					log.Printf("Get message %q failed: %v", m2.Id, err)
 					return
 				}
+				msgChan <- listEntry{
+					msg: mres,
+				}
 			}()
 		}
 		go func() {
@@ -287,11 +286,12 @@ func list(label, search, pageToken string, nres int, historyID uint64) (uint64,
 			msg: m,
 		})
 	}
-	return newHistoryID, ret, msgChan, nil
+	return profile.HistoryId, res.NextPageToken, ret, msgChan, nil
 }
 
 // TODO: clean this up to look more like list().
-func listThreads(label, search, pageToken string, nres int, historyID uint64) ([]listEntry, <-chan listEntry) {
+// The returned page token is for the next page, or "" if this was the last.
+func listThreads(ctx context.Context, label, search, pageToken string, nres int, historyID uint64) (string, []listEntry, <-chan listEntry) {
 	log.Printf("Listing thread label %q, search %q. historyID %v", label, search, historyID)
 	syncP := parallel{} // Run the parts that can't wait in parallel.
 
@@ -304,24 +304,12 @@ func listThreads(label, search, pageToken string, nres int, historyID uint64) ([
 	syncP.add(func(ch chan<- func()) {
 		defer close(ch)
 		var err error
-		st := time.Now()
-		q := gmailService.Users.Threads.List(email).
-			PageToken(pageToken).
-			MaxResults(int64(nres)).
-			Fields("threads,resultSizeEstimate")
-		if label != "" {
-			q = q.LabelIds(label)
-		}
-		if search != "" {
-			q = q.Q(search)
-		}
-		res, err = q.Do()
+		res, err = mailBackend.ListThreads(label, search, pageToken, int64(nres))
 		if err != nil {
 			ch <- func() {
 				funcErr = append(funcErr, fmt.Errorf("Listing threads: %v", err))
 			}
 		}
-		profileAPI("Users.Threads.List", time.Since(st))
 	})
 
 	// Get Profile to update status line.
@@ -329,13 +317,11 @@ func listThreads(label, search, pageToken string, nres int, historyID uint64) ([
 	var profile *gmail.Profile
 	syncP.add(func(ch chan<- func()) {
 		defer close(ch)
-		st := time.Now()
 		var err error
-		profile, err = gmailService.Users.GetProfile(email).Do()
+		profile, err = mailBackend.GetProfile()
 		if err != nil {
 			log.Fatalf("Get profile: %v", err)
 		}
-		log.Printf("Users.GetProfile: %v", time.Since(st))
 	})
 	syncP.run()
 
@@ -345,30 +331,23 @@ func listThreads(label, search, pageToken string, nres int, historyID uint64) ([
 	var wg sync.WaitGroup
 	// Load thread message bodies async.
 	{
-		for _, m := range res.Threads {
+		for n, m := range res.Threads {
 			wg.Add(1)
-			m2 := m
+			n, m2 := n, m
 			go func() {
 				defer wg.Done()
-				st := time.Now()
-				for bo := 0; ; bo++ {
-					mres, err := gmailService.Users.Threads.Get(email, m2.Id).Format("full").Do()
-					if err != nil {
-						s, done := backoff(bo)
-						if done {
-							log.Printf("Get thread failed, retrying: %v", err)
-							return
-						}
-						log.Printf("Get thread %q failed, retrying after %v: %v", m2.Id, s, err)
-						sleep(s)
-						continue
-					}
-					profileAPI("Users.Thread.Get", time.Since(st))
-					msgChan <- listEntry{
-						thread: mres,
-					}
+				var mres *gmail.Thread
+				if err := fetchRetry(ctx, n, func() error {
+					var err error
+					mres, err = mailBackend.GetThread(m2.Id, "full")
+					return err
+				}); err != nil {
+					log.Printf("Get thread %q failed: %v", m2.Id, err)
 					return
 				}
+				msgChan <- listEntry{
+					thread: mres,
+				}
 			}()
 		}
 		go func() {
@@ -385,7 +364,7 @@ func listThreads(label, search, pageToken string, nres int, historyID uint64) ([
 			thread: m,
 		})
 	}
-	return ret, msgChan
+	return res.NextPageToken, ret, msgChan
 }
 
 func updateLabels(ls []*gmail.Label) {
@@ -398,14 +377,12 @@ func updateLabels(ls []*gmail.Label) {
 }
 
 func getLabels() ([]*gmail.Label, error) {
-	st := time.Now()
-	res, err := gmailService.Users.Labels.List(email).Do()
+	ls, err := mailBackend.ListLabels()
 	if err != nil {
 		nc.Status("[red]Listing labels: %v", err)
 		return nil, err
 	}
-	profileAPI("Users.Labels.List", time.Since(st))
-	return res.Labels, nil
+	return ls, nil
 }
 
 func mimeDecode(s string) (string, error) {
@@ -441,6 +418,10 @@ func getBodyRecurse(m *gmail.MessagePart) string {
 	body := ""
 	htmlBody := "" // Used only if there's no plaintext version.
 	for _, p := range m.Parts {
+		if p.Filename != "" {
+			// Attachment.
+			continue
+		}
 		switch p.MimeType {
 		case "text/plain":
 			data, err := mimeDecode(p.Body.Data)
@@ -454,7 +435,7 @@ func getBodyRecurse(m *gmail.MessagePart) string {
 				return fmt.Sprintf("mime decoding error for text/html: %v", err)
 			}
 			htmlBody += string(data)
-		case "multipart/alternative", "multipart/related":
+		case "multipart/alternative", "multipart/related", "multipart/mixed", "multipart/signed":
 			body += getBodyRecurse(p)
 		default:
 			// Skip.
@@ -476,7 +457,8 @@ func getBodyRecurse(m *gmail.MessagePart) string {
 }
 
 func getBody(m *gmail.Message) string {
-	if m.Payload == nil {
+	if m.Payload == nil || (m.Payload.Body == nil && len(m.Payload.Parts) == 0) {
+		// Not fetched, or only metadata.
 		return "loading..."
 	}
 	return strings.Trim(getBodyRecurse(m.Payload), " \n\r\t")
@@ -582,83 +564,28 @@ func breakLines(in []string) []string {
 	return out
 }
 
-func standardHeaders() string {
-	return "Content-Type: text/plain; charset=UTF-8\n"
-}
-
-func getReply(openMessage *gmail.Message) (string, error) {
-	subject := cmdglib.GetHeader(openMessage, "Subject")
-	if !replyRE.MatchString(subject) {
-		subject = *replyPrefix + subject
+// threadHeaders returns In-Reply-To and References header lines that make
+// a reply to (or forward of) m part of the same thread on all clients.
+func threadHeaders(m *gmail.Message) string {
+	id := cmdglib.GetHeader(m, "Message-ID")
+	if id == "" {
+		return ""
 	}
-
-	addr := cmdglib.GetHeader(openMessage, "Reply-To")
-	if addr == "" {
-		addr = cmdglib.GetHeader(openMessage, "From")
+	refs := cmdglib.GetHeader(m, "References")
+	if refs == "" {
+		refs = cmdglib.GetHeader(m, "In-Reply-To")
 	}
-
-	head := fmt.Sprintf("To: %s\nSubject: %s\n\nOn %s, %s said:\n",
-		addr,
-		subject,
-		cmdglib.GetHeader(openMessage, "Date"),
-		cmdglib.GetHeader(openMessage, "From"),
-	)
-	s, err := runEditorHeadersOK(head + strings.Join(prefixQuote(breakLines(strings.Split(getBody(openMessage), "\n"))), "\n"))
-	return standardHeaders() + s, err
+	return fmt.Sprintf("In-Reply-To: %s\nReferences: %s\n", id, strings.Join(append(strings.Fields(refs), id), " "))
 }
 
-func getReplyAll(openMessage *gmail.Message) (string, error) {
-	subject := cmdglib.GetHeader(openMessage, "Subject")
-	if !replyRE.MatchString(subject) {
-		subject = *replyPrefix + subject
-	}
-
-	cc := strings.Split(cmdglib.GetHeader(openMessage, "Cc"), ",")
-	addr := cmdglib.GetHeader(openMessage, "Reply-To")
-	if addr == "" {
-		addr = cmdglib.GetHeader(openMessage, "From")
-	} else {
-		cc = append(cc, cmdglib.GetHeader(openMessage, "From"))
-	}
-	cc = append(cc, strings.Split(cmdglib.GetHeader(openMessage, "To"), ",")...)
-	var ncc []string
-	for _, a := range cc {
-		a = strings.Trim(a, " ")
-		if len(a) == 0 {
-			continue
-		}
-
-		// Don't CC self, that would be silly.
-		if strings.Contains(a, "<"+emailAddress+">") || a == emailAddress {
-			continue
-		}
-		ncc = append(ncc, a)
-	}
-
-	head := fmt.Sprintf("To: %s\nCc: %s\nSubject: %s\n\nOn %s, %s said:\n",
-		addr,
-		strings.Join(ncc, ", "),
-		subject,
-		cmdglib.GetHeader(openMessage, "Date"),
-		cmdglib.GetHeader(openMessage, "From"))
-	s, err := runEditorHeadersOK(head + strings.Join(prefixQuote(breakLines(strings.Split(getBody(openMessage), "\n"))), "\n"))
-	return standardHeaders() + s, err
-}
-
-func getForward(openMessage *gmail.Message) (string, error) {
-	subject := cmdglib.GetHeader(openMessage, "Subject")
-	if !forwardRE.MatchString(subject) {
-		subject = *forwardPrefix + subject
+// inThread runs the editor on input, and adds threading headers for m to
+// the result. They're added after editing to not clutter the editor.
+func inThread(m *gmail.Message, input string) (string, error) {
+	s, err := runEditorHeadersOK(input)
+	if err != nil {
+		return "", err
 	}
-	head := fmt.Sprintf("To: \nSubject: %s\n\n--------- Forwarded message -----------\nDate: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n",
-		subject,
-		cmdglib.GetHeader(openMessage, "Date"),
-		cmdglib.GetHeader(openMessage, "From"),
-		cmdglib.GetHeader(openMessage, "To"),
-		cmdglib.GetHeader(openMessage, "Subject"),
-	)
-	s, err := runEditorHeadersOK(head + strings.Join(breakLines(strings.Split(getBody(openMessage), "\n")), "\n"))
-	return standardHeaders() + s, err
+	return threadHeaders(m) + s, nil
 }
 
 func runPager(input string) error {
@@ -688,21 +615,74 @@ func runSomething() func() {
 	}
 }
 
+// errAborted is returned when the user chooses to not send after all.
+var errAborted = errors.New("aborted by user")
+
+// notSavedError is returned by sendMenu when sending failed, and saving
+// the email for later failed too.
+type notSavedError struct {
+	send, save error
+}
+
+func (e *notSavedError) Error() string {
+	return fmt.Sprintf("%v; and saving failed: %v", e.send, e.save)
+}
+
 // createSend asks how to send the message just composed, and sends it.
 // thread is the thread id, and may be empty.
 // msg is the string representation of the message.
-func createSend(thread, msg string) (err error) {
+func createSend(thread, msg string) error {
+	return createSendDraft(thread, "", msg, nil)
+}
+
+// createSendDraft is like createSend, but for an existing draft, which is
+// updated instead of a new one created when saving, and sent as the draft.
+// draftID may be empty. atts are attachments already in the draft.
+func createSendDraft(thread, draftID, msg string, atts []*attachment) error {
+	abort := "Abort, discarding draft"
+	if draftID != "" {
+		abort = "Abort, discarding changes"
+	}
+	return sendMenu(thread, draftID, abort, msg, atts)
+}
+
+// createReply is createSend for a reply to, or forward of, orig. atts
+// are attachments to send along. If orig was decrypted, its text is in
+// msg, so the reply is encrypted too unless the user chooses otherwise.
+func createReply(orig *gmail.Message, msg string, atts []*attachment) error {
+	return sendMenuPGP(orig.ThreadId, "", "Abort, discarding draft", msg, atts, replyPGPMode(orig))
+}
+
+// sendMenu is createSendDraft with the text of the abort choice given.
+// Returns errAborted if the user aborted.
+func sendMenu(thread, draftID, abort, msg string, atts []*attachment) error {
+	return sendMenuPGP(thread, draftID, abort, msg, atts, pgpNone)
+}
+
+// sendMenuPGP is sendMenu with the PGP mode already chosen, such as when
+// coming back after undoing sending.
+func sendMenuPGP(thread, draftID, abort, msg string, atts []*attachment, pgp pgpMode) (err error) {
+	editedAgain := false // The failsafe is up to the new sendMenu.
 	defer func() {
-		if err != nil {
+		if err != nil && err != errAborted && !editedAgain {
 			if err2 := saveFailedSend(msg); err2 != nil {
 				nc.Status("[red]Double fail: %v; %v", err, err2)
 				log.Printf("Failed while laving failsafe: %v %v", err, err2)
+				err = &notSavedError{send: err, save: err2}
 			}
 		}
 	}()
-	// Run menu.
+	send := sendMessage
+	if draftID != "" {
+		send = func(thread, msg string, add []string) (*gmail.Message, error) {
+			return sendDraft(draftID, thread, msg, add)
+		}
+	}
+
+	// Run menu until the user is done attaching files.
 	var choice gc.Key
-	{
+	var sendAt time.Time
+	for {
 		cs := []keyChoice{
 			{'s', "Send"},
 			{'S', "Send and archive"},
@@ -714,120 +694,164 @@ func createSend(thread, msg string) (err error) {
 			)
 		}
 		cs = append(cs,
+			keyChoice{'l', "Send later"},
+			keyChoice{'t', "Attach file"},
+		)
+		if len(atts) > 0 {
+			cs = append(cs, keyChoice{'T', "Remove attachment"})
+		}
+		cs = append(cs,
+			keyChoice{'g', "PGP sign/encrypt"},
 			keyChoice{'d', "Save as draft"},
-			keyChoice{'a', "Abort, discarding draft"},
+			keyChoice{'a', abort},
 		)
-		choice = keyMenu(cs)
+		summary := composeSummary(msg, atts)
+		if pgp != pgpNone {
+			summary = append(summary, "PGP: "+pgp.String())
+		}
+		choice = keyMenuSummary(summary, cs)
+		if choice == 'g' {
+			pgp = choosePGPMode(msg, pgp)
+			continue
+		}
+		if choice == 't' {
+			if a := attachFileDialog(); a != nil {
+				atts = append(atts, a)
+			}
+			continue
+		}
+		if choice == 'T' {
+			var names []string
+			for _, a := range atts {
+				names = append(names, a.String())
+			}
+			if _, n := stringChoice("Remove attachment", names, false); n >= 0 {
+				nc.Status("Removed attachment %q", atts[n].name)
+				atts = append(atts[:n], atts[n+1:]...)
+			}
+			continue
+		}
+		if choice == 'l' {
+			var ok bool
+			if sendAt, ok = askSendTime(); !ok {
+				continue
+			}
+		}
+		if strings.ContainsRune("sSwWl", rune(choice)) && !preSendOK(msg, atts) {
+			continue
+		}
+		break
 	}
-	switch choice {
-	case 's':
-		st := time.Now()
-		if _, err := gmailService.Users.Messages.Send(email, &gmail.Message{
-			ThreadId: thread,
-			Raw:      mimeEncode(msg),
-		}).Do(); err != nil {
-			nc.Status("Error sending: %v", err)
+	text := msg
+	if choice != 'a' {
+		// From here on the failsafe saves the encoded message, with attachments.
+		var raw string
+		var err error
+		if pgp != pgpNone && choice != 'd' {
+			raw, err = runPGP(msg, atts, pgp)
+		} else {
+			raw, err = composeMessage(msg, atts)
+		}
+		if err != nil {
+			nc.Status("[red]Error composing email: %v", err)
 			return err
 		}
-		log.Printf("Users.Messages.Send: %v", time.Since(st))
-		nc.Status("[green]Successfully sent")
-	case 'S':
-		st := time.Now()
-		if _, err := gmailService.Users.Messages.Send(email, &gmail.Message{
-			ThreadId: thread,
-			Raw:      mimeEncode(msg),
-		}).Do(); err != nil {
+		msg = raw
+	}
+	if strings.ContainsRune("sSwW", rune(choice)) && *undoSend > 0 && !sendCountdown() {
+		headers, input := splitThreadHeaders(text)
+		edited, err := runEditorHeadersOK(input)
+		if err != nil {
+			return err
+		}
+		editedAgain = true
+		return sendMenuPGP(thread, draftID, abort, headers+edited, atts, pgp)
+	}
+	switch choice {
+	case 's', 'S':
+		if _, err := send(thread, msg, nil); err == opqueue.ErrQueued {
+			nc.Status("[green]Offline, queued for sending")
+		} else if err == opqueue.ErrMaybeSent {
+			nc.Status(maybeSentStatus)
+		} else if err != nil {
 			nc.Status("Error sending: %v", err)
 			return err
+		} else {
+			nc.Status("[green]Successfully sent")
 		}
-		log.Printf("Users.Messages.Send: %v", time.Since(st))
-		nc.Status("[green]Successfully sent")
-		go func() {
-			// TODO: Do this in a better way.
-			nc.Input <- 'e'
-		}()
-	case 'w': // Send with label.
+		if choice == 'S' {
+			go func() {
+				// TODO: Do this in a better way.
+				nc.Input <- 'e'
+			}()
+		}
+	case 'w', 'W': // Send with label, and maybe archive.
 		st := time.Now()
 		l, hasLabel := labels[*waitingLabel]
 		nc.Status("Sending with label...")
 
-		// Send.
-		gmsg, err := gmailService.Users.Messages.Send(email, &gmail.Message{
-			ThreadId: thread,
-			Raw:      mimeEncode(msg),
-		}).Do()
-		if err != nil {
+		var add []string
+		if hasLabel {
+			add = []string{l}
+		}
+		gmsg, err := send(thread, msg, add)
+		switch {
+		case err == opqueue.ErrQueued:
+			nc.Status("[green]Offline, queued for sending")
+		case err == opqueue.ErrMaybeSent:
+			nc.Status(maybeSentStatus)
+		case gmsg == nil:
 			nc.Status("Error sending: %v", err)
 			return err
-		}
-
-		if !hasLabel {
+		case err != nil:
+			nc.Status("Error labelling: %v", err)
+			log.Printf("Error labelling: %v", err)
+		case !hasLabel:
 			nc.Status("Sent OK, [red]but label %q doesn't exist, so can't add it.", *waitingLabel)
-		} else {
-			// Add label.
-			if _, err := gmailService.Users.Messages.Modify(email, gmsg.Id, &gmail.ModifyMessageRequest{
-				AddLabelIds: []string{l},
-			}).Do(); err != nil {
-				nc.Status("Error labelling: %v", err)
-				log.Printf("Error labelling: %v", err)
-			} else {
-				nc.Status("Successfully sent (with waiting label %q)", l)
-				log.Printf("Users.Messages.Send+Add waiting: %v", time.Since(st))
-			}
+		default:
+			log.Printf("Users.Messages.Send+Add waiting: %v", time.Since(st))
 			nc.Status("[green]Sent with label")
 		}
-	case 'W': // Send with label and archive.
-		st := time.Now()
-		l, hasLabel := labels[*waitingLabel]
-
-		nc.Status("Sending with label...")
-		gmsg, err := gmailService.Users.Messages.Send(email, &gmail.Message{
-			ThreadId: thread,
-			Raw:      mimeEncode(msg),
-		}).Do()
-		if err != nil {
-			nc.Status("Error sending: %v", err)
+		if choice == 'W' {
+			go func() {
+				// TODO: Archive in a better way.
+				nc.Input <- 'e'
+			}()
+		}
+	case 'l':
+		if err := scheduleSend(thread, msg, sendAt); err != nil {
+			nc.Status("[red]Error scheduling email: %v", err)
 			return err
 		}
-
-		if !hasLabel {
-			nc.Status("Sent OK, [red]but label %q doesn't exist, so can't add it.", *waitingLabel)
-		} else {
-			// Add label.
-			if _, err := gmailService.Users.Messages.Modify(email, gmsg.Id, &gmail.ModifyMessageRequest{
-				AddLabelIds: []string{l},
-			}).Do(); err != nil {
-				nc.Status("Error labelling: %v", err)
-				log.Printf("Error labelling: %v", err)
-			} else {
-				nc.Status("Successfully sent (with waiting label %q)", l)
-				log.Printf("Users.Messages.Send+Add waiting: %v", time.Since(st))
-				go func() {
-					// TODO: Do this in a better way.
-					nc.Input <- 'e'
-				}()
+		nc.Status("[green]Scheduled for %s", sendAt.Format(scheduledFormat))
+		if draftID != "" {
+			// Or it'd be left behind, looking unsent.
+			if err := mailBackend.DeleteDraft(draftID); err != nil {
+				log.Printf("Failed to delete scheduled draft %q: %v", draftID, err)
+				nc.Status("[red]Scheduled, but failed to delete the draft: %v", err)
 			}
-			nc.Status("[green]Sent with label")
 		}
-		go func() {
-			// TODO: Archive in a better way.
-			nc.Input <- 'e'
-		}()
 	case 'a':
 		nc.Status("Aborted send")
+		return errAborted
 	case 'd':
-		st := time.Now()
-		if _, err := gmailService.Users.Drafts.Create(email, &gmail.Draft{
+		d := &gmail.Draft{
 			Message: &gmail.Message{
 				ThreadId: thread,
 				Raw:      mimeEncode(msg),
 			},
-		}).Do(); err != nil {
+		}
+		if draftID != "" {
+			d.Id = draftID
+			_, err = mailBackend.UpdateDraft(draftID, d)
+		} else {
+			_, err = mailBackend.CreateDraft(d)
+		}
+		if err != nil {
 			nc.Status("[red]Error saving as draft: %v", err)
 			return err
 		}
 		nc.Status("Saved draft")
-		log.Printf("Users.Drafts.Create: %v", time.Since(st))
 	default:
 		nc.Status("[red]Error: invalid key %q pressed!", choice)
 		return fmt.Errorf("invalid key %q", choice)
@@ -863,11 +887,29 @@ func reconnect() error {
 	if err != nil {
 		return fmt.Errorf("failed to connect to gmail: %v", err)
 	}
-	gmailService, err = gmail.New(authedClient)
+	g, err := gmail.New(authedClient)
 	if err != nil {
 		return err
 	}
-	gmailService.UserAgent = userAgent
+	g.UserAgent = userAgent
+	mailBackend = backend.NewGmail(g, email, profileAPI)
+	if *useCache {
+		c, err := backend.NewCache(mailBackend, path.Join(*configDir, cacheDirName), localKey)
+		if err != nil {
+			return fmt.Errorf("failed to open cache: %v", err)
+		}
+		msgCache = c
+		mailBackend = c
+	}
+	if opQueue == nil {
+		q, err := opqueue.Open(path.Join(*configDir, queueDirName), mailBackend, localKey)
+		if err != nil {
+			return fmt.Errorf("failed to open offline queue: %v", err)
+		}
+		opQueue = q
+	} else {
+		opQueue.SetBackend(mailBackend)
+	}
 	return nil
 }
 
@@ -899,6 +941,10 @@ func main() {
 	if forwardRE, err = regexp.Compile(*forwardRegex); err != nil {
 		log.Fatalf("-forward_regexp %q is not a valid regex: %v", *forwardRegex, err)
 	}
+	if *maxParallel < 1 {
+		log.Fatalf("-parallel must be at least 1, was %d", *maxParallel)
+	}
+	fetcher = scheduler.New(*maxParallel)
 	if *configDir == "" {
 		*configDir = path.Join(os.Getenv("HOME"), defaultConfigDir)
 	}
@@ -943,18 +989,31 @@ func main() {
 		}
 	}
 
+	if localKey, err = atrest.FromFlags(*configDir, *gpg, *encryptTo, *passphraseCmd); err != nil {
+		log.Fatalf("Failed to get key for encrypting local mail data: %v", err)
+	}
+	if err := encryptSaved(); err != nil {
+		log.Fatalf("Failed to encrypt saved emails: %v", err)
+	}
+	if scheduled, err = sendlater.Open(path.Join(*configDir, sendlater.DirName), localKey); err != nil {
+		log.Fatalf("Failed to open scheduled emails: %v", err)
+	}
+
 	if err := reconnect(); err != nil {
 		log.Fatalf("Failed to create gmail client: %v", err)
 	}
 
 	// Make sure oauth keys are correct before setting up ncurses.
 	{
-		profile, err := gmailService.Users.GetProfile(email).Do()
+		profile, err := mailBackend.GetProfile()
 		if err != nil {
 			log.Fatalf("Get profile: %v", err)
 		}
 		emailAddress = profile.EmailAddress
 	}
+	if err := loadIdentities(); err != nil {
+		log.Printf("Failed to get send-as addresses, only sending as %s: %v", emailAddress, err)
+	}
 
 	// Get some initial data that should always succeed.
 	if c, err := getLabels(); err != nil {
@@ -962,9 +1021,8 @@ func main() {
 	} else {
 		updateLabels(c)
 	}
-	if err := updateContacts(); err != nil {
-		log.Fatalf("Getting contacts: %v", err)
-	}
+	addressBook = newAddressBook()
+	go updateContacts()
 
 	// Redirect logging.
 	{
@@ -986,6 +1044,7 @@ func main() {
 		nc.Stop()
 	}()
 	nc.Status("Start[green]ing [red]up...")
+	savedNotice()
 
 	messageListMain(*threadView)
 }
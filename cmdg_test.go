@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"sort"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/addressbook"
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
 )
 
 type sortUpdatesByID []listEntry
@@ -89,9 +95,13 @@ func TestBreakLines(t *testing.T) {
 
 func fakeAPIMeMessages(t *testing.T, w http.ResponseWriter, r *http.Request) {
 	t.Logf("Requested message: %v", r.URL)
-	if got, want := r.FormValue("format"), "full"; got != want {
+	r.ParseForm()
+	if got, want := r.FormValue("format"), "metadata"; got != want {
 		t.Errorf("Got format=%q, want %q", got, want)
 	}
+	if got, want := r.Form["metadataHeaders"], backend.MetadataHeaders; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got metadataHeaders=%q, want %q", got, want)
+	}
 	p := strings.Split(r.URL.Path, "/")
 	msgs := map[string]string{
 		"id-message-1": `
@@ -140,33 +150,13 @@ func fakeAPIMeMessages(t *testing.T, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func fakeAPIMeHistory(t *testing.T, w http.ResponseWriter, r *http.Request) {
-	t.Logf("Requested history message: %v", r.URL)
-	historyID, err := strconv.Atoi(r.FormValue("startHistoryId"))
-	if err != nil {
-		t.Fatalf("historyID not uint64: %v", err)
-	}
-	if historyID == 0 {
-		t.Errorf("Got historyID=%v, want !=0", historyID)
-	}
-	if _, err := w.Write([]byte(`{
-  "history": [
-    { "id": "1" },
-    { "id": "12345", "messages": [ {"id": "id-message-1" } ] }
-  ],
-  "historyId": "12346"
-}`)); err != nil {
-		t.Errorf("Failed to write profile response: %v", err)
-	}
-}
-
 func TestListMessages(t *testing.T) {
-	sleep = func(time.Duration) {}
-	var err error
-	gmailService, err = gmail.New(http.DefaultClient)
+	sleep = func(context.Context, time.Duration) error { return nil }
+	g, err := gmail.New(http.DefaultClient)
 	if err != nil {
 		t.Fatal(err)
 	}
+	mailBackend = backend.NewGmail(g, email, nil)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -206,26 +196,18 @@ func TestListMessages(t *testing.T) {
 		}
 	})
 	mux.HandleFunc("/me/messages/", func(w http.ResponseWriter, r *http.Request) { fakeAPIMeMessages(t, w, r) })
-	mux.HandleFunc("/me/history", func(w http.ResponseWriter, r *http.Request) { fakeAPIMeHistory(t, w, r) })
 
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
-	for _, historyID := range []uint64{0, 100} {
-		gmailService.BasePath = ts.URL
-		newHistoryID, msgs, more, errs := list("", "", "", 100, historyID)
+	{
+		g.BasePath = ts.URL
+		newHistoryID, _, msgs, more, errs := list(context.Background(), "", "", "", 100)
 		if len(errs) != 0 {
 			t.Fatalf("Listing emails: %+v", errs)
 		}
-		// History API not called when historyID is 0
-		if historyID == 0 {
-			if got, want := newHistoryID, uint64(0); got != want {
-				t.Errorf("history ID: got %v, want %v", got, want)
-			}
-		} else {
-			if got, want := newHistoryID, uint64(12346); got != want {
-				t.Errorf("history ID: got %v, want %v", got, want)
-			}
+		if got, want := newHistoryID, uint64(12345); got != want {
+			t.Errorf("history ID: got %v, want %v", got, want)
 		}
 		if got, want := len(msgs), 2; got != want {
 			t.Fatalf("got %d messages, want %d", got, want)
@@ -286,3 +268,254 @@ func TestBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchRetryCancelled(t *testing.T) {
+	defer func(old func(context.Context, time.Duration) error) { sleep = old }(sleep)
+	sleep = sleepContext
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	st := time.Now()
+	err := fetchRetry(ctx, 0, func() error {
+		calls++
+		cancel()
+		return fmt.Errorf("server trouble")
+	})
+	if err == nil {
+		t.Errorf("want error")
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+	if d := time.Since(st); d > time.Second {
+		t.Errorf("took %v after cancel", d)
+	}
+}
+
+// newFake starts a fake Gmail server and points mailBackend at it.
+func newFake(t *testing.T) *fakegmail.Server {
+	sleep = func(context.Context, time.Duration) error { return nil }
+	f := fakegmail.New("foo@bar.com")
+	g, err := f.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailBackend = backend.NewGmail(g, email, nil)
+	authedClient = http.DefaultClient
+	peopleURL = f.URL() + "/v1/people/me/connections"
+	return f
+}
+
+// fakeMessage returns message number n. extra is additional newline terminated headers.
+func fakeMessage(n int, extra string) string {
+	return fmt.Sprintf(`From: Sender %d <sender%d@example.com>
+To: foo@bar.com
+Subject: Message %d
+Message-ID: <msg%d@example.com>
+Date: Mon, %d Jan 2016 15:04:05 +0000
+%s
+Body of message %d.
+`, n, n, n, n, n, extra, n)
+}
+
+func TestListFake(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 5; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox, cmdglib.Unread); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.AddMessage(fakeMessage(6, ""), cmdglib.Sent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message gets fail a few times, forcing backoff.
+	f.InjectError("GET", "messages/", http.StatusTooManyRequests, 2)
+	f.InjectError("GET", "messages/", http.StatusInternalServerError, 1)
+
+	hid := f.HistoryID()
+	newHistoryID, _, msgs, more, errs := list(context.Background(), cmdglib.Inbox, "", "", 100)
+	if len(errs) != 0 {
+		t.Fatalf("Listing emails: %+v", errs)
+	}
+	if got, want := newHistoryID, hid; got != want {
+		t.Errorf("history ID: got %v, want %v", got, want)
+	}
+	if got, want := len(msgs), 5; got != want {
+		t.Fatalf("got %d messages, want %d", got, want)
+	}
+	var subjects []string
+	for m := range more {
+		subjects = append(subjects, cmdglib.GetHeader(m.msg, "Subject"))
+	}
+	sort.Strings(subjects)
+	if got, want := subjects, []string{"Message 1", "Message 2", "Message 3", "Message 4", "Message 5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := f.Requests("GET", "messages/"), 5+3; got != want {
+		t.Errorf("got %d message gets, want %d", got, want)
+	}
+
+	// Pagination and search.
+	_, _, msgs, more, errs = list(context.Background(), "", "sender3", "", 100)
+	if len(errs) != 0 {
+		t.Fatalf("Listing emails: %+v", errs)
+	}
+	for range more {
+	}
+	if got, want := len(msgs), 1; got != want {
+		t.Errorf("search: got %d messages, want %d", got, want)
+	}
+	var next string
+	_, next, msgs, more, errs = list(context.Background(), "", "", "", 4)
+	if len(errs) != 0 {
+		t.Fatalf("Listing emails: %+v", errs)
+	}
+	for range more {
+	}
+	if got, want := len(msgs), 4; got != want {
+		t.Errorf("page: got %d messages, want %d", got, want)
+	}
+	if next == "" {
+		t.Fatalf("page: no next page token")
+	}
+	first := msgs[0].msg.Id
+	_, next, msgs, more, errs = list(context.Background(), "", "", next, 4)
+	if len(errs) != 0 {
+		t.Fatalf("Listing emails: %+v", errs)
+	}
+	for range more {
+	}
+	if len(msgs) == 0 {
+		t.Fatalf("page 2: got no messages")
+	}
+	for _, m := range msgs {
+		if m.msg.Id == first {
+			t.Errorf("page 2: repeated message %q from page 1", first)
+		}
+	}
+}
+
+func TestListThreadsFake(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	if _, err := f.AddMessage(fakeMessage(1, ""), cmdglib.Inbox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.AddMessage(fakeMessage(2, "In-Reply-To: <msg1@example.com>\n"), cmdglib.Inbox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.AddMessage(fakeMessage(3, ""), cmdglib.Inbox); err != nil {
+		t.Fatal(err)
+	}
+	f.InjectError("GET", "threads/", http.StatusInternalServerError, 1)
+
+	_, ts, more := listThreads(context.Background(), cmdglib.Inbox, "", "", 100, 0)
+	if got, want := len(ts), 2; got != want {
+		t.Fatalf("got %d threads, want %d", got, want)
+	}
+	sizes := make(map[string]int)
+	for m := range more {
+		sizes[cmdglib.GetHeader(m.thread.Messages[0], "Subject")] = len(m.thread.Messages)
+	}
+	if got, want := sizes, map[string]int{"Message 1": 2, "Message 3": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestListCancelled(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, msgs, more, errs := list(ctx, cmdglib.Inbox, "", "", 100)
+	if len(errs) != 0 {
+		t.Fatalf("Listing emails: %+v", errs)
+	}
+	if got, want := len(msgs), 3; got != want {
+		t.Errorf("got %d stubs, want %d", got, want)
+	}
+	for m := range more {
+		t.Errorf("got message %q after cancel", m.ID())
+	}
+	if got, want := f.Requests("GET", "messages/"), 0; got != want {
+		t.Errorf("got %d message fetches after cancel, want %d", got, want)
+	}
+}
+
+func TestThreadHeaders(t *testing.T) {
+	msg := func(hs ...string) *gmail.Message {
+		m := &gmail.Message{Payload: &gmail.MessagePart{}}
+		for n := 0; n < len(hs); n += 2 {
+			m.Payload.Headers = append(m.Payload.Headers, &gmail.MessagePartHeader{Name: hs[n], Value: hs[n+1]})
+		}
+		return m
+	}
+	for _, test := range []struct {
+		msg  *gmail.Message
+		want string
+	}{
+		{msg(), ""},
+		{msg("Message-Id", "<a@x>"), "In-Reply-To: <a@x>\nReferences: <a@x>\n"},
+		{msg("Message-ID", "<b@x>", "In-Reply-To", "<a@x>"), "In-Reply-To: <b@x>\nReferences: <a@x> <b@x>\n"},
+		{
+			msg("Message-ID", "<c@x>", "In-Reply-To", "<b@x>", "References", "<a@x>\r\n <b@x>"),
+			"In-Reply-To: <c@x>\nReferences: <a@x> <b@x> <c@x>\n",
+		},
+	} {
+		if got := threadHeaders(test.msg); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+
+	// Kept through composing, and when continuing a draft.
+	raw, err := composeMessage(threadHeaders(msg("Message-ID", "<b@x>", "References", "<a@x>"))+"To: foo@example.com\nSubject: Re: x\n\nHello\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"In-Reply-To: <b@x>\r\n", "References: <a@x> <b@x>\r\n"} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("composed message lacks %q:\n%s", want, raw)
+		}
+	}
+	draft := msg("To", "foo@example.com", "In-Reply-To", "<b@x>", "References", "<a@x> <b@x>")
+	if got, want := draftThreadHeaders(draft), "In-Reply-To: <b@x>\nReferences: <a@x> <b@x>\n"; got != want {
+		t.Errorf("draft: got %q, want %q", got, want)
+	}
+}
+
+func TestContactAddresses(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer func() { addressBook = addressbook.New(contactsRefresh) }()
+	f.AddContact("Foo Bar", "foo@example.com")
+	if _, err := f.AddMessage("From: foo@bar.com\nTo: Baz <baz@example.com>\nSubject: Hi\n\nHi\n", cmdglib.Sent); err != nil {
+		t.Fatal(err)
+	}
+	oldAliases := *contactsAliases
+	defer func() { *contactsAliases = oldAliases }()
+	*contactsAliases = "addressbook/testdata/aliases"
+
+	// Google contacts being down doesn't matter.
+	f.InjectError("GET", "people/", http.StatusServiceUnavailable, 1)
+	addressBook = newAddressBook()
+	updateContacts()
+	got := contactAddresses()
+	if got, want := len(got), 7; got != want {
+		t.Errorf("got %d addresses, want %d: %q", got, want, got)
+	}
+	if got, want := got[:2], []string{"me", "Baz <baz@example.com>"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	addressBook = newAddressBook()
+	updateContacts()
+	if got, want := contactAddresses()[2], "Foo Bar <foo@example.com>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
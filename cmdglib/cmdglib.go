@@ -136,3 +136,14 @@ func HasLabel(labels []string, needle string) bool {
 	}
 	return false
 }
+
+// ChangeLabels returns labels with add added and remove removed.
+func ChangeLabels(labels, add, remove []string) []string {
+	ret := []string{}
+	for _, l := range append(append([]string{}, labels...), add...) {
+		if !HasLabel(remove, l) && !HasLabel(ret, l) {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
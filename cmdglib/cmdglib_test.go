@@ -1,6 +1,7 @@
 package cmdglib
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -19,3 +20,17 @@ func TestDateFormats(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels, add, remove, want []string
+	}{
+		{nil, nil, nil, []string{}},
+		{[]string{"a", "b"}, []string{"c", "a"}, []string{"b"}, []string{"a", "c"}},
+		{[]string{"a"}, nil, []string{"a"}, []string{}},
+	} {
+		if got := ChangeLabels(test.labels, test.add, test.remove); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ChangeLabels(%q, %q, %q): got %q, want %q", test.labels, test.add, test.remove, got, test.want)
+		}
+	}
+}
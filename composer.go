@@ -0,0 +1,380 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Max line length of base64 encoded attachments, per RFC 2045.
+	base64LineLength = 76
+
+	// Header lines are folded to be at most this long, per RFC 5322.
+	headerLineLength = 78
+
+	// Body lines longer than this can't be sent as 7bit, per RFC 5322.
+	maxBodyLineLength = 998
+)
+
+var (
+	// Headers that contain address lists, and are validated and encoded as such.
+	addressHeaders = []string{"From", "To", "Cc", "Bcc", "Reply-To"}
+
+	// Headers that the composer sets, so they're dropped if the user wrote them.
+	mimeHeaders = []string{"MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+)
+
+// header is one header line of an outgoing email.
+type header struct {
+	name  string
+	value string
+}
+
+// outgoing is an email as written by the user, before it's turned into MIME.
+type outgoing struct {
+	headers     []header
+	body        string
+	attachments []*attachment
+}
+
+// splitMessage splits an email as written in the editor into header lines and body.
+func splitMessage(msg string) ([]string, string) {
+	msg = strings.Replace(msg, "\r\n", "\n", -1)
+	parts := strings.SplitN(msg, "\n\n", 2)
+	var body string
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	var headers []string
+	for _, l := range strings.Split(parts[0], "\n") {
+		if l == "" {
+			continue
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(headers) > 0 {
+			// Continuation line.
+			headers[len(headers)-1] += "\n" + l
+			continue
+		}
+		headers = append(headers, l)
+	}
+	return headers, body
+}
+
+func isHeader(name string, list []string) bool {
+	for _, h := range list {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOutgoing parses an email as written in the editor.
+func parseOutgoing(msg string) (*outgoing, error) {
+	lines, body := splitMessage(msg)
+	o := &outgoing{body: body}
+	for _, l := range lines {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.ContainsAny(kv[0], " \t") {
+			return nil, fmt.Errorf("malformed header line %q", l)
+		}
+		name := textproto.CanonicalMIMEHeaderKey(kv[0])
+		if isHeader(name, mimeHeaders) {
+			continue
+		}
+		// Unfold.
+		value := strings.TrimSpace(strings.Join(strings.Fields(kv[1]), " "))
+		o.headers = append(o.headers, header{name: name, value: value})
+	}
+	return o, nil
+}
+
+// get returns the first value of a header, or "".
+func (o *outgoing) get(name string) string {
+	for _, h := range o.headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// validate checks that all the addresses can be parsed.
+func (o *outgoing) validate() error {
+	for _, h := range o.headers {
+		if !isHeader(h.name, addressHeaders) || h.value == "" {
+			continue
+		}
+		if _, err := mail.ParseAddressList(h.value); err != nil {
+			return fmt.Errorf("bad address in %s %q: %v", h.name, h.value, err)
+		}
+	}
+	return nil
+}
+
+// encodeHeader returns the header encoded per RFC 2047, and folded.
+func encodeHeader(h header) (string, error) {
+	var value string
+	if isHeader(h.name, addressHeaders) {
+		as, err := mail.ParseAddressList(h.value)
+		if err != nil {
+			return "", fmt.Errorf("bad address in %s %q: %v", h.name, h.value, err)
+		}
+		var s []string
+		for _, a := range as {
+			s = append(s, a.String())
+		}
+		value = strings.Join(s, ", ")
+	} else {
+		value = mime.QEncoding.Encode("utf-8", h.value)
+	}
+	return foldHeader(h.name + ": " + value), nil
+}
+
+// foldHeader breaks a header line at spaces so that lines are at most
+// headerLineLength long, where possible.
+func foldHeader(s string) string {
+	var lines []string
+	cur := ""
+	for _, w := range strings.Split(s, " ") {
+		switch {
+		case cur == "":
+			cur = w
+		case len(lines) == 0 && !strings.Contains(cur, " "):
+			// Don't break between header name and value.
+			cur += " " + w
+		case len(cur)+1+len(w) > headerLineLength:
+			lines = append(lines, cur)
+			cur = " " + w
+		default:
+			cur += " " + w
+		}
+	}
+	lines = append(lines, cur)
+	return strings.Join(lines, "\r\n")
+}
+
+// decodeHeader decodes RFC 2047 encoded words, for putting headers in the editor.
+func decodeHeader(s string) string {
+	d, err := new(mime.WordDecoder).DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
+
+// bodyEncoding returns the Content-Transfer-Encoding to use for a text body.
+func bodyEncoding(body string) string {
+	for _, l := range strings.Split(body, "\n") {
+		if len(l) > maxBodyLineLength {
+			return "quoted-printable"
+		}
+	}
+	for _, r := range body {
+		if r >= utf8.RuneSelf {
+			return "quoted-printable"
+		}
+	}
+	return "7bit"
+}
+
+// encodeBody encodes a text body with CRLF line endings.
+func encodeBody(body, enc string) (string, error) {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\n", "\r\n", -1)
+	if enc != "quoted-printable" {
+		return body, nil
+	}
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// base64Lines base64 encodes data, broken into lines.
+func base64Lines(data []byte) string {
+	s := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(s) > base64LineLength {
+		b.WriteString(s[:base64LineLength] + "\r\n")
+		s = s[base64LineLength:]
+	}
+	b.WriteString(s + "\r\n")
+	return b.String()
+}
+
+// attachmentEncoding returns the Content-Transfer-Encoding of an attachment,
+// and its data encoded with it. Attached emails may not be base64 encoded
+// (RFC 2046 section 5.2.1), so they're sent as is with CRLF line endings,
+// and as binary if they have NULs, lone CRs or too long lines. If safe is
+// set they have to be 7bit, since signed content can't be anything else
+// (RFC 3156 section 3).
+func attachmentEncoding(a *attachment, safe bool) (string, string, error) {
+	if mt, _, err := mime.ParseMediaType(a.contentType); err != nil || mt != "message/rfc822" {
+		return "base64", base64Lines(a.data), nil
+	}
+	data := strings.Replace(string(a.data), "\r\n", "\n", -1)
+	data = strings.Replace(data, "\n", "\r\n", -1)
+	enc := "7bit"
+	for _, l := range strings.Split(data, "\r\n") {
+		if len(l) > maxBodyLineLength || strings.ContainsAny(l, "\x00\r") {
+			enc = "binary"
+			break
+		}
+	}
+	if enc == "7bit" {
+		for _, r := range data {
+			if r >= utf8.RuneSelf {
+				enc = "8bit"
+				break
+			}
+		}
+	}
+	if safe && enc != "7bit" {
+		return "", "", fmt.Errorf("attached email %q is %s, and can't be signed. Forward it inline or with its attachments instead", a.name, enc)
+	}
+	return enc, data, nil
+}
+
+// build returns the email as MIME, ready to send.
+func (o *outgoing) build() (string, error) {
+	head, err := o.encodeHeaders()
+	if err != nil {
+		return "", err
+	}
+	content, err := o.content(false)
+	if err != nil {
+		return "", err
+	}
+	return head + "MIME-Version: 1.0\r\n" + content, nil
+}
+
+// encodeHeaders returns the headers written by the user, encoded and
+// folded. Empty headers are skipped.
+func (o *outgoing) encodeHeaders() (string, error) {
+	var b bytes.Buffer
+	for _, h := range o.headers {
+		if h.value == "" {
+			continue
+		}
+		s, err := encodeHeader(h)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s + "\r\n")
+	}
+	return b.String(), nil
+}
+
+// content returns the body and attachments as one MIME entity, starting
+// with its Content-Type header. If safe is set the text is always
+// quoted-printable, so that it survives servers changing whitespace, and
+// attached emails must be 7bit.
+func (o *outgoing) content(safe bool) (string, error) {
+	var b bytes.Buffer
+	enc := bodyEncoding(o.body)
+	if safe {
+		enc = "quoted-printable"
+	}
+	body, err := encodeBody(o.body, enc)
+	if err != nil {
+		return "", err
+	}
+	textHeader := textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {enc},
+	}
+
+	if len(o.attachments) == 0 {
+		for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, textHeader.Get(k))
+		}
+		b.WriteString("\r\n" + body)
+		return b.String(), nil
+	}
+
+	w := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()}))
+	p, err := w.CreatePart(textHeader)
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.Write([]byte(body)); err != nil {
+		return "", err
+	}
+	for _, a := range o.attachments {
+		enc, data, err := attachmentEncoding(a, safe)
+		if err != nil {
+			return "", err
+		}
+		p, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mediaType(a.contentType, map[string]string{"name": a.name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})},
+			"Content-Transfer-Encoding": {enc},
+		})
+		if err != nil {
+			return "", err
+		}
+		if _, err := p.Write([]byte(data)); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// composeMessage turns an email as written in the editor, and any
+// attachments, into a MIME message ready to send.
+func composeMessage(msg string, atts []*attachment) (string, error) {
+	o, err := parseOutgoing(msg)
+	if err != nil {
+		return "", err
+	}
+	if err := o.validate(); err != nil {
+		return "", err
+	}
+	o.attachments = atts
+	return o.build()
+}
+
+// checkMessage returns an error if an email as written in the editor can't be sent.
+func checkMessage(msg string) error {
+	o, err := parseOutgoing(msg)
+	if err != nil {
+		return err
+	}
+	return o.validate()
+}
@@ -0,0 +1,157 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestFoldHeader(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"Subject: short", "Subject: short"},
+		{
+			"Subject: " + strings.Repeat("word ", 20) + "end",
+			"Subject: word word word word word word word word word word word word word word\r\n word word word word word word end",
+		},
+		{
+			// Can't be broken.
+			"Subject: " + strings.Repeat("x", 100),
+			"Subject: " + strings.Repeat("x", 100),
+		},
+	} {
+		got := foldHeader(test.in)
+		if got != test.want {
+			t.Errorf("foldHeader(%q):\ngot  %q\nwant %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestComposeMessage(t *testing.T) {
+	longSubject := "Smörgåsbord " + strings.Repeat("och mer ", 15)
+	raw, err := composeMessage("To: Jörg Müller <jorg@example.com>, plain@example.com\n"+
+		"Cc: \n"+
+		"Subject: "+longSubject+"\n"+
+		"Content-Type: text/html\n"+
+		"\n"+
+		"Hej då!\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, l := range strings.Split(raw, "\r\n") {
+		if l == "" {
+			break
+		}
+		// Encoded words can't be broken, but are at most 75 characters.
+		for _, w := range strings.Fields(l) {
+			if len(w) > 75 {
+				t.Errorf("header line %d has too long word (%d): %q", n, len(w), w)
+			}
+		}
+		if len(l) > headerLineLength && strings.Contains(strings.TrimSpace(l[strings.Index(l, " ")+1:]), " ") {
+			t.Errorf("header line %d not folded (%d): %q", n, len(l), l)
+		}
+		for _, r := range l {
+			if r > 127 {
+				t.Errorf("header line %d not ASCII: %q", n, l)
+				break
+			}
+		}
+	}
+	if strings.Contains(raw, "Cc:") {
+		t.Errorf("empty Cc not dropped:\n%s", raw)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(mime.WordDecoder)
+	subj, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subj, strings.TrimSpace(longSubject); got != want {
+		t.Errorf("subject: got %q, want %q", got, want)
+	}
+	to, err := m.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(to), 2; got != want {
+		t.Fatalf("got %d recipients, want %d", got, want)
+	}
+	if got, want := to[0].Name, "Jörg Müller"; got != want {
+		t.Errorf("name: got %q, want %q", got, want)
+	}
+	if got, want := to[0].Address, "jorg@example.com"; got != want {
+		t.Errorf("address: got %q, want %q", got, want)
+	}
+	if got, want := m.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("Content-Type: got %q, want %q", got, want)
+	}
+	if got, want := m.Header.Get("Content-Transfer-Encoding"), "quoted-printable"; got != want {
+		t.Errorf("Content-Transfer-Encoding: got %q, want %q", got, want)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), "Hej då!\r\n"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+}
+
+func TestComposeASCII(t *testing.T) {
+	raw, err := composeMessage("To: foo@example.com\nSubject: Hello\n\nPlain body.\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "To: <foo@example.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"Plain body.\r\n"
+	if raw != want {
+		t.Errorf("got:\n%q\nwant:\n%q", raw, want)
+	}
+}
+
+func TestComposeBadAddress(t *testing.T) {
+	for _, msg := range []string{
+		"To: not an address\nSubject: x\n\nbody",
+		"To: foo@example.com\nCc: <broken@\nSubject: x\n\nbody",
+		"To foo@example.com\n\nbody",
+	} {
+		if _, err := composeMessage(msg, nil); err == nil {
+			t.Errorf("%q: want error", msg)
+		}
+		if err := checkMessage(msg); err == nil {
+			t.Errorf("checkMessage(%q): want error", msg)
+		}
+	}
+}
@@ -1,66 +1,56 @@
 package main
 
 import (
-	"encoding/xml"
-	"fmt"
-	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
 	"time"
+
+	"github.com/ThomasHabets/cmdg/addressbook"
+	"github.com/ThomasHabets/cmdg/backend"
 )
 
-type contactEmail struct {
-	Primary bool   `xml:"primary,attr"`
-	Rel     string `xml:"rel,attr"`
-	Email   string `xml:"address,attr"`
-}
-type contactEntry struct {
-	ID    string         `xml:"id"`
-	Title string         `xml:"title"`
-	Email []contactEmail `xml:"email"`
-}
-type contactsT struct {
-	ID    string         `xml:"id"`
-	Title string         `xml:"title"`
-	Entry []contactEntry `xml:"entry"`
-}
+// How often each address book source is updated, at most.
+const contactsRefresh = 10 * time.Minute
 
-func updateContacts() error {
-	c, err := getContacts()
-	if err != nil {
-		return err
-	}
-	contacts = c
-	return nil
-}
+var (
+	peopleURL = addressbook.PeopleURL
 
-func contactAddresses() []string {
-	ret := []string{"me"}
-	for _, c := range contacts.Entry {
-		for _, e := range c.Email {
-			if c.Title != "" {
-				ret = append(ret, fmt.Sprintf("%s <%s>", c.Title, e.Email))
-			} else {
-				ret = append(ret, e.Email)
-			}
+	// addressBook is set up from flags in main.
+	addressBook = addressbook.New(contactsRefresh)
+)
+
+// newAddressBook returns an address book with the sources turned on by flags.
+func newAddressBook() *addressbook.Book {
+	var srcs []addressbook.Source
+	if *contactsGoogle {
+		srcs = append(srcs, addressbook.NewPeople(func() *http.Client { return authedClient }, peopleURL))
+	}
+	if *contactsAliases != "" {
+		srcs = append(srcs, addressbook.NewAliases(*contactsAliases))
+	}
+	if *contactsVCard != "" {
+		var ps []string
+		for _, p := range strings.Split(*contactsVCard, ",") {
+			ps = append(ps, path.Clean(p))
 		}
+		srcs = append(srcs, addressbook.NewVCard(ps))
 	}
-	return ret
+	if *contactsSent > 0 {
+		srcs = append(srcs, addressbook.NewSent(func() backend.Backend { return mailBackend }, fetcher, *contactsSent))
+	}
+	return addressbook.New(contactsRefresh, srcs...)
 }
 
-func getContacts() (contactsT, error) {
-	st := time.Now()
-	resp, err := authedClient.Get("https://www.google.com/m8/feeds/contacts/default/full")
-	if err != nil {
-		return contactsT{}, fmt.Errorf("getting contacts: %v", err)
-	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return contactsT{}, fmt.Errorf("reading contacts: %v", err)
+// updateContacts updates the address book. Sources that fail keep their
+// old contacts, so it's only logged.
+func updateContacts() {
+	for _, err := range addressBook.Update() {
+		log.Printf("Getting contacts: %v", err)
 	}
-	profileAPI("Contacts.Get", time.Since(st))
-	var c contactsT
-	if err := xml.Unmarshal(b, &c); err != nil {
-		return contactsT{}, fmt.Errorf("decoding contacts XML: %v", err)
-	}
-	return c, nil
+}
+
+func contactAddresses() []string {
+	return append([]string{"me"}, addressBook.Addresses()...)
 }
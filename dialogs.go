@@ -69,10 +69,10 @@ func readDir(d string) ([]os.FileInfo, error) {
 	return files, nil
 }
 
-func fullscreenWindow() *gc.Window {
+func fullscreenWindow() ncwrap.Window {
 	maxY, maxX := winSize()
 
-	w, err := gc.NewWindow(maxY-5, maxX-4, 2, 2)
+	w, err := nc.NewWindow(maxY-5, maxX-4, 2, 2)
 	if err != nil {
 		log.Fatalf("Creating stringChoice window: %v", err)
 	}
@@ -115,7 +115,7 @@ func loadFileDialog() (string, error) {
 				w.Print(fmt.Sprintf("   %s\n", printName))
 			}
 		}
-		winBorder(w)
+		w.Border()
 		w.Refresh()
 		select {
 		case key := <-nc.Input:
@@ -151,7 +151,7 @@ func loadFileDialog() (string, error) {
 // Run in main/ncurses goroutine.
 func saveFileDialog(fn string) (string, error) {
 	defer func() {
-		gc.Cursor(0)
+		nc.Cursor(false)
 	}()
 	w := fullscreenWindow()
 	defer w.Delete()
@@ -195,12 +195,12 @@ func saveFileDialog(fn string) (string, error) {
 				w.Print(fmt.Sprintf("   %s\n", printName))
 			}
 		}
-		gc.Cursor(0)
-		winBorder(w)
+		nc.Cursor(false)
+		w.Border()
 		w.Refresh()
 		if fileNameEdit {
 			w.Move(1, 2+len(filenamePrompt)+len(fn))
-			gc.Cursor(1)
+			nc.Cursor(true)
 			w.Refresh()
 			select {
 			case key := <-nc.Input:
@@ -0,0 +1,258 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/ncwrap"
+)
+
+type sortDraftsNewestFirst []*gmail.Draft
+
+func (a sortDraftsNewestFirst) Len() int      { return len(a) }
+func (a sortDraftsNewestFirst) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a sortDraftsNewestFirst) Less(i, j int) bool {
+	if a[i].Message.InternalDate != a[j].Message.InternalDate {
+		return a[i].Message.InternalDate > a[j].Message.InternalDate
+	}
+	return a[i].Id < a[j].Id
+}
+
+// draftThreadHeaders returns the threading headers of a draft, which are
+// not shown in the editor but need to be kept when the draft is changed.
+func draftThreadHeaders(m *gmail.Message) string {
+	var ret string
+	for _, h := range []string{"In-Reply-To", "References"} {
+		if v := cmdglib.GetHeader(m, h); v != "" {
+			ret += fmt.Sprintf("%s: %s\n", h, v)
+		}
+	}
+	return ret
+}
+
+// messageAttachments downloads the attachments of a message, such as a draft
+// so that they're kept when it's changed, or a message being forwarded.
+func messageAttachments(m *gmail.Message) ([]*attachment, error) {
+	var atts []*attachment
+	for _, p := range partTree(m) {
+		if p.part.Filename == "" || p.part.Body == nil {
+			continue
+		}
+		data := p.part.Body.Data
+		if id := p.part.Body.AttachmentId; id != "" {
+			b, err := mailBackend.GetAttachment(m.Id, id)
+			if err != nil {
+				return nil, fmt.Errorf("getting attachment %q: %v", p.part.Filename, err)
+			}
+			data = b.Data
+		}
+		dec, err := mimeDecode(data)
+		if err != nil {
+			return nil, fmt.Errorf("decoding attachment %q: %v", p.part.Filename, err)
+		}
+		atts = append(atts, &attachment{
+			name:        p.part.Filename,
+			contentType: p.part.MimeType,
+			data:        []byte(dec),
+		})
+	}
+	return atts, nil
+}
+
+// sendDraft replaces the content of a draft, sends it, and adds labels to
+// the sent message. If sending worked but labelling didn't, both the sent
+// message and an error is returned.
+func sendDraft(id, thread, msg string, add []string) (*gmail.Message, error) {
+	if _, err := mailBackend.UpdateDraft(id, &gmail.Draft{
+		Id: id,
+		Message: &gmail.Message{
+			ThreadId: thread,
+			Raw:      mimeEncode(msg),
+		},
+	}); err != nil {
+		return nil, err
+	}
+	m, err := mailBackend.SendDraft(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(add) > 0 {
+		return m, mailBackend.ModifyMessage(m.Id, add, nil)
+	}
+	return m, nil
+}
+
+// editDraft runs the editor on a draft, and then asks what to do with it.
+// Recipients, thread and attachments are kept.
+func editDraft(d *gmail.Draft) {
+	m := d.Message
+	atts, err := messageAttachments(m)
+	if err != nil {
+		nc.Status("[red]Failed to get draft attachments: %v", err)
+		return
+	}
+	msg, err := runEditorHeadersOK(draftEditorText(m))
+	if err != nil {
+		nc.Status("Running editor: %v", err)
+		return
+	}
+	createSendDraft(m.ThreadId, d.Id, draftThreadHeaders(m)+msg, atts)
+}
+
+// sendDraftMenu asks how to send a draft as it is, without editing it.
+func sendDraftMenu(d *gmail.Draft) {
+	m := d.Message
+	atts, err := messageAttachments(m)
+	if err != nil {
+		nc.Status("[red]Failed to get draft attachments: %v", err)
+		return
+	}
+	createSendDraft(m.ThreadId, d.Id, draftThreadHeaders(m)+draftEditorText(m), atts)
+}
+
+// draftEditorText returns an unsent email the way it's shown in the editor.
+func draftEditorText(m *gmail.Message) string {
+	var from string
+	if f := cmdglib.GetHeader(m, "From"); f != "" {
+		from = "From: " + decodeHeader(f) + "\n"
+	}
+	return fmt.Sprintf("%sTo: %s\nCc: %s\nBcc: %s\nSubject: %s\n\n%s",
+		from,
+		decodeHeader(cmdglib.GetHeader(m, "To")),
+		decodeHeader(cmdglib.GetHeader(m, "Cc")),
+		decodeHeader(cmdglib.GetHeader(m, "Bcc")),
+		decodeHeader(cmdglib.GetHeader(m, "Subject")),
+		getBody(m),
+	)
+}
+
+// draftsPrint prints the list of drafts, and returns the new scroll position.
+func draftsPrint(w ncwrap.Window, drafts []*gmail.Draft, cur, scroll int) int {
+	maxY, maxX := w.MaxYX()
+	rows := maxY - 5
+	scroll = listScroll(scroll, cur, rows)
+	w.Clear()
+	ncwrap.ColorPrint(w, "\n [bold]Drafts[unbold]: %d\n\n", len(drafts))
+	for n := scroll; n < len(drafts) && n < scroll+rows; n++ {
+		m := drafts[n].Message
+		prefix := "  "
+		if n == cur {
+			prefix = "[bold]>"
+		}
+		to := decodeHeader(cmdglib.GetHeader(m, "To"))
+		if to == "" {
+			to = "(no recipient)"
+		}
+		line := fmt.Sprintf("%s %-25.25s %s",
+			time.Unix(m.InternalDate/1000, 0).Local().Format("Jan 02 15:04"),
+			to,
+			decodeHeader(cmdglib.GetHeader(m, "Subject")))
+		if len(line) > maxX-6 && maxX > 6 {
+			line = line[:maxX-6]
+		}
+		ncwrap.ColorPrint(w, " %s %s[unbold]\n", ncwrap.Preformat(prefix), line)
+	}
+	w.Border()
+	w.Refresh()
+	return scroll
+}
+
+// draftsView shows drafts, newest first, and lets the user edit, send or delete them.
+func draftsView() {
+	nc.Status("Loading drafts...")
+	drafts, err := getDrafts()
+	if err != nil {
+		nc.Status("[red]Getting drafts: %v", err)
+		return
+	}
+	nc.Status("")
+	reload := func() {
+		if ds, err := getDrafts(); err != nil {
+			nc.Status("[red]Getting drafts: %v", err)
+		} else {
+			drafts = ds
+		}
+	}
+	cur, scroll := 0, 0
+	for {
+		if cur >= len(drafts) {
+			cur = len(drafts) - 1
+		}
+		if cur < 0 {
+			cur = 0
+		}
+		// New window each time, since the editor restarts the UI.
+		w := fullscreenWindow()
+		scroll = draftsPrint(w, drafts, cur, scroll)
+		key := <-nc.Input
+		w.Delete()
+		switch key {
+		case '?':
+			helpWin(`q, ^C, ^G         Back
+^P, p, k, Up      Previous
+^N, n, j, Down    Next
+Enter, e          Edit draft
+S                 Send draft
+D                 Delete draft
+r                 Reload drafts
+`)
+		case 'q', ctrlC, ctrlG:
+			return
+		case gc.KEY_UP, 'p', ctrlP, 'k':
+			if cur > 0 {
+				cur--
+			}
+		case gc.KEY_DOWN, 'n', ctrlN, 'j':
+			cur++
+		case 'r':
+			reload()
+		case '\n', '\r', 'e':
+			if len(drafts) == 0 {
+				break
+			}
+			editDraft(drafts[cur])
+			reload()
+		case 'S':
+			if len(drafts) == 0 {
+				break
+			}
+			sendDraftMenu(drafts[cur])
+			reload()
+		case 'D':
+			if len(drafts) == 0 {
+				break
+			}
+			if !confirm(fmt.Sprintf("Delete draft %q?", decodeHeader(cmdglib.GetHeader(drafts[cur].Message, "Subject")))) {
+				break
+			}
+			if err := mailBackend.DeleteDraft(drafts[cur].Id); err != nil {
+				nc.Status("[red]Failed to delete draft: %v", err)
+				break
+			}
+			nc.Status("[green]Deleted draft")
+			reload()
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+func TestDraftsView(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := mailBackend.CreateDraft(&gmail.Draft{
+			Message: &gmail.Message{Raw: mimeEncode(fakeMessage(n, ""))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := startHeadless(t)
+	defer stopHeadless()
+	done := make(chan struct{})
+	go func() {
+		draftsView()
+		close(done)
+	}()
+	if !s.WaitFor("Drafts: 3", 5*time.Second) {
+		t.Fatalf("drafts not shown. Screen:\n%s", s.Contents())
+	}
+	if got, want := s.Line(5), "Message 3"; !strings.Contains(got, want) || !strings.Contains(got, ">") {
+		t.Errorf("first draft: got %q, want selected %q", got, want)
+	}
+
+	// Delete the newest, and send the oldest.
+	nc.Input <- 'D'
+	if !s.WaitFor(`Delete draft "Message 3"?`, 5*time.Second) {
+		t.Fatalf("delete not confirmed. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'y'
+	if !s.WaitFor("Drafts: 2", 5*time.Second) {
+		t.Fatalf("draft not deleted. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'j'
+	nc.Input <- 'S'
+	if !s.WaitFor("Abort, discarding changes", 5*time.Second) {
+		t.Fatalf("send menu not shown. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 's'
+	if !s.WaitFor("Drafts: 1", 5*time.Second) {
+		t.Fatalf("draft not sent. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'q'
+	<-done
+
+	drafts, err := getDrafts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drafts) != 1 || cmdglib.GetHeader(drafts[0].Message, "Subject") != "Message 2" {
+		t.Errorf("want only draft 2 left, got %d drafts", len(drafts))
+	}
+	res, err := mailBackend.ListMessages(cmdglib.Sent, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Fatalf("got %d sent, want %d", got, want)
+	}
+	m, err := mailBackend.GetMessage(res.Messages[0].Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cmdglib.GetHeader(m, "Subject"), "Message 1"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestCreateSendDraft(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	orig, err := f.AddMessage(fakeMessage(1, ""), cmdglib.Inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := composeMessage("In-Reply-To: <msg1@example.com>\nReferences: <msg1@example.com>\nTo: foo@example.com\nCc: cc@example.com\nBcc: bcc@example.com\nSubject: Re: Message 1\n\nFirst version.\n",
+		[]*attachment{{name: "data.bin", contentType: "application/octet-stream", data: []byte{1, 2, 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := mailBackend.CreateDraft(&gmail.Draft{Message: &gmail.Message{ThreadId: orig.ThreadId, Raw: mimeEncode(raw)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drafts, err := getDrafts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := drafts[0].Message
+	if got, want := getBody(m), "First version."; got != want {
+		t.Errorf("draft body: got %q, want %q", got, want)
+	}
+	atts, err := messageAttachments(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 || atts[0].name != "data.bin" || string(atts[0].data) != "\x01\x02\x03" {
+		t.Fatalf("got attachments %v, want data.bin", atts)
+	}
+
+	// As if edited, then saved.
+	s := startHeadless(t)
+	defer stopHeadless()
+	edited := draftThreadHeaders(m) + "To: foo@example.com\nCc: cc@example.com\nBcc: bcc@example.com\nSubject: Re: Message 1\n\nSecond version.\n"
+	nc.Input <- 'd'
+	if err := createSendDraft(m.ThreadId, d.Id, edited, atts); err != nil {
+		t.Fatal(err)
+	}
+	drafts, err = getDrafts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(drafts), 1; got != want {
+		t.Fatalf("got %d drafts after saving, want %d", got, want)
+	}
+	m = drafts[0].Message
+	if got, want := drafts[0].Id, d.Id; got != want {
+		t.Errorf("got draft ID %q, want %q", got, want)
+	}
+	if got, want := getBody(m), "Second version."; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	for h, want := range map[string]string{
+		"Cc":          "<cc@example.com>",
+		"Bcc":         "<bcc@example.com>",
+		"In-Reply-To": "<msg1@example.com>",
+	} {
+		if got := cmdglib.GetHeader(m, h); got != want {
+			t.Errorf("%s: got %q, want %q", h, got, want)
+		}
+	}
+	if got, want := m.ThreadId, orig.ThreadId; got != want {
+		t.Errorf("got thread %q, want %q", got, want)
+	}
+	if atts, err := messageAttachments(m); err != nil || len(atts) != 1 {
+		t.Errorf("attachment not kept: %v, %v", atts, err)
+	}
+
+	// Send it.
+	go func() {
+		if !s.WaitFor("Abort, discarding changes", 5*time.Second) {
+			t.Errorf("not editing a draft. Screen:\n%s", s.Contents())
+		}
+		nc.Input <- 's'
+	}()
+	if err := createSendDraft(m.ThreadId, d.Id, edited, atts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "drafts/send"), 1; got != want {
+		t.Errorf("got %d draft sends, want %d", got, want)
+	}
+	if drafts, err := getDrafts(); err != nil || len(drafts) != 0 {
+		t.Errorf("got %d drafts after sending, want none: %v", len(drafts), err)
+	}
+	res, err := mailBackend.ListMessages(cmdglib.Sent, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Fatalf("got %d sent, want %d", got, want)
+	}
+	if got, want := res.Messages[0].ThreadId, orig.ThreadId; got != want {
+		t.Errorf("sent in thread %q, want %q", got, want)
+	}
+}
@@ -25,8 +25,7 @@ const (
 // It can't send to cloud because the reason it failed to send may be
 // that the network is down or OAuth is broken.
 //
-// TODO: It would be nice if this were encrypted with a key that *is*
-// in the cloud though.
+// It's encrypted if -encrypt_to or -encrypt_passphrase_cmd is used.
 func saveFailedSend(msg string) error {
 	dir := path.Join(*configDir, savedDir)
 	if err := os.MkdirAll(dir, savedDirMode); err != nil {
@@ -38,12 +37,16 @@ func saveFailedSend(msg string) error {
 		log.Printf("Failed to chmod %q, continuing anyway: %v", dir, err)
 	}
 
-	f, err := ioutil.TempFile(dir, "saved-")
+	data, err := localKey.Seal([]byte(msg))
+	if err != nil {
+		return fmt.Errorf("error encrypting failsafe file. Data lost: %v", err)
+	}
+	f, err := ioutil.TempFile(dir, savedPrefix)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if _, err := f.Write([]byte(msg)); err != nil {
+	if _, err := f.Write(data); err != nil {
 		// TODO: Is there anything better we can do? Try again?
 		return fmt.Errorf("error saving failsafe file. Data lost: %v", err)
 	}
@@ -106,6 +109,11 @@ func runEditorHeadersOK(input string) (string, error) {
 			input = s
 			continue
 		}
+		if err := checkMessage(s); err != nil {
+			nc.Status("[red]%v, reopening editor", err)
+			input = s
+			continue
+		}
 		break
 	}
 	return s, nil
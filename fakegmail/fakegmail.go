@@ -0,0 +1,1108 @@
+// Package fakegmail provides an in-process fake of the Gmail API, for tests.
+//
+// It keeps messages, threads, labels, drafts and history in memory,
+// and speaks enough of the REST API for the Gmail client library to
+// be pointed at it. Errors can be injected to test retry logic.
+package fakegmail
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	defaultPageSize = 100
+	snippetLength   = 100
+)
+
+// System labels that always exist.
+var systemLabels = []string{"INBOX", "UNREAD", "DRAFT", "IMPORTANT", "SPAM", "STARRED", "TRASH", "SENT"}
+
+type injectedError struct {
+	method string // "" matches all methods.
+	prefix string // Path prefix, after the user ID. E.g. "messages/".
+	code   int
+	count  int
+}
+
+// contact is a People API connection.
+type contact struct {
+	name   string
+	emails []string
+}
+
+type message struct {
+	msg     *gmail.Message // Full format.
+	raw     []byte
+	deleted bool
+}
+
+type newestFirst []*gmail.Message
+
+func (a newestFirst) Len() int           { return len(a) }
+func (a newestFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a newestFirst) Less(i, j int) bool { return a[i].InternalDate > a[j].InternalDate }
+
+type oldestFirst []*message
+
+func (a oldestFirst) Len() int           { return len(a) }
+func (a oldestFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a oldestFirst) Less(i, j int) bool { return a[i].msg.InternalDate < a[j].msg.InternalDate }
+
+type sortDrafts []*gmail.Draft
+
+func (a sortDrafts) Len() int           { return len(a) }
+func (a sortDrafts) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a sortDrafts) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+// Server is a fake Gmail API server.
+type Server struct {
+	ts *httptest.Server
+
+	mu           sync.Mutex
+	emailAddress string
+	historyID    uint64
+	minHistoryID uint64 // History older than this has "expired".
+	nextID       int
+	messages     map[string]*message
+	order        []string // Message IDs in insertion order.
+	labels       map[string]*gmail.Label
+	drafts       map[string]*gmail.Draft
+	sendAs       []*gmail.SendAs // Aliases, in addition to the primary address.
+	contacts     []contact
+	history      []*gmail.History
+	errs         []*injectedError
+	requests     map[string]int
+}
+
+// New starts a new fake server for the given email address.
+func New(emailAddress string) *Server {
+	s := &Server{
+		emailAddress: emailAddress,
+		historyID:    1000,
+		minHistoryID: 1000,
+		messages:     make(map[string]*message),
+		labels:       make(map[string]*gmail.Label),
+		drafts:       make(map[string]*gmail.Draft),
+		requests:     make(map[string]int),
+	}
+	for _, l := range systemLabels {
+		s.labels[l] = &gmail.Label{Id: l, Name: l, Type: "system"}
+	}
+	s.ts = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the base path to use for the client.
+func (s *Server) URL() string {
+	return s.ts.URL
+}
+
+// Service returns a Gmail client talking to the fake.
+func (s *Server) Service() (*gmail.Service, error) {
+	g, err := gmail.New(http.DefaultClient)
+	if err != nil {
+		return nil, err
+	}
+	g.BasePath = s.ts.URL
+	return g, nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.ts.Close()
+}
+
+// AddLabel adds a user label and returns its ID.
+func (s *Server) AddLabel(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := fmt.Sprintf("Label_%d", len(s.labels))
+	s.labels[id] = &gmail.Label{Id: id, Name: name, Type: "user"}
+	return id
+}
+
+// AddSendAs adds a send-as alias. The primary address is always there.
+func (s *Server) AddSendAs(sa *gmail.SendAs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendAs = append(s.sendAs, sa)
+}
+
+// AddContact adds a contact, as listed by the People API under
+// URL()+"/v1/people/me/connections".
+func (s *Server) AddContact(name string, emails ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contacts = append(s.contacts, contact{name: name, emails: emails})
+}
+
+// AddMessage adds a message to the mailbox, as if it was received.
+// raw is the RFC 2822 message.
+func (s *Server) AddMessage(raw string, labelIDs ...string) (*gmail.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert([]byte(raw), "", labelIDs)
+}
+
+// InjectError makes the next count requests fail with HTTP status code.
+// method is the HTTP method to match, or "" for any.
+// prefix is matched against the path after the user ID, e.g. "messages/" or "history".
+func (s *Server) InjectError(method, prefix string, code, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = append(s.errs, &injectedError{
+		method: method,
+		prefix: prefix,
+		code:   code,
+		count:  count,
+	})
+}
+
+// ClearErrors removes all injected errors that are left.
+func (s *Server) ClearErrors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errs = nil
+}
+
+// ExpireHistory makes all history up until now unavailable, as if it's too old.
+func (s *Server) ExpireHistory() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minHistoryID = s.historyID
+	s.history = nil
+}
+
+// HistoryID returns the current history ID.
+func (s *Server) HistoryID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.historyID
+}
+
+// Message returns a copy of the current state of a message, or nil.
+func (s *Server) Message(id string) *gmail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, found := s.messages[id]
+	if !found || m.deleted {
+		return nil
+	}
+	c := *m.msg
+	c.LabelIds = append([]string{}, m.msg.LabelIds...)
+	return &c
+}
+
+// Requests returns the number of requests made with the given method and path prefix.
+func (s *Server) Requests(method, prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k, v := range s.requests {
+		p := strings.SplitN(k, " ", 2)
+		if (method == "" || p[0] == method) && strings.HasPrefix(p[1], prefix) {
+			n += v
+		}
+	}
+	return n
+}
+
+// newHistory bumps the history ID and returns a new history record.
+// Must be called with the lock held.
+func (s *Server) newHistory() *gmail.History {
+	s.historyID++
+	h := &gmail.History{Id: s.historyID}
+	s.history = append(s.history, h)
+	return h
+}
+
+func stub(m *gmail.Message) *gmail.Message {
+	return &gmail.Message{Id: m.Id, ThreadId: m.ThreadId}
+}
+
+// insert parses and adds a message. Must be called with the lock held.
+func (s *Server) insert(raw []byte, threadID string, labelIDs []string) (*gmail.Message, error) {
+	payload, snippet, err := parseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.nextID++
+	id := fmt.Sprintf("%016x", s.nextID)
+	if threadID == "" {
+		threadID = s.findThread(payload)
+	}
+	if threadID == "" {
+		threadID = id
+	}
+	date := time.Now()
+	if d := header(payload, "Date"); d != "" {
+		if t, err := mail.ParseDate(d); err == nil {
+			date = t
+		}
+	}
+	h := s.newHistory()
+	m := &gmail.Message{
+		Id:           id,
+		ThreadId:     threadID,
+		HistoryId:    h.Id,
+		InternalDate: date.UnixNano() / int64(time.Millisecond),
+		LabelIds:     append([]string{}, labelIDs...),
+		Payload:      payload,
+		SizeEstimate: int64(len(raw)),
+		Snippet:      snippet,
+	}
+	s.messages[id] = &message{msg: m, raw: raw}
+	s.order = append(s.order, id)
+	h.Messages = []*gmail.Message{stub(m)}
+	h.MessagesAdded = []*gmail.HistoryMessageAdded{{Message: &gmail.Message{
+		Id:       id,
+		ThreadId: threadID,
+		LabelIds: m.LabelIds,
+	}}}
+	return m, nil
+}
+
+// findThread finds the thread of the message this one is a reply to, if any.
+func (s *Server) findThread(p *gmail.MessagePart) string {
+	refs := strings.Fields(header(p, "In-Reply-To") + " " + header(p, "References"))
+	for _, ref := range refs {
+		for _, id := range s.order {
+			m := s.messages[id]
+			if !m.deleted && header(m.msg.Payload, "Message-ID") == ref {
+				return m.msg.ThreadId
+			}
+		}
+	}
+	return ""
+}
+
+func header(p *gmail.MessagePart, name string) string {
+	if p == nil {
+		return ""
+	}
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func encode(b []byte) string {
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	if b, err := base64.URLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// parseMessage turns an RFC 2822 message into a Gmail message part tree.
+func parseMessage(raw []byte) (*gmail.MessagePart, string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing message: %v", err)
+	}
+	var snippet string
+	p, err := parsePart(m.Header, m.Body, "", &snippet)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(snippet) > snippetLength {
+		snippet = snippet[:snippetLength]
+	}
+	return p, snippet, nil
+}
+
+func parsePart(h map[string][]string, body io.Reader, partID string, snippet *string) (*gmail.MessagePart, error) {
+	p := &gmail.MessagePart{
+		PartId:   partID,
+		MimeType: "text/plain",
+		Body:     &gmail.MessagePartBody{},
+	}
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			p.Headers = append(p.Headers, &gmail.MessagePartHeader{Name: k, Value: v})
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(header(p, "Content-Type"))
+	if err == nil {
+		p.MimeType = mediaType
+	}
+	if _, dp, err := mime.ParseMediaType(header(p, "Content-Disposition")); err == nil {
+		p.Filename = dp["filename"]
+	}
+	if strings.HasPrefix(p.MimeType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for n := 0; ; n++ {
+			sub, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading multipart: %v", err)
+			}
+			id := strconv.Itoa(n)
+			if partID != "" {
+				id = partID + "." + id
+			}
+			c, err := parsePart(sub.Header, sub, id, snippet)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, c)
+		}
+		return p, nil
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+	if strings.EqualFold(header(p, "Content-Transfer-Encoding"), "base64") {
+		if d, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(b)), "")); err == nil {
+			b = d
+		}
+	}
+	p.Body.Size = int64(len(b))
+	if p.Filename != "" {
+		p.Body.AttachmentId = "att-" + encode(b)
+	} else {
+		p.Body.Data = encode(b)
+	}
+	if *snippet == "" && p.MimeType == "text/plain" {
+		*snippet = strings.Join(strings.Fields(string(b)), " ")
+	}
+	return p, nil
+}
+
+// writeError writes an error in the format the Gmail API uses.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": msg,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("fakegmail: writing response: %v", err)
+	}
+}
+
+// injected returns the injected error code for this request, or 0.
+// Must be called with the lock held.
+func (s *Server) injected(method, path string) int {
+	for n, e := range s.errs {
+		if (e.method == "" || e.method == method) && strings.HasPrefix(path, e.prefix) {
+			e.count--
+			if e.count <= 0 {
+				s.errs = append(s.errs[:n], s.errs[n+1:]...)
+			}
+			return e.code
+		}
+	}
+	return 0
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	// Path is /<user>/<resource>..., except for the People API.
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if !strings.HasPrefix(path, "people/") {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) != 2 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if parts[0] != "me" && parts[0] != s.emailAddress {
+			writeError(w, http.StatusForbidden, "wrong user")
+			return
+		}
+		path = parts[1]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method+" "+path]++
+	if code := s.injected(r.Method, path); code != 0 {
+		writeError(w, code, "injected error")
+		return
+	}
+
+	p := strings.Split(path, "/")
+	switch {
+	case r.Method == "GET" && path == "profile":
+		s.getProfile(w, r)
+	case r.Method == "GET" && path == "messages":
+		s.listMessages(w, r)
+	case r.Method == "POST" && path == "messages/send":
+		s.sendMessage(w, r)
+	case r.Method == "POST" && path == "messages/import":
+		s.importMessage(w, r)
+	case r.Method == "POST" && path == "messages/batchModify":
+		s.batchModify(w, r)
+	case r.Method == "GET" && len(p) == 2 && p[0] == "messages":
+		s.getMessage(w, r, p[1])
+	case r.Method == "POST" && len(p) == 3 && p[0] == "messages" && p[2] == "modify":
+		s.modifyMessage(w, r, p[1])
+	case r.Method == "POST" && len(p) == 3 && p[0] == "messages" && p[2] == "trash":
+		s.trashMessage(w, r, p[1])
+	case r.Method == "GET" && len(p) == 4 && p[0] == "messages" && p[2] == "attachments":
+		s.getAttachment(w, r, p[1], p[3])
+	case r.Method == "GET" && path == "threads":
+		s.listThreads(w, r)
+	case r.Method == "GET" && len(p) == 2 && p[0] == "threads":
+		s.getThread(w, r, p[1])
+	case r.Method == "GET" && path == "labels":
+		s.listLabels(w, r)
+	case r.Method == "GET" && path == "settings/sendAs":
+		s.listSendAs(w, r)
+	case r.Method == "GET" && path == "drafts":
+		s.listDrafts(w, r)
+	case r.Method == "POST" && path == "drafts":
+		s.createDraft(w, r)
+	case r.Method == "POST" && path == "drafts/send":
+		s.sendDraft(w, r)
+	case r.Method == "GET" && len(p) == 2 && p[0] == "drafts":
+		s.getDraft(w, r, p[1])
+	case r.Method == "PUT" && len(p) == 2 && p[0] == "drafts":
+		s.updateDraft(w, r, p[1])
+	case r.Method == "DELETE" && len(p) == 2 && p[0] == "drafts":
+		s.deleteDraft(w, r, p[1])
+	case r.Method == "GET" && path == "history":
+		s.listHistory(w, r)
+	case r.Method == "GET" && path == "people/me/connections":
+		s.listConnections(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown request %s %s", r.Method, path))
+	}
+}
+
+// page returns the start and end index for a page, and the next page token.
+func page(r *http.Request, total int) (int, int, string, error) {
+	start := 0
+	if t := r.FormValue("pageToken"); t != "" {
+		var err error
+		if start, err = strconv.Atoi(t); err != nil || start < 0 || start > total {
+			return 0, 0, "", fmt.Errorf("bad page token %q", t)
+		}
+	}
+	size := defaultPageSize
+	if m := r.FormValue("maxResults"); m != "" {
+		var err error
+		if size, err = strconv.Atoi(m); err != nil || size <= 0 {
+			return 0, 0, "", fmt.Errorf("bad maxResults %q", m)
+		}
+	}
+	end := start + size
+	next := strconv.Itoa(end)
+	if end >= total {
+		end = total
+		next = ""
+	}
+	return start, end, next, nil
+}
+
+func hasLabel(m *gmail.Message, l string) bool {
+	for _, ml := range m.LabelIds {
+		if ml == l {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if a message matches the label and search query.
+// The search is only a case insensitive substring match on headers and snippet.
+func matches(m *gmail.Message, labelIDs []string, q string, spamTrash bool) bool {
+	for _, l := range labelIDs {
+		if !hasLabel(m, l) {
+			return false
+		}
+	}
+	if !spamTrash && (hasLabel(m, "SPAM") || hasLabel(m, "TRASH")) {
+		return false
+	}
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	if strings.Contains(strings.ToLower(m.Snippet), q) {
+		return true
+	}
+	for _, h := range m.Payload.Headers {
+		if strings.Contains(strings.ToLower(h.Value), q) {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns the matching messages, newest first.
+// Must be called with the lock held.
+func (s *Server) matching(r *http.Request) []*gmail.Message {
+	var ret []*gmail.Message
+	for n := len(s.order) - 1; n >= 0; n-- {
+		m := s.messages[s.order[n]]
+		if m.deleted {
+			continue
+		}
+		if matches(m.msg, r.Form["labelIds"], r.FormValue("q"), r.FormValue("includeSpamTrash") == "true") {
+			ret = append(ret, m.msg)
+		}
+	}
+	sort.Stable(newestFirst(ret))
+	return ret
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	threads := make(map[string]bool)
+	n := 0
+	for _, m := range s.messages {
+		if !m.deleted {
+			n++
+			threads[m.msg.ThreadId] = true
+		}
+	}
+	writeJSON(w, &gmail.Profile{
+		EmailAddress:  s.emailAddress,
+		HistoryId:     s.historyID,
+		MessagesTotal: int64(n),
+		ThreadsTotal:  int64(len(threads)),
+	})
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ms := s.matching(r)
+	start, end, next, err := page(r, len(ms))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := &gmail.ListMessagesResponse{
+		NextPageToken:      next,
+		ResultSizeEstimate: int64(len(ms)),
+	}
+	for _, m := range ms[start:end] {
+		res.Messages = append(res.Messages, stub(m))
+	}
+	writeJSON(w, res)
+}
+
+// formatMessage returns a message in the requested format.
+func (s *Server) formatMessage(m *message, format string, metadataHeaders []string) *gmail.Message {
+	c := *m.msg
+	switch strings.ToLower(format) {
+	case "", "full":
+	case "raw":
+		c.Payload = nil
+		c.Raw = encode(m.raw)
+	case "minimal":
+		c.Payload = nil
+	case "metadata":
+		p := &gmail.MessagePart{MimeType: m.msg.Payload.MimeType}
+		for _, h := range m.msg.Payload.Headers {
+			keep := len(metadataHeaders) == 0
+			for _, mh := range metadataHeaders {
+				if strings.EqualFold(mh, h.Name) {
+					keep = true
+				}
+			}
+			if keep {
+				p.Headers = append(p.Headers, h)
+			}
+		}
+		c.Payload = p
+	}
+	return &c
+}
+
+func (s *Server) getMessage(w http.ResponseWriter, r *http.Request, id string) {
+	r.ParseForm()
+	m, found := s.messages[id]
+	if !found || m.deleted {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	writeJSON(w, s.formatMessage(m, r.FormValue("format"), r.Form["metadataHeaders"]))
+}
+
+func (s *Server) getAttachment(w http.ResponseWriter, r *http.Request, msgID, id string) {
+	m, found := s.messages[msgID]
+	if !found || m.deleted || !strings.HasPrefix(id, "att-") {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	data := strings.TrimPrefix(id, "att-")
+	b, err := decode(data)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	writeJSON(w, &gmail.MessagePartBody{
+		AttachmentId: id,
+		Data:         data,
+		Size:         int64(len(b)),
+	})
+}
+
+// modify changes the labels of a message. Must be called with the lock held.
+func (s *Server) modify(m *message, add, remove []string) {
+	var added, removed []string
+	for _, l := range add {
+		if !hasLabel(m.msg, l) {
+			m.msg.LabelIds = append(m.msg.LabelIds, l)
+			added = append(added, l)
+		}
+	}
+	for _, l := range remove {
+		if hasLabel(m.msg, l) {
+			var ls []string
+			for _, ml := range m.msg.LabelIds {
+				if ml != l {
+					ls = append(ls, ml)
+				}
+			}
+			m.msg.LabelIds = ls
+			removed = append(removed, l)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	h := s.newHistory()
+	m.msg.HistoryId = h.Id
+	h.Messages = []*gmail.Message{stub(m.msg)}
+	if len(added) > 0 {
+		h.LabelsAdded = []*gmail.HistoryLabelAdded{{
+			LabelIds: added,
+			Message:  &gmail.Message{Id: m.msg.Id, ThreadId: m.msg.ThreadId, LabelIds: m.msg.LabelIds},
+		}}
+	}
+	if len(removed) > 0 {
+		h.LabelsRemoved = []*gmail.HistoryLabelRemoved{{
+			LabelIds: removed,
+			Message:  &gmail.Message{Id: m.msg.Id, ThreadId: m.msg.ThreadId, LabelIds: m.msg.LabelIds},
+		}}
+	}
+}
+
+func (s *Server) modifyMessage(w http.ResponseWriter, r *http.Request, id string) {
+	m, found := s.messages[id]
+	if !found || m.deleted {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	var req gmail.ModifyMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+	writeJSON(w, stub(m.msg))
+}
+
+func (s *Server) batchModify(w http.ResponseWriter, r *http.Request) {
+	var req gmail.BatchModifyMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, id := range req.Ids {
+		if m, found := s.messages[id]; found && !m.deleted {
+			s.modify(m, req.AddLabelIds, req.RemoveLabelIds)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) trashMessage(w http.ResponseWriter, r *http.Request, id string) {
+	m, found := s.messages[id]
+	if !found || m.deleted {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	s.modify(m, []string{"TRASH"}, []string{"INBOX", "UNREAD"})
+	writeJSON(w, stub(m.msg))
+}
+
+func (s *Server) readMessage(r *http.Request) (*gmail.Message, []byte, error) {
+	var req gmail.Message
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, nil, err
+	}
+	raw, err := decode(req.Raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding raw message: %v", err)
+	}
+	return &req, raw, nil
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	req, raw, err := s.readMessage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m, err := s.insert(raw, req.ThreadId, []string{"SENT"})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, stub(m))
+}
+
+func (s *Server) importMessage(w http.ResponseWriter, r *http.Request) {
+	req, raw, err := s.readMessage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ls := req.LabelIds
+	if len(ls) == 0 {
+		ls = []string{"INBOX", "UNREAD"}
+	}
+	m, err := s.insert(raw, req.ThreadId, ls)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, stub(m))
+}
+
+// threads returns thread IDs of matching messages, newest first.
+func (s *Server) threads(r *http.Request) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, m := range s.matching(r) {
+		if !seen[m.ThreadId] {
+			seen[m.ThreadId] = true
+			ret = append(ret, m.ThreadId)
+		}
+	}
+	return ret
+}
+
+// thread returns the messages in a thread, oldest first.
+func (s *Server) thread(id string) []*message {
+	var ret []*message
+	for _, mid := range s.order {
+		m := s.messages[mid]
+		if !m.deleted && m.msg.ThreadId == id {
+			ret = append(ret, m)
+		}
+	}
+	sort.Stable(oldestFirst(ret))
+	return ret
+}
+
+func (s *Server) listThreads(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ts := s.threads(r)
+	start, end, next, err := page(r, len(ts))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := &gmail.ListThreadsResponse{
+		NextPageToken:      next,
+		ResultSizeEstimate: int64(len(ts)),
+	}
+	for _, id := range ts[start:end] {
+		ms := s.thread(id)
+		last := ms[len(ms)-1].msg
+		res.Threads = append(res.Threads, &gmail.Thread{
+			Id:        id,
+			HistoryId: last.HistoryId,
+			Snippet:   last.Snippet,
+		})
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) getThread(w http.ResponseWriter, r *http.Request, id string) {
+	r.ParseForm()
+	ms := s.thread(id)
+	if len(ms) == 0 {
+		writeError(w, http.StatusNotFound, "thread not found")
+		return
+	}
+	t := &gmail.Thread{Id: id}
+	for _, m := range ms {
+		fm := s.formatMessage(m, r.FormValue("format"), r.Form["metadataHeaders"])
+		t.Messages = append(t.Messages, fm)
+		if fm.HistoryId > t.HistoryId {
+			t.HistoryId = fm.HistoryId
+		}
+		t.Snippet = fm.Snippet
+	}
+	writeJSON(w, t)
+}
+
+func (s *Server) listLabels(w http.ResponseWriter, r *http.Request) {
+	res := &gmail.ListLabelsResponse{}
+	var ids []string
+	for id := range s.labels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		res.Labels = append(res.Labels, s.labels[id])
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) listSendAs(w http.ResponseWriter, r *http.Request) {
+	res := &gmail.ListSendAsResponse{
+		SendAs: []*gmail.SendAs{{
+			SendAsEmail: s.emailAddress,
+			IsPrimary:   true,
+			IsDefault:   true,
+		}},
+	}
+	res.SendAs = append(res.SendAs, s.sendAs...)
+	writeJSON(w, res)
+}
+
+func (s *Server) listConnections(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("personFields") == "" {
+		writeError(w, http.StatusBadRequest, "personFields missing")
+		return
+	}
+	// Paged like the Gmail API, but with a different parameter name.
+	r.Form.Set("maxResults", r.FormValue("pageSize"))
+	start, end, next, err := page(r, len(s.contacts))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	type name struct {
+		DisplayName string `json:"displayName"`
+	}
+	type email struct {
+		Value string `json:"value"`
+	}
+	type person struct {
+		ResourceName   string  `json:"resourceName"`
+		Names          []name  `json:"names,omitempty"`
+		EmailAddresses []email `json:"emailAddresses,omitempty"`
+	}
+	res := struct {
+		Connections   []person `json:"connections"`
+		NextPageToken string   `json:"nextPageToken,omitempty"`
+		TotalPeople   int      `json:"totalPeople"`
+	}{
+		NextPageToken: next,
+		TotalPeople:   len(s.contacts),
+	}
+	for n, c := range s.contacts[start:end] {
+		p := person{ResourceName: fmt.Sprintf("people/c%d", start+n)}
+		if c.name != "" {
+			p.Names = []name{{DisplayName: c.name}}
+		}
+		for _, e := range c.emails {
+			p.EmailAddresses = append(p.EmailAddresses, email{Value: e})
+		}
+		res.Connections = append(res.Connections, p)
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) sortedDrafts() []*gmail.Draft {
+	var ret []*gmail.Draft
+	for _, d := range s.drafts {
+		ret = append(ret, d)
+	}
+	sort.Sort(sortDrafts(ret))
+	return ret
+}
+
+func (s *Server) listDrafts(w http.ResponseWriter, r *http.Request) {
+	ds := s.sortedDrafts()
+	start, end, next, err := page(r, len(ds))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := &gmail.ListDraftsResponse{
+		NextPageToken:      next,
+		ResultSizeEstimate: int64(len(ds)),
+	}
+	for _, d := range ds[start:end] {
+		res.Drafts = append(res.Drafts, &gmail.Draft{Id: d.Id, Message: stub(d.Message)})
+	}
+	writeJSON(w, res)
+}
+
+// setDraft creates or replaces the message of a draft. Must be called with the lock held.
+func (s *Server) setDraft(id string, r *http.Request) (*gmail.Draft, error) {
+	var req gmail.Draft
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	if req.Message == nil {
+		return nil, fmt.Errorf("draft has no message")
+	}
+	raw, err := decode(req.Message.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("decoding raw message: %v", err)
+	}
+	if old, found := s.drafts[id]; found {
+		s.delete(old.Message.Id)
+	}
+	m, err := s.insert(raw, req.Message.ThreadId, []string{"DRAFT"})
+	if err != nil {
+		return nil, err
+	}
+	d := &gmail.Draft{Id: id, Message: m}
+	s.drafts[id] = d
+	return d, nil
+}
+
+// delete permanently deletes a message. Must be called with the lock held.
+func (s *Server) delete(id string) {
+	m, found := s.messages[id]
+	if !found || m.deleted {
+		return
+	}
+	m.deleted = true
+	h := s.newHistory()
+	h.Messages = []*gmail.Message{stub(m.msg)}
+	h.MessagesDeleted = []*gmail.HistoryMessageDeleted{{Message: stub(m.msg)}}
+}
+
+func (s *Server) createDraft(w http.ResponseWriter, r *http.Request) {
+	s.nextID++
+	d, err := s.setDraft(fmt.Sprintf("r%d", s.nextID), r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, &gmail.Draft{Id: d.Id, Message: stub(d.Message)})
+}
+
+func (s *Server) getDraft(w http.ResponseWriter, r *http.Request, id string) {
+	d, found := s.drafts[id]
+	if !found {
+		writeError(w, http.StatusNotFound, "draft not found")
+		return
+	}
+	writeJSON(w, &gmail.Draft{Id: d.Id, Message: s.formatMessage(s.messages[d.Message.Id], r.FormValue("format"), nil)})
+}
+
+func (s *Server) updateDraft(w http.ResponseWriter, r *http.Request, id string) {
+	if _, found := s.drafts[id]; !found {
+		writeError(w, http.StatusNotFound, "draft not found")
+		return
+	}
+	d, err := s.setDraft(id, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, &gmail.Draft{Id: d.Id, Message: stub(d.Message)})
+}
+
+func (s *Server) deleteDraft(w http.ResponseWriter, r *http.Request, id string) {
+	d, found := s.drafts[id]
+	if !found {
+		writeError(w, http.StatusNotFound, "draft not found")
+		return
+	}
+	s.delete(d.Message.Id)
+	delete(s.drafts, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) sendDraft(w http.ResponseWriter, r *http.Request) {
+	var req gmail.Draft
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d, found := s.drafts[req.Id]
+	if !found {
+		writeError(w, http.StatusNotFound, "draft not found")
+		return
+	}
+	m := s.messages[d.Message.Id]
+	delete(s.drafts, req.Id)
+	s.modify(m, []string{"SENT"}, []string{"DRAFT"})
+	writeJSON(w, stub(m.msg))
+}
+
+func (s *Server) listHistory(w http.ResponseWriter, r *http.Request) {
+	startID, err := strconv.ParseUint(r.FormValue("startHistoryId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad startHistoryId")
+		return
+	}
+	if startID < s.minHistoryID {
+		writeError(w, http.StatusNotFound, "Requested entity was not found.")
+		return
+	}
+	var hs []*gmail.History
+	for _, h := range s.history {
+		if h.Id > startID {
+			hs = append(hs, h)
+		}
+	}
+	start, end, next, err := page(r, len(hs))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, &gmail.ListHistoryResponse{
+		History:       hs[start:end],
+		HistoryId:     s.historyID,
+		NextPageToken: next,
+	})
+}
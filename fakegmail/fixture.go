@@ -0,0 +1,68 @@
+package fakegmail
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Fixture is a fake server for me@example.com, a client for it, and a
+// directory for local state, as used by tests of the on-disk stores.
+type Fixture struct {
+	*Server
+	Service *gmail.Service
+	Dir     string
+}
+
+// NewFixture starts a fake server, and creates a temporary directory
+// named after name.
+func NewFixture(name string) (*Fixture, error) {
+	s := New("me@example.com")
+	g, err := s.Service()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &Fixture{Server: s, Service: g, Dir: dir}, nil
+}
+
+// Close stops the server and removes the directory.
+func (f *Fixture) Close() {
+	f.Server.Close()
+	os.RemoveAll(f.Dir)
+}
+
+// AddTestMessage adds message number n, from sender<n>@example.com, and
+// returns its ID.
+func (s *Server) AddTestMessage(n int, labelIDs ...string) (string, error) {
+	m, err := s.AddMessage(fmt.Sprintf("From: sender%d@example.com\r\nTo: me@example.com\r\nSubject: Message %d\r\n\r\nBody %d\r\n", n, n, n), labelIDs...)
+	if err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+// forwardMode is how a message is forwarded.
+type forwardMode int
+
+const (
+	forwardInline       forwardMode = iota // Text body quoted, attachments dropped.
+	forwardWithFiles                       // Text body quoted, attachments kept.
+	forwardAsAttachment                    // The whole original attached as message/rfc822.
+)
+
+// Longest file name, in characters, to give a message forwarded as attachment.
+const maxForwardName = 60
+
+// chooseForwardMode asks how to forward a message. Returns false if aborted.
+func chooseForwardMode() (forwardMode, bool) {
+	switch keyMenu([]keyChoice{
+		{'i', "Inline, text only"},
+		{'f', "Inline, with original attachments"},
+		{'a', "As attachment"},
+	}) {
+	case 'i':
+		return forwardInline, true
+	case 'f':
+		return forwardWithFiles, true
+	case 'a':
+		return forwardAsAttachment, true
+	}
+	return 0, false
+}
+
+// forwardAttachments returns what to attach when forwarding m.
+func forwardAttachments(m *gmail.Message, mode forwardMode) ([]*attachment, error) {
+	switch mode {
+	case forwardWithFiles:
+		return messageAttachments(m)
+	case forwardAsAttachment:
+		raw, err := mailBackend.GetMessage(m.Id, "raw")
+		if err != nil {
+			return nil, fmt.Errorf("getting original message: %v", err)
+		}
+		data, err := mimeDecode(raw.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("decoding original message: %v", err)
+		}
+		return []*attachment{{
+			name:        forwardedName(decodeHeader(cmdglib.GetHeader(m, "Subject"))),
+			contentType: "message/rfc822",
+			data:        []byte(data),
+		}}, nil
+	}
+	return nil, nil
+}
+
+// forwardedName returns the file name of a message forwarded as attachment,
+// made from its subject.
+func forwardedName(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if rs := []rune(name); len(rs) > maxForwardName {
+		name = string(rs[:maxForwardName])
+	}
+	if name == "" {
+		name = "forwarded"
+	}
+	return name + ".eml"
+}
+
+// getForward composes a forward of m, in the editor. Unless forwarded as
+// attachment the text body is included.
+func getForward(m *gmail.Message, mode forwardMode) (string, error) {
+	subject := decodeHeader(cmdglib.GetHeader(m, "Subject"))
+	if !forwardRE.MatchString(subject) {
+		subject = *forwardPrefix + subject
+	}
+	head := fmt.Sprintf("%sTo: \nSubject: %s\n\n", fromLine(addressedIdentity(m)), subject)
+	if mode == forwardAsAttachment {
+		return inThread(m, head)
+	}
+	head += fmt.Sprintf("--------- Forwarded message -----------\nDate: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n",
+		cmdglib.GetHeader(m, "Date"),
+		decodeHeader(cmdglib.GetHeader(m, "From")),
+		decodeHeader(cmdglib.GetHeader(m, "To")),
+		decodeHeader(cmdglib.GetHeader(m, "Subject")),
+	)
+	return inThread(m, head+strings.Join(breakLines(strings.Split(getBody(m), "\n")), "\n"))
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+func TestForwardAttachments(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	raw, err := composeMessage("To: foo@example.com\nSubject: Report: Q3\n\nSee attached.\n",
+		[]*attachment{{name: "data.bin", contentType: "application/octet-stream", data: []byte{1, 2, 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := f.AddMessage(raw, cmdglib.Inbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mailBackend.GetMessage(orig.Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if atts, err := forwardAttachments(m, forwardInline); err != nil || len(atts) != 0 {
+		t.Errorf("inline: got attachments %v, %v, want none", atts, err)
+	}
+	atts, err := forwardAttachments(m, forwardWithFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 || atts[0].name != "data.bin" || string(atts[0].data) != "\x01\x02\x03" {
+		t.Errorf("with files: got attachments %v, want data.bin", atts)
+	}
+
+	atts, err = forwardAttachments(m, forwardAsAttachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 1 {
+		t.Fatalf("as attachment: got %d attachments, want 1", len(atts))
+	}
+	a := atts[0]
+	if got, want := a.name, "Report_ Q3.eml"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if got, want := a.contentType, "message/rfc822"; got != want {
+		t.Errorf("got content type %q, want %q", got, want)
+	}
+	if got, want := string(a.data), raw; got != want {
+		t.Errorf("attached message differs from original. Got:\n%s\nWant:\n%s", got, want)
+	}
+
+	// The attached message must not be base64 encoded.
+	fwd, err := composeMessage("To: bar@example.com\nSubject: Fwd: Report: Q3\n\n", atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fwd, "Content-Type: message/rfc822") || !strings.Contains(fwd, "Content-Transfer-Encoding: 7bit") {
+		t.Errorf("attached message not 7bit message/rfc822:\n%s", fwd)
+	}
+	if !strings.Contains(fwd, "\r\nSubject: Report: Q3\r\n") {
+		t.Errorf("attached message not included as is:\n%s", fwd)
+	}
+}
+
+func TestAttachmentEncoding(t *testing.T) {
+	eml := "message/rfc822"
+	for _, test := range []struct {
+		contentType, data string
+		safe              bool
+		want              string // Encoding, or "" for error.
+	}{
+		{eml, "Subject: x\n\nHello\n", false, "7bit"},
+		{eml, "Subject: x\n\nHello\n", true, "7bit"},
+		{eml, "Subject: x\n\nHéllo\n", false, "8bit"},
+		{eml, "Subject: x\n\n" + strings.Repeat("x", maxBodyLineLength) + "\n", false, "7bit"},
+		{eml, "Subject: x\n\n" + strings.Repeat("x", maxBodyLineLength+1) + "\n", false, "binary"},
+		{eml, "Subject: x\n\nHello\x00\n", false, "binary"},
+		{eml, "Subject: x\n\nHello\rthere\n", false, "binary"},
+		{eml, "Subject: x\n\nHéllo\n", true, ""},
+		{eml, "Subject: x\n\nHello\x00\n", true, ""},
+		{"application/octet-stream", "\x00\xff", true, "base64"},
+	} {
+		got, _, err := attachmentEncoding(&attachment{name: "a.eml", contentType: test.contentType, data: []byte(test.data)}, test.safe)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q safe=%v: got %q, want error", test.data, test.safe, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q safe=%v: got %q, %v, want %q", test.data, test.safe, got, err, test.want)
+		}
+	}
+}
+
+func TestForwardedName(t *testing.T) {
+	for _, test := range []struct {
+		subject, want string
+	}{
+		{"Hello", "Hello.eml"},
+		{"  a/b\\c: d?\t", "a_b_c_ d_.eml"},
+		{"", "forwarded.eml"},
+		{strings.Repeat("ö", 100), strings.Repeat("ö", maxForwardName) + ".eml"},
+	} {
+		if got := forwardedName(test.subject); got != test.want {
+			t.Errorf("forwardedName(%q): got %q, want %q", test.subject, got, test.want)
+		}
+	}
+}
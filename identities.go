@@ -0,0 +1,146 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"path"
+	"strings"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/addressbook"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+const (
+	// Relative to configDir. Contains one signature file per identity,
+	// named after the address.
+	signaturesDir = "signatures"
+)
+
+var (
+	// Addresses the user can send as, with the default one first.
+	identities []*gmail.SendAs
+)
+
+// loadIdentities loads the send-as addresses. Aliases that aren't
+// verified yet are skipped, since Gmail won't send as them.
+func loadIdentities() error {
+	sas, err := mailBackend.ListSendAs()
+	if err != nil {
+		return err
+	}
+	var ids []*gmail.SendAs
+	for _, sa := range sas {
+		if sa.VerificationStatus != "" && sa.VerificationStatus != "accepted" {
+			continue
+		}
+		if sa.IsDefault {
+			ids = append([]*gmail.SendAs{sa}, ids...)
+		} else {
+			ids = append(ids, sa)
+		}
+	}
+	identities = ids
+	return nil
+}
+
+// defaultIdentity returns the identity to use if nothing else says otherwise.
+// Returns nil if identities couldn't be loaded.
+func defaultIdentity() *gmail.SendAs {
+	if len(identities) == 0 {
+		return nil
+	}
+	return identities[0]
+}
+
+// identityAddress returns the address of an identity, as shown in the editor.
+func identityAddress(sa *gmail.SendAs) string {
+	return addressbook.FormatAddress(sa.DisplayName, sa.SendAsEmail)
+}
+
+// fromLine returns the From header line for an identity, or nothing if
+// there's no identity, in which case Gmail uses the primary address.
+func fromLine(sa *gmail.SendAs) string {
+	if sa == nil {
+		return ""
+	}
+	return "From: " + identityAddress(sa) + "\n"
+}
+
+// findIdentity returns the identity with the given address, or nil.
+func findIdentity(addr string) *gmail.SendAs {
+	for _, sa := range identities {
+		if strings.EqualFold(sa.SendAsEmail, addr) {
+			return sa
+		}
+	}
+	return nil
+}
+
+// addressedIdentity returns the identity a message was sent to, so that
+// replies come from the same address. Falls back to the default identity.
+func addressedIdentity(m *gmail.Message) *gmail.SendAs {
+	for _, h := range []string{"To", "Cc", "Delivered-To"} {
+		// net/mail decodes RFC 2047 names itself. Decoding first could
+		// unquote a comma and break parsing.
+		as, err := mail.ParseAddressList(cmdglib.GetHeader(m, h))
+		if err != nil {
+			continue
+		}
+		for _, a := range as {
+			if sa := findIdentity(a.Address); sa != nil {
+				return sa
+			}
+		}
+	}
+	return defaultIdentity()
+}
+
+// chooseIdentity asks which identity to send as, if there's more than one.
+func chooseIdentity() *gmail.SendAs {
+	if len(identities) < 2 {
+		return defaultIdentity()
+	}
+	var ss []string
+	for _, sa := range identities {
+		ss = append(ss, identityAddress(sa))
+	}
+	if _, n := stringChoice("From", ss, false); n >= 0 {
+		return identities[n]
+	}
+	return defaultIdentity()
+}
+
+// getSignature returns the signature of an identity, or the default
+// signature if the identity doesn't have its own.
+func getSignature(sa *gmail.SendAs) string {
+	if sa != nil {
+		if b, err := ioutil.ReadFile(path.Join(*configDir, signaturesDir, strings.ToLower(sa.SendAsEmail))); err == nil {
+			return string(b)
+		}
+	}
+	b, err := ioutil.ReadFile(*signature)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
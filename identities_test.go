@@ -0,0 +1,124 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	gc "github.com/rthornton128/goncurses"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestIdentities(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer func() { identities = nil }()
+	f.AddSendAs(&gmail.SendAs{SendAsEmail: "work@example.com", DisplayName: "Foo at Work", VerificationStatus: "accepted"})
+	f.AddSendAs(&gmail.SendAs{SendAsEmail: "new@example.com", VerificationStatus: "pending"})
+	if err := loadIdentities(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(identities), 2; got != want {
+		t.Fatalf("got %d identities, want %d", got, want)
+	}
+	if got, want := defaultIdentity().SendAsEmail, "foo@bar.com"; got != want {
+		t.Errorf("default: got %q, want %q", got, want)
+	}
+
+	msg := func(to, cc string) *gmail.Message {
+		return &gmail.Message{Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{
+			{Name: "To", Value: to},
+			{Name: "Cc", Value: cc},
+		}}}
+	}
+	for _, test := range []struct {
+		msg  *gmail.Message
+		want string
+	}{
+		{msg("foo@bar.com", ""), "From: foo@bar.com\n"},
+		{msg("Bob <bob@example.com>, Work <WORK@example.com>", ""), "From: Foo at Work <work@example.com>\n"},
+		{msg("list@example.com", "work@example.com"), "From: Foo at Work <work@example.com>\n"},
+		{msg("list@example.com", "new@example.com"), "From: foo@bar.com\n"},
+		{msg("not an address", ""), "From: foo@bar.com\n"},
+		{msg("=?utf-8?Q?Doe=2C_Jane?= <jane@example.com>, =?utf-8?Q?W=C3=B6rk?= <work@example.com>", ""), "From: Foo at Work <work@example.com>\n"},
+	} {
+		if got := fromLine(addressedIdentity(test.msg)); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+
+	// Without identities no From header is added.
+	identities = nil
+	if got := fromLine(addressedIdentity(msg("work@example.com", ""))); got != "" {
+		t.Errorf("got %q, want nothing", got)
+	}
+}
+
+func TestChooseIdentity(t *testing.T) {
+	startHeadless(t)
+	defer stopHeadless()
+	defer func() { identities = nil }()
+	identities = []*gmail.SendAs{{SendAsEmail: "foo@bar.com"}, {SendAsEmail: "work@example.com"}}
+	for _, k := range []gc.Key{gc.KEY_DOWN, gc.KEY_DOWN, '\n'} {
+		nc.Input <- k
+	}
+	if got, want := chooseIdentity().SendAsEmail, "work@example.com"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	nc.Input <- '\n'
+	if got, want := chooseIdentity().SendAsEmail, "foo@bar.com"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIdentitySignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, oldSig := *configDir, *signature
+	defer func() { *configDir, *signature = oldDir, oldSig }()
+	*configDir = dir
+	*signature = path.Join(dir, "signature")
+	if err := os.Mkdir(path.Join(dir, signaturesDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*signature, []byte("-- \nFoo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, signaturesDir, "work@example.com"), []byte("-- \nFoo, Work Inc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		sa   *gmail.SendAs
+		want string
+	}{
+		{nil, "-- \nFoo\n"},
+		{&gmail.SendAs{SendAsEmail: "foo@bar.com"}, "-- \nFoo\n"},
+		{&gmail.SendAs{SendAsEmail: "Work@example.com"}, "-- \nFoo, Work Inc\n"},
+	} {
+		if got := getSignature(test.sa); got != test.want {
+			t.Errorf("%+v: got %q, want %q", test.sa, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+
+	"github.com/ThomasHabets/cmdg/ncwrap"
+	"github.com/ThomasHabets/cmdg/opqueue"
+	"github.com/ThomasHabets/cmdg/sendlater"
+)
+
+// How scheduled times are shown.
+const scheduledFormat = "Mon Jan 02 15:04"
+
+// sendCountdown waits -undo_send before sending, showing a countdown.
+// Returns false if the user undid the sending. Other keys pressed during
+// the countdown are typed ahead, and passed on once the email is sent.
+func sendCountdown() bool {
+	var ahead []gc.Key
+	end := time.Now().Add(*undoSend)
+	for {
+		left := end.Sub(time.Now())
+		if left <= 0 {
+			typeAhead(ahead)
+			return true
+		}
+		nc.Status("Sending in %d seconds. Press u to undo, or s to send now", int(math.Ceil(left.Seconds())))
+		wait := left % time.Second
+		if wait == 0 {
+			wait = time.Second
+		}
+		select {
+		case key := <-nc.Input:
+			switch key {
+			case 'u', ctrlC, ctrlG:
+				nc.Status("Sending undone")
+				return false
+			case 's':
+				typeAhead(ahead)
+				return true
+			default:
+				ahead = append(ahead, key)
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// typeAhead puts keys back on the input, for the next view to read.
+func typeAhead(keys []gc.Key) {
+	for _, key := range keys {
+		select {
+		case nc.Input <- key:
+		default:
+			log.Printf("Input full, dropping typed ahead key %v", key)
+			return
+		}
+	}
+}
+
+// splitThreadHeaders splits the threading headers added by inThread from
+// an email as written in the editor, so that they're not shown when it's
+// edited again.
+func splitThreadHeaders(msg string) (string, string) {
+	headers, body := splitMessage(msg)
+	var thread string
+	var rest []string
+	for _, h := range headers {
+		if isHeader(strings.SplitN(h, ":", 2)[0], []string{"In-Reply-To", "References"}) {
+			thread += h + "\n"
+		} else {
+			rest = append(rest, h)
+		}
+	}
+	return thread, strings.Join(rest, "\n") + "\n\n" + body
+}
+
+// parseSendTime parses when to send an email, as one of "15:04" (the next
+// time it's that time), "tomorrow 15:04", "fri 15:04", "2006-01-02 15:04",
+// or a duration like "2h30m".
+func parseSendTime(s string, now time.Time) (time.Time, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if d, err := time.ParseDuration(strings.TrimPrefix(s, "+")); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("%q is not in the future", s)
+		}
+		return now.Add(d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, now.Location()); err == nil {
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("%q is in the past", s)
+		}
+		return t, nil
+	}
+	day, clock := "", s
+	switch f := strings.Fields(s); len(f) {
+	case 1:
+	case 2:
+		day, clock = f[0], f[1]
+	default:
+		return time.Time{}, fmt.Errorf("can't parse time %q", s)
+	}
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't parse time %q", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), c.Hour(), c.Minute(), 0, 0, now.Location())
+	switch {
+	case day == "":
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+	case day == "today":
+	case day == "tomorrow":
+		t = t.AddDate(0, 0, 1)
+	case len(day) >= 3:
+		found := false
+		for n := 0; n <= 7 && !found; n++ {
+			d := t.AddDate(0, 0, n)
+			if d.After(now) && strings.HasPrefix(strings.ToLower(d.Weekday().String()), day) {
+				t, found = d, true
+			}
+		}
+		if !found {
+			return time.Time{}, fmt.Errorf("unknown day %q", day)
+		}
+	default:
+		return time.Time{}, fmt.Errorf("unknown day %q", day)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("%q is in the past", s)
+	}
+	return t, nil
+}
+
+// askSendTime asks when to send an email. Returns false if the user didn't
+// give a time.
+func askSendTime() (time.Time, bool) {
+	s := getText("Send at (15:04, tomorrow 9:00, fri 8:00, 2h, 2006-01-02 15:04):")
+	if strings.TrimSpace(s) == "" {
+		return time.Time{}, false
+	}
+	t, err := parseSendTime(s, time.Now())
+	if err != nil {
+		nc.Status("[red]%v", err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// scheduleSend schedules a composed email to be sent at t.
+func scheduleSend(thread, raw string, t time.Time) error {
+	if scheduled == nil {
+		return fmt.Errorf("scheduled sending disabled")
+	}
+	return scheduled.Add(&sendlater.Message{
+		ThreadID: thread,
+		Raw:      raw,
+		SendAt:   t,
+	})
+}
+
+// sendScheduled sends a scheduled email, queueing it if offline. Returns
+// opqueue.ErrMaybeSent like sendMessage.
+func sendScheduled(thread, raw string, add []string) error {
+	m, err := sendMessage(thread, raw, add)
+	switch {
+	case err == opqueue.ErrQueued:
+		return nil
+	case m != nil && err != nil:
+		log.Printf("Sent scheduled email %s, but failed to label it: %v", m.Id, err)
+		return nil
+	}
+	return err
+}
+
+// dispatchScheduled sends scheduled emails that are due, and shows how it went.
+func dispatchScheduled() {
+	if scheduled == nil {
+		return
+	}
+	maybeSent := 0
+	n, errs := scheduled.Dispatch(time.Now(), func(thread, raw string, add []string) error {
+		err := sendScheduled(thread, raw, add)
+		if err == opqueue.ErrMaybeSent {
+			// Now in the offline queue, for the user to check.
+			maybeSent++
+			return nil
+		}
+		return err
+	})
+	for _, err := range errs {
+		log.Printf("Sending scheduled emails: %v", err)
+	}
+	switch {
+	case maybeSent > 0:
+		nc.Status(maybeSentStatus)
+	case len(errs) > 0:
+		nc.Status("[red]Failed to send %d scheduled emails, press S to see them", len(errs))
+	case n > 0:
+		nc.Status("[green]Sent %d scheduled emails", n)
+	}
+}
+
+// listScheduled returns the scheduled emails, showing any errors.
+func listScheduled() []*sendlater.Message {
+	ms, errs := scheduled.List()
+	for _, err := range errs {
+		log.Printf("Listing scheduled emails: %v", err)
+	}
+	if len(errs) > 0 {
+		nc.Status("[red]Failed to read %d scheduled emails: %v", len(errs), errs[0])
+	}
+	return ms
+}
+
+// unschedule cancels sending a scheduled email, and keeps it with the
+// saved unsent emails.
+func unschedule(m *sendlater.Message) {
+	if err := scheduled.Remove(m.ID); err != nil {
+		nc.Status("[red]Failed to cancel: %v", err)
+		return
+	}
+	if err := saveFailedSend(m.Raw); err != nil {
+		log.Printf("Failed to save cancelled email %q: %v", m.Subject(), err)
+		if err2 := scheduleSend(m.ThreadID, m.Raw, m.SendAt); err2 != nil {
+			nc.Status("[red]Double fail, email lost: %v; %v", err, err2)
+			return
+		}
+		nc.Status("[red]Failed to save email, still scheduled: %v", err)
+		return
+	}
+	nc.Status("Cancelled, email kept with saved emails (R)")
+}
+
+// scheduledPrint prints the list of scheduled emails, and returns the new scroll position.
+func scheduledPrint(w ncwrap.Window, ms []*sendlater.Message, cur, scroll int) int {
+	maxY, maxX := w.MaxYX()
+	rows := maxY - 5
+	scroll = listScroll(scroll, cur, rows)
+	w.Clear()
+	ncwrap.ColorPrint(w, "\n [bold]Scheduled emails[unbold]: %d\n\n", len(ms))
+	for n := scroll; n < len(ms) && n < scroll+rows; n++ {
+		m := ms[n]
+		prefix := "  "
+		if n == cur {
+			prefix = "[bold]>"
+		}
+		status := ""
+		switch {
+		case m.Error != "":
+			status = "[red]FAILED: " + m.Error
+		case m.Sending:
+			status = "[green]sending"
+		}
+		to := m.Header("To")
+		if to == "" {
+			to = "(no recipient)"
+		}
+		line := fmt.Sprintf("%s %-25.25s %s", m.SendAt.Local().Format(scheduledFormat), to, m.Subject())
+		if len(line) > maxX-6 && maxX > 6 {
+			line = line[:maxX-6]
+		}
+		ncwrap.ColorPrint(w, " %s %s %s[unbold]\n", ncwrap.Preformat(prefix), line, ncwrap.Preformat(status))
+	}
+	w.Border()
+	w.Refresh()
+	return scroll
+}
+
+// scheduledView shows emails scheduled to be sent later, and lets the user
+// send them now, change when they're sent, or cancel them.
+func scheduledView() {
+	if scheduled == nil {
+		nc.Status("Scheduled sending disabled")
+		return
+	}
+	ms := listScheduled()
+	w := fullscreenWindow()
+	defer w.Delete()
+	cur, scroll := 0, 0
+	for {
+		if cur >= len(ms) {
+			cur = len(ms) - 1
+		}
+		if cur < 0 {
+			cur = 0
+		}
+		scroll = scheduledPrint(w, ms, cur, scroll)
+		key := <-nc.Input
+		switch key {
+		case '?':
+			helpWin(`q, ^C, ^G         Back
+^P, p, k, Up      Previous
+^N, n, j, Down    Next
+s                 Send now
+t                 Change time, and retry if failed
+d                 Cancel, keeping the email with saved emails
+r                 Reload
+`)
+		case 'q', ctrlC, ctrlG:
+			return
+		case gc.KEY_UP, 'p', ctrlP, 'k':
+			if cur > 0 {
+				cur--
+			}
+		case gc.KEY_DOWN, 'n', ctrlN, 'j':
+			cur++
+		case 'r':
+			ms = listScheduled()
+		case 's', 't':
+			if len(ms) == 0 {
+				break
+			}
+			t := time.Now()
+			if key == 't' {
+				var ok bool
+				if t, ok = askSendTime(); !ok {
+					break
+				}
+			}
+			if err := scheduled.Reschedule(ms[cur].ID, t); err != nil {
+				nc.Status("[red]Failed to reschedule: %v", err)
+			} else if key == 's' {
+				nc.Status("Sending...")
+				dispatchScheduled()
+			} else {
+				nc.Status("[green]Scheduled for %s", t.Format(scheduledFormat))
+			}
+			ms = listScheduled()
+		case 'd':
+			if len(ms) == 0 {
+				break
+			}
+			unschedule(ms[cur])
+			ms = listScheduled()
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+
+	"github.com/ThomasHabets/cmdg/sendlater"
+)
+
+func TestParseSendTime(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2016, 1, 6, 10, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		in   string
+		want time.Time
+	}{
+		{"2h30m", now.Add(150 * time.Minute)},
+		{"+15m", now.Add(15 * time.Minute)},
+		{"15:04", time.Date(2016, 1, 6, 15, 4, 0, 0, time.UTC)},
+		{"9:00", time.Date(2016, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{"tomorrow 9:00", time.Date(2016, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{"Today 23:00", time.Date(2016, 1, 6, 23, 0, 0, 0, time.UTC)},
+		{"fri 08:00", time.Date(2016, 1, 8, 8, 0, 0, 0, time.UTC)},
+		{"wednesday 11:00", time.Date(2016, 1, 6, 11, 0, 0, 0, time.UTC)},
+		{"wed 9:00", time.Date(2016, 1, 13, 9, 0, 0, 0, time.UTC)},
+		{"2016-02-01 12:30", time.Date(2016, 2, 1, 12, 30, 0, 0, time.UTC)},
+		{"-1h", time.Time{}},
+		{"today 9:00", time.Time{}},
+		{"2015-12-01 12:30", time.Time{}},
+		{"someday 9:00", time.Time{}},
+		{"25:00", time.Time{}},
+		{"soon", time.Time{}},
+	} {
+		got, err := parseSendTime(test.in, now)
+		if test.want.IsZero() {
+			if err == nil {
+				t.Errorf("parseSendTime(%q): got %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSendTime(%q): %v", test.in, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("parseSendTime(%q): got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestSplitThreadHeaders(t *testing.T) {
+	headers, input := splitThreadHeaders("In-Reply-To: <a@b>\nReferences: <c@d>\n <a@b>\nTo: foo@example.com\nSubject: Re: x\n\nBody.\n")
+	if got, want := headers, "In-Reply-To: <a@b>\nReferences: <c@d>\n <a@b>\n"; got != want {
+		t.Errorf("headers: got %q, want %q", got, want)
+	}
+	if got, want := input, "To: foo@example.com\nSubject: Re: x\n\nBody.\n"; got != want {
+		t.Errorf("input: got %q, want %q", got, want)
+	}
+}
+
+// withScheduled sets up a store of scheduled emails in a temporary directory.
+func withScheduled(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cmdg-scheduled-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled, err = sendlater.Open(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		scheduled = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSendLater(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t)()
+	defer withScheduled(t)()
+	s := startHeadless(t)
+	defer stopHeadless()
+	go func() {
+		nc.Input <- 'l'
+		if !s.WaitFor("Send at", 5*time.Second) {
+			t.Errorf("time not asked for. Screen:\n%s", s.Contents())
+		}
+		for _, r := range "2h\n" {
+			nc.Input <- gc.Key(r)
+		}
+	}()
+	st := time.Now()
+	if err := sendMenu("", "", "Abort", "To: foo@example.com\nSubject: Later\n\nHello.\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	ms, errs := scheduled.List()
+	if len(ms) != 1 || len(errs) != 0 {
+		t.Fatalf("got scheduled %v, %v, want one email", ms, errs)
+	}
+	if got, want := ms[0].Subject(), "Later"; got != want {
+		t.Errorf("got subject %q, want %q", got, want)
+	}
+	if at := ms[0].SendAt; at.Before(st.Add(2*time.Hour)) || at.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("scheduled for %v, want in 2h", at)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 0; got != want {
+		t.Errorf("sent %d emails right away, want %d", got, want)
+	}
+
+	// Not due yet.
+	dispatchScheduled()
+	if got, want := f.Requests("POST", "messages/send"), 0; got != want {
+		t.Errorf("sent %d emails too early, want %d", got, want)
+	}
+	if err := scheduled.Reschedule(ms[0].ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	dispatchScheduled()
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("sent %d emails, want %d", got, want)
+	}
+	if ms, _ := scheduled.List(); len(ms) != 0 {
+		t.Errorf("still scheduled after sending: %v", ms)
+	}
+}
+
+func TestUndoSendCountdown(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t)()
+	defer func(d time.Duration) { *undoSend = d }(*undoSend)
+	*undoSend = time.Minute
+	s := startHeadless(t)
+	defer stopHeadless()
+	go func() {
+		nc.Input <- 's'
+		if !s.WaitFor("Sending in 60 seconds", 5*time.Second) {
+			t.Errorf("no countdown. Screen:\n%s", s.Contents())
+		}
+		if got, want := f.Requests("POST", "messages/send"), 0; got != want {
+			t.Errorf("sent %d emails during countdown, want %d", got, want)
+		}
+		nc.Input <- 's'
+	}()
+	if err := sendMenu("", "", "Abort", "To: foo@example.com\nSubject: Hi\n\nHello.\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("sent %d emails, want %d", got, want)
+	}
+	if !s.WaitFor("Successfully sent", 5*time.Second) {
+		t.Errorf("not sent. Screen:\n%s", s.Contents())
+	}
+}
+
+func TestSendCountdownTypeAhead(t *testing.T) {
+	defer func(d time.Duration) { *undoSend = d }(*undoSend)
+	*undoSend = time.Minute
+	s := startHeadless(t)
+	defer stopHeadless()
+	go func() {
+		if !s.WaitFor("Sending in 60 seconds", 5*time.Second) {
+			t.Errorf("no countdown. Screen:\n%s", s.Contents())
+		}
+		nc.Input <- 'j'
+		nc.Input <- 'k'
+		nc.Input <- 's'
+	}()
+	if !sendCountdown() {
+		t.Fatal("sending undone")
+	}
+	for _, want := range []gc.Key{'j', 'k'} {
+		select {
+		case got := <-nc.Input:
+			if got != want {
+				t.Errorf("got key %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("typed ahead key %v lost", want)
+		}
+	}
+}
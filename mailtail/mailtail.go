@@ -27,6 +27,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ThomasHabets/cmdg/backend"
 	"github.com/ThomasHabets/cmdg/cmdglib"
 	"github.com/ThomasHabets/drive-du/lib"
 	"github.com/golang/glog"
@@ -45,10 +46,10 @@ var (
 	pollInterval = flag.Duration("poll", 10*time.Second, "Time to wait between polls.")
 )
 
-func mailTail(g *gmail.Service, historyID uint64) uint64 {
+func mailTail(b backend.Backend, historyID uint64) uint64 {
 	pageToken := ""
 	for {
-		res, err := g.Users.History.List(email).MaxResults(pageSize).StartHistoryId(historyID).PageToken(pageToken).Do()
+		res, err := b.ListHistory(historyID, pageToken, pageSize)
 		if err != nil {
 			glog.Errorf("Listing history since %v: %v", historyID, err)
 			continue
@@ -62,7 +63,7 @@ func mailTail(g *gmail.Service, historyID uint64) uint64 {
 				n, m := n, m
 				go func() {
 					defer wg.Done()
-					mres, err := g.Users.Messages.Get(email, m.Message.Id).Format("full").Do()
+					mres, err := b.GetMessage(m.Message.Id, "full")
 					if err != nil {
 						glog.Errorf("Getting message %q, skipping: %v", m.Message.Id, err)
 					} else {
@@ -124,9 +125,10 @@ func main() {
 	if err != nil {
 		glog.Exitf("Failed to create gmail client: %v", err)
 	}
+	b := backend.NewGmail(g, email, nil)
 
 	// Make sure oauth keys are correct before setting up ncurses.
-	prof, err := g.Users.GetProfile(email).Do()
+	prof, err := b.GetProfile()
 	if err != nil {
 		glog.Exitf("Get profile: %v", err)
 	}
@@ -134,12 +136,12 @@ func main() {
 
 	if false {
 		initialMessages := int64(10)
-		res, err := g.Users.Messages.List(email).MaxResults(initialMessages).Do()
+		res, err := b.ListMessages("", "", "", initialMessages)
 		if err != nil {
 			glog.Exitf("Getting messages: %v", err)
 		}
 		msg := res.Messages[len(res.Messages)-1]
-		m, err := g.Users.Messages.Get(email, msg.Id).Format("full").Do()
+		m, err := b.GetMessage(msg.Id, "full")
 		if err != nil {
 			glog.Errorf("Getting latest message %q: %v", msg.Id, err)
 		} else {
@@ -147,7 +149,7 @@ func main() {
 		}
 	}
 	for {
-		historyID = mailTail(g, historyID)
+		historyID = mailTail(b, historyID)
 		time.Sleep(*pollInterval)
 	}
 }
@@ -19,8 +19,39 @@ package main
  */
 
 import (
+	"net/http"
 	"testing"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/fakegmail"
 )
 
 func TestBuilds(t *testing.T) {
 }
+
+func TestMailTail(t *testing.T) {
+	f := fakegmail.New("foo@bar.com")
+	defer f.Close()
+	g, err := f.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.NewGmail(g, email, nil)
+	start := f.HistoryID()
+	for n := 0; n < pageSize+5; n++ {
+		if _, err := f.AddMessage("From: a@example.com\nSubject: hello\n\nbody\n", "INBOX"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.InjectError("GET", "history", http.StatusInternalServerError, 1)
+	if got, want := mailTail(b, start), f.HistoryID(); got != want {
+		t.Errorf("got history ID %v, want %v", got, want)
+	}
+	// One failed, then two pages.
+	if got, want := f.Requests("GET", "history"), 3; got != want {
+		t.Errorf("got %d history calls, want %d", got, want)
+	}
+	if got, want := f.Requests("GET", "messages/"), pageSize+5; got != want {
+		t.Errorf("got %d message gets, want %d", got, want)
+	}
+}
@@ -2,32 +2,38 @@
 package messagegetter
 
 import (
+	"context"
 	"log"
 	"sync"
 	"time"
 
 	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/scheduler"
 )
 
 // MessageGetter provides an async interface to fetch gmail messages.
 type MessageGetter struct {
-	g          *gmail.Service
-	idc        chan string
-	mc         chan *gmail.Message
-	email      string
-	profileAPI func(op string, d time.Duration)
-	backoff    func(n int) (time.Duration, bool)
+	ctx     context.Context
+	b       backend.Backend
+	s       *scheduler.Scheduler
+	n       int // Number of messages added, used as priority.
+	idc     chan string
+	mc      chan *gmail.Message
+	backoff func(n int) (time.Duration, bool)
 }
 
-// New creates a new MessageGetter.
-func New(g *gmail.Service, email string, profileAPI func(op string, d time.Duration), backoff func(n int) (time.Duration, bool)) *MessageGetter {
+// New creates a new MessageGetter. Messages are fetched through s, in the
+// order they're added, until ctx is cancelled.
+func New(ctx context.Context, b backend.Backend, s *scheduler.Scheduler, backoff func(n int) (time.Duration, bool)) *MessageGetter {
 	m := &MessageGetter{
-		g:          g,
-		idc:        make(chan string),
-		mc:         make(chan *gmail.Message),
-		profileAPI: profileAPI,
-		backoff:    backoff,
-		email:      email,
+		ctx:     ctx,
+		b:       b,
+		s:       s,
+		idc:     make(chan string),
+		mc:      make(chan *gmail.Message),
+		backoff: backoff,
 	}
 	go m.run()
 	return m
@@ -43,12 +49,20 @@ func (m *MessageGetter) run() {
 	var wg sync.WaitGroup
 	for id := range m.idc {
 		wg.Add(1)
-		id := id
+		id, prio := id, m.n
+		m.n++
 		go func() {
 			defer wg.Done()
-			st := time.Now()
 			for bo := 0; ; bo++ {
-				msg, err := m.g.Users.Messages.Get(m.email, id).Format("full").Do()
+				var msg *gmail.Message
+				err := m.s.Do(m.ctx, prio, func() error {
+					var err error
+					msg, err = m.b.GetMessage(id, "full")
+					return err
+				})
+				if m.ctx.Err() != nil {
+					return
+				}
 				if err != nil {
 					s, done := m.backoff(bo)
 					if done {
@@ -56,11 +70,14 @@ func (m *MessageGetter) run() {
 						log.Printf("Get message failed, backoff expired, giving up: %v", err)
 						return
 					}
-					time.Sleep(s)
 					log.Printf("Users.Messages.Get failed, retrying: %v", err)
+					select {
+					case <-m.ctx.Done():
+						return
+					case <-time.After(s):
+					}
 					continue
 				}
-				m.profileAPI("Users.Messages.Get", time.Since(st))
 				m.mc <- msg
 				return
 			}
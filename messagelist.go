@@ -19,12 +19,10 @@ package main
  */
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -50,28 +48,16 @@ const (
 	ctrlL           = 12
 
 	draftListBatchSize = 100
-)
 
-func getSignature() string {
-	b, err := ioutil.ReadFile(*signature)
-	if err != nil {
-		return ""
-	}
-	return string(b)
-}
+	// Number of messages/threads to list per page.
+	listPageSize = 100
+
+	// Width of snippet lines when showing details.
+	snippetWidth = 70
+)
 
 func winSize() (int, int) {
-	var maxX, maxY int
-	a := make(chan int, 2)
-	b := make(chan int, 2)
-	nc.ApplyMain(func(w *gc.Window) {
-		y, x := gc.StdScr().MaxYX()
-		a <- x
-		b <- y
-	})
-	maxX = <-a
-	maxY = <-b
-	return maxY, maxX
+	return nc.Size()
 }
 
 func sortedLabels() []string {
@@ -83,18 +69,12 @@ func sortedLabels() []string {
 	return ls
 }
 
-func winBorder(w *gc.Window) {
-	if err := w.Border(gc.ACS_VLINE, gc.ACS_VLINE, gc.ACS_HLINE, gc.ACS_HLINE, gc.ACS_ULCORNER, gc.ACS_URCORNER, gc.ACS_LLCORNER, gc.ACS_LRCORNER); err != nil {
-		log.Fatalf("Failed to add border: %v", err)
-	}
-}
-
 // stringChoice interactively asks the user for a label or email or something, and returns it.
 // if 'free' is true, allow 'write-ins'. Else 'write-ins' become empty string.
 func stringChoice(prompt string, ls []string, free bool) (string, int) {
 	maxY, maxX := winSize()
 
-	w, err := gc.NewWindow(maxY-5, maxX-4, 2, 2)
+	w, err := nc.NewWindow(maxY-5, maxX-4, 2, 2)
 	if err != nil {
 		log.Fatalf("Creating stringChoice window: %v", err)
 	}
@@ -124,7 +104,7 @@ func stringChoice(prompt string, ls []string, free bool) (string, int) {
 				break
 			}
 		}
-		winBorder(w)
+		w.Border()
 		w.Refresh()
 		select {
 		case key := <-nc.Input:
@@ -172,7 +152,7 @@ func getText(prompt string) string {
 	height := 7
 	width := maxX - 4
 	x, y := maxX/2-width/2, maxY/2-height/2
-	w, err := gc.NewWindow(height, width, y, x)
+	w, err := nc.NewWindow(height, width, y, x)
 	if err != nil {
 		log.Fatalf("Creating text window: %v", err)
 	}
@@ -182,7 +162,7 @@ func getText(prompt string) string {
 	for {
 		w.Clear()
 		w.Print(pad(fmt.Sprintf("%s %s\n", prompt, s)))
-		winBorder(w)
+		w.Border()
 		w.Refresh()
 		select {
 		case key := <-nc.Input:
@@ -217,14 +197,14 @@ func helpWin(s string) {
 	width := maxX - 4
 	x, y := maxX/2-width/2, maxY/2-height/2
 
-	w, err := gc.NewWindow(height, width, y, x)
+	w, err := nc.NewWindow(height, width, y, x)
 	if err != nil {
 		log.Fatalf("Creating text window: %v", err)
 	}
 	defer w.Delete()
 	w.Clear()
 	ncwrap.ColorPrint(w, "%s", ncwrap.Preformat(pad(s)))
-	winBorder(w)
+	w.Border()
 	w.Refresh()
 	<-nc.Input
 }
@@ -240,6 +220,15 @@ func markedMessages(msgs []listEntry, marked map[string]bool) []listEntry {
 	return ret
 }
 
+// entryIDs returns the IDs of messages/threads.
+func entryIDs(es []listEntry) []string {
+	var ret []string
+	for _, e := range es {
+		ret = append(ret, e.ID())
+	}
+	return ret
+}
+
 type listEntry struct {
 	msg    *gmail.Message
 	thread *gmail.Thread
@@ -309,14 +298,21 @@ type messageListState struct {
 	quit          bool                         // All done.
 	historyID     uint64                       // Last seen historyID.
 	current       int                          // Index of current email/thread.
+	scroll        int                          // Index of first email/thread on screen.
 	showDetails   bool                         // Show snippets.
 	currentLabel  string                       // Current label/folder.
 	currentSearch string                       // Current search expression.
 	msgs          []listEntry                  // Current messages.
+	nextPageToken string                       // Page token for loading more, or "" if all loaded.
+	loadingMore   bool                         // Next page is being loaded.
 	marked        map[string]bool              // Marked message/thread IDs.
 	msgDo         chan func(*messageListState) // Do things in sync handler.
 	msgsCh        chan []listEntry             // Full list of messages/threads, possibly only initial data.
 	msgUpdateCh   chan listEntry               // Send back updated/full messages/threads.
+	ctx           context.Context              // Cancelled when the view changes.
+	cancel        context.CancelFunc           // Cancels ctx.
+	loading       *int32                       // Non-zero while loading the view. New with each ctx.
+	loads         sync.WaitGroup               // Running loads, of any view.
 }
 
 func (m *messageListState) archive(id string) {
@@ -337,120 +333,310 @@ func (m *messageListState) archive(id string) {
 	}
 }
 
-var isLoading int32
+// Most messages/threads the API returns per list call.
+var maxListSize = 500
 
-// bgLoadMsgs loads messages asynchronously and sends that info back to the main thread via channels.
-func bgLoadMsgs(msgDo chan<- func(*messageListState), msgsCh chan<- []listEntry, msgUpdateCh chan<- listEntry, thread bool, historyID uint64, label, search string) {
-	// Disable concurrent reloads, except for the acceptable race condition.
-	{
-		n := atomic.LoadInt32(&isLoading)
-		if n > 0 {
-			return
+// listPages is list or listThreads, paging until size messages/threads are
+// loaded. If a later page fails, what was loaded so far is returned, with
+// the page token to load the rest.
+func listPages(ctx context.Context, thread bool, label, search string, size int, historyID uint64) (uint64, string, []listEntry, <-chan listEntry, []error) {
+	var newHistoryID uint64
+	var page string
+	var ret []listEntry
+	var chs []<-chan listEntry
+	for len(ret) < size {
+		n := size - len(ret)
+		if n > maxListSize {
+			n = maxListSize
+		}
+		var next string
+		var l []listEntry
+		var lch <-chan listEntry
+		var errs []error
+		if thread {
+			next, l, lch = listThreads(ctx, label, search, page, n, historyID)
+		} else {
+			var h uint64
+			h, next, l, lch, errs = list(ctx, label, search, page, n)
+			if page == "" {
+				newHistoryID = h
+			}
+		}
+		if len(errs) != 0 {
+			if page == "" {
+				return 0, "", nil, nil, errs
+			}
+			log.Printf("Listing label %q, search %q after %d: %v", label, search, len(ret), errs)
+			break
+		}
+		ret = append(ret, l...)
+		chs = append(chs, lch)
+		if page = next; page == "" {
+			break
 		}
-		atomic.AddInt32(&isLoading, 1)
-		defer atomic.AddInt32(&isLoading, -1)
 	}
+	return newHistoryID, page, ret, mergeEntries(chs), nil
+}
+
+// mergeEntries returns a channel with everything from chs, closed when
+// they all are.
+func mergeEntries(chs []<-chan listEntry) <-chan listEntry {
+	if len(chs) == 1 {
+		return chs[0]
+	}
+	ret := make(chan listEntry)
+	var wg sync.WaitGroup
+	for _, ch := range chs {
+		wg.Add(1)
+		ch := ch
+		go func() {
+			defer wg.Done()
+			for m := range ch {
+				ret <- m
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ret)
+	}()
+	return ret
+}
+
+// doMain runs f in the main thread, unless ctx is cancelled first.
+// Returns false if it wasn't run.
+func doMain(ctx context.Context, msgDo chan<- func(*messageListState), f func(*messageListState)) bool {
+	select {
+	case msgDo <- f:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// bgLoadMsgs loads messages asynchronously and sends that info back to the main thread via channels.
+// Up to size messages/threads are loaded. Fetching stops if ctx is cancelled.
+// Only one load per loading counter runs at a time, so a load for a new
+// view isn't held up by one for the old view.
+func bgLoadMsgs(ctx context.Context, loading *int32, msgDo chan<- func(*messageListState), msgsCh chan<- []listEntry, msgUpdateCh chan<- listEntry, thread bool, historyID uint64, label, search string, size int) {
+	if !atomic.CompareAndSwapInt32(loading, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(loading, 0)
 
 	log.Printf("Loading label %q, search %q", label, search)
+	replayQueue()
+	dispatchScheduled()
+	if msgCache != nil {
+		// Show what we have while loading.
+		if !thread && historyID == 0 {
+			var l []listEntry
+			for _, m := range msgCache.CachedMessages(label, search) {
+				l = append(l, listEntry{msg: m})
+			}
+			if len(l) > 0 {
+				select {
+				case msgsCh <- l:
+				case <-ctx.Done():
+				}
+			}
+		}
+		if err := msgCache.Sync(); err != nil {
+			log.Printf("Syncing cache: %v", err)
+		}
+	}
+
 	var l []listEntry
 	var lch <-chan listEntry
 	var errs []error
+	var next string
+	synced := false
 
 	// Get messages/threads.
-	if thread {
-		l, lch = listThreads(label, search, "", 100, historyID)
-	} else {
+	switch {
+	case thread:
+		_, next, l, lch, _ = listPages(ctx, true, label, search, size, historyID)
+	case *enableHistory && historyID > 0:
+		// Only apply what changed since last time.
+		if err := syncMsgs(ctx, msgDo, historyID, label, search); err != nil {
+			log.Printf("Failed to sync from history ID %d, reloading: %v", historyID, err)
+		} else {
+			synced = true
+		}
+	}
+	if !thread && !synced && ctx.Err() == nil {
 		var newHistoryID uint64
 		var lch2 <-chan listEntry
-		c := make(chan listEntry)
-		lch = c
-		newHistoryID, l, lch2, errs = list(label, search, "", 100, historyID)
-		go func() {
-			defer close(c)
-			goodHistoryID := true
-			var nh uint64
-			// Get the *lowest* history ID. That's the safest bet.
-			for m := range lch2 {
-				if nh == 0 || m.msg.HistoryId < nh {
-					nh = m.msg.HistoryId
-				}
-				c <- m
-			}
-			if newHistoryID == 0 {
-				newHistoryID = nh
-				goodHistoryID = false
-			}
-			msgDo <- func(state *messageListState) {
-				if goodHistoryID || state.historyID == 0 {
-					state.historyID = newHistoryID
+		newHistoryID, next, l, lch2, errs = listPages(ctx, false, label, search, size, 0)
+		if len(errs) == 0 {
+			c := make(chan listEntry)
+			lch = c
+			go func() {
+				defer close(c)
+				for m := range lch2 {
+					c <- m
 				}
-			}
-		}()
+				doMain(ctx, msgDo, func(state *messageListState) {
+					if state.currentLabel == label && state.currentSearch == search {
+						state.historyID = newHistoryID
+					}
+				})
+			}()
+		}
 	}
-	if len(errs) == 1 && errs[0] == errNoHistory {
-		// Nothing changed, and that's fine.
-		log.Printf("No changes since last reload.")
-	} else if len(errs) != 0 {
-		msgDo <- func(*messageListState) {
+	switch {
+	case synced:
+		log.Printf("Synced label %q, search %q", label, search)
+	case ctx.Err() != nil:
+		// View changed, so don't show this list.
+		log.Printf("Loading label %q, search %q cancelled", label, search)
+		if lch != nil {
+			for range lch {
+			}
+		}
+	case len(errs) != 0:
+		doMain(ctx, msgDo, func(*messageListState) {
 			e := []string{}
 			for _, ee := range errs {
 				e = append(e, ee.Error())
 			}
 			helpWin(fmt.Sprintf("[red]ERROR listing:\n%v", strings.Join(e, "\n")))
-			nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+			nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+		})
+	default:
+		doMain(ctx, msgDo, func(state *messageListState) {
+			if state.currentLabel == label && state.currentSearch == search {
+				state.nextPageToken = next
+			}
+		})
+		select {
+		case msgsCh <- l:
+		case <-ctx.Done():
 		}
-	} else {
-		msgsCh <- l
 		for m := range lch {
-			msgUpdateCh <- m
-		}
-	}
-	// Get contacts.
-	if c, err := getContacts(); err != nil {
-		log.Printf("Getting contacts: %v", err)
-	} else {
-		msgDo <- func(state *messageListState) {
-			contacts = c
+			select {
+			case msgUpdateCh <- m:
+			case <-ctx.Done():
+			}
 		}
 	}
+	updateContacts()
 
 	// Get labels.
 	if c, err := getLabels(); err != nil {
 		log.Printf("Getting labels: %v", err)
 	} else {
-		msgDo <- func(state *messageListState) {
+		doMain(ctx, msgDo, func(state *messageListState) {
 			updateLabels(c)
-		}
+		})
 	}
 }
 
 // goLoadMsgs schedules a message reload.
 func (m *messageListState) goLoadMsgs() {
-	go bgLoadMsgs(m.msgDo, m.msgsCh, m.msgUpdateCh, m.thread, m.historyID, m.currentLabel, m.currentSearch)
+	if m.loading == nil {
+		m.loading = new(int32)
+	}
+	m.loads.Add(1)
+	go func(ctx context.Context, loading *int32, thread bool, historyID uint64, label, search string, size int) {
+		defer m.loads.Done()
+		bgLoadMsgs(ctx, loading, m.msgDo, m.msgsCh, m.msgUpdateCh, thread, historyID, label, search, size)
+	}(m.ctx, m.loading, m.thread, m.historyID, m.currentLabel, m.currentSearch, m.reloadSize())
+}
+
+// reloadSize returns how many messages/threads to reload, so that pages
+// already loaded with loadMore aren't dropped. Reloads of more than
+// maxListSize are done in several pages.
+func (m *messageListState) reloadSize() int {
+	if len(m.msgs) > listPageSize {
+		return len(m.msgs)
+	}
+	return listPageSize
+}
+
+// bgLoadMore loads the page of messages/threads after the ones already in the list, and appends them.
+func bgLoadMore(ctx context.Context, msgDo chan<- func(*messageListState), msgUpdateCh chan<- listEntry, thread bool, label, search, pageToken string) {
+	log.Printf("Loading more of label %q, search %q", label, search)
+	var l []listEntry
+	var lch <-chan listEntry
+	var errs []error
+	var next string
+	if thread {
+		next, l, lch = listThreads(ctx, label, search, pageToken, listPageSize, 0)
+	} else {
+		_, next, l, lch, errs = list(ctx, label, search, pageToken, listPageSize)
+	}
+	msgDo <- func(state *messageListState) {
+		state.loadingMore = false
+		if len(errs) != 0 {
+			nc.Status("[red]Failed to load more messages: %v", errs[0])
+			return
+		}
+		if state.thread != thread || state.currentLabel != label || state.currentSearch != search || state.nextPageToken != pageToken {
+			// View changed while loading.
+			return
+		}
+		seen := make(map[string]bool)
+		for _, m := range state.msgs {
+			seen[m.ID()] = true
+		}
+		for _, m := range l {
+			if !seen[m.ID()] {
+				state.msgs = append(state.msgs, m)
+			}
+		}
+		state.nextPageToken = next
+		state.applyPending()
+	}
+	if lch != nil {
+		for m := range lch {
+			msgUpdateCh <- m
+		}
+	}
+}
+
+// loadMore schedules loading the next page, if there is one.
+func (m *messageListState) loadMore() {
+	if m.nextPageToken == "" || m.loadingMore {
+		return
+	}
+	m.loadingMore = true
+	nc.Status("Loading more...")
+	go bgLoadMore(m.ctx, m.msgDo, m.msgUpdateCh, m.thread, m.currentLabel, m.currentSearch, m.nextPageToken)
 }
 
+// changeLabel switches to another label or search, and stops loading the old one.
 func (m *messageListState) changeLabel(label, search string) {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.loading = new(int32)
 	m.historyID = 0
+	m.nextPageToken = ""
+	// Don't show, or act on, the old view's messages while loading.
+	m.msgs = nil
+	m.current = 0
+	m.scroll = 0
 	m.marked = make(map[string]bool)
 	m.currentLabel = label
 	m.currentSearch = search
+	nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 	m.goLoadMsgs()
 }
 
 // getDrafts returns all the drafts, with full message content.
 func getDrafts() ([]*gmail.Draft, error) {
 	var page string
-	mg := messagegetter.New(gmailService, email, profileAPI, backoff)
+	mg := messagegetter.New(context.Background(), mailBackend, fetcher, backoff)
 
 	var drafts []*gmail.Draft
 	dmap := make(map[string]int)
 	for {
-		ts := time.Now()
-		l, err := gmailService.Users.Drafts.List(email).MaxResults(draftListBatchSize).PageToken(page).Do()
+		l, err := mailBackend.ListDrafts(page, draftListBatchSize)
 		if err != nil {
 			return nil, err
 		}
-		profileAPI("Users.Drafts.List", time.Since(ts))
 		page = l.NextPageToken
 		for _, d := range l.Drafts {
 			mg.Add(d.Message.Id)
@@ -465,7 +651,7 @@ func getDrafts() ([]*gmail.Draft, error) {
 	for m := range mg.Get() {
 		drafts[dmap[m.Id]].Message = m
 	}
-	// TODO: Sort drafts.
+	sort.Sort(sortDraftsNewestFirst(drafts))
 	return drafts, nil
 }
 
@@ -475,114 +661,127 @@ type keyChoice struct {
 }
 
 func keyMenu(choices []keyChoice) gc.Key {
+	return keyMenuSummary(nil, choices)
+}
+
+// keyMenuSummary is like keyMenu, but shows some lines of text above the
+// choices. The summary is cut to fit the screen.
+func keyMenuSummary(summary []string, choices []keyChoice) gc.Key {
 	maxY, maxX := winSize()
-	height := len(choices) + 4
 	width := 70
+	if width > maxX {
+		width = maxX
+	}
+	// Borders, and blank lines above and below.
+	room := maxY - len(choices) - 5
+	if len(summary) > 0 {
+		room-- // Blank line after the summary.
+	}
+	if len(summary) > room {
+		if room < 1 {
+			summary = nil
+		} else {
+			summary = append(append([]string{}, summary[:room-1]...), "...")
+		}
+	}
+	height := len(choices) + 4
+	if len(summary) > 0 {
+		height += len(summary) + 1
+	}
+	if height > maxY {
+		height = maxY
+	}
 	x, y := maxX/2-width/2, maxY/2-height/2
-	w, err := gc.NewWindow(height, width, y, x)
+	w, err := nc.NewWindow(height, width, y, x)
 	if err != nil {
-		log.Fatalf("Failed to create send dialog: %v", err)
+		// Screen too small. Ask on the status line instead.
+		log.Printf("Failed to create menu window: %v", err)
+		var cs []string
+		for _, c := range choices {
+			cs = append(cs, gc.KeyString(c.key)+"="+c.help)
+		}
+		nc.Status("%s", strings.Join(cs, ", "))
+		return waitForChoice(choices, func() {})
 	}
 	defer w.Delete()
-	log.Printf("send window: %d %d %d %d", height, width, y, x)
+	log.Printf("menu window: %d %d %d %d", height, width, y, x)
 
 	w.Clear()
 	w.Print("\n\n")
+	if len(summary) > 0 {
+		for _, l := range summary {
+			w.Printf("   %s\n", cutString(l, width-5))
+		}
+		w.Print("\n")
+	}
 	for _, c := range choices {
-		w.Printf("   %s - %s\n", gc.KeyString(c.key), c.help)
+		w.Printf("   %s\n", cutString(gc.KeyString(c.key)+" - "+c.help, width-5))
 	}
-	winBorder(w)
-	for {
+	w.Border()
+	return waitForChoice(choices, func() {
 		w.Refresh()
-		gc.Cursor(0)
+		nc.Cursor(false)
+	})
+}
+
+// waitForChoice reads keys until one of the choices is pressed. refresh is
+// run before each key.
+func waitForChoice(choices []keyChoice, refresh func()) gc.Key {
+	for {
+		refresh()
 		key := <-nc.Input
 		for _, c := range choices {
 			if key == c.key {
 				return c.key
 			}
-			log.Printf("Invalid choice %v", key)
 		}
+		log.Printf("Invalid choice %v", key)
 	}
 }
 
-func continueDraft() {
-	drafts, err := getDrafts()
-	if err != nil {
-		nc.Status("Getting drafts: %v", err)
+// cutString cuts s to at most n characters.
+func cutString(s string, n int) string {
+	if n < 0 {
+		n = 0
 	}
-	var ss []string
-	for n, d := range drafts {
-		ss = append(ss, fmt.Sprintf("To:%s %s %d", cmdglib.GetHeader(d.Message, "To"), d.Message.Snippet, n))
-	}
-	dn, _ := stringChoice("Draft", ss, false)
-	re := regexp.MustCompile(` (\d+)$`)
-	m := re.FindStringSubmatch(dn)
-	if len(m) != 2 {
-		nc.Status("Selecting draft failed!")
-		return
-	}
-	n, err := strconv.Atoi(m[1])
-	if err != nil {
-		nc.Status("Internal error selecting draft: %v", err)
-		return
-	}
-	oldDraft := drafts[n]
-	input := fmt.Sprintf("To: %s\nCc: %s\nBcc: %s\nSubject: %s\n\n%s",
-		cmdglib.GetHeader(oldDraft.Message, "To"),
-		cmdglib.GetHeader(oldDraft.Message, "Cc"),
-		cmdglib.GetHeader(oldDraft.Message, "Bcc"),
-		cmdglib.GetHeader(oldDraft.Message, "Subject"),
-		getBody(oldDraft.Message),
-	)
-	newDraft, err := runEditor(input)
-	if err != nil {
-		nc.Status("Running editor: %v", err)
-		return
-	}
-	choice := keyMenu([]keyChoice{
-		// Don't use 's', since it could mean save or send.
-		{'d', "Discard changes"},
-		{'D', "Discard draft"},
-		{'u', "Update draft"},
-		{'S', "Send"},
-	})
-	switch choice {
-	case 'd': // Discard changes.
-		nc.Status("Discarded change to draft")
-	case 'D': // Discard draft.
-		nc.Status("TODO: Discard draft")
-	case 'u': // Update draft.
-		// TODO: Retry.
-		st := time.Now()
-		if _, err := gmailService.Users.Drafts.Update(email, oldDraft.Id, &gmail.Draft{
-			Message: &gmail.Message{
-				ThreadId: oldDraft.Message.ThreadId,
-				Raw:      mimeEncode(newDraft),
-			},
-		}).Do(); err != nil {
-			nc.Status("[red]Error updating draft %s: %v", oldDraft.Id, err)
-			return
-		}
-		profileAPI("Users.Drafts.Update", time.Since(st))
-		nc.Status("[green]Updated draft")
-	case 'S': // Send.
-		nc.Status("TODO: Send draft.")
+	r := []rune(s)
+	if len(r) <= n {
+		return s
 	}
+	return string(r[:n])
+}
+
+// confirm asks a yes or no question.
+func confirm(question string) bool {
+	return keyMenuSummary([]string{question}, []keyChoice{
+		{'y', "Yes"},
+		{'n', "No"},
+	}) == 'y'
 }
 
 func compose() {
-	to, _ := stringChoice("To", contactAddresses(), true)
-	if strings.EqualFold(to, "me") {
-		p, err := gmailService.Users.GetProfile(email).Do()
-		if err != nil {
-			nc.Status("[red]Failed to get own email address: %v", err)
-			return
+	rs := recipientsDialog(contactAddresses())
+	if rs == nil {
+		nc.Status("Aborted compose")
+		return
+	}
+	for _, as := range rs {
+		for n, a := range as {
+			if !strings.EqualFold(a, "me") {
+				continue
+			}
+			p, err := mailBackend.GetProfile()
+			if err != nil {
+				nc.Status("[red]Failed to get own email address: %v", err)
+				return
+			}
+			as[n] = p.EmailAddress
 		}
-		to = p.EmailAddress
 	}
+	from := chooseIdentity()
 	nc.Status("Running editor")
-	input := fmt.Sprintf("To: %s\nSubject: \n\n%s\n", to, getSignature())
-	sendMessage, err := runEditor(input)
+	input := fmt.Sprintf("%s%sSubject: \n\n%s\n", fromLine(from), rs.headers(), getSignature(from))
+	sendMessage, err := runEditorHeadersOK(input)
 	if err != nil {
 		helpWin(fmt.Sprintf("Running editor:\n%v", err))
 		return
@@ -599,24 +798,28 @@ func messageListInput(key gc.Key, state *messageListState) {
 	case '?':
 		helpWin(`q                 Quit
 Up, p, ^P, k      Previous
-Down, n, ^N, j    Next
+Down, n, ^N, j    Next (loads more at the end)
+PgUp, PgDn        Previous/next page
 r, ^R             Reload
 Space, x          Mark/unmark
 Tab               Show/hide snippets
 Right, Enter, >   Open message
 g                 Go to label
 c                 Compose
-C                 Continue draft
+C                 Drafts
 d                 Delete marked emails
 e                 Archive marked emails
 l                 Label marked emails
 L                 Unlabel marked emails
+Q                 Show offline queue
+R                 Recover saved unsent emails
+S                 Show emails scheduled to be sent later
 s                 Search
 1                 Go to inbox
 0                 Re-read config
 ^L                Refresh screen.
 `)
-		nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+		nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 	case 'q':
 		state.quit = true
 	case '0':
@@ -632,6 +835,24 @@ s                 Search
 	case gc.KEY_DOWN, 'n', ctrlN, 'j':
 		if state.current < len(state.msgs)-1 {
 			state.current++
+		} else {
+			state.loadMore()
+		}
+	case gc.KEY_PPAGE:
+		maxY, _ := winSize()
+		state.current -= maxY - 3
+		if state.current < 0 {
+			state.current = 0
+		}
+	case gc.KEY_NPAGE:
+		maxY, _ := winSize()
+		state.current += maxY - 3
+		if state.current >= len(state.msgs)-1 {
+			state.current = len(state.msgs) - 1
+			state.loadMore()
+		}
+		if state.current < 0 {
+			state.current = 0
 		}
 	case gc.KEY_TAB:
 		state.showDetails = !state.showDetails
@@ -683,57 +904,43 @@ s                 Search
 		// We could be in sent folders or a search that sees this message.
 		state.goLoadMsgs()
 	case 'C':
-		continueDraft()
+		draftsView()
+		nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	case 'R':
+		savedView()
+		nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	case 'S':
+		scheduledView()
+		nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	case 'Q':
+		queueView()
+		state.applyPending()
+		nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 	case 'd':
 		if len(mm) == 0 {
 			nc.Status("No messages marked")
 			break
 		}
-		allFine := true
-		for _, m := range mm {
-			st := time.Now()
-			if _, err := gmailService.Users.Messages.Trash(email, m.ID()).Do(); err == nil {
-				state.goLoadMsgs()
-				log.Printf("Users.Messages.Trash: %v", time.Since(st))
-				delete(state.marked, m.ID())
-			} else {
-				nc.Status("[red]Failed to trash message %s: %v", m, err)
-				allFine = false
-			}
-		}
-		if allFine {
-			nc.Status("[green]Trashed messages")
+		done, queued, errs := batchTrashMessages(entryIDs(mm))
+		for _, id := range done {
+			delete(state.marked, id)
 		}
+		state.applyPending()
+		state.goLoadMsgs()
+		batchStatus("Trashed", "trashing", len(mm), len(done), queued, errs)
 
 	case 'e': // Archive.
 		if len(mm) == 0 {
 			nc.Status("No messages marked")
 			break
 		}
-		var errCount int32
-		var wg sync.WaitGroup
-		for _, m := range mm {
-			m := m
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				st := time.Now()
-				if _, err := gmailService.Users.Messages.Modify(email, m.ID(), &gmail.ModifyMessageRequest{
-					RemoveLabelIds: []string{cmdglib.Inbox},
-				}).Do(); err == nil {
-					state.archive(m.ID())
-					log.Printf("Users.Messages.Archive: %v", time.Since(st))
-				} else {
-					nc.Status("[red]Failed to archive message %s: %v", m, err)
-					atomic.AddInt32(&errCount, 1)
-				}
-			}()
+		done, queued, errs := batchModifyMessages(entryIDs(mm), nil, []string{cmdglib.Inbox})
+		for _, id := range done {
+			state.archive(id)
 		}
-		wg.Wait()
+		state.applyPending()
 		state.goLoadMsgs()
-		if errCount > 0 {
-			nc.Status("[green]Archived messages")
-		}
+		batchStatus("Archived", "archiving", len(mm), len(done), queued, errs)
 
 	case 'l': // Add label.
 		if len(mm) == 0 {
@@ -742,31 +949,10 @@ s                 Search
 		}
 		newLabel, _ := stringChoice("Add label", sortedLabels(), false)
 		if newLabel != "" {
-			id := labels[newLabel]
-			var errCount int32
-			var wg sync.WaitGroup
-			for _, m := range mm {
-				m := m
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					st := time.Now()
-					if _, err := gmailService.Users.Messages.Modify(email, m.ID(), &gmail.ModifyMessageRequest{
-						AddLabelIds: []string{id},
-					}).Do(); err == nil {
-						state.goLoadMsgs()
-						log.Printf("Users.Messages.Label: %v", time.Since(st))
-					} else {
-						log.Printf("Users.Messages.Label error: %v", err)
-						nc.Status("[red]Failed to label message %s: %v", m, err)
-						atomic.AddInt32(&errCount, 1)
-					}
-				}()
-			}
-			wg.Wait()
-			if errCount > 0 {
-				nc.Status("[green]Labelled messages")
-			}
+			done, queued, errs := batchModifyMessages(entryIDs(mm), []string{labels[newLabel]}, nil)
+			state.applyPending()
+			state.goLoadMsgs()
+			batchStatus("Labelled", "labelling", len(mm), len(done), queued, errs)
 		}
 
 	case 'L': // Remove label.
@@ -793,27 +979,16 @@ s                 Search
 		// Ask for labels.
 		newLabel, _ := stringChoice("Remove label", ls, false)
 		if newLabel != "" {
-			state.goLoadMsgs()
 			id := labels[newLabel]
-			allFine := true
-			for _, m := range mm {
-				st := time.Now()
-				if _, err := gmailService.Users.Messages.Modify(email, m.ID(), &gmail.ModifyMessageRequest{
-					RemoveLabelIds: []string{id},
-				}).Do(); err == nil {
-					state.goLoadMsgs()
-					log.Printf("Users.Messages.Unlabel: %v", time.Since(st))
-					if state.currentLabel == newLabel {
-						delete(state.marked, m.ID())
-					}
-				} else {
-					nc.Status("[red]Failed to unlabel message %s: %v", m, err)
-					allFine = false
+			done, queued, errs := batchModifyMessages(entryIDs(mm), nil, []string{id})
+			if state.currentLabel == id {
+				for _, id := range done {
+					delete(state.marked, id)
 				}
 			}
-			if allFine {
-				nc.Status("[green]Unlabel messages")
-			}
+			state.applyPending()
+			state.goLoadMsgs()
+			batchStatus("Unlabelled", "unlabelling", len(mm), len(done), queued, errs)
 		}
 
 	case 's':
@@ -823,7 +998,7 @@ s                 Search
 		}
 
 	case ctrlL:
-		nc.ApplyMain(func(w *gc.Window) {
+		nc.ApplyMain(func(w ncwrap.Window) {
 			w.Refresh()
 		})
 
@@ -833,17 +1008,23 @@ s                 Search
 }
 
 func messageListMain(thread bool) {
-	nc.ApplyMain(func(w *gc.Window) {
-		w.Clear()
-		w.Print("Loading...")
-	})
-	state := messageListState{
+	runMessageList(&messageListState{
 		thread:      thread,
 		msgDo:       make(chan func(*messageListState)),
 		msgsCh:      make(chan []listEntry),
 		msgUpdateCh: make(chan listEntry),
-	}
+	})
+}
+
+// runMessageList shows the inbox in state, until the user quits.
+func runMessageList(state *messageListState) {
+	nc.ApplyMain(func(w ncwrap.Window) {
+		w.Clear()
+		w.Print("Loading...")
+	})
 	state.changeLabel(cmdglib.Inbox, "")
+	// Stop loading when quitting.
+	defer func() { state.cancel() }()
 
 	refreshTicker := time.NewTicker(refreshDuration)
 	defer refreshTicker.Stop()
@@ -857,7 +1038,10 @@ func messageListMain(thread bool) {
 
 		// User input.
 		case key := <-nc.Input:
-			messageListInput(key, &state)
+			messageListInput(key, state)
+			if !state.thread {
+				prefetchAround(state.ctx, entryIDs(state.msgs), state.current)
+			}
 
 		// New list of messages in current view.
 		case newMsgs := <-state.msgsCh:
@@ -878,6 +1062,7 @@ func messageListMain(thread bool) {
 			if state.current < 0 {
 				state.current = 0
 			}
+			state.applyPending()
 
 		// Update to one message.
 		case m := <-state.msgUpdateCh:
@@ -886,31 +1071,78 @@ func messageListMain(thread bool) {
 					state.msgs[n] = m
 				}
 			}
+			state.applyPending()
 		case f := <-state.msgDo:
-			f(&state)
+			f(state)
 		}
-		nc.ApplyMain(func(w *gc.Window) {
+		nc.ApplyMain(func(w ncwrap.Window) {
 			if redraw {
 				w.Clear()
 			}
-			messageListPrint(w, state.msgs, state.marked, state.current, state.showDetails, state.currentLabel, state.currentSearch)
+			state.scroll = messageListPrint(w, state.msgs, state.marked, state.current, state.scroll, state.showDetails, state.currentLabel, state.currentSearch)
 		})
 	}
 }
 
+// listScroll returns the index of the first entry to show, given the previous one, such that
+// the current entry is visible in a window with room for 'rows' entries.
+func listScroll(scroll, current, rows int) int {
+	if rows < 1 {
+		rows = 1
+	}
+	if current < scroll {
+		scroll = current
+	}
+	if current >= scroll+rows {
+		scroll = current - rows + 1
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
+
+// snippetLines returns the snippet of an entry split into lines.
+func snippetLines(m *listEntry) []string {
+	var ret []string
+	s := m.Snippet()
+	for len(s) > 0 {
+		n := snippetWidth
+		// TODO: don't break mid-rune.
+		if n >= len(s) {
+			n = len(s)
+		}
+		ret = append(ret, strings.Trim(s[:n], spaces))
+		s = s[n:]
+	}
+	return ret
+}
+
+// messageListPrint draws the list, scrolled so that the current entry is visible.
+// Returns the new scroll position.
 // This runs in the UI goroutine.
-func messageListPrint(w *gc.Window, msgs []listEntry, marked map[string]bool, current int, showDetails bool, currentLabel, currentSearch string) {
+func messageListPrint(w ncwrap.Window, msgs []listEntry, marked map[string]bool, current, scroll int, showDetails bool, currentLabel, currentSearch string) int {
 	w.Move(0, 0)
 	maxY, maxX := w.MaxYX()
 
+	rows := maxY
+	if showDetails && current >= 0 && current < len(msgs) {
+		rows -= len(snippetLines(&msgs[current]))
+	}
+	scroll = listScroll(scroll, current, rows)
+
 	fromMax := 20
 	tsWidth := 6
 	if len(msgs) == 0 {
 		ncwrap.ColorPrint(w, "<empty for label %q, search query %q>", currentLabel, currentSearch)
 	}
 	inSent := (currentLabel == cmdglib.Sent)
+	lines := 0
 	for n, m := range msgs {
-		if n >= maxY {
+		if n < scroll {
+			continue
+		}
+		if lines >= maxY {
 			break
 		}
 		style := ""
@@ -950,23 +1182,16 @@ func messageListPrint(w *gc.Window, msgs []listEntry, marked map[string]bool, cu
 		}
 		s = fmt.Sprintf("%-*.*s", maxX-10, maxX-10, s)
 		ncwrap.ColorPrint(w, "%s%s\n", ncwrap.Preformat(style), s)
+		lines++
 		if n == current && showDetails {
-			//maxX, _ := messagesView.Size()
-			maxX := 80
-			maxX -= 10
-			s := m.Snippet()
-			for len(s) > 0 {
-				n := maxX
-				// TODO: don't break mid-rune.
-				if n >= len(s) {
-					n = len(s)
-				}
-				ncwrap.ColorPrint(w, "    %s\n", strings.Trim(s[:n], spaces))
-				s = s[n:]
+			for _, l := range snippetLines(&m) {
+				ncwrap.ColorPrint(w, "    %s\n", l)
+				lines++
 			}
 		}
 	}
-	for i := len(msgs); i < maxY; i++ {
+	for ; lines < maxY; lines++ {
 		w.Printf("\n")
 	}
+	return scroll
 }
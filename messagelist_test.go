@@ -0,0 +1,443 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/ncwrap"
+)
+
+// runBGLoad runs bgLoadMsgs and applies its results to state, like messageListMain would.
+func runBGLoad(state *messageListState) {
+	msgDo := make(chan func(*messageListState))
+	msgsCh := make(chan []listEntry)
+	msgUpdateCh := make(chan listEntry)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bgLoadMsgs(context.Background(), new(int32), msgDo, msgsCh, msgUpdateCh, state.thread, state.historyID, state.currentLabel, state.currentSearch, state.reloadSize())
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case f := <-msgDo:
+			f(state)
+		case l := <-msgsCh:
+			state.msgs = l
+		case m := <-msgUpdateCh:
+			for n := range state.msgs {
+				if state.msgs[n].ID() == m.ID() {
+					state.msgs[n] = m
+				}
+			}
+		}
+	}
+}
+
+func TestBGLoadMsgs(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	work := f.AddLabel("Work")
+	f.InjectError("GET", "messages/", http.StatusTooManyRequests, 1)
+
+	state := &messageListState{currentLabel: cmdglib.Inbox}
+	runBGLoad(state)
+	if got, want := len(state.msgs), 3; got != want {
+		t.Fatalf("got %d messages, want %d", got, want)
+	}
+	for _, m := range state.msgs {
+		if m.msg.Payload == nil {
+			t.Errorf("message %q never fully loaded", m.ID())
+		}
+	}
+	if state.historyID == 0 {
+		t.Errorf("history ID not set")
+	}
+	if got, want := labels["Work"], work; got != want {
+		t.Errorf("label ID: got %q, want %q", got, want)
+	}
+
+	// Reload with nothing new shouldn't list messages again.
+	lists := f.Requests("GET", "messages")
+	state.historyID = f.HistoryID()
+	runBGLoad(state)
+	if got, want := f.Requests("GET", "messages"), lists; got != want {
+		t.Errorf("got %d list/get calls, want %d", got, want)
+	}
+}
+
+func TestGetDrafts(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := mailBackend.CreateDraft(&gmail.Draft{
+			Message: &gmail.Message{Raw: mimeEncode(fakeMessage(n, ""))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.InjectError("GET", "messages/", http.StatusInternalServerError, 1)
+	drafts, err := getDrafts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, d := range drafts {
+		subjects = append(subjects, cmdglib.GetHeader(d.Message, "Subject"))
+	}
+	if got, want := len(subjects), 3; got != want {
+		t.Fatalf("got %d drafts, want %d", got, want)
+	}
+	// Newest first.
+	for n, want := range []string{"Message 3", "Message 2", "Message 1"} {
+		if got := subjects[n]; got != want {
+			t.Errorf("draft %d: got subject %q, want %q", n, got, want)
+		}
+	}
+}
+
+// startHeadless sets up a fake UI as the global nc.
+func startHeadless(t *testing.T) *ncwrap.Headless {
+	n, s, err := ncwrap.StartHeadless(24, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc = n
+	return s
+}
+
+func stopHeadless() {
+	nc.Stop()
+	nc = nil
+}
+
+func TestKeyMenuSummaryTooLong(t *testing.T) {
+	s := startHeadless(t)
+	defer stopHeadless()
+	var summary []string
+	for n := 0; n < 50; n++ {
+		summary = append(summary, fmt.Sprintf("Line %d %s", n, strings.Repeat("x", 100)))
+	}
+	done := make(chan gc.Key)
+	go func() {
+		done <- keyMenuSummary(summary, []keyChoice{{'s', "Send"}, {'b', "Back"}})
+	}()
+	if !s.WaitFor("- Back", 5*time.Second) {
+		t.Fatalf("choices not shown. Screen:\n%s", s.Contents())
+	}
+	if got := s.Contents(); !strings.Contains(got, "Line 0 xxx") || !strings.Contains(got, "...") || strings.Contains(got, "Line 49") {
+		t.Errorf("summary not cut to fit. Screen:\n%s", got)
+	}
+	nc.Input <- 'x'
+	nc.Input <- 'b'
+	if got, want := <-done, gc.Key('b'); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStringChoice(t *testing.T) {
+	s := startHeadless(t)
+	defer stopHeadless()
+	for _, k := range "wor\n" {
+		nc.Input <- gc.Key(k)
+	}
+	l, n := stringChoice("Go to label", []string{"INBOX", "Work", "Personal"}, false)
+	if got, want := l, "Work"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("got index %d, want %d", got, want)
+	}
+	if got, want := s.Line(3), "  |Go to label> wor"; !strings.HasPrefix(got, want) {
+		t.Errorf("prompt: got %q, want prefix %q", got, want)
+	}
+}
+
+func TestMessageListMain(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := startHeadless(t)
+	defer stopHeadless()
+
+	state := &messageListState{
+		msgDo:       make(chan func(*messageListState)),
+		msgsCh:      make(chan []listEntry),
+		msgUpdateCh: make(chan listEntry),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runMessageList(state)
+	}()
+	for _, want := range []string{"Sender 1", "Sender 2", "Sender 3"} {
+		if !s.WaitFor(want, 5*time.Second) {
+			t.Fatalf("%q not shown. Screen:\n%s", want, s.Contents())
+		}
+	}
+	for y, want := range []string{"Message 3", "Message 2", "Message 1"} {
+		if got := s.Line(y); !strings.Contains(got, want) {
+			t.Errorf("line %d: got %q, want %q", y, got, want)
+		}
+	}
+	if got, want := s.Cell(0, 0), (ncwrap.Cell{Rune: '*', Color: 4}); got != want {
+		t.Errorf("current message: got %+v, want %+v", got, want)
+	}
+
+	// Move down, and mark.
+	nc.Input <- 'n'
+	nc.Input <- 'x'
+	nc.Input <- 'q'
+	<-done
+	state.loads.Wait()
+	if got, want := s.Line(1)[:2], "*X"; got != want {
+		t.Errorf("second line: got %q, want %q", got, want)
+	}
+}
+
+func TestListScroll(t *testing.T) {
+	for _, test := range []struct {
+		scroll, current, rows int
+		want                  int
+	}{
+		{0, 0, 10, 0},
+		{0, 9, 10, 0},
+		{0, 10, 10, 1},
+		{5, 3, 10, 3},
+		{5, 14, 10, 5},
+		{5, 20, 10, 11},
+		{3, 0, 0, 0},
+	} {
+		if got := listScroll(test.scroll, test.current, test.rows); got != test.want {
+			t.Errorf("listScroll(%d, %d, %d): got %d, want %d", test.scroll, test.current, test.rows, got, test.want)
+		}
+	}
+}
+
+func TestLoadMore(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	const total = listPageSize + 5
+	for n := 1; n <= total; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := &messageListState{currentLabel: cmdglib.Inbox}
+	runBGLoad(state)
+	if got, want := len(state.msgs), listPageSize; got != want {
+		t.Fatalf("got %d messages, want %d", got, want)
+	}
+	if state.nextPageToken == "" {
+		t.Fatalf("no next page token after first page")
+	}
+
+	msgDo := make(chan func(*messageListState))
+	msgUpdateCh := make(chan listEntry)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bgLoadMore(context.Background(), msgDo, msgUpdateCh, false, state.currentLabel, state.currentSearch, state.nextPageToken)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case f := <-msgDo:
+			f(state)
+		case m := <-msgUpdateCh:
+			for n := range state.msgs {
+				if state.msgs[n].ID() == m.ID() {
+					state.msgs[n] = m
+				}
+			}
+		}
+	}
+	if got, want := len(state.msgs), total; got != want {
+		t.Fatalf("got %d messages, want %d", got, want)
+	}
+	if got, want := state.nextPageToken, ""; got != want {
+		t.Errorf("next page token: got %q, want %q", got, want)
+	}
+	seen := make(map[string]bool)
+	for _, m := range state.msgs {
+		if seen[m.ID()] {
+			t.Errorf("message %q listed twice", m.ID())
+		}
+		seen[m.ID()] = true
+		if m.msg.Payload == nil {
+			t.Errorf("message %q never fully loaded", m.ID())
+		}
+	}
+
+	// A full reload keeps what's been loaded, even when it takes more
+	// than one list call.
+	defer func(n int) { maxListSize = n }(maxListSize)
+	maxListSize = listPageSize / 2
+	state.historyID = 0
+	runBGLoad(state)
+	if got, want := len(state.msgs), total; got != want {
+		t.Errorf("after reload got %d messages, want %d", got, want)
+	}
+	if got, want := state.nextPageToken, ""; got != want {
+		t.Errorf("next page token after reload: got %q, want %q", got, want)
+	}
+}
+
+func TestMessageListPrintScroll(t *testing.T) {
+	s := startHeadless(t)
+	defer stopHeadless()
+	var msgs []listEntry
+	for n := 0; n < 50; n++ {
+		msgs = append(msgs, listEntry{msg: &gmail.Message{
+			Id:      fmt.Sprintf("%d", n),
+			Payload: &gmail.MessagePart{Headers: []*gmail.MessagePartHeader{{Name: "Subject", Value: fmt.Sprintf("Subject %d", n)}}},
+		}})
+	}
+	var scroll int
+	nc.ApplyMain(func(w ncwrap.Window) {
+		scroll = messageListPrint(w, msgs, nil, 40, 0, false, cmdglib.Inbox, "")
+	})
+	if scroll == 0 {
+		t.Fatalf("did not scroll")
+	}
+	if !s.WaitFor("Subject 40", 5*time.Second) {
+		t.Fatalf("current message not shown. Screen:\n%s", s.Contents())
+	}
+	if got, want := s.Line(0), fmt.Sprintf("Subject %d", scroll); !strings.Contains(got, want) {
+		t.Errorf("first line: got %q, want %q", got, want)
+	}
+
+	// Scrolling back up keeps the position until the cursor is above it.
+	old := scroll
+	nc.ApplyMain(func(w ncwrap.Window) {
+		w.Clear()
+		scroll = messageListPrint(w, msgs, nil, old+5, scroll, false, cmdglib.Inbox, "")
+	})
+	if got, want := scroll, old; got != want {
+		t.Errorf("scroll: got %d, want %d", got, want)
+	}
+	nc.ApplyMain(func(w ncwrap.Window) {
+		w.Clear()
+		scroll = messageListPrint(w, msgs, nil, 10, scroll, false, cmdglib.Inbox, "")
+	})
+	if got, want := scroll, 10; got != want {
+		t.Errorf("scroll: got %d, want %d", got, want)
+	}
+}
+
+// slowList is a backend where listing a search blocks until release is closed.
+type slowList struct {
+	backend.Backend
+	search  string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *slowList) ListMessages(label, search, pageToken string, nres int64) (*gmail.ListMessagesResponse, error) {
+	if search == b.search {
+		close(b.started)
+		<-b.release
+	}
+	return b.Backend.ListMessages(label, search, pageToken, nres)
+}
+
+func TestChangeLabelWhileLoading(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	for n := 1; n <= 3; n++ {
+		if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slow := &slowList{
+		Backend: mailBackend,
+		search:  "slow",
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	mailBackend = slow
+	s := startHeadless(t)
+	defer stopHeadless()
+
+	state := &messageListState{
+		msgDo:       make(chan func(*messageListState)),
+		msgsCh:      make(chan []listEntry),
+		msgUpdateCh: make(chan listEntry),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runMessageList(state)
+	}()
+	defer func() {
+		nc.Input <- 'q'
+		<-done
+		state.loads.Wait()
+	}()
+	if !s.WaitFor("Sender 1", 5*time.Second) {
+		t.Fatalf("inbox not shown. Screen:\n%s", s.Contents())
+	}
+	search := func(q string) {
+		nc.Input <- 's'
+		for _, r := range q + "\n" {
+			nc.Input <- gc.Key(r)
+		}
+	}
+
+	// Search for something slow to list, and while that's loading, for
+	// something else.
+	search("slow")
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("slow search not started")
+	}
+	search("sender2@")
+	defer close(slow.release)
+	if !s.WaitFor("Sender 2", 5*time.Second) {
+		t.Fatalf("search result not shown. Screen:\n%s", s.Contents())
+	}
+	for _, old := range []string{"Sender 1", "Sender 3"} {
+		if strings.Contains(s.Contents(), old) {
+			t.Errorf("%q from the old view still shown. Screen:\n%s", old, s.Contents())
+		}
+	}
+}
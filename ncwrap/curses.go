@@ -0,0 +1,137 @@
+package ncwrap
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"log"
+
+	gc "github.com/rthornton128/goncurses"
+)
+
+// cursesScreen is the real terminal.
+type cursesScreen struct {
+	root *gc.Window
+}
+
+func newCursesScreen() (*cursesScreen, error) {
+	s := &cursesScreen{}
+	var err error
+	s.root, err = gc.Init()
+	if err != nil {
+		return nil, err
+	}
+	if err := gc.StartColor(); err != nil {
+		return nil, err
+	}
+
+	gc.Echo(false)
+	gc.Raw(true)
+	gc.Cursor(1)
+	gc.Cursor(0)
+
+	if false {
+		if err := gc.InitColor(100, 0, 255, 255); err != nil {
+			return nil, fmt.Errorf("failed to set color: %v", err)
+		}
+	}
+
+	// Set up colors.
+	for n, c := range []struct{ fg, bg int16 }{
+		{gc.C_WHITE, gc.C_BLACK},
+		{gc.C_GREEN, gc.C_BLACK},
+		{gc.C_RED, gc.C_BLACK},
+		{gc.C_BLACK, gc.C_WHITE},
+	} {
+		log.Printf("InitPair(%v,%v,%v)", n+1, c.fg, c.bg)
+		if err := gc.InitPair(int16(n+1), c.fg, c.bg); err != nil {
+			return nil, fmt.Errorf("InitPair(%v,%v,%v) failed: %v", n+1, c.fg, c.bg, err)
+		}
+	}
+
+	// Only StdScr is needed, I think.
+	gc.StdScr().Keypad(true)
+
+	// TODO: instead of setting timeout to poll, select on the fd or something.
+	s.root.Timeout(100)
+	return s, nil
+}
+
+// Size implements Screen.
+func (s *cursesScreen) Size() (int, int) {
+	return gc.StdScr().MaxYX()
+}
+
+// NewWindow implements Screen.
+func (s *cursesScreen) NewWindow(height, width, y, x int) (Window, error) {
+	w, err := gc.NewWindow(height, width, y, x)
+	if err != nil {
+		return nil, err
+	}
+	w.Keypad(true)
+	return &cursesWindow{w: w}, nil
+}
+
+// GetKey implements Screen.
+func (s *cursesScreen) GetKey() gc.Key {
+	return s.root.GetChar()
+}
+
+// Cursor implements Screen.
+func (s *cursesScreen) Cursor(visible bool) {
+	if visible {
+		gc.Cursor(1)
+	} else {
+		gc.Cursor(0)
+	}
+}
+
+// End implements Screen.
+func (s *cursesScreen) End() {
+	gc.End()
+}
+
+// cursesWindow is a real ncurses window.
+type cursesWindow struct {
+	w *gc.Window
+}
+
+func (w *cursesWindow) Print(s string)                       { w.w.Print(s) }
+func (w *cursesWindow) Printf(f string, args ...interface{}) { w.w.Printf(f, args...) }
+func (w *cursesWindow) Move(y, x int)                        { w.w.Move(y, x) }
+func (w *cursesWindow) MaxYX() (int, int)                    { return w.w.MaxYX() }
+func (w *cursesWindow) Resize(height, width int)             { w.w.Resize(height, width) }
+func (w *cursesWindow) Clear()                               { w.w.Clear() }
+func (w *cursesWindow) Refresh()                             { w.w.Refresh() }
+func (w *cursesWindow) Delete()                              { w.w.Delete() }
+func (w *cursesWindow) ColorOn(pair int16)                   { w.w.ColorOn(pair) }
+
+func (w *cursesWindow) Bold(on bool) {
+	if on {
+		w.w.AttrOn(gc.A_BOLD)
+	} else {
+		w.w.AttrOff(gc.A_BOLD)
+	}
+}
+
+func (w *cursesWindow) Border() {
+	if err := w.w.Border(gc.ACS_VLINE, gc.ACS_VLINE, gc.ACS_HLINE, gc.ACS_HLINE, gc.ACS_ULCORNER, gc.ACS_URCORNER, gc.ACS_LLCORNER, gc.ACS_LRCORNER); err != nil {
+		log.Fatalf("Failed to add border: %v", err)
+	}
+}
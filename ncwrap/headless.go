@@ -0,0 +1,277 @@
+package ncwrap
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+)
+
+const headlessPoll = 10 * time.Millisecond
+
+// Cell is one character on a headless screen.
+type Cell struct {
+	Rune  rune
+	Color int16
+	Bold  bool
+}
+
+// Headless is an in-memory Screen, for testing.
+// Key presses are scripted by writing to NCWrap.Input.
+type Headless struct {
+	mu     sync.Mutex
+	height int
+	width  int
+	cells  [][]Cell
+	cursor bool
+	ended  bool
+}
+
+// NewHeadless creates a new in-memory screen.
+func NewHeadless(height, width int) *Headless {
+	return &Headless{
+		height: height,
+		width:  width,
+		cells:  newCells(height, width),
+	}
+}
+
+func newCells(height, width int) [][]Cell {
+	c := make([][]Cell, height)
+	for y := range c {
+		c[y] = make([]Cell, width)
+		for x := range c[y] {
+			c[y][x].Rune = ' '
+		}
+	}
+	return c
+}
+
+// Size implements Screen.
+func (s *Headless) Size() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.height, s.width
+}
+
+// NewWindow implements Screen.
+func (s *Headless) NewWindow(height, width, y, x int) (Window, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height <= 0 || width <= 0 || y < 0 || x < 0 || y+height > s.height || x+width > s.width {
+		return nil, fmt.Errorf("window %dx%d at %d,%d doesn't fit on %dx%d screen", height, width, y, x, s.height, s.width)
+	}
+	return &headlessWindow{
+		s:      s,
+		y:      y,
+		x:      x,
+		height: height,
+		width:  width,
+		cells:  newCells(height, width),
+		color:  1,
+	}, nil
+}
+
+// GetKey implements Screen. Headless screens never have keys pressed.
+func (s *Headless) GetKey() gc.Key {
+	time.Sleep(headlessPoll)
+	return 0
+}
+
+// Cursor implements Screen.
+func (s *Headless) Cursor(visible bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursor = visible
+}
+
+// End implements Screen.
+func (s *Headless) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+// Cell returns what's shown at a position on the screen.
+func (s *Headless) Cell(y, x int) Cell {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cells[y][x]
+}
+
+// Line returns the text of one line of the screen, without trailing spaces.
+func (s *Headless) Line(y int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.line(y)
+}
+
+func (s *Headless) line(y int) string {
+	var r []rune
+	for _, c := range s.cells[y] {
+		r = append(r, c.Rune)
+	}
+	return strings.TrimRight(string(r), " ")
+}
+
+// Contents returns all text on the screen.
+func (s *Headless) Contents() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for y := range s.cells {
+		lines = append(lines, s.line(y))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WaitFor waits until the screen contains the string, and returns true if it did in time.
+func (s *Headless) WaitFor(str string, timeout time.Duration) bool {
+	for st := time.Now(); time.Since(st) < timeout; time.Sleep(headlessPoll) {
+		if strings.Contains(s.Contents(), str) {
+			return true
+		}
+	}
+	return false
+}
+
+// headlessWindow is a window on a Headless screen.
+// Like ncurses it draws to its own buffer, which is copied to the screen on Refresh.
+type headlessWindow struct {
+	s             *Headless
+	y, x          int
+	height, width int
+	cells         [][]Cell
+	cy, cx        int
+	color         int16
+	bold          bool
+}
+
+// put writes one rune at the cursor. Must be called with the lock held.
+func (w *headlessWindow) put(r rune) {
+	if w.cy >= w.height {
+		return
+	}
+	if r == '\n' {
+		for x := w.cx; x < w.width; x++ {
+			w.cells[w.cy][x] = Cell{Rune: ' ', Color: w.color}
+		}
+		w.cy++
+		w.cx = 0
+		return
+	}
+	w.cells[w.cy][w.cx] = Cell{Rune: r, Color: w.color, Bold: w.bold}
+	w.cx++
+	if w.cx >= w.width {
+		w.cy++
+		w.cx = 0
+	}
+}
+
+func (w *headlessWindow) Print(s string) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	for _, r := range s {
+		w.put(r)
+	}
+}
+
+func (w *headlessWindow) Printf(f string, args ...interface{}) {
+	w.Print(fmt.Sprintf(f, args...))
+}
+
+func (w *headlessWindow) Move(y, x int) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	if y >= 0 && y < w.height && x >= 0 && x < w.width {
+		w.cy, w.cx = y, x
+	}
+}
+
+func (w *headlessWindow) MaxYX() (int, int) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	return w.height, w.width
+}
+
+func (w *headlessWindow) Resize(height, width int) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	n := newCells(height, width)
+	for y := 0; y < height && y < w.height; y++ {
+		for x := 0; x < width && x < w.width; x++ {
+			n[y][x] = w.cells[y][x]
+		}
+	}
+	w.cells, w.height, w.width = n, height, width
+	if w.cy >= height || w.cx >= width {
+		w.cy, w.cx = 0, 0
+	}
+}
+
+func (w *headlessWindow) Clear() {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.cells = newCells(w.height, w.width)
+	w.cy, w.cx = 0, 0
+}
+
+func (w *headlessWindow) Border() {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	for x := 0; x < w.width; x++ {
+		w.cells[0][x] = Cell{Rune: '-', Color: w.color}
+		w.cells[w.height-1][x] = Cell{Rune: '-', Color: w.color}
+	}
+	for y := 0; y < w.height; y++ {
+		w.cells[y][0] = Cell{Rune: '|', Color: w.color}
+		w.cells[y][w.width-1] = Cell{Rune: '|', Color: w.color}
+	}
+	for _, c := range [][2]int{{0, 0}, {0, w.width - 1}, {w.height - 1, 0}, {w.height - 1, w.width - 1}} {
+		w.cells[c[0]][c[1]] = Cell{Rune: '+', Color: w.color}
+	}
+}
+
+func (w *headlessWindow) Refresh() {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	for y := 0; y < w.height && w.y+y < w.s.height; y++ {
+		for x := 0; x < w.width && w.x+x < w.s.width; x++ {
+			w.s.cells[w.y+y][w.x+x] = w.cells[y][x]
+		}
+	}
+}
+
+func (w *headlessWindow) Delete() {}
+
+func (w *headlessWindow) ColorOn(pair int16) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.color = pair
+}
+
+func (w *headlessWindow) Bold(on bool) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.bold = on
+}
@@ -21,7 +21,6 @@ package ncwrap
 
 import (
 	"fmt"
-	"log"
 	"regexp"
 	"strings"
 
@@ -30,13 +29,13 @@ import (
 
 // NCWrap wraps ncurses with cmdg-specific windows and thread safe input handling.
 type NCWrap struct {
-	root    *gc.Window
-	wmain   *gc.Window
-	whr     *gc.Window
-	wstatus *gc.Window
+	screen  Screen
+	wmain   Window
+	whr     Window
+	wstatus Window
 
 	status chan string
-	main   chan func(*gc.Window)
+	main   chan func(Window)
 	redraw chan bool
 	done   chan chan bool
 
@@ -62,7 +61,7 @@ func formatUnescape(s string) string {
 }
 
 // ColorPrint prints something with color codes embedded.
-func ColorPrint(w *gc.Window, f string, args ...interface{}) {
+func ColorPrint(w Window, f string, args ...interface{}) {
 	newargs := []interface{}{}
 	for n := range args {
 		if s, ok := args[n].(*Preformated); ok {
@@ -77,7 +76,7 @@ func ColorPrint(w *gc.Window, f string, args ...interface{}) {
 	//colorRE := regexp.MustCompile(`(.*?)(\[color (\w+)\]([^a-z. ]+)?:)?(.*)`)
 	colorRE := regexp.MustCompile(`(?s)(.*?)\[(\w+)\]([^[]*)`)
 	w.ColorOn(1)
-	w.AttrOff(gc.A_BOLD)
+	w.Bold(false)
 	for {
 		m := colorRE.FindStringSubmatch(s)
 		if len(m) == 0 {
@@ -91,11 +90,11 @@ func ColorPrint(w *gc.Window, f string, args ...interface{}) {
 		case "red":
 			w.ColorOn(3)
 		case "bold":
-			w.AttrOn(gc.A_BOLD)
+			w.Bold(true)
 		case "reverse":
 			w.ColorOn(4)
 		case "unbold":
-			w.AttrOff(gc.A_BOLD)
+			w.Bold(false)
 		default:
 			w.ColorOn(1)
 		}
@@ -116,70 +115,44 @@ func Preformat(s string) *Preformated {
 
 // Start sets up ncurses and takes over the terminal.
 func Start() (*NCWrap, error) {
-	nc := &NCWrap{}
-	var err error
-	nc.root, err = gc.Init()
+	screen, err := newCursesScreen()
 	if err != nil {
 		return nil, err
 	}
-	if err := gc.StartColor(); err != nil {
-		return nil, err
-	}
-
-	gc.Echo(false)
-	gc.Raw(true)
-	gc.Cursor(1)
-	gc.Cursor(0)
+	return start(screen)
+}
 
-	if false {
-		if err := gc.InitColor(100, 0, 255, 255); err != nil {
-			return nil, fmt.Errorf("failed to set color: %v", err)
-		}
+// StartHeadless sets up a UI that isn't connected to a terminal, for testing.
+func StartHeadless(height, width int) (*NCWrap, *Headless, error) {
+	screen := NewHeadless(height, width)
+	nc, err := start(screen)
+	if err != nil {
+		return nil, nil, err
 	}
+	return nc, screen, nil
+}
 
-	h, w := nc.root.MaxYX()
-	nc.wmain, err = gc.NewWindow(h-2, w, 0, 0)
+func start(screen Screen) (*NCWrap, error) {
+	nc := &NCWrap{
+		screen: screen,
+	}
+	var err error
+	h, w := screen.Size()
+	nc.wmain, err = screen.NewWindow(h-2, w, 0, 0)
 	if err != nil {
 		return nil, err
 	}
-	nc.whr, err = gc.NewWindow(1, w, h-2, 0)
+	nc.whr, err = screen.NewWindow(1, w, h-2, 0)
 	if err != nil {
 		return nil, err
 	}
-	nc.wstatus, err = gc.NewWindow(1, w, h-1, 0)
+	nc.wstatus, err = screen.NewWindow(1, w, h-1, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set up colors.
-	if true {
-		for n, c := range []struct{ fg, bg int16 }{
-			{gc.C_WHITE, gc.C_BLACK},
-			{gc.C_GREEN, gc.C_BLACK},
-			{gc.C_RED, gc.C_BLACK},
-			{gc.C_BLACK, gc.C_WHITE},
-		} {
-			log.Printf("InitPair(%v,%v,%v)", n+1, c.fg, c.bg)
-			if err := gc.InitPair(int16(n+1), c.fg, c.bg); err != nil {
-				return nil, fmt.Errorf("InitPair(%v,%v,%v) failed: %v", n+1, c.fg, c.bg, err)
-			}
-			nc.wmain.ColorOn(int16(n + 1))
-			nc.wstatus.ColorOn(int16(n + 1))
-			nc.whr.ColorOn(int16(n + 1))
-		}
-	}
-	nc.wmain.Color(0)
-	nc.wstatus.Color(0)
-	nc.whr.Color(0)
-
-	// Only StdScr is needed, I think.
-	nc.wmain.Keypad(true)
-	nc.whr.Keypad(true)
-	nc.wstatus.Keypad(true)
-	gc.StdScr().Keypad(true)
-
 	nc.status = make(chan string, 100)
-	nc.main = make(chan func(*gc.Window), 100)
+	nc.main = make(chan func(Window), 100)
 	nc.redraw = make(chan bool, 100)
 	nc.done = make(chan chan bool)
 	nc.Input = make(chan gc.Key, 100)
@@ -199,7 +172,7 @@ func Start() (*NCWrap, error) {
 				f(nc.wmain)
 				nc.wmain.Refresh()
 			case <-nc.redraw:
-				h, w := nc.root.MaxYX()
+				h, w := nc.screen.Size()
 				nc.wmain.Resize(h-2, w)
 				nc.whr.Resize(1, w)
 				nc.whr.Move(h-2, 0)
@@ -211,12 +184,10 @@ func Start() (*NCWrap, error) {
 			}
 		}
 	}()
-	// TODO: instead of setting timeout to poll, select on the fd or something.
-	nc.root.Timeout(100)
 	go func() {
 		// Input goroutine.
 		for {
-			ch := nc.root.GetChar()
+			ch := nc.screen.GetKey()
 			if ch != 0 {
 				nc.Input <- ch
 			}
@@ -244,14 +215,13 @@ func (nc *NCWrap) Stop() {
 	nc.done <- dc
 	<-dc
 	<-dc
-	gc.End()
+	nc.screen.End()
 }
 
 // Status prints a message to the status line.
 func (nc *NCWrap) Status(s string, args ...interface{}) {
 	if nc == nil {
-		// TODO: Instead of bailing out like this, make a fake
-		// UI for testing.
+		// Tests that don't need a UI don't start one.
 		return
 	}
 	nc.status <- fmt.Sprintf(s, args...)
@@ -263,9 +233,9 @@ func (nc *NCWrap) Redraw() {
 }
 
 // ApplyMain applies a function synchronously to the main window.
-func (nc *NCWrap) ApplyMain(f func(*gc.Window)) {
+func (nc *NCWrap) ApplyMain(f func(Window)) {
 	s := make(chan bool)
-	nc.main <- func(w *gc.Window) {
+	nc.main <- func(w Window) {
 		defer close(s)
 		f(w)
 	}
@@ -274,5 +244,24 @@ func (nc *NCWrap) ApplyMain(f func(*gc.Window)) {
 
 // Apply runs the function synchronously in the UI goroutine.
 func (nc *NCWrap) Apply(f func()) {
-	nc.ApplyMain(func(*gc.Window) { f() })
+	nc.ApplyMain(func(Window) { f() })
+}
+
+// Size returns the height and width of the screen.
+func (nc *NCWrap) Size() (int, int) {
+	var h, w int
+	nc.Apply(func() {
+		h, w = nc.screen.Size()
+	})
+	return h, w
+}
+
+// NewWindow creates a new window on the screen.
+func (nc *NCWrap) NewWindow(height, width, y, x int) (Window, error) {
+	return nc.screen.NewWindow(height, width, y, x)
+}
+
+// Cursor sets whether the cursor is visible.
+func (nc *NCWrap) Cursor(visible bool) {
+	nc.screen.Cursor(visible)
 }
@@ -0,0 +1,102 @@
+package ncwrap
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeadlessStatus(t *testing.T) {
+	nc, s, err := StartHeadless(10, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Stop()
+	nc.Status("Hello [green]world[unbold]!")
+	if !s.WaitFor("Hello world!", time.Second) {
+		t.Fatalf("Status not shown. Screen:\n%s", s.Contents())
+	}
+	if got, want := s.Line(9), "Hello world!"; got != want {
+		t.Errorf("status line: got %q, want %q", got, want)
+	}
+	if got, want := s.Cell(9, 0).Color, int16(1); got != want {
+		t.Errorf("'Hello' color: got %d, want %d", got, want)
+	}
+	if got, want := s.Cell(9, 6).Color, int16(2); got != want {
+		t.Errorf("'world' color: got %d, want %d", got, want)
+	}
+	if got, want := s.Line(8), "----------------------------------------"; got != want {
+		t.Errorf("separator: got %q, want %q", got, want)
+	}
+}
+
+func TestHeadlessMain(t *testing.T) {
+	nc, s, err := StartHeadless(10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Stop()
+	nc.ApplyMain(func(w Window) {
+		w.Clear()
+		ColorPrint(w, "[bold]one[unbold]\ntwo\n")
+		w.Move(3, 2)
+		w.Print("0123456789012345678901234")
+	})
+	for y, want := range []string{"one", "two", "", "  012345678901234567", "8901234", ""} {
+		if got := s.Line(y); got != want {
+			t.Errorf("line %d: got %q, want %q", y, got, want)
+		}
+	}
+	if !s.Cell(0, 0).Bold {
+		t.Errorf("'one' not bold")
+	}
+	if s.Cell(1, 0).Bold {
+		t.Errorf("'two' is bold")
+	}
+	if h, w := nc.Size(); h != 10 || w != 20 {
+		t.Errorf("size: got %dx%d, want 10x20", h, w)
+	}
+}
+
+func TestHeadlessWindow(t *testing.T) {
+	nc, s, err := StartHeadless(10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Stop()
+	if _, err := nc.NewWindow(5, 30, 0, 0); err == nil {
+		t.Errorf("want error creating too wide window")
+	}
+	w, err := nc.NewWindow(4, 6, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Print("\n x")
+	w.Border()
+	if got, want := s.Line(2), ""; got != want {
+		t.Errorf("before refresh: got %q, want %q", got, want)
+	}
+	w.Refresh()
+	for y, want := range []string{"", "", "  +----+", "  |x   |", "  |    |", "  +----+"} {
+		if got := s.Line(y); got != want {
+			t.Errorf("line %d: got %q, want %q", y, got, want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ncwrap
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	gc "github.com/rthornton128/goncurses"
+)
+
+// Screen is a terminal, real or fake.
+type Screen interface {
+	// Size returns the height and width of the screen.
+	Size() (int, int)
+
+	// NewWindow creates a window at y,x.
+	NewWindow(height, width, y, x int) (Window, error)
+
+	// GetKey waits a short while for a key press. Returns 0 if there was none.
+	GetKey() gc.Key
+
+	// Cursor sets whether the cursor is visible.
+	Cursor(visible bool)
+
+	// End hands back the terminal.
+	End()
+}
+
+// Window is a part of the screen that can be drawn on.
+type Window interface {
+	// Print prints at the cursor position.
+	Print(s string)
+	Printf(f string, args ...interface{})
+
+	// Move moves the cursor.
+	Move(y, x int)
+
+	// MaxYX returns the height and width of the window.
+	MaxYX() (int, int)
+
+	Resize(height, width int)
+	Clear()
+	Border()
+
+	// Refresh shows the changes on the screen.
+	Refresh()
+
+	// Delete removes the window.
+	Delete()
+
+	// ColorOn sets the color pair for further printing.
+	// 1 is normal, 2 green, 3 red, 4 reverse.
+	ColorOn(pair int16)
+	Bold(on bool)
+}
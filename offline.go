@@ -0,0 +1,287 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	gc "github.com/rthornton128/goncurses"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/ncwrap"
+	"github.com/ThomasHabets/cmdg/opqueue"
+)
+
+// modifyMessage adds and removes labels, queueing it if offline.
+// Returns opqueue.ErrQueued if queued.
+func modifyMessage(id string, add, remove []string) error {
+	if opQueue == nil {
+		return mailBackend.ModifyMessage(id, add, remove)
+	}
+	return opQueue.Modify(id, add, remove)
+}
+
+// trashMessage trashes a message, queueing it if offline.
+// Returns opqueue.ErrQueued if queued.
+func trashMessage(id string) error {
+	if opQueue == nil {
+		return mailBackend.TrashMessage(id)
+	}
+	return opQueue.Trash(id)
+}
+
+// batchModifyMessages adds and removes labels on many messages, in as few
+// requests as possible, queueing if offline. Returns the messages that were
+// modified or queued, if anything was queued, and one error per failed chunk.
+func batchModifyMessages(ids []string, add, remove []string) ([]string, bool, []error) {
+	return inChunks(ids, func(chunk []string) error {
+		if opQueue == nil {
+			return mailBackend.BatchModifyMessages(chunk, add, remove)
+		}
+		return opQueue.BatchModify(chunk, add, remove)
+	})
+}
+
+// batchTrashMessages trashes many messages. Return values like batchModifyMessages.
+func batchTrashMessages(ids []string) ([]string, bool, []error) {
+	return inChunks(ids, func(chunk []string) error {
+		if opQueue == nil {
+			return mailBackend.BatchTrashMessages(chunk)
+		}
+		return opQueue.BatchTrash(chunk)
+	})
+}
+
+// inChunks runs f on as big chunks of ids as the API allows.
+func inChunks(ids []string, f func([]string) error) ([]string, bool, []error) {
+	var done []string
+	var errs []error
+	queued := false
+	for st := 0; st < len(ids); st += backend.MaxBatch {
+		end := st + backend.MaxBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[st:end]
+		switch err := f(chunk); err {
+		case opqueue.ErrQueued:
+			queued = true
+			done = append(done, chunk...)
+		case nil:
+			done = append(done, chunk...)
+		default:
+			log.Printf("Batch of messages %d-%d failed: %v", st+1, end, err)
+			errs = append(errs, fmt.Errorf("messages %d-%d: %v", st+1, end, err))
+		}
+	}
+	return done, queued, errs
+}
+
+// batchStatus shows how a bulk operation went.
+func batchStatus(did, doing string, total, done int, queued bool, errs []error) {
+	switch {
+	case len(errs) > 0:
+		var es []string
+		for _, e := range errs {
+			es = append(es, e.Error())
+		}
+		nc.Status("[red]Failed %s %d of %d messages: %s", doing, total-done, total, strings.Join(es, "; "))
+	case queued:
+		nc.Status("[green]Offline, queued %s messages", doing)
+	default:
+		nc.Status("[green]%s messages", did)
+	}
+}
+
+// Shown when sending failed in a way that it may still have worked.
+const maybeSentStatus = "[red]Sending may have failed. Check Sent mail, then retry or drop it in the offline queue (Q)"
+
+// sendMessage sends a message and adds labels to it, queueing it if offline.
+// Returns opqueue.ErrQueued if queued, and opqueue.ErrMaybeSent if it's
+// queued for the user to check. If sending worked but labelling didn't,
+// both the sent message and an error is returned.
+func sendMessage(thread, msg string, add []string) (*gmail.Message, error) {
+	if opQueue == nil {
+		m, err := mailBackend.SendMessage(&gmail.Message{
+			ThreadId: thread,
+			Raw:      mimeEncode(msg),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(add) > 0 {
+			return m, mailBackend.ModifyMessage(m.Id, add, nil)
+		}
+		return m, nil
+	}
+	return opQueue.Send(thread, msg, add)
+}
+
+// replayQueue runs operations queued while offline, and shows how it went.
+// Queued emails were checked by preSendOK before they were queued, so
+// they're not checked again.
+func replayQueue() {
+	if opQueue == nil || opQueue.Pending() == 0 {
+		return
+	}
+	n, err := opQueue.Replay()
+	if err != nil {
+		log.Printf("Replaying queue: %v", err)
+		nc.Status("[red]Offline, %d operations queued", opQueue.Pending())
+		return
+	}
+	if n > 0 {
+		nc.Status("[green]Back online, %d queued operations done", n)
+	}
+}
+
+// applyPending changes the message list to look like queued operations are already done.
+func (m *messageListState) applyPending() {
+	if opQueue == nil || m.thread {
+		return
+	}
+	ops := opQueue.Ops()
+	if len(ops) == 0 {
+		return
+	}
+	var curID string
+	if m.current < len(m.msgs) {
+		curID = m.msgs[m.current].ID()
+	}
+	var msgs []listEntry
+	for _, e := range m.msgs {
+		ls := e.msg.LabelIds
+		changed := false
+		for _, o := range ops {
+			if o.MsgID != e.msg.Id || o.Failed {
+				continue
+			}
+			changed = true
+			switch o.Type {
+			case opqueue.Modify:
+				ls = cmdglib.ChangeLabels(ls, o.Add, o.Remove)
+			case opqueue.Trash:
+				ls = cmdglib.ChangeLabels(ls, []string{cmdglib.Trash}, nil)
+			}
+		}
+		if !inView(ls, m.currentLabel) {
+			delete(m.marked, e.msg.Id)
+			continue
+		}
+		if changed {
+			msg := *e.msg
+			msg.LabelIds = ls
+			e.msg = &msg
+		}
+		msgs = append(msgs, e)
+	}
+	m.msgs = msgs
+	m.setCurrentID(curID)
+}
+
+// queueView shows operations queued while offline, and lets the user deal with failed ones.
+func queueView() {
+	if opQueue == nil {
+		nc.Status("Offline queue disabled")
+		return
+	}
+	w := fullscreenWindow()
+	defer w.Delete()
+	cur := 0
+	for {
+		ops := opQueue.Ops()
+		if cur >= len(ops) {
+			cur = len(ops) - 1
+		}
+		if cur < 0 {
+			cur = 0
+		}
+		w.Clear()
+		ncwrap.ColorPrint(w, "\n [bold]Offline queue[unbold]: %d pending, %d failed\n\n", opQueue.Pending(), len(ops)-opQueue.Pending())
+		for n, o := range ops {
+			prefix := "  "
+			if n == cur {
+				prefix = "[bold]>"
+			}
+			status := "[green]pending"
+			if o.Failed {
+				status = "[red]FAILED"
+			}
+			ncwrap.ColorPrint(w, " %s %s %s %s[unbold]\n", ncwrap.Preformat(prefix), o.Created.Format("Jan 02 15:04"), o.String(), ncwrap.Preformat(status))
+			if o.Error != "" {
+				ncwrap.ColorPrint(w, "        %s\n", o.Error)
+			}
+		}
+		w.Border()
+		w.Refresh()
+		key := <-nc.Input
+		switch key {
+		case '?':
+			helpWin(`q, ^C, ^G         Back
+^P, p, k, Up      Previous
+^N, n, j, Down    Next
+r                 Retry all now
+R                 Retry failed operation
+d                 Drop operation
+`)
+		case 'q', ctrlC, ctrlG:
+			return
+		case gc.KEY_UP, 'p', ctrlP, 'k':
+			if cur > 0 {
+				cur--
+			}
+		case gc.KEY_DOWN, 'n', ctrlN, 'j':
+			cur++
+		case 'r':
+			nc.Status("Replaying queue...")
+			replayQueue()
+		case 'R':
+			if len(ops) > 0 && ops[cur].Failed {
+				if err := opQueue.Retry(ops[cur].ID); err != nil {
+					nc.Status("[red]Failed to retry: %v", err)
+				} else {
+					replayQueue()
+				}
+			}
+		case 'd':
+			if len(ops) == 0 {
+				break
+			}
+			o := ops[cur]
+			if o.Type == opqueue.Send {
+				// Don't lose the email.
+				if err := saveFailedSend(o.Raw); err != nil {
+					nc.Status("[red]Failed to save email, not dropping it: %v", err)
+					break
+				}
+			}
+			if err := opQueue.Drop(o.ID); err != nil {
+				nc.Status("[red]Failed to drop operation: %v", err)
+			} else if o.Type == opqueue.Send {
+				nc.Status("Dropped sending, email saved in %s", savedDir)
+			} else {
+				nc.Status("Dropped %s", o.String())
+			}
+		}
+	}
+}
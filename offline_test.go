@@ -0,0 +1,193 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/opqueue"
+)
+
+// newQueue sets up an offline queue in front of mailBackend.
+func newQueue(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cmdg-offline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := opqueue.Open(dir, mailBackend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opQueue = q
+	return func() {
+		q.Close()
+		opQueue = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestOfflineArchive(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer newQueue(t)()
+	var ids []string
+	for n := 1; n <= 3; n++ {
+		m, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.Id)
+	}
+	startHeadless(t)
+	defer stopHeadless()
+
+	state := &messageListState{
+		currentLabel: cmdglib.Inbox,
+		marked:       make(map[string]bool),
+	}
+	runBGLoad(state)
+	state.marked[ids[0]] = true
+	state.marked[ids[1]] = true
+
+	// Network goes down.
+	f.InjectError("", "", http.StatusServiceUnavailable, 1000)
+	// Don't start background reloads.
+	state.loading = new(int32)
+	atomic.StoreInt32(state.loading, 1)
+	messageListInput('e', state)
+	if got, want := subjects(state), []string{"Message 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := opQueue.Pending(), 2; got != want {
+		t.Errorf("got %d queued, want %d", got, want)
+	}
+
+	// A reload while offline still shows the messages as archived.
+	state.msgs = nil
+	for _, id := range ids {
+		state.msgs = append(state.msgs, listEntry{msg: f.Message(id)})
+	}
+	state.applyPending()
+	if got, want := len(state.msgs), 1; got != want {
+		t.Errorf("got %d messages, want %d", got, want)
+	}
+
+	// Back online.
+	f.ClearErrors()
+	replayQueue()
+	if got, want := opQueue.Pending(), 0; got != want {
+		t.Errorf("got %d queued, want %d", got, want)
+	}
+	for _, id := range ids[:2] {
+		if cmdglib.HasLabel(f.Message(id).LabelIds, cmdglib.Inbox) {
+			t.Errorf("message %q still in inbox", id)
+		}
+	}
+}
+
+func TestInChunks(t *testing.T) {
+	var ids []string
+	for n := 0; n < 2*backend.MaxBatch+10; n++ {
+		ids = append(ids, fmt.Sprintf("%d", n))
+	}
+	var chunks []int
+	done, queued, errs := inChunks(ids, func(chunk []string) error {
+		chunks = append(chunks, len(chunk))
+		switch len(chunks) {
+		case 2:
+			return opqueue.ErrQueued
+		case 3:
+			return fmt.Errorf("broken")
+		}
+		return nil
+	})
+	if got, want := chunks, []int{backend.MaxBatch, backend.MaxBatch, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks: got %v, want %v", got, want)
+	}
+	if got, want := len(done), 2*backend.MaxBatch; got != want {
+		t.Errorf("got %d done, want %d", got, want)
+	}
+	if !queued {
+		t.Errorf("want queued")
+	}
+	if got, want := len(errs), 1; got != want {
+		t.Fatalf("got %d errors, want %d", got, want)
+	}
+	if got, want := errs[0].Error(), "messages 2001-2010: broken"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestBatchArchive(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	var ids []string
+	for n := 1; n <= 5; n++ {
+		m, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.Id)
+	}
+	done, queued, errs := batchModifyMessages(ids, nil, []string{cmdglib.Inbox})
+	if len(errs) != 0 || queued || len(done) != len(ids) {
+		t.Fatalf("got done %q, queued %v, errors %v", done, queued, errs)
+	}
+	if got, want := f.Requests("POST", "messages/"), 1; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+	for _, id := range ids {
+		if cmdglib.HasLabel(f.Message(id).LabelIds, cmdglib.Inbox) {
+			t.Errorf("%s still in inbox", id)
+		}
+	}
+}
+
+func TestApplyPendingLabels(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer newQueue(t)()
+	m, err := f.AddMessage(fakeMessage(1, ""), cmdglib.Inbox, cmdglib.Unread)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offline, star and mark as read. Same number of labels as before.
+	f.InjectError("", "", http.StatusServiceUnavailable, 1000)
+	if err := opQueue.Modify(m.Id, []string{cmdglib.Starred}, []string{cmdglib.Unread}); err != opqueue.ErrQueued {
+		t.Fatalf("got %v, want %v", err, opqueue.ErrQueued)
+	}
+	state := &messageListState{
+		currentLabel: cmdglib.Inbox,
+		marked:       make(map[string]bool),
+		msgs:         []listEntry{{msg: f.Message(m.Id)}},
+	}
+	state.applyPending()
+	if got, want := state.msgs[0].msg.LabelIds, []string{cmdglib.Inbox, cmdglib.Starred}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels %q, want %q", got, want)
+	}
+}
@@ -29,10 +29,10 @@ import (
 	"sort"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/ThomasHabets/cmdg/cmdglib"
 	"github.com/ThomasHabets/cmdg/ncwrap"
+	"github.com/ThomasHabets/cmdg/opqueue"
 	gc "github.com/rthornton128/goncurses"
 	gmail "google.golang.org/api/gmail/v1"
 )
@@ -71,21 +71,14 @@ func maxScroll(lines, height int) int {
 	return lines - height/2
 }
 
-func openMessagePrint(w *gc.Window, msgs []*gmail.Message, current int, marked bool, currentLabel string, scroll int) {
+func openMessagePrint(w ncwrap.Window, msgs []*gmail.Message, current int, marked bool, currentLabel string, scroll int) {
 	m := msgs[current]
 	go func() {
 		if !cmdglib.HasLabel(m.LabelIds, cmdglib.Unread) {
 			return
 		}
-		id := m.Id
-		st := time.Now()
-		_, err := gmailService.Users.Messages.Modify(email, id, &gmail.ModifyMessageRequest{
-			RemoveLabelIds: []string{cmdglib.Unread},
-		}).Do()
-		if err != nil {
-			// TODO: log to file or something.
-		} else {
-			log.Printf("Users.Messages.Modify(remove unread): %v", time.Since(st))
+		if err := mailBackend.ModifyMessage(m.Id, nil, []string{cmdglib.Unread}); err != nil {
+			log.Printf("Failed to remove unread label from %q: %v", m.Id, err)
 		}
 	}()
 
@@ -131,6 +124,10 @@ func openMessagePrint(w *gc.Window, msgs []*gmail.Message, current int, marked b
 	} else {
 		tss = ts.Local().Format(preferredTimeFormat)
 	}
+	var pgpstr string
+	if s := getPGPStatus(m.Id); s != nil {
+		pgpstr = "PGP: " + s.String() + "[normal]\n"
+	}
 	ncwrap.ColorPrint(w, `Email %d of %d%s
 From: %s
 To: %s
@@ -138,7 +135,7 @@ CC: %s
 Date: %s
 Subject: [bold]%s[unbold]
 Labels: [bold]%s[unbold]%s
-%s
+%s%s
 %s`,
 		current+1, len(msgs), ncwrap.Preformat(mstr),
 		cmdglib.GetHeader(m, "From"),
@@ -148,6 +145,7 @@ Labels: [bold]%s[unbold]%s
 		cmdglib.GetHeader(m, "Subject"),
 		labelIDs[currentLabel],
 		lsstr,
+		ncwrap.Preformat(pgpstr),
 		strings.Repeat("-", width),
 		body)
 }
@@ -193,10 +191,16 @@ func browseAttachments(msg *gmail.Message) error {
 		p = parts[partMap[a]]
 	}
 
-	// Download attachment.
+	// Download attachment, unless it's already here (e.g. decrypted).
 	var dec string
-	{
-		body, err := gmailService.Users.Messages.Attachments.Get(email, msg.Id, p.part.Body.AttachmentId).Do()
+	if p.part.Body.AttachmentId == "" {
+		var err error
+		dec, err = mimeDecode(p.part.Body.Data)
+		if err != nil {
+			return err
+		}
+	} else {
+		body, err := mailBackend.GetAttachment(msg.Id, p.part.Body.AttachmentId)
 		if err != nil {
 			return err
 		}
@@ -273,10 +277,31 @@ func browseAttachments(msg *gmail.Message) error {
 func openMessageMain(msgs []*gmail.Message, state *messageListState) {
 	nc.Status("Opening message")
 	scroll := 0
-	nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+	nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	var ids []string
+	for _, m := range msgs {
+		ids = append(ids, m.Id)
+	}
 	for {
 		maxY, _ := winSize()
-		nc.ApplyMain(func(w *gc.Window) {
+
+		// The list only has metadata.
+		m, err := fullMessage(state.ctx, msgs[state.current])
+		if err != nil {
+			nc.Status("[red]Failed to load message: %v", err)
+			return
+		}
+		if isPGPMIME(m) && getPGPStatus(m.Id) == nil {
+			nc.Status("Checking PGP/MIME...")
+			m = openMessagePGP(m, false)
+		} else if d, err := pgpMessage(m, false); err == nil {
+			// Already checked, this just gets the decrypted content.
+			m = d
+		}
+		msgs[state.current] = m
+		prefetchAround(state.ctx, ids, state.current)
+
+		nc.ApplyMain(func(w ncwrap.Window) {
 			openMessagePrint(w, msgs, state.current, state.marked[msgs[state.current].Id], state.currentLabel, scroll)
 		})
 		key := <-nc.Input
@@ -286,14 +311,15 @@ func openMessageMain(msgs []*gmail.Message, state *messageListState) {
 			helpWin(`q                 Quit
 ^P, k             Previous
 ^N, j             Next
-f                 Forward
+f                 Forward, inline or as attachment
 r                 Reply
 a                 Reply all
+R                 Reply to mailing list
 e                 Archive
 l                 Add label
 L                 Remove label
 x                 Mark message (TODO)
-v                 Verify GPG signature
+v                 Verify GPG signature, downloading missing keys
 p, Up             Scroll up
 n, Down           Scroll down
 Space             Page down
@@ -303,9 +329,9 @@ U                 Mark message unread and close.
 t                 Browse attachments.
 \                 Show raw message.
 `)
-			nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+			nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 		case '\\':
-			if m, err := gmailService.Users.Messages.Get(email, msgs[state.current].Id).Format("RAW").Do(); err != nil {
+			if m, err := mailBackend.GetMessage(msgs[state.current].Id, "raw"); err != nil {
 				nc.Status("Failed to retrieve RAW message: %v", err)
 			} else {
 				dec, err := mimeDecode(m.Raw)
@@ -316,7 +342,7 @@ t                 Browse attachments.
 					if err := runPager(dec); err != nil {
 						helpWin(fmt.Sprintf("Error running pager:\n%v", err))
 					}
-					nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+					nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 				}
 			}
 		case 't':
@@ -330,12 +356,10 @@ t                 Browse attachments.
 		case gc.KEY_LEFT, '<', 'u':
 			return
 		case 'U':
-			st := time.Now()
-			if _, err := gmailService.Users.Messages.Modify(email, msgs[state.current].Id, &gmail.ModifyMessageRequest{
-				AddLabelIds: []string{cmdglib.Unread},
-			}).Do(); err == nil {
-				log.Printf("Users.Messages.Modify(mark unread): %v", time.Since(st))
+			if err := modifyMessage(msgs[state.current].Id, []string{cmdglib.Unread}, nil); err == nil {
 				nc.Status("[green]OK, marked unread")
+			} else if err == opqueue.ErrQueued {
+				nc.Status("[green]Offline, queued marking unread")
 			} else {
 				nc.Status("Failed to marked unread: %v", err)
 			}
@@ -351,12 +375,21 @@ t                 Browse attachments.
 				state.current++
 			}
 		case 'f':
+			mode, ok := chooseForwardMode()
+			if !ok {
+				break
+			}
+			atts, err := forwardAttachments(msgs[state.current], mode)
+			if err != nil {
+				nc.Status("[red]Failed to get attachments to forward: %v", err)
+				break
+			}
 			nc.Status("Composing forward")
-			msg, err := getForward(msgs[state.current])
+			msg, err := getForward(msgs[state.current], mode)
 			if err != nil {
 				nc.Status("Failed to compose forward: %v", err)
 			} else {
-				createSend(msgs[state.current].ThreadId, msg)
+				createReply(msgs[state.current], msg, atts)
 			}
 		case 'r':
 			nc.Status("Composing reply")
@@ -364,7 +397,7 @@ t                 Browse attachments.
 			if err != nil {
 				nc.Status("Failed to compose reply: %v", err)
 			} else {
-				createSend(msgs[state.current].ThreadId, msg)
+				createReply(msgs[state.current], msg, nil)
 			}
 		case 'a':
 			nc.Status("Composing reply to all")
@@ -372,15 +405,23 @@ t                 Browse attachments.
 			if err != nil {
 				nc.Status("Failed to compose reply all: %v", err)
 			} else {
-				createSend(msgs[state.current].ThreadId, msg)
+				createReply(msgs[state.current], msg, nil)
+			}
+		case 'R':
+			nc.Status("Composing reply to list")
+			msg, err := getReplyList(msgs[state.current])
+			if err != nil {
+				nc.Status("[red]Failed to compose reply to list: %v", err)
+			} else {
+				createReply(msgs[state.current], msg, nil)
 			}
 		case 'e':
-			st := time.Now()
-			if _, err := gmailService.Users.Messages.Modify(email, msgs[state.current].Id, &gmail.ModifyMessageRequest{
-				RemoveLabelIds: []string{cmdglib.Inbox},
-			}).Do(); err == nil {
-				log.Printf("Users.Messages.Modify(archive): %v", time.Since(st))
-				nc.Status("[green]OK, archived")
+			if err := modifyMessage(msgs[state.current].Id, nil, []string{cmdglib.Inbox}); err == nil || err == opqueue.ErrQueued {
+				if err == nil {
+					nc.Status("[green]OK, archived")
+				} else {
+					nc.Status("[green]Offline, queued archiving")
+				}
 				state.archive(msgs[state.current].Id)
 			} else {
 				nc.Status("Failed to archive: %v", err)
@@ -391,10 +432,10 @@ t                 Browse attachments.
 			label, _ := stringChoice("Add label", ls, false)
 			if label != "" {
 				id := labels[label]
-				if _, err := gmailService.Users.Messages.Modify(email, msgs[state.current].Id, &gmail.ModifyMessageRequest{
-					AddLabelIds: []string{id},
-				}).Do(); err != nil {
-					nc.Status("[red]Failed to apply label %q: %v", id, labelIDs[id], err)
+				if err := modifyMessage(msgs[state.current].Id, []string{id}, nil); err == opqueue.ErrQueued {
+					nc.Status("[green]Offline, queued applying label %q (%q)", id, labelIDs[id])
+				} else if err != nil {
+					nc.Status("[red]Failed to apply label %q (%q): %v", id, labelIDs[id], err)
 				} else {
 					nc.Status("[green]Applied label %q (%q)", id, labelIDs[id])
 				}
@@ -405,9 +446,9 @@ t                 Browse attachments.
 			label, _ := stringChoice("Remove label", ls, false)
 			if label != "" {
 				id := labels[label]
-				if _, err := gmailService.Users.Messages.Modify(email, msgs[state.current].Id, &gmail.ModifyMessageRequest{
-					RemoveLabelIds: []string{id},
-				}).Do(); err != nil {
+				if err := modifyMessage(msgs[state.current].Id, nil, []string{id}); err == opqueue.ErrQueued {
+					nc.Status("[green]Offline, queued removing label %q (%q)", id, labelIDs[id])
+				} else if err != nil {
 					nc.Status("[red]Failed to remove label %q (%q): %v", id, labelIDs[id], err)
 				} else {
 					nc.Status("[green]Removed label %q (%q)", id, labelIDs[id])
@@ -417,7 +458,16 @@ t                 Browse attachments.
 		case 'x':
 			state.marked[msgs[state.current].Id] = true
 		case 'v':
-			openMessageCmdGPGVerify(msgs[state.current], true)
+			// The shown email may be decrypted, so check the original.
+			if orig, err := fullMessage(state.ctx, msgs[state.current]); err == nil && isPGPMIME(orig) {
+				nc.Status("Verifying...")
+				openMessagePGP(orig, true)
+				if s := getPGPStatus(orig.Id); s != nil {
+					nc.Status("%s", s.String())
+				}
+			} else {
+				openMessageCmdGPGVerify(msgs[state.current], true)
+			}
 		case 'n', gc.KEY_DOWN: // Scroll down.
 			scroll += 2
 		case 'p', gc.KEY_UP: // Scroll up.
@@ -452,6 +502,22 @@ func downloadKey(keyID string) {
 	}
 }
 
+// openMessagePGP checks a PGP/MIME email, and returns the email to show.
+// The terminal is let go while GnuPG runs, in case it needs to ask for a passphrase.
+func openMessagePGP(m *gmail.Message, recheck bool) *gmail.Message {
+	d, err := func() (*gmail.Message, error) {
+		defer runSomething()()
+		return pgpMessage(m, recheck)
+	}()
+	nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
+	if err != nil {
+		log.Printf("Checking PGP/MIME email %q: %v", m.Id, err)
+		nc.Status("[red]Failed to check PGP/MIME: %v", err)
+		return m
+	}
+	return d
+}
+
 func openMessageCmdGPGVerify(msg *gmail.Message, doDownload bool) {
 	nc.Status("Verifying...")
 	s, ok := doOpenMessageCmdGPGVerify(msg, doDownload)
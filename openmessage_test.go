@@ -19,9 +19,14 @@ package main
  */
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
 )
 
 func TestGPGVerifyKeyNotFound(t *testing.T) {
@@ -95,3 +100,53 @@ func TestGPGVerifyExecFail(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+func TestOpenMessageMain(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	var msgs []*gmail.Message
+	for n := 1; n <= 2; n++ {
+		m, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox, cmdglib.Unread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, f.Message(m.Id))
+	}
+	s := startHeadless(t)
+	defer stopHeadless()
+
+	state := &messageListState{
+		currentLabel: cmdglib.Inbox,
+		marked:       make(map[string]bool),
+		ctx:          context.Background(),
+	}
+	nc.Input <- 'j'
+	nc.Input <- 'q'
+	openMessageMain(msgs, state)
+	if !state.quit {
+		t.Errorf("'q' didn't quit")
+	}
+	if got, want := state.current, 1; got != want {
+		t.Errorf("current: got %d, want %d", got, want)
+	}
+	for y, want := range []string{
+		"Email 2 of 2",
+		"From: Sender 2 <sender2@example.com>",
+		"To: foo@bar.com",
+	} {
+		if got := s.Line(y); got != want {
+			t.Errorf("line %d: got %q, want %q", y, got, want)
+		}
+	}
+	if !strings.Contains(s.Contents(), "Body of message 2.") {
+		t.Errorf("Body not shown. Screen:\n%s", s.Contents())
+	}
+
+	// Both messages were shown, and should be marked as read.
+	for st := time.Now(); time.Since(st) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if !cmdglib.HasLabel(f.Message(msgs[0].Id).LabelIds, cmdglib.Unread) && !cmdglib.HasLabel(f.Message(msgs[1].Id).LabelIds, cmdglib.Unread) {
+			return
+		}
+	}
+	t.Errorf("Messages still unread")
+}
@@ -33,7 +33,7 @@ func openThreadMain(ts []*gmail.Thread, state *messageListState) {
 	scroll := 0
 	currentMessage := 0
 	for {
-		nc.ApplyMain(func(w *gc.Window) {
+		nc.ApplyMain(func(w ncwrap.Window) {
 			openThreadPrint(w, ts, state.current, currentMessage, state.marked[ts[state.current].Id], state.currentLabel, scroll)
 		})
 		key := <-nc.Input
@@ -56,7 +56,7 @@ x                 Mark thread (TODO)
 Space             Page down
 Backspace         Page up
 `)
-			nc.ApplyMain(func(w *gc.Window) { w.Clear() })
+			nc.ApplyMain(func(w ncwrap.Window) { w.Clear() })
 		case 'q':
 			state.quit = true
 			return
@@ -94,7 +94,7 @@ Backspace         Page up
 
 // openThreadPrint redraws the thread list.
 // It's run in the UI goroutine.
-func openThreadPrint(w *gc.Window, ts []*gmail.Thread, currentThread, currentMessage int, marked bool, currentLabel string, scroll int) {
+func openThreadPrint(w ncwrap.Window, ts []*gmail.Thread, currentThread, currentMessage int, marked bool, currentLabel string, scroll int) {
 	w.Clear()
 	t := ts[currentThread]
 	w.Move(0, 0)
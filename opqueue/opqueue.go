@@ -0,0 +1,746 @@
+// Package opqueue is a durable queue of mail operations, so that cmdg
+// can keep working while offline.
+//
+// Operations are run directly when nothing is queued. If that fails
+// because the server can't be reached they're written to a journal, and
+// replayed in order once it can.
+package opqueue
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
+)
+
+// Operation types.
+const (
+	Modify = "modify"
+	Trash  = "trash"
+	Send   = "send"
+)
+
+const (
+	dirMode  os.FileMode = 0700
+	fileMode os.FileMode = 0600
+
+	// Relative to the queue directory.
+	journalFile = "journal"
+)
+
+// ErrQueued is returned when an operation couldn't be done now, and was
+// queued instead.
+var ErrQueued = errors.New("queued until back online")
+
+// ErrMaybeSent is returned when sending failed in a way that the message
+// may still have been sent. It's queued as failed, for the user to check
+// Sent mail and then retry or drop it.
+var ErrMaybeSent = errors.New("may have been sent, check Sent mail before retrying from the offline queue")
+
+// Op is one queued operation.
+type Op struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Created  time.Time `json:"created"`
+	MsgID    string    `json:"msgId,omitempty"`    // Message to modify or trash.
+	Add      []string  `json:"add,omitempty"`      // Labels to add. For Send they're added to the sent message.
+	Remove   []string  `json:"remove,omitempty"`   // Labels to remove.
+	ThreadID string    `json:"threadId,omitempty"` // Thread of message to send.
+	Raw      string    `json:"raw,omitempty"`      // Message to send, not base64 encoded.
+	Error    string    `json:"error,omitempty"`    // Why the last attempt failed.
+	Failed   bool      `json:"failed,omitempty"`   // Not retried until the user says so.
+}
+
+// String returns a one line description of the operation.
+func (o *Op) String() string {
+	switch o.Type {
+	case Modify:
+		return fmt.Sprintf("Modify %s, add %q, remove %q", o.MsgID, o.Add, o.Remove)
+	case Trash:
+		return fmt.Sprintf("Trash %s", o.MsgID)
+	case Send:
+		subject := ""
+		for _, l := range strings.Split(strings.SplitN(o.Raw, "\n\n", 2)[0], "\n") {
+			if strings.HasPrefix(strings.ToLower(l), "subject:") {
+				subject = strings.TrimSpace(l[len("subject:"):])
+			}
+		}
+		return fmt.Sprintf("Send %q", subject)
+	}
+	return fmt.Sprintf("Unknown operation %q", o.Type)
+}
+
+// entry is one line in the journal.
+type entry struct {
+	Add   *Op    `json:"add,omitempty"`   // Operation queued.
+	Done  uint64 `json:"done,omitempty"`  // Operation done or dropped.
+	Fail  uint64 `json:"fail,omitempty"`  // Operation failed.
+	Retry uint64 `json:"retry,omitempty"` // Failed operation to be retried.
+	Error string `json:"error,omitempty"`
+}
+
+// Queue is a durable queue of operations.
+type Queue struct {
+	replayMu sync.Mutex // Only one replay at a time.
+
+	mu     sync.Mutex
+	b      backend.Backend
+	key    *atrest.Key // Encrypts journal lines, if not nil.
+	fn     string
+	f      *os.File
+	ops    []*Op
+	nextID uint64
+}
+
+// Open opens the queue in dir, creating it if needed. If key is not nil
+// the journal is encrypted with it, including what was written before
+// encryption was turned on.
+func Open(dir string, b backend.Backend, key *atrest.Key) (*Queue, error) {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		b:   b,
+		key: key,
+		fn:  path.Join(dir, journalFile),
+	}
+	if err := q.load(); err != nil {
+		return nil, fmt.Errorf("reading journal %q: %v", q.fn, err)
+	}
+	if err := q.compact(); err != nil {
+		return nil, fmt.Errorf("compacting journal %q: %v", q.fn, err)
+	}
+	return q, nil
+}
+
+// Close closes the journal.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
+
+// SetBackend changes the backend operations are run against.
+func (q *Queue) SetBackend(b backend.Backend) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.b = b
+}
+
+func (q *Queue) backend() backend.Backend {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.b
+}
+
+// load reads the journal.
+func (q *Queue) load() error {
+	f, err := os.Open(q.fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<30)
+	var bad error
+	for s.Scan() {
+		if bad != nil {
+			// Only the last line can be torn.
+			return bad
+		}
+		line, err := q.decrypt(s.Bytes())
+		if err != nil {
+			bad = err
+			continue
+		}
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// Most likely a crash while writing the last line, and that operation never happened.
+			log.Printf("Skipping bad journal line: %v", err)
+			continue
+		}
+		switch {
+		case e.Add != nil:
+			q.ops = append(q.ops, e.Add)
+			if e.Add.ID >= q.nextID {
+				q.nextID = e.Add.ID + 1
+			}
+		case e.Done != 0:
+			q.remove(e.Done)
+		case e.Fail != 0:
+			if o := q.find(e.Fail); o != nil {
+				o.Failed = true
+				o.Error = e.Error
+			}
+		case e.Retry != 0:
+			if o := q.find(e.Retry); o != nil {
+				o.Failed = false
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if bad != nil {
+		// Without a newline, the last line is from a crash while writing it.
+		if torn, err := lastLineTorn(f); err != nil || !torn {
+			return bad
+		}
+		log.Printf("Skipping bad journal line: %v", bad)
+	}
+	return nil
+}
+
+// lastLineTorn returns true if the file doesn't end with a newline.
+func lastLineTorn(f *os.File) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() == 0 {
+		return false, nil
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, fi.Size()-1); err != nil {
+		return false, err
+	}
+	return b[0] != '\n', nil
+}
+
+// decrypt returns a journal line as JSON. Lines written without
+// encryption are JSON already.
+func (q *Queue) decrypt(line []byte) ([]byte, error) {
+	if len(line) > 0 && line[0] == '{' {
+		return line, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if !atrest.IsEncrypted(b) {
+		return nil, errors.New("neither JSON nor encrypted")
+	}
+	return q.key.Open(b)
+}
+
+// compact rewrites the journal with only the operations still queued,
+// and opens it for appending.
+func (q *Queue) compact() error {
+	tmp := q.fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, o := range q.ops {
+		if err := q.writeEntry(f, &entry{Add: o}); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.fn); err != nil {
+		return err
+	}
+	q.f, err = os.OpenFile(q.fn, os.O_WRONLY|os.O_APPEND, fileMode)
+	return err
+}
+
+func (q *Queue) writeEntry(f *os.File, e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if q.key != nil {
+		enc, err := q.key.Seal(b)
+		if err != nil {
+			return err
+		}
+		b = []byte(base64.StdEncoding.EncodeToString(enc))
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// journal durably appends entries. Must be called with the lock held.
+func (q *Queue) journal(es ...*entry) error {
+	for _, e := range es {
+		if err := q.writeEntry(q.f, e); err != nil {
+			return err
+		}
+	}
+	return q.f.Sync()
+}
+
+// find must be called with the lock held.
+func (q *Queue) find(id uint64) *Op {
+	for _, o := range q.ops {
+		if o.ID == id {
+			return o
+		}
+	}
+	return nil
+}
+
+// remove must be called with the lock held.
+func (q *Queue) remove(id uint64) {
+	for n, o := range q.ops {
+		if o.ID == id {
+			q.ops = append(q.ops[:n], q.ops[n+1:]...)
+			return
+		}
+	}
+}
+
+// Transient returns true if err means that the server couldn't be
+// reached or had a temporary problem, so that it's worth trying again later.
+func Transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return true
+	}
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+// NotSent returns true if err means that a request never reached the
+// server, or was refused without being acted on, so that sending it again
+// can't send an email twice. A timeout or a server error after the
+// request was sent doesn't say if it was acted on.
+func NotSent(err error) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == http.StatusTooManyRequests
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Ops returns copies of all queued operations, in order.
+func (q *Queue) Ops() []Op {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ret []Op
+	for _, o := range q.ops {
+		ret = append(ret, *o)
+	}
+	return ret
+}
+
+// Pending returns the number of operations waiting to be replayed.
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending()
+}
+
+func (q *Queue) pending() int {
+	n := 0
+	for _, o := range q.ops {
+		if !o.Failed {
+			n++
+		}
+	}
+	return n
+}
+
+// Modify adds and removes labels on a message.
+func (q *Queue) Modify(id string, add, remove []string) error {
+	_, err := q.do(&Op{
+		Type:   Modify,
+		MsgID:  id,
+		Add:    add,
+		Remove: remove,
+	})
+	return err
+}
+
+// Trash moves a message to the trash.
+func (q *Queue) Trash(id string) error {
+	_, err := q.do(&Op{
+		Type:  Trash,
+		MsgID: id,
+	})
+	return err
+}
+
+// BatchModify adds and removes labels on up to backend.MaxBatch messages
+// in one request. If offline, one Modify per message is queued.
+func (q *Queue) BatchModify(ids []string, add, remove []string) error {
+	var ops []*Op
+	for _, id := range ids {
+		ops = append(ops, &Op{
+			Type:   Modify,
+			MsgID:  id,
+			Add:    add,
+			Remove: remove,
+		})
+	}
+	return q.doBatch(ops)
+}
+
+// BatchTrash moves up to backend.MaxBatch messages to the trash in one
+// request. If offline, one Trash per message is queued.
+func (q *Queue) BatchTrash(ids []string) error {
+	var ops []*Op
+	for _, id := range ids {
+		ops = append(ops, &Op{
+			Type:  Trash,
+			MsgID: id,
+		})
+	}
+	return q.doBatch(ops)
+}
+
+// Send sends a message, and adds labels to it once sent.
+// If the message is sent but labelling fails the message is returned together with the error.
+func (q *Queue) Send(threadID, raw string, add []string) (*gmail.Message, error) {
+	return q.do(&Op{
+		Type:     Send,
+		ThreadID: threadID,
+		Raw:      raw,
+		Add:      add,
+	})
+}
+
+// do runs the operation now if nothing else is queued, and queues it
+// if the server can't be reached. Returns ErrQueued if queued. A send that
+// may have worked is queued as failed, and ErrMaybeSent returned.
+func (q *Queue) do(op *Op) (*gmail.Message, error) {
+	if q.Pending() == 0 {
+		m, err := q.run(op)
+		if !Transient(err) {
+			return m, err
+		}
+		if op.Type == Send && !NotSent(err) {
+			log.Printf("Sending may have worked, queueing as failed: %v", err)
+			op.Failed = true
+			op.Error = maybeSent(err)
+			if err := q.add(op); err != nil {
+				return nil, err
+			}
+			return nil, ErrMaybeSent
+		}
+		log.Printf("Queueing %s: %v", op, err)
+		op.Error = err.Error()
+	}
+	if err := q.add(op); err != nil {
+		return nil, err
+	}
+	return nil, ErrQueued
+}
+
+// doBatch is like do, but for operations of the same type and labels that
+// can be run as one batch request.
+func (q *Queue) doBatch(ops []*Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if q.Pending() == 0 {
+		err := q.runBatch(ops)
+		if !Transient(err) {
+			return err
+		}
+		log.Printf("Queueing batch of %d operations: %v", len(ops), err)
+		for _, op := range ops {
+			op.Error = err.Error()
+		}
+	}
+	if err := q.add(ops...); err != nil {
+		return err
+	}
+	return ErrQueued
+}
+
+// add adds operations to the end of the queue.
+func (q *Queue) add(ops ...*Op) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var es []*entry
+	for _, op := range ops {
+		op.ID = q.nextID
+		if op.ID == 0 {
+			op.ID = 1
+		}
+		q.nextID = op.ID + 1
+		op.Created = time.Now()
+		es = append(es, &entry{Add: op})
+	}
+	if err := q.journal(es...); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+	q.ops = append(q.ops, ops...)
+	return nil
+}
+
+// run runs an operation against the server.
+func (q *Queue) run(op *Op) (*gmail.Message, error) {
+	b := q.backend()
+	switch op.Type {
+	case Modify:
+		return nil, b.ModifyMessage(op.MsgID, op.Add, op.Remove)
+	case Trash:
+		return nil, b.TrashMessage(op.MsgID)
+	case Send:
+		m, err := b.SendMessage(&gmail.Message{
+			ThreadId: op.ThreadID,
+			Raw:      base64.URLEncoding.EncodeToString([]byte(op.Raw)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(op.Add) > 0 {
+			if err := b.ModifyMessage(m.Id, op.Add, nil); Transient(err) {
+				// Sending can't be undone, so label it later.
+				if err := q.add(&Op{Type: Modify, MsgID: m.Id, Add: op.Add, Error: err.Error()}); err != nil {
+					return m, err
+				}
+			} else if err != nil {
+				return m, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown operation type %q", op.Type)
+}
+
+// runBatch runs operations that batchable() says can be one request.
+func (q *Queue) runBatch(ops []*Op) error {
+	var ids []string
+	for _, op := range ops {
+		ids = append(ids, op.MsgID)
+	}
+	b := q.backend()
+	switch ops[0].Type {
+	case Modify:
+		return b.BatchModifyMessages(ids, ops[0].Add, ops[0].Remove)
+	case Trash:
+		return b.BatchTrashMessages(ids)
+	}
+	return fmt.Errorf("can't batch operation type %q", ops[0].Type)
+}
+
+// batchable returns true if the two operations can be done in the same batch request.
+func batchable(a, b *Op) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case Modify:
+		return equal(a.Add, b.Add) && equal(a.Remove, b.Remove)
+	case Trash:
+		return true
+	}
+	return false
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n := range a {
+		if a[n] != b[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the next operations to replay, or nil. Operations in a row
+// that can be batched are returned together.
+func (q *Queue) next() []*Op {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ret []*Op
+	for _, o := range q.ops {
+		if o.Failed {
+			continue
+		}
+		if len(ret) > 0 && (len(ret) >= backend.MaxBatch || !batchable(ret[0], o)) {
+			break
+		}
+		ret = append(ret, o)
+	}
+	return ret
+}
+
+// Replay runs queued operations in order, and returns how many were done.
+//
+// It stops at the first operation that fails because the server can't be
+// reached, and returns that error. Operations that fail for other
+// reasons are marked as failed and skipped. Operations on messages that
+// no longer exist are dropped, since there's nothing left to do.
+func (q *Queue) Replay() (int, error) {
+	q.replayMu.Lock()
+	defer q.replayMu.Unlock()
+	done := 0
+	for {
+		ops := q.next()
+		if len(ops) == 0 {
+			return done, nil
+		}
+		if len(ops) > 1 {
+			err := q.runBatch(ops)
+			if Transient(err) {
+				q.mu.Lock()
+				ops[0].Error = err.Error()
+				q.mu.Unlock()
+				return done, err
+			}
+			if err == nil {
+				done += len(ops)
+				if err := q.drop(ops); err != nil {
+					return done, err
+				}
+				continue
+			}
+			// Find out which ones failed.
+			log.Printf("Batch of %d operations failed, retrying one by one: %v", len(ops), err)
+		}
+		for _, op := range ops {
+			ok, err := q.replayOne(op)
+			if ok {
+				done++
+			}
+			if err != nil {
+				return done, err
+			}
+		}
+	}
+}
+
+// replayOne runs one queued operation. Returns true if the operation is
+// no longer queued, and an error if replay should stop.
+func (q *Queue) replayOne(op *Op) (bool, error) {
+	_, err := q.run(op)
+	switch {
+	case op.Type == Send && Transient(err) && !NotSent(err):
+		// Don't send it again without the user checking.
+		log.Printf("%s may have been sent: %v", op, err)
+		if err := q.setFailed(op.ID, errors.New(maybeSent(err))); err != nil {
+			return false, err
+		}
+		return false, err
+	case Transient(err):
+		q.mu.Lock()
+		op.Error = err.Error()
+		q.mu.Unlock()
+		return false, err
+	case err == nil:
+		return true, q.Drop(op.ID)
+	case op.Type != Send && backend.IsNotFound(err):
+		log.Printf("Dropping %s, message is gone: %v", op, err)
+		return true, q.Drop(op.ID)
+	default:
+		log.Printf("%s failed: %v", op, err)
+		return false, q.setFailed(op.ID, err)
+	}
+}
+
+// maybeSent is the error shown for a send that may have worked.
+func maybeSent(err error) string {
+	return fmt.Sprintf("may have been sent, check Sent mail before retrying: %v", err)
+}
+
+func (q *Queue) setFailed(id uint64, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	o := q.find(id)
+	if o == nil {
+		return nil
+	}
+	if err := q.journal(&entry{Fail: id, Error: err.Error()}); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+	o.Failed = true
+	o.Error = err.Error()
+	return nil
+}
+
+// Retry makes a failed operation be retried on next replay.
+func (q *Queue) Retry(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	o := q.find(id)
+	if o == nil {
+		return nil
+	}
+	if err := q.journal(&entry{Retry: id}); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+	o.Failed = false
+	return nil
+}
+
+// drop removes operations that are done from the queue.
+func (q *Queue) drop(ops []*Op) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var es []*entry
+	for _, op := range ops {
+		es = append(es, &entry{Done: op.ID})
+	}
+	if err := q.journal(es...); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+	for _, op := range ops {
+		q.remove(op.ID)
+	}
+	return nil
+}
+
+// Drop removes an operation from the queue.
+func (q *Queue) Drop(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.find(id) == nil {
+		return nil
+	}
+	if err := q.journal(&entry{Done: id}); err != nil {
+		return fmt.Errorf("writing journal: %v", err)
+	}
+	q.remove(id)
+	return nil
+}
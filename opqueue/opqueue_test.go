@@ -0,0 +1,433 @@
+package opqueue
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+)
+
+func newTestQueue(t *testing.T) (*fakegmail.Server, *Queue, string, func()) {
+	f, err := fakegmail.NewFixture("cmdg-opqueue-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := Open(f.Dir, backend.NewGmail(f.Service, "me", nil), nil)
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f.Server, q, f.Dir, func() {
+		q.Close()
+		f.Close()
+	}
+}
+
+func addMessage(t *testing.T, f *fakegmail.Server, n int, labels ...string) string {
+	id, err := f.AddTestMessage(n, labels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDirect(t *testing.T) {
+	f, q, _, cleanup := newTestQueue(t)
+	defer cleanup()
+	id := addMessage(t, f, 1, cmdglib.Inbox)
+	if err := q.Modify(id, []string{cmdglib.Starred}, []string{cmdglib.Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Message(id).LabelIds, []string{cmdglib.Starred}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got labels %q, want %q", got, want)
+	}
+	if got := q.Ops(); len(got) != 0 {
+		t.Errorf("got queued ops %v, want none", got)
+	}
+
+	// Errors that aren't about being offline are returned, not queued.
+	if err := q.Trash("nonexistent"); err == nil || err == ErrQueued {
+		t.Errorf("want error trashing nonexistent message, got %v", err)
+	}
+	if got := q.Ops(); len(got) != 0 {
+		t.Errorf("got queued ops %v, want none", got)
+	}
+}
+
+func TestQueueAndReplay(t *testing.T) {
+	f, q, dir, cleanup := newTestQueue(t)
+	defer cleanup()
+	id1 := addMessage(t, f, 1, cmdglib.Inbox)
+	id2 := addMessage(t, f, 2, cmdglib.Inbox)
+	work := f.AddLabel("Work")
+
+	f.InjectError("POST", "messages/", http.StatusServiceUnavailable, 1)
+	if err := q.Modify(id1, nil, []string{cmdglib.Inbox}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	// Queued behind the first one, without trying.
+	posts := f.Requests("POST", "")
+	if err := q.Trash(id2); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if _, err := q.Send("", "To: foo@example.com\nSubject: Hello\n\nBody\n", []string{work}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if got, want := f.Requests("POST", ""), posts; got != want {
+		t.Errorf("got %d POSTs, want %d", got, want)
+	}
+	if got, want := q.Pending(), 3; got != want {
+		t.Errorf("got %d pending, want %d", got, want)
+	}
+	if got, want := f.Message(id1).LabelIds, []string{cmdglib.Inbox}; !reflect.DeepEqual(got, want) {
+		t.Errorf("labels changed before replay: got %q, want %q", got, want)
+	}
+
+	// Survives restart.
+	q.Close()
+	var err error
+	q, err = Open(dir, q.b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := q.Ops()
+	if got, want := len(ops), 3; got != want {
+		t.Fatalf("got %d ops after reopening, want %d", got, want)
+	}
+	for n, want := range []string{Modify, Trash, Send} {
+		if got := ops[n].Type; got != want {
+			t.Errorf("op %d: got %q, want %q", n, got, want)
+		}
+	}
+	if got, want := ops[2].String(), `Send "Hello"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Still offline.
+	f.InjectError("POST", "messages/", http.StatusServiceUnavailable, 1)
+	if n, err := q.Replay(); err == nil || n != 0 {
+		t.Errorf("want error and 0 done, got %v and %d", err, n)
+	}
+	if got, want := q.Pending(), 3; got != want {
+		t.Errorf("got %d pending, want %d", got, want)
+	}
+
+	// Back online.
+	if n, err := q.Replay(); err != nil || n != 3 {
+		t.Fatalf("want 3 done, got %d: %v", n, err)
+	}
+	if got, want := f.Message(id1).LabelIds, []string{}; len(got) != 0 {
+		t.Errorf("got labels %q, want %q", got, want)
+	}
+	if !cmdglib.HasLabel(f.Message(id2).LabelIds, cmdglib.Trash) {
+		t.Errorf("not trashed: %q", f.Message(id2).LabelIds)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+
+	// Journal is compacted when reopened.
+	q.Close()
+	q, err = Open(dir, q.b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Ops(); len(got) != 0 {
+		t.Errorf("got ops %v after replay, want none", got)
+	}
+	fi, err := os.Stat(path.Join(dir, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("journal not compacted, size %d", fi.Size())
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	f, q, dir, cleanup := newTestQueue(t)
+	defer cleanup()
+	id := addMessage(t, f, 1, cmdglib.Inbox)
+
+	f.InjectError("POST", "messages/", http.StatusServiceUnavailable, 1)
+	if err := q.Modify("gone", nil, []string{cmdglib.Inbox}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if err := q.Modify(id, []string{"NOSUCHLABEL"}, nil); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if err := q.Modify(id, nil, []string{cmdglib.Inbox}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	f.InjectError("POST", "messages/"+id+"/modify", http.StatusBadRequest, 1)
+
+	// Message that's gone is dropped, failed op is skipped.
+	if n, err := q.Replay(); err != nil || n != 2 {
+		t.Fatalf("want 2 done, got %d: %v", n, err)
+	}
+	ops := q.Ops()
+	if len(ops) != 1 || !ops[0].Failed || ops[0].Error == "" {
+		t.Fatalf("want one failed op with error, got %+v", ops)
+	}
+	if got, want := q.Pending(), 0; got != want {
+		t.Errorf("got %d pending, want %d", got, want)
+	}
+
+	// Failed state survives restart.
+	q.Close()
+	var err error
+	if q, err = Open(dir, q.b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ops := q.Ops(); len(ops) != 1 || !ops[0].Failed {
+		t.Fatalf("want one failed op, got %+v", ops)
+	}
+
+	if err := q.Retry(ops[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := q.Pending(), 1; got != want {
+		t.Errorf("got %d pending, want %d", got, want)
+	}
+	if err := q.Drop(ops[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Ops(); len(got) != 0 {
+		t.Errorf("got ops %v, want none", got)
+	}
+}
+
+func TestTornJournal(t *testing.T) {
+	_, q, dir, cleanup := newTestQueue(t)
+	defer cleanup()
+	q.Close()
+	if err := ioutil.WriteFile(path.Join(dir, journalFile), []byte(`{"add":{"id":1,"type":"trash","msgId":"abc"}}
+{"add":{"id":2,"type":"tra`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := Open(dir, q.b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := q.Ops()
+	if len(ops) != 1 || ops[0].MsgID != "abc" {
+		t.Fatalf("got %+v, want one trash op", ops)
+	}
+	if _, err := q.Send("", "Subject: x\n\nfoo", nil); err != nil && err != ErrQueued {
+		t.Fatal(err)
+	}
+	if got, want := q.Ops()[1].ID, uint64(2); got != want {
+		t.Errorf("new ID: got %d, want %d", got, want)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	f, q, _, cleanup := newTestQueue(t)
+	defer cleanup()
+	var ids []string
+	for n := 0; n < 6; n++ {
+		ids = append(ids, addMessage(t, f, n, cmdglib.Inbox))
+	}
+
+	// Online, one request.
+	if err := q.BatchModify(ids[:2], nil, []string{cmdglib.Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "messages/batchModify"), 1; got != want {
+		t.Errorf("got %d batch requests, want %d", got, want)
+	}
+	for _, id := range ids[:2] {
+		if got := f.Message(id).LabelIds; len(got) != 0 {
+			t.Errorf("%s: got labels %q, want none", id, got)
+		}
+	}
+
+	// Offline, queued one per message.
+	f.InjectError("POST", "messages/", http.StatusServiceUnavailable, 1)
+	if err := q.BatchModify(ids[2:4], nil, []string{cmdglib.Inbox}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if err := q.BatchModify(ids[4:], nil, []string{cmdglib.Inbox}); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if err := q.BatchTrash(ids[:2]); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	if got, want := q.Pending(), 6; got != want {
+		t.Errorf("got %d pending, want %d", got, want)
+	}
+
+	// Replayed as one batch per kind of operation.
+	before := f.Requests("POST", "messages/batchModify")
+	if n, err := q.Replay(); err != nil || n != 6 {
+		t.Fatalf("want 6 done, got %d: %v", n, err)
+	}
+	if got, want := f.Requests("POST", "messages/batchModify")-before, 2; got != want {
+		t.Errorf("got %d batch requests, want %d", got, want)
+	}
+	for _, id := range ids[2:] {
+		if got := f.Message(id).LabelIds; len(got) != 0 {
+			t.Errorf("%s: got labels %q, want none", id, got)
+		}
+	}
+	for _, id := range ids[:2] {
+		if !cmdglib.HasLabel(f.Message(id).LabelIds, cmdglib.Trash) {
+			t.Errorf("%s: not trashed: %q", id, f.Message(id).LabelIds)
+		}
+	}
+}
+
+func TestMaybeSent(t *testing.T) {
+	f, q, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	// Server error when sending directly.
+	f.InjectError("POST", "messages/send", http.StatusServiceUnavailable, 1)
+	if _, err := q.Send("", "To: foo@example.com\nSubject: One\n\nBody\n", nil); err != ErrMaybeSent {
+		t.Fatalf("want ErrMaybeSent, got %v", err)
+	}
+	ops := q.Ops()
+	if len(ops) != 1 || !ops[0].Failed || !strings.Contains(ops[0].Error, "may have been sent") {
+		t.Fatalf("got %+v, want failed send", ops)
+	}
+	if _, err := q.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("resent without asking: got %d sends, want %d", got, want)
+	}
+	if err := q.Retry(ops[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Replay(); err != nil || n != 1 {
+		t.Fatalf("got %d replayed, %v, want 1", n, err)
+	}
+
+	// Server error when replaying.
+	f.InjectError("POST", "messages/send", http.StatusTooManyRequests, 1)
+	if _, err := q.Send("", "To: foo@example.com\nSubject: Two\n\nBody\n", nil); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	f.InjectError("POST", "messages/send", http.StatusInternalServerError, 1)
+	if _, err := q.Replay(); err == nil {
+		t.Fatal("want replay error")
+	}
+	if ops := q.Ops(); len(ops) != 1 || !ops[0].Failed {
+		t.Fatalf("got %+v, want failed send", ops)
+	}
+	if _, err := q.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 4; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+}
+
+func TestNotSent(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, false},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{&url.Error{Op: "Post", Err: &net.DNSError{Err: "no such host"}}, true},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: errors.New("connection reset")}}, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := NotSent(test.err); got != test.want {
+			t.Errorf("NotSent(%v): got %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	f, q, dir, cleanup := newTestQueue(t)
+	defer cleanup()
+	f.InjectError("POST", "messages/", http.StatusTooManyRequests, 1)
+	if _, err := q.Send("", "To: foo@example.com\nSubject: Secret\n\nBody\n", nil); err != ErrQueued {
+		t.Fatalf("want ErrQueued, got %v", err)
+	}
+	q.Close()
+
+	// Turning on encryption encrypts what's already queued.
+	key, err := atrest.NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, err = Open(dir, q.b, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Trash("abc"); err != nil && err != ErrQueued {
+		t.Fatal(err)
+	}
+	if got, want := len(q.Ops()), 2; got != want {
+		t.Fatalf("got %d ops, want %d", got, want)
+	}
+	q.Close()
+	fn := path.Join(dir, journalFile)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Secret")) || bytes.Contains(data, []byte("abc")) {
+		t.Errorf("journal not encrypted: %q", data)
+	}
+
+	// Can't be read without the key.
+	if _, err := Open(dir, q.b, nil); err == nil {
+		t.Errorf("opened encrypted journal without key")
+	}
+	other, err := atrest.NewKey(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, q.b, other); err == nil {
+		t.Errorf("opened encrypted journal with wrong key")
+	}
+
+	// Torn last line is skipped.
+	if err := ioutil.WriteFile(fn, append(data, data[:20]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if q, err = Open(dir, q.b, key); err != nil {
+		t.Fatal(err)
+	}
+	ops := q.Ops()
+	if len(ops) != 2 || ops[0].String() != `Send "Secret"` {
+		t.Errorf("got %v, want send and trash", ops)
+	}
+}
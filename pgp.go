@@ -0,0 +1,294 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Sending PGP/MIME (RFC 3156) signed and encrypted email.
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os/exec"
+	"strings"
+)
+
+// pgpMode is how to protect an outgoing email.
+type pgpMode int
+
+const (
+	pgpNone pgpMode = iota
+	pgpSign
+	pgpEncrypt
+	pgpSignEncrypt
+)
+
+func (m pgpMode) String() string {
+	switch m {
+	case pgpSign:
+		return "Signed"
+	case pgpEncrypt:
+		return "Encrypted"
+	case pgpSignEncrypt:
+		return "Signed and encrypted"
+	}
+	return "None"
+}
+
+// encrypt returns true if the mode encrypts.
+func (m pgpMode) encrypt() bool {
+	return m == pgpEncrypt || m == pgpSignEncrypt
+}
+
+// runGPG runs GnuPG with input on stdin, and returns stdout.
+func runGPG(input string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(*gpg, append([]string{"--batch", "--no-tty"}, args...)...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("gpg %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// runGPGStatus is like runGPG, but also returns the machine readable
+// status output. Output is returned even on error, since e.g. a bad
+// signature is an error.
+func runGPGStatus(input string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(*gpg, append([]string{"--batch", "--no-tty", "--status-fd", "2"}, args...)...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("gpg %s failed: %v", args[0], err)
+	}
+	return stdout.String(), stderr.String(), err
+}
+
+// gpgFindKey returns true if there's a public key for addr. If it's not
+// in the keyring it's looked up as configured by auto-key-locate in
+// gpg.conf (by default using Web Key Directory).
+func gpgFindKey(addr string) bool {
+	_, err := runGPG("", "--locate-keys", addr)
+	return err == nil
+}
+
+// gpgHasSecretKey returns true if there's a secret key for addr.
+func gpgHasSecretKey(addr string) bool {
+	_, err := runGPG("", "--list-secret-keys", addr)
+	return err == nil
+}
+
+// addresses returns the bare addresses in some headers.
+func (o *outgoing) addresses(hs ...string) []string {
+	var ret []string
+	for _, h := range o.headers {
+		if !isHeader(h.name, hs) || h.value == "" {
+			continue
+		}
+		as, err := mail.ParseAddressList(h.value)
+		if err != nil {
+			continue
+		}
+		for _, a := range as {
+			ret = append(ret, a.Address)
+		}
+	}
+	return ret
+}
+
+// sender returns the address the email is sent from.
+func (o *outgoing) sender() string {
+	if f := o.addresses("From"); len(f) > 0 {
+		return f[0]
+	}
+	return emailAddress
+}
+
+// pgpMissingKeys returns the addresses of an email as written in the editor
+// that it can't be encrypted to. The sender is included, since the sent
+// copy would otherwise be unreadable.
+func pgpMissingKeys(msg string) ([]string, error) {
+	o, err := parseOutgoing(msg)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, a := range append(o.addresses("To", "Cc", "Bcc"), o.sender()) {
+		if !gpgFindKey(a) {
+			missing = append(missing, a)
+		}
+	}
+	return missing, nil
+}
+
+// crlf converts GnuPG output to CRLF line endings.
+func crlf(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// pgpSigned returns content as a multipart/signed entity.
+func pgpSigned(content, sender string) (string, error) {
+	args := []string{"--detach-sign", "--armor", "--digest-algo", "SHA256"}
+	if gpgHasSecretKey(sender) {
+		args = append(args, "--local-user", sender)
+	}
+	sig, err := runGPG(content, args...)
+	if err != nil {
+		return "", err
+	}
+	boundary := multipart.NewWriter(nil).Boundary()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/signed", map[string]string{
+		"boundary": boundary,
+		"micalg":   "pgp-sha256",
+		"protocol": "application/pgp-signature",
+	}))
+	// The signature is over exactly what's between the boundaries,
+	// excluding the CRLF before the second one.
+	fmt.Fprintf(&b, "--%s\r\n%s\r\n--%s\r\n", boundary, content, boundary)
+	b.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP digital signature\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n--%s--\r\n", crlf(sig), boundary)
+	return b.String(), nil
+}
+
+// pgpEncrypted returns content as a multipart/encrypted entity, encrypted
+// to the recipients and the sender. Bcc recipients aren't shown in the
+// encrypted message.
+func pgpEncrypted(content string, o *outgoing, sign bool) (string, error) {
+	sender := o.sender()
+	args := []string{"--encrypt", "--armor", "--recipient", sender}
+	if sign {
+		args = append(args, "--sign")
+		if gpgHasSecretKey(sender) {
+			args = append(args, "--local-user", sender)
+		}
+	}
+	for _, a := range o.addresses("To", "Cc") {
+		args = append(args, "--recipient", a)
+	}
+	for _, a := range o.addresses("Bcc") {
+		args = append(args, "--hidden-recipient", a)
+	}
+	enc, err := runGPG(content, args...)
+	if err != nil {
+		return "", err
+	}
+	boundary := multipart.NewWriter(nil).Boundary()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"boundary": boundary,
+		"protocol": "application/pgp-encrypted",
+	}))
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	b.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	b.WriteString("Version: 1\r\n\r\n")
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	b.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	b.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n--%s--\r\n", crlf(enc), boundary)
+	return b.String(), nil
+}
+
+// composePGPMessage is like composeMessage, but signs and/or encrypts the
+// email with GnuPG, as PGP/MIME.
+func composePGPMessage(msg string, atts []*attachment, mode pgpMode) (string, error) {
+	o, err := parseOutgoing(msg)
+	if err != nil {
+		return "", err
+	}
+	if err := o.validate(); err != nil {
+		return "", err
+	}
+	o.attachments = atts
+	head, err := o.encodeHeaders()
+	if err != nil {
+		return "", err
+	}
+	content, err := o.content(true)
+	if err != nil {
+		return "", err
+	}
+	var body string
+	switch mode {
+	case pgpSign:
+		body, err = pgpSigned(content, o.sender())
+	case pgpEncrypt, pgpSignEncrypt:
+		body, err = pgpEncrypted(content, o, mode == pgpSignEncrypt)
+	default:
+		body = content
+	}
+	if err != nil {
+		return "", err
+	}
+	return head + "MIME-Version: 1.0\r\n" + body, nil
+}
+
+// choosePGPMode asks how to protect an email, and returns the new mode.
+// Encryption is refused if there are recipients without keys.
+func choosePGPMode(msg string, cur pgpMode) pgpMode {
+	var mode pgpMode
+	switch keyMenu([]keyChoice{
+		{'n', "No signing or encryption"},
+		{'s', "Sign"},
+		{'e', "Encrypt"},
+		{'b', "Sign and encrypt"},
+	}) {
+	case 'n':
+		mode = pgpNone
+	case 's':
+		mode = pgpSign
+	case 'e':
+		mode = pgpEncrypt
+	case 'b':
+		mode = pgpSignEncrypt
+	default:
+		return cur
+	}
+	if !mode.encrypt() {
+		return mode
+	}
+	nc.Status("Looking up PGP keys...")
+	missing, err := pgpMissingKeys(msg)
+	if err != nil {
+		nc.Status("[red]Can't encrypt: %v", err)
+		return cur
+	}
+	if len(missing) > 0 {
+		nc.Status("[red]Can't encrypt, no PGP key for: %s", strings.Join(missing, ", "))
+		return cur
+	}
+	nc.Status("[green]PGP keys found for all recipients")
+	return mode
+}
+
+// runPGP composes a PGP/MIME email, letting go of the terminal while GnuPG
+// runs in case it needs to ask for a passphrase.
+func runPGP(msg string, atts []*attachment, mode pgpMode) (string, error) {
+	defer runSomething()()
+	return composePGPMessage(msg, atts, mode)
+}
@@ -0,0 +1,210 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeGPG makes GnuPG calls go to a fake, and returns the prefix of the
+// files where it saves its input.
+func fakeGPG(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cmdg-pgp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *gpg
+	*gpg = "./testdata/gpg_pgpmime.sh"
+	out := path.Join(dir, "gpg")
+	os.Setenv("GPG_FAKE_OUT", out)
+	return out, func() {
+		*gpg = old
+		os.Unsetenv("GPG_FAKE_OUT")
+		os.RemoveAll(dir)
+	}
+}
+
+func readFile(t *testing.T, fn string) string {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// readPGPMessage parses a PGP/MIME message, and returns its media type, parameters and parts.
+func readPGPMessage(t *testing.T, raw string) (*mail.Message, string, map[string]string, [][]byte) {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts [][]byte
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := r.NextRawPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, []byte(p.Header.Get("Content-Type")+"\n"+string(b)))
+	}
+	return m, mt, params, parts
+}
+
+func TestPGPSign(t *testing.T) {
+	out, cleanup := fakeGPG(t)
+	defer cleanup()
+	raw, err := composePGPMessage("From: foo@bar.com\nTo: bar@example.com\nSubject: Signed\n\nTrailing space \nFrom here\n", nil, pgpSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, mt, params, parts := readPGPMessage(t, raw)
+	if got, want := m.Header.Get("Subject"), "Signed"; got != want {
+		t.Errorf("Subject: got %q, want %q", got, want)
+	}
+	if got, want := mt, "multipart/signed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := params["micalg"], "pgp-sha256"; got != want {
+		t.Errorf("micalg: got %q, want %q", got, want)
+	}
+	if got, want := params["protocol"], "application/pgp-signature"; got != want {
+		t.Errorf("protocol: got %q, want %q", got, want)
+	}
+	if got, want := len(parts), 2; got != want {
+		t.Fatalf("got %d parts, want %d", got, want)
+	}
+	if got, want := string(parts[1]), "application/pgp-signature; name=\"signature.asc\"\n-----BEGIN PGP SIGNATURE-----\r\n\r\nc2lnbmF0dXJl\r\n-----END PGP SIGNATURE-----\r\n"; got != want {
+		t.Errorf("signature part: got %q, want %q", got, want)
+	}
+
+	// Exactly the first part is signed.
+	signed := readFile(t, out+".in")
+	b := params["boundary"]
+	if !strings.Contains(raw, "\r\n--"+b+"\r\n"+signed+"\r\n--"+b+"\r\n") {
+		t.Errorf("signed data %q is not the first part of:\n%s", signed, raw)
+	}
+	if got, want := signed, "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nTrailing space=20\r\nFrom here\r\n"; got != want {
+		t.Errorf("signed data: got %q, want %q", got, want)
+	}
+	if got := readFile(t, out+".args"); strings.Contains(got, "--local-user") {
+		t.Errorf("no secret key, but signing with --local-user: %q", got)
+	}
+}
+
+func TestPGPEncrypt(t *testing.T) {
+	out, cleanup := fakeGPG(t)
+	defer cleanup()
+	msg := "From: foo@bar.com\nTo: A <a@example.com>\nCc: b@example.com\nBcc: c@example.com\nSubject: Secret\n\nHello\n"
+	atts := []*attachment{{name: "a.txt", contentType: "text/plain", data: []byte("attached")}}
+	for _, test := range []struct {
+		mode pgpMode
+		sign bool
+	}{
+		{pgpEncrypt, false},
+		{pgpSignEncrypt, true},
+	} {
+		raw, err := composePGPMessage(msg, atts, test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mt, params, parts := readPGPMessage(t, raw)
+		if got, want := mt, "multipart/encrypted"; got != want {
+			t.Errorf("%v: got %q, want %q", test.mode, got, want)
+		}
+		if got, want := params["protocol"], "application/pgp-encrypted"; got != want {
+			t.Errorf("%v: protocol: got %q, want %q", test.mode, got, want)
+		}
+		if got, want := len(parts), 2; got != want {
+			t.Fatalf("%v: got %d parts, want %d", test.mode, got, want)
+		}
+		if got, want := string(parts[0]), "application/pgp-encrypted\nVersion: 1\r\n"; got != want {
+			t.Errorf("%v: got %q, want %q", test.mode, got, want)
+		}
+		if got, want := string(parts[1]), "application/octet-stream; name=\"encrypted.asc\"\n-----BEGIN PGP MESSAGE-----\r\n\r\nZW5jcnlwdGVk\r\n-----END PGP MESSAGE-----\r\n"; got != want {
+			t.Errorf("%v: got %q, want %q", test.mode, got, want)
+		}
+
+		args := strings.Fields(readFile(t, out+".args"))
+		var recipients, hidden []string
+		sign := false
+		for n, a := range args {
+			switch a {
+			case "--recipient":
+				recipients = append(recipients, args[n+1])
+			case "--hidden-recipient":
+				hidden = append(hidden, args[n+1])
+			case "--sign":
+				sign = true
+			}
+		}
+		if got, want := recipients, []string{"foo@bar.com", "a@example.com", "b@example.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: recipients: got %q, want %q", test.mode, got, want)
+		}
+		if got, want := hidden, []string{"c@example.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: hidden recipients: got %q, want %q", test.mode, got, want)
+		}
+		if sign != test.sign {
+			t.Errorf("%v: got sign %v, want %v", test.mode, sign, test.sign)
+		}
+
+		// The whole content is encrypted, with the attachment.
+		in := readFile(t, out+".in")
+		if !strings.HasPrefix(in, "Content-Type: multipart/mixed;") || !strings.Contains(in, "a.txt") {
+			t.Errorf("%v: wrong encrypted content:\n%s", test.mode, in)
+		}
+		if strings.Contains(in, "Secret") {
+			t.Errorf("%v: headers in encrypted content:\n%s", test.mode, in)
+		}
+	}
+}
+
+func TestPGPMissingKeys(t *testing.T) {
+	_, cleanup := fakeGPG(t)
+	defer cleanup()
+	missing, err := pgpMissingKeys("From: foo@bar.com\nTo: a@example.com, nokey@example.com\nBcc: Hidden <nokey2@example.com>\nSubject: x\n\nbody\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := missing, []string{"nokey@example.com", "nokey2@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	missing, err = pgpMissingKeys("From: nokey@bar.com\nTo: a@example.com\n\nbody\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := missing, []string{"nokey@bar.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sender: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+// Reading PGP/MIME (RFC 3156) signed and encrypted email.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// pgpStatus is the result of checking a PGP/MIME email.
+type pgpStatus struct {
+	encrypted bool   // The email is encrypted.
+	decrypted bool   // The email could be decrypted.
+	signed    bool   // There's a signature.
+	good      bool   // The signature is good.
+	trusted   bool   // The signature is made by a trusted key.
+	keyID     string // Key that made the signature.
+	signer    string // User ID of the key that made the signature.
+	problem   string // Why the email couldn't be decrypted or verified.
+
+	// Only the marked part of the email is signed or encrypted. E.g. a
+	// mailing list may have added a footer.
+	partSigned    bool
+	partEncrypted bool
+}
+
+// Put around the part of the shown email that's signed or encrypted, when
+// it's not all of it.
+const (
+	pgpBeginMarker = "----- Begin %s part -----\n"
+	pgpEndMarker   = "\n----- End %s part -----\n"
+)
+
+// String returns the status as shown in the message header area.
+func (s *pgpStatus) String() string {
+	var enc string
+	switch {
+	case s.encrypted && !s.decrypted:
+		return "[red]Encrypted, can't decrypt: " + s.problem
+	case s.encrypted && s.partEncrypted:
+		enc = "Decrypted marked part, "
+	case s.encrypted:
+		enc = "Decrypted, "
+	}
+	var untrusted string
+	if !s.trusted {
+		untrusted = " (untrusted key)"
+	}
+	switch {
+	case !s.signed:
+		return "[red]" + enc + "not signed"
+	case s.good && s.partSigned:
+		return "[red]" + enc + "partially signed by " + s.signer + untrusted + ", only the marked part is covered"
+	case s.good && s.trusted:
+		return "[green]" + enc + "good signature from " + s.signer
+	case s.good:
+		return "[green]" + enc + "good signature from " + s.signer + "[red] (untrusted key)"
+	case s.problem != "":
+		return fmt.Sprintf("[red]%scan't check signature by key %s: %s", enc, s.keyID, s.problem)
+	}
+	return fmt.Sprintf("[red]%sBAD signature by key %s %s", enc, s.keyID, s.signer)
+}
+
+// addStatus reads GnuPG --status-fd output into s.
+func (s *pgpStatus) addStatus(out string) {
+	for _, l := range strings.Split(out, "\n") {
+		f := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(l), "[GNUPG:] "), " ", 3)
+		if len(f) == 0 || !strings.HasPrefix(l, "[GNUPG:] ") {
+			continue
+		}
+		arg := func(n int) string {
+			if len(f) > n {
+				return f[n]
+			}
+			return ""
+		}
+		switch f[0] {
+		case "GOODSIG":
+			s.signed, s.good, s.keyID, s.signer = true, true, arg(1), arg(2)
+		case "BADSIG":
+			s.signed, s.good, s.keyID, s.signer = true, false, arg(1), arg(2)
+		case "EXPKEYSIG", "REVKEYSIG":
+			s.signed, s.good, s.keyID, s.signer = true, false, arg(1), arg(2)
+			s.problem = "key expired or revoked"
+		case "ERRSIG":
+			s.signed, s.keyID = true, arg(1)
+			if s.problem == "" {
+				s.problem = "error checking signature"
+			}
+		case "NO_PUBKEY":
+			s.problem = "public key not found"
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			s.trusted = true
+		case "DECRYPTION_OKAY":
+			s.decrypted = true
+		case "NO_SECKEY":
+			s.problem = "no secret key"
+		case "DECRYPTION_FAILED":
+			if s.problem == "" {
+				s.problem = "decryption failed"
+			}
+		}
+	}
+}
+
+// canonicalCRLF makes all line endings CRLF, which is the form signatures are made over.
+func canonicalCRLF(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// splitEntity splits a MIME entity into header and body.
+func splitEntity(entity string) (textproto.MIMEHeader, string, error) {
+	body := ""
+	head := entity
+	if strings.HasPrefix(entity, "\r\n") {
+		head, body = "", entity[2:]
+	} else if n := strings.Index(entity, "\r\n\r\n"); n >= 0 {
+		head, body = entity[:n+2], entity[n+4:]
+	}
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(head + "\r\n"))).ReadMIMEHeader()
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing MIME headers: %v", err)
+	}
+	return h, body, nil
+}
+
+// splitMultipart returns the exact contents of each part of a multipart
+// body, as needed for checking signatures (RFC 2046 section 5.1.1).
+func splitMultipart(body, boundary string) ([]string, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("multipart without boundary")
+	}
+	delim := "\r\n--" + boundary
+	rest := "\r\n" + body // The first delimiter may be at the very start.
+	n := strings.Index(rest, delim)
+	if n < 0 {
+		return nil, fmt.Errorf("multipart boundary not found")
+	}
+	rest = rest[n+len(delim):]
+	var parts []string
+	for !strings.HasPrefix(rest, "--") {
+		// Skip to end of delimiter line.
+		n := strings.Index(rest, "\r\n")
+		if n < 0 {
+			return nil, fmt.Errorf("multipart delimiter line not terminated")
+		}
+		rest = rest[n+2:]
+		n = strings.Index(rest, delim)
+		if n < 0 {
+			return nil, fmt.Errorf("multipart not terminated")
+		}
+		parts = append(parts, rest[:n])
+		rest = rest[n+len(delim):]
+	}
+	return parts, nil
+}
+
+// hasText returns true if a MIME entity has text that's shown as part of
+// the email body, as opposed to attachments.
+func hasText(entity string) bool {
+	h, body, err := splitEntity(entity)
+	if err != nil {
+		return true
+	}
+	if d, dp, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && (d == "attachment" || dp["filename"] != "") {
+		return false
+	}
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// Default is text/plain.
+		return true
+	}
+	if !strings.HasPrefix(mt, "multipart/") {
+		return strings.HasPrefix(mt, "text/") && params["name"] == ""
+	}
+	parts, err := splitMultipart(body, params["boundary"])
+	if err != nil {
+		return true
+	}
+	for _, p := range parts {
+		if hasText(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// findPGPEntity returns the first multipart/signed or multipart/encrypted
+// entity in a MIME entity, and its media type. If there's text outside of
+// it that would be shown in the body, partial is true.
+func findPGPEntity(entity string) (string, string, bool, error) {
+	h, body, err := splitEntity(entity)
+	if err != nil {
+		return "", "", false, err
+	}
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") {
+		return "", "", false, nil
+	}
+	if mt == "multipart/signed" || mt == "multipart/encrypted" {
+		return entity, mt, false, nil
+	}
+	parts, err := splitMultipart(body, params["boundary"])
+	if err != nil {
+		return "", "", false, err
+	}
+	for i, p := range parts {
+		e, mt, partial, err := findPGPEntity(p)
+		if err != nil {
+			return "", "", false, err
+		}
+		if mt == "" {
+			continue
+		}
+		for j, o := range parts {
+			if j != i && hasText(o) {
+				partial = true
+			}
+		}
+		return e, mt, partial, nil
+	}
+	return "", "", false, nil
+}
+
+// pgpParts returns the two parts of a multipart/signed or multipart/encrypted entity.
+func pgpParts(entity string) (string, string, error) {
+	h, body, err := splitEntity(entity)
+	if err != nil {
+		return "", "", err
+	}
+	_, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return "", "", err
+	}
+	parts, err := splitMultipart(body, params["boundary"])
+	if err != nil {
+		return "", "", err
+	}
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("got %d parts, want 2", len(parts))
+	}
+	return parts[0], parts[1], nil
+}
+
+// pgpVerify checks a multipart/signed entity. If download is set, a
+// missing key is downloaded, and the check redone.
+func pgpVerify(entity string, download bool) *pgpStatus {
+	s := &pgpStatus{signed: true}
+	signed, sigPart, err := pgpParts(entity)
+	if err != nil {
+		s.problem = err.Error()
+		return s
+	}
+	_, sig, err := splitEntity(sigPart)
+	if err != nil {
+		s.problem = err.Error()
+		return s
+	}
+	f, err := ioutil.TempFile("", "cmdg-sig-")
+	if err != nil {
+		s.problem = err.Error()
+		return s
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte(sig)); err != nil {
+		f.Close()
+		s.problem = err.Error()
+		return s
+	}
+	if err := f.Close(); err != nil {
+		s.problem = err.Error()
+		return s
+	}
+	_, status, err := runGPGStatus(signed, "--verify", f.Name(), "-")
+	s.addStatus(status)
+	if !s.good && s.problem == "public key not found" && download {
+		downloadKey(s.keyID)
+		return pgpVerify(entity, false)
+	}
+	if !s.good && s.problem == "" && s.signer == "" && err != nil {
+		s.problem = err.Error()
+	}
+	return s
+}
+
+// pgpDecrypt decrypts a multipart/encrypted entity, returning the
+// decrypted content, or nil if it couldn't be decrypted. If it was signed
+// before encrypting, the signature is checked.
+func pgpDecrypt(entity string, download bool) (*pgpStatus, *gmail.MessagePart, error) {
+	s := &pgpStatus{encrypted: true}
+	_, encPart, err := pgpParts(entity)
+	if err != nil {
+		s.problem = err.Error()
+		return s, nil, nil
+	}
+	_, enc, err := splitEntity(encPart)
+	if err != nil {
+		s.problem = err.Error()
+		return s, nil, nil
+	}
+	dec, status, err := runGPGStatus(enc, "--decrypt")
+	s.addStatus(status)
+	if !s.decrypted {
+		if s.problem == "" && err != nil {
+			s.problem = err.Error()
+		}
+		return s, nil, nil
+	}
+	dec = canonicalCRLF(dec)
+
+	// Signed, then encrypted (RFC 3156 section 6.1).
+	if inner, mt, partial, err := findPGPEntity(dec); err == nil && mt == "multipart/signed" && !s.signed {
+		v := pgpVerify(inner, download)
+		v.encrypted, v.decrypted = true, true
+		if signed, _, err := pgpParts(inner); err == nil {
+			c, err := mimePart(signed)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !partial {
+				return v, c, nil
+			}
+			v.partSigned = true
+			p, err := markedPart(dec, inner, c, "signed")
+			return v, p, err
+		}
+	}
+	p, err := mimePart(dec)
+	return s, p, err
+}
+
+// decodeTransfer undoes a Content-Transfer-Encoding.
+func decodeTransfer(body, enc string) (string, error) {
+	switch strings.ToLower(enc) {
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+		return string(b), err
+	case "quoted-printable":
+		b, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+		return string(b), err
+	}
+	return body, nil
+}
+
+// mimePart parses a MIME entity into a MessagePart, like the Gmail API
+// would. Used for showing decrypted email.
+func mimePart(entity string) (*gmail.MessagePart, error) {
+	return mimePartReplace(entity, "", nil)
+}
+
+// textPart returns a text/plain MessagePart.
+func textPart(s string) *gmail.MessagePart {
+	return &gmail.MessagePart{
+		MimeType: "text/plain",
+		Headers:  []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "text/plain; charset=utf-8"}},
+		Body:     &gmail.MessagePartBody{Data: mimeEncode(s), Size: int64(len(s))},
+	}
+}
+
+// markedPart parses a MIME entity like mimePart, but with the signed or
+// encrypted entity old replaced by its content covered, between markers.
+func markedPart(entity, old string, covered *gmail.MessagePart, what string) (*gmail.MessagePart, error) {
+	return mimePartReplace(entity, old, &gmail.MessagePart{
+		MimeType: "multipart/mixed",
+		Body:     &gmail.MessagePartBody{},
+		Parts: []*gmail.MessagePart{
+			textPart(fmt.Sprintf(pgpBeginMarker, what)),
+			covered,
+			textPart(fmt.Sprintf(pgpEndMarker, what)),
+		},
+	})
+}
+
+// mimePartReplace parses a MIME entity like mimePart, but with the entity
+// old replaced by the already parsed part with.
+func mimePartReplace(entity, old string, with *gmail.MessagePart) (*gmail.MessagePart, error) {
+	if with != nil && entity == old {
+		return with, nil
+	}
+	h, body, err := splitEntity(entity)
+	if err != nil {
+		return nil, err
+	}
+	p := &gmail.MessagePart{MimeType: "text/plain", Body: &gmail.MessagePartBody{}}
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			p.Headers = append(p.Headers, &gmail.MessagePartHeader{Name: k, Value: v})
+		}
+	}
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil {
+		p.MimeType = mt
+	}
+	if _, dp, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+		p.Filename = dp["filename"]
+	}
+	if strings.HasPrefix(p.MimeType, "multipart/") {
+		parts, err := splitMultipart(body, params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range parts {
+			c, err := mimePartReplace(e, old, with)
+			if err != nil {
+				return nil, err
+			}
+			p.Parts = append(p.Parts, c)
+		}
+		return p, nil
+	}
+	data, err := decodeTransfer(body, h.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	p.Body.Data = mimeEncode(data)
+	p.Body.Size = int64(len(data))
+	return p, nil
+}
+
+// pgpResult is what's known about a PGP/MIME email.
+type pgpResult struct {
+	status  *pgpStatus
+	payload *gmail.MessagePart // Decrypted content, or nil.
+}
+
+// pgpCheck verifies and/or decrypts a raw email.
+func pgpCheck(raw string, download bool) (*pgpResult, error) {
+	raw = canonicalCRLF(raw)
+	entity, mt, partial, err := findPGPEntity(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch mt {
+	case "multipart/signed":
+		r := &pgpResult{status: pgpVerify(entity, download)}
+		if !partial {
+			// Shown as is.
+			return r, nil
+		}
+		r.status.partSigned = true
+		signed, _, err := pgpParts(entity)
+		if err != nil {
+			return r, nil
+		}
+		c, err := mimePart(signed)
+		if err == nil {
+			r.payload, err = markedPart(raw, entity, c, "signed")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing signed email: %v", err)
+		}
+		return r, nil
+	case "multipart/encrypted":
+		s, dec, err := pgpDecrypt(entity, download)
+		if err != nil {
+			return nil, fmt.Errorf("parsing decrypted email: %v", err)
+		}
+		r := &pgpResult{status: s, payload: dec}
+		if dec != nil && partial {
+			s.partEncrypted, s.partSigned = true, s.signed
+			if r.payload, err = markedPart(raw, entity, dec, "encrypted"); err != nil {
+				return nil, fmt.Errorf("parsing decrypted email: %v", err)
+			}
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("not a PGP/MIME email")
+}
+
+// isPGPMIME returns true if the email has a PGP/MIME signed or encrypted part.
+func isPGPMIME(m *gmail.Message) bool {
+	if m.Payload == nil {
+		return false
+	}
+	for _, p := range partTree(m) {
+		if p.part.MimeType == "multipart/signed" || p.part.MimeType == "multipart/encrypted" {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// PGP/MIME results by message ID, so they're only checked once.
+	pgpResultsMutex sync.Mutex
+	pgpResults      = make(map[string]*pgpResult)
+)
+
+// getPGPStatus returns the PGP/MIME status of an email, or nil if not checked.
+func getPGPStatus(id string) *pgpStatus {
+	pgpResultsMutex.Lock()
+	defer pgpResultsMutex.Unlock()
+	if r, found := pgpResults[id]; found {
+		return r.status
+	}
+	return nil
+}
+
+// replyPGPMode returns the PGP mode to start with when replying to, or
+// forwarding, m.
+func replyPGPMode(m *gmail.Message) pgpMode {
+	if s := getPGPStatus(m.Id); s != nil && s.decrypted {
+		return pgpEncrypt
+	}
+	return pgpNone
+}
+
+// pgpMessage checks signatures on, and decrypts, an email if it's
+// PGP/MIME. Returns the email to show, which is a decrypted copy if it
+// could be decrypted. If recheck is set the check is redone, and missing
+// keys downloaded.
+func pgpMessage(m *gmail.Message, recheck bool) (*gmail.Message, error) {
+	if !isPGPMIME(m) {
+		return m, nil
+	}
+	pgpResultsMutex.Lock()
+	r, found := pgpResults[m.Id]
+	pgpResultsMutex.Unlock()
+	if !found || recheck {
+		rm, err := mailBackend.GetMessage(m.Id, "raw")
+		if err != nil {
+			return m, err
+		}
+		raw, err := mimeDecode(rm.Raw)
+		if err != nil {
+			return m, err
+		}
+		if r, err = pgpCheck(raw, recheck); err != nil {
+			return m, err
+		}
+		pgpResultsMutex.Lock()
+		pgpResults[m.Id] = r
+		pgpResultsMutex.Unlock()
+	}
+	if r.payload == nil {
+		return m, nil
+	}
+	c := *m
+	p := *r.payload
+	// The decrypted part only describes the content. Anything else in it
+	// isn't what the email was sent with.
+	p.Headers = nil
+	for _, h := range m.Payload.Headers {
+		if !isContentHeader(h.Name) {
+			p.Headers = append(p.Headers, h)
+		}
+	}
+	for _, h := range r.payload.Headers {
+		if isContentHeader(h.Name) {
+			p.Headers = append(p.Headers, h)
+		}
+	}
+	c.Payload = &p
+	return &c, nil
+}
+
+// isContentHeader returns true for MIME headers that describe the content
+// of an entity.
+func isContentHeader(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "content-")
+}
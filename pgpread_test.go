@@ -0,0 +1,350 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/ncwrap"
+)
+
+func TestSplitMultipart(t *testing.T) {
+	body := "preamble\r\n--b\r\nContent-Type: text/plain\r\n\r\none\r\n\r\n--b  \r\n\r\ntwo--b\r\n--b--\r\nepilogue\r\n"
+	got, err := splitMultipart(body, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Content-Type: text/plain\r\n\r\none\r\n", "\r\ntwo--b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, body := range []string{"no boundary", "--b\r\nnot terminated", "--b"} {
+		if _, err := splitMultipart(body, "b"); err == nil {
+			t.Errorf("%q: want error", body)
+		}
+	}
+}
+
+func TestPGPVerifyMIME(t *testing.T) {
+	out, cleanup := fakeGPG(t)
+	defer cleanup()
+	for _, test := range []struct {
+		body string
+		want string
+	}{
+		{"Hello\n", "[green]good signature from Foo <foo@bar.com>"},
+		{"Hello, tampered\n", "[red]BAD signature by key 0123456789ABCDEF Foo <foo@bar.com>"},
+		{"Hello, unknownkey\n", "[red]can't check signature by key FEDCBA9876543210: public key not found"},
+	} {
+		raw, err := composePGPMessage("From: foo@bar.com\nTo: bar@example.com\nSubject: Signed\n\n"+test.body, nil, pgpSign)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Line endings may have been changed on the way.
+		for _, raw := range []string{raw, strings.Replace(raw, "\r\n", "\n", -1)} {
+			r, err := pgpCheck(raw, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.status.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if r.payload != nil {
+				t.Errorf("got payload for signed email")
+			}
+			if got, want := readFile(t, out+".verified"), readFile(t, out+".in"); got != want {
+				t.Errorf("verified %q, but signed %q", got, want)
+			}
+		}
+	}
+
+	// Signed part inside another multipart, e.g. by a mailing list adding a footer.
+	raw, err := composePGPMessage("To: bar@example.com\nSubject: Signed\n\nHello\n", nil, pgpSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := strings.Index(raw, "Content-Type: multipart/signed")
+	raw = raw[:n] + "Content-Type: multipart/mixed; boundary=list\r\n\r\n--list\r\n" + raw[n:] + "\r\n--list\r\nContent-Type: text/plain\r\n\r\nList footer\r\n--list--\r\n"
+	r, err := pgpCheck(raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[red]partially signed by Foo <foo@bar.com>, only the marked part is covered"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.payload == nil {
+		t.Fatal("no payload with marked signed part")
+	}
+	if got, want := getBody(&gmail.Message{Payload: r.payload}), "----- Begin signed part -----\nHello\r\n\n----- End signed part -----\nList footer"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	// Only attachments outside the signed part.
+	raw = strings.Replace(raw, "Content-Type: text/plain\r\n\r\nList footer", "Content-Type: text/plain\r\nContent-Disposition: attachment; filename=foo.txt\r\n\r\nAttached", 1)
+	if r, err = pgpCheck(raw, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[green]good signature from Foo <foo@bar.com>"; got != want {
+		t.Errorf("with attachment got %q, want %q", got, want)
+	}
+	if r.payload != nil {
+		t.Errorf("got payload for signed email with attachment")
+	}
+
+	if _, err := pgpCheck("Subject: x\r\n\r\nNot PGP/MIME\r\n", false); err == nil {
+		t.Errorf("want error checking non-PGP/MIME email")
+	}
+}
+
+func TestPGPDecryptMIME(t *testing.T) {
+	_, cleanup := fakeGPG(t)
+	defer cleanup()
+	msg := "From: foo@bar.com\nTo: bar@example.com\nSubject: Secret\n\nSecret body\n"
+	atts := []*attachment{{name: "secret.bin", contentType: "application/octet-stream", data: []byte("attached secret")}}
+	raw, err := composePGPMessage(msg, atts, pgpEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := pgpCheck(raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[red]Decrypted, not signed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.payload == nil {
+		t.Fatal("no decrypted payload")
+	}
+	m := &gmail.Message{Payload: r.payload}
+	if got, want := getBody(m), "Secret body"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	var found bool
+	for _, p := range partTree(m) {
+		if p.part.Filename != "secret.bin" {
+			continue
+		}
+		found = true
+		if got, err := mimeDecode(p.part.Body.Data); err != nil || got != "attached secret" {
+			t.Errorf("attachment: got %q, %v", got, err)
+		}
+	}
+	if !found {
+		t.Errorf("decrypted attachment not found")
+	}
+
+	// Encrypted part inside another multipart.
+	n := strings.Index(raw, "Content-Type: multipart/encrypted")
+	nested := raw[:n] + "Content-Type: multipart/mixed; boundary=list\r\n\r\n--list\r\n" + raw[n:] + "\r\n--list\r\nContent-Type: text/plain\r\n\r\nList footer\r\n--list--\r\n"
+	if r, err = pgpCheck(nested, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[red]Decrypted marked part, not signed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := getBody(&gmail.Message{Payload: r.payload}), "----- Begin encrypted part -----\nSecret body\r\n\n----- End encrypted part -----\nList footer"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	// Can't decrypt.
+	r, err = pgpCheck(strings.Replace(raw, "ZW5jcnlwdGVk", "b3RoZXI=", -1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[red]Encrypted, can't decrypt: no secret key"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.payload != nil {
+		t.Errorf("got payload for undecryptable email")
+	}
+}
+
+func TestPGPDecryptSignedMIME(t *testing.T) {
+	out, cleanup := fakeGPG(t)
+	defer cleanup()
+	// Signed, then encrypted.
+	signed, err := composePGPMessage("To: bar@example.com\n\nSigned secret\n", nil, pgpSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := strings.Index(signed, "Content-Type: multipart/signed")
+	raw, err := composePGPMessage("To: bar@example.com\nSubject: Secret\n\nplaceholder\n", nil, pgpEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What's decrypted is what was last encrypted.
+	if err := ioutil.WriteFile(out+".in", []byte(signed[n:]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := pgpCheck(raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.status.String(), "[green]Decrypted, good signature from Foo <foo@bar.com>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := getBody(&gmail.Message{Payload: r.payload}), "Signed secret"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+}
+
+func TestPGPMessage(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	_, cleanup := fakeGPG(t)
+	defer cleanup()
+	pgpResults = make(map[string]*pgpResult)
+	raw, err := composePGPMessage("From: foo@bar.com\nTo: foo@bar.com\nSubject: Signed\nDate: Mon, 1 Jan 2016 15:04:05 +0000\n\nHello\n", nil, pgpSign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := f.AddMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := f.AddMessage(fakeMessage(1, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mailBackend.GetMessage(plain.Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isPGPMIME(m) {
+		t.Errorf("plain email is PGP/MIME")
+	}
+	if got, err := pgpMessage(m, false); err != nil || got != m {
+		t.Errorf("plain email changed: %v", err)
+	}
+	if s := getPGPStatus(m.Id); s != nil {
+		t.Errorf("plain email got status %s", s)
+	}
+
+	m, err = mailBackend.GetMessage(signed.Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPGPMIME(m) {
+		t.Fatalf("signed email not PGP/MIME")
+	}
+	if got, want := getBody(m), "Hello"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+	if getPGPStatus(m.Id) != nil {
+		t.Errorf("status before check")
+	}
+	if _, err := pgpMessage(m, false); err != nil {
+		t.Fatal(err)
+	}
+	if s := getPGPStatus(m.Id); s == nil || !s.good {
+		t.Fatalf("got status %v, want good", s)
+	}
+	if got, want := replyPGPMode(m), pgpNone; got != want {
+		t.Errorf("reply to signed email: got %v, want %v", got, want)
+	}
+
+	// Only checked once.
+	before := f.Requests("GET", "messages/")
+	if _, err := pgpMessage(m, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Requests("GET", "messages/") - before; got != 0 {
+		t.Errorf("got %d requests for checked email, want none", got)
+	}
+
+	// Shown in the header area.
+	s := startHeadless(t)
+	defer stopHeadless()
+	nc.ApplyMain(func(w ncwrap.Window) {
+		openMessagePrint(w, []*gmail.Message{m}, 0, false, "", 0)
+	})
+	if got, want := s.Line(7), "PGP: good signature from Foo <foo@bar.com>"; !strings.HasPrefix(got, want) {
+		t.Errorf("got line %q, want %q", got, want)
+	}
+}
+
+func TestPGPMessageHeaders(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	out, cleanup := fakeGPG(t)
+	defer cleanup()
+	pgpResults = make(map[string]*pgpResult)
+	raw, err := composePGPMessage("From: foo@bar.com\nTo: foo@bar.com\nSubject: Secret\nDate: Mon, 1 Jan 2016 15:04:05 +0000\n\nplaceholder\n", nil, pgpEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What's decrypted is what was last encrypted.
+	if err := ioutil.WriteFile(out+".in", []byte("From: evil@example.com\r\nSubject: Spoofed\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nSecret body\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := f.AddMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mailBackend.GetMessage(enc.Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := pgpMessage(m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []struct {
+		name, want string
+	}{
+		{"From", "<foo@bar.com>"},
+		{"Subject", "Secret"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+	} {
+		var got []string
+		for _, ph := range d.Payload.Headers {
+			if ph.Name == h.name {
+				got = append(got, ph.Value)
+			}
+		}
+		if want := []string{h.want}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", h.name, got, want)
+		}
+	}
+	if got, want := getBody(d), "Secret body"; got != want {
+		t.Errorf("body: got %q, want %q", got, want)
+	}
+
+	// Replies quote the decrypted text, so are encrypted too.
+	if got, want := replyPGPMode(d), pgpEncrypt; got != want {
+		t.Errorf("reply mode: got %v, want %v", got, want)
+	}
+	s := startHeadless(t)
+	defer stopHeadless()
+	done := make(chan error)
+	go func() { done <- createReply(d, "To: foo@bar.com\nSubject: Re: Secret\n\n> Secret body\n", nil) }()
+	if !s.WaitFor("PGP: "+pgpEncrypt.String(), 5*time.Second) {
+		t.Errorf("reply not encrypted. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'a'
+	if got, want := <-done, errAborted; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
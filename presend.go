@@ -0,0 +1,182 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Gmail refuses to send emails bigger than this. Variable for tests.
+var maxSendSize = 25 << 20
+
+const (
+	// Pre-send hooks taking longer than this are killed, and stop the sending.
+	hookTimeout = 30 * time.Second
+
+	// Exit codes of pre-send hooks.
+	hookWarn = 1
+	hookVeto = 2
+)
+
+// Words in the body that suggest there should be an attachment.
+var attachRE = regexp.MustCompile(`(?i)\battach(ed|ing|ment|ments)?\b`)
+
+// sendProblem is something wrong with an email about to be sent.
+type sendProblem struct {
+	check string // Built-in check or hook that found it.
+	text  string
+	veto  bool // Email can't be sent.
+}
+
+func (p sendProblem) String() string {
+	return p.check + ": " + p.text
+}
+
+// preSendChecks runs the built-in checks and the pre-send hooks on an email
+// as written in the editor, and returns the problems found. The size check
+// and hooks are only run if the email can be composed.
+func preSendChecks(msg string, atts []*attachment) []sendProblem {
+	o, err := parseOutgoing(msg)
+	if err != nil {
+		return []sendProblem{{"format", err.Error(), true}}
+	}
+	var ps []sendProblem
+	if o.get("Subject") == "" {
+		ps = append(ps, sendProblem{"subject", "subject is empty", false})
+	}
+	if len(atts) == 0 && mentionsAttachment(o.body) {
+		ps = append(ps, sendProblem{"attachment", "mentions an attachment, but nothing is attached", false})
+	}
+	badAddress := false
+	for _, h := range o.headers {
+		if !isHeader(h.name, []string{"To", "Cc", "Bcc"}) || h.value == "" {
+			continue
+		}
+		if _, err := mail.ParseAddressList(h.value); err != nil {
+			ps = append(ps, sendProblem{"recipients", fmt.Sprintf("can't parse %s %q: %v", h.name, h.value, err), true})
+			badAddress = true
+		}
+	}
+	if badAddress {
+		return ps
+	}
+	raw, err := composeMessage(msg, atts)
+	if err != nil {
+		return append(ps, sendProblem{"format", err.Error(), true})
+	}
+	if len(raw) > maxSendSize {
+		ps = append(ps, sendProblem{"size", fmt.Sprintf("email is %s, more than the limit of %s", sizeString(len(raw)), sizeString(maxSendSize)), true})
+	}
+	return append(ps, runPreSendHooks(raw)...)
+}
+
+// mentionsAttachment returns true if the body, not counting quoted text,
+// talks about an attachment.
+func mentionsAttachment(body string) bool {
+	for _, l := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(l, ">") && attachRE.MatchString(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// runPreSendHooks runs the hooks in -presend_hooks on a composed email, and
+// returns the problems they found. A hook that fails to run stops the
+// sending, since it may be there to keep things from leaking.
+func runPreSendHooks(raw string) []sendProblem {
+	var ps []sendProblem
+	for _, h := range strings.Split(*preSendHooks, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if p := runPreSendHook(h, raw); p != nil {
+			ps = append(ps, *p)
+		}
+	}
+	return ps
+}
+
+// runPreSendHook runs one pre-send hook, and returns the problem it found, if any.
+func runPreSendHook(hook, raw string) *sendProblem {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = strings.NewReader(raw)
+	out, err := cmd.Output()
+	if err == nil {
+		return nil
+	}
+	text := strings.TrimSpace(string(out))
+	log.Printf("Pre-send hook %q: %v: %q", hook, err, text)
+	if i := strings.Index(text, "\n"); i >= 0 {
+		text = text[:i]
+	}
+	p := &sendProblem{check: path.Base(hook), text: text, veto: true}
+	if e, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		switch e.ExitCode() {
+		case hookWarn:
+			p.veto = false
+			fallthrough
+		case hookVeto:
+			if p.text == "" {
+				p.text = "no reason given"
+			}
+			return p
+		}
+	}
+	p.text = fmt.Sprintf("failed to run: %v", err)
+	return p
+}
+
+// preSendOK runs the pre-send checks, and returns true if the email should
+// be sent. Warnings are shown for the user to confirm, and a veto means
+// going back to the send menu.
+func preSendOK(msg string, atts []*attachment) bool {
+	nc.Status("Checking email before sending...")
+	ps := preSendChecks(msg, atts)
+	if len(ps) == 0 {
+		return true
+	}
+	var summary []string
+	veto := false
+	for _, p := range ps {
+		summary = append(summary, p.String())
+		veto = veto || p.veto
+	}
+	if veto {
+		nc.Status("[red]Not sending, email failed checks")
+		keyMenuSummary(summary, []keyChoice{{'b', "Back"}})
+		return false
+	}
+	nc.Status("OK")
+	return keyMenuSummary(summary, []keyChoice{
+		{'s', "Send anyway"},
+		{'b', "Back"},
+	}) == 's'
+}
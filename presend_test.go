@@ -0,0 +1,147 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreSendChecks(t *testing.T) {
+	defer func(h string) { *preSendHooks = h }(*preSendHooks)
+	defer func(n int) { maxSendSize = n }(maxSendSize)
+	maxSendSize = 10 << 10
+	file := []*attachment{{name: "a.txt", contentType: "text/plain", data: []byte("a")}}
+	for _, test := range []struct {
+		name  string
+		msg   string
+		atts  []*attachment
+		hooks string
+		want  []sendProblem
+	}{
+		{
+			name: "OK",
+			msg:  "To: foo@example.com\nSubject: Hi\n\nHello.\n",
+		},
+		{
+			name: "empty subject",
+			msg:  "To: foo@example.com\nSubject: \n\nHello.\n",
+			want: []sendProblem{{"subject", "subject is empty", false}},
+		},
+		{
+			name: "attachment mentioned",
+			msg:  "To: foo@example.com\nSubject: Hi\n\nReport attached.\n",
+			want: []sendProblem{{"attachment", "mentions an attachment, but nothing is attached", false}},
+		},
+		{
+			name: "attachment mentioned and attached",
+			msg:  "To: foo@example.com\nSubject: Hi\n\nReport attached.\n",
+			atts: file,
+		},
+		{
+			name: "attachment mentioned only in quote",
+			msg:  "To: foo@example.com\nSubject: Hi\n\nThanks!\n\n> See the attachment.\n",
+		},
+		{
+			name: "unparsable recipient",
+			msg:  "To: foo@example.com\nCc: <<bar\nSubject: Hi\n\nHello.\n",
+			want: []sendProblem{{"recipients", `can't parse Cc "<<bar": mail: invalid string`, true}},
+		},
+		{
+			name: "oversize",
+			msg:  "To: foo@example.com\nSubject: Hi\n\nHello.\n",
+			atts: []*attachment{{name: "big.bin", contentType: "application/octet-stream", data: make([]byte, maxSendSize)}},
+			want: []sendProblem{{"size", "email is 14.3 KiB, more than the limit of 10.0 KiB", true}},
+		},
+		{
+			name:  "hooks",
+			msg:   "To: foo@example.com\nSubject: Hi\n\nHello, this is CONFIDENTIAL.\n",
+			hooks: "./testdata/presend_warn.sh, ./testdata/presend_dlp.sh",
+			want: []sendProblem{
+				{"presend_warn.sh", "Possible misspelling: teh", false},
+				{"presend_dlp.sh", "Confidential content, not sending", true},
+			},
+		},
+		{
+			name:  "hook allows",
+			msg:   "To: foo@example.com\nSubject: Hi\n\nHello.\n",
+			hooks: "./testdata/presend_dlp.sh",
+		},
+		{
+			name:  "missing hook",
+			msg:   "To: foo@example.com\nSubject: Hi\n\nHello.\n",
+			hooks: "./testdata/nonexistent.sh",
+			want:  []sendProblem{{"nonexistent.sh", "failed to run: fork/exec ./testdata/nonexistent.sh: no such file or directory", true}},
+		},
+	} {
+		*preSendHooks = test.hooks
+		got := preSendChecks(test.msg, test.atts)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for n := range got {
+			if got[n] != test.want[n] {
+				t.Errorf("%s: problem %d: got %+v, want %+v", test.name, n, got[n], test.want[n])
+			}
+		}
+	}
+}
+
+func TestPreSendMenu(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t)()
+	defer func(h string) { *preSendHooks = h }(*preSendHooks)
+	*preSendHooks = "./testdata/presend_dlp.sh"
+	s := startHeadless(t)
+	defer stopHeadless()
+
+	// Vetoed, so back to the menu and abort.
+	go func() {
+		nc.Input <- 's'
+		if !s.WaitFor("Confidential content", 5*time.Second) {
+			t.Errorf("veto not shown. Screen:\n%s", s.Contents())
+		}
+		nc.Input <- 'b'
+		nc.Input <- 'a'
+	}()
+	if got, want := sendMenu("", "", "Abort", "To: foo@example.com\nSubject: Hi\n\nCONFIDENTIAL\n", nil), errAborted; got != want {
+		t.Errorf("vetoed: got %v, want %v", got, want)
+	}
+
+	// Warned, but sent anyway.
+	go func() {
+		nc.Input <- 's'
+		if !s.WaitFor("Send anyway", 5*time.Second) {
+			t.Errorf("warning not shown. Screen:\n%s", s.Contents())
+		}
+		if !strings.Contains(s.Contents(), "subject is empty") {
+			t.Errorf("empty subject not warned about. Screen:\n%s", s.Contents())
+		}
+		nc.Input <- 's'
+	}()
+	if err := sendMenu("", "", "Abort", "To: foo@example.com\nSubject: \n\nHello.\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("sent %d emails, want %d", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	gc "github.com/rthornton128/goncurses"
+
+	"github.com/ThomasHabets/cmdg/ncwrap"
+)
+
+// Headers that recipientsDialog fills in, in order.
+var recipientHeaders = []string{"To", "Cc", "Bcc"}
+
+// recipients are the addresses of an email being composed, one list per
+// header in recipientHeaders.
+type recipients [3][]string
+
+// headers returns the recipients as header lines for the editor.
+func (r *recipients) headers() string {
+	var ret string
+	for n, h := range recipientHeaders {
+		ret += fmt.Sprintf("%s: %s\n", h, strings.Join(r[n], ", "))
+	}
+	return ret
+}
+
+// has returns true if the address is already a recipient.
+func (r *recipients) has(addr string) bool {
+	for _, as := range r {
+		for _, a := range as {
+			if strings.EqualFold(a, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recipientsDialog asks for To, Cc and Bcc addresses, completing them from
+// candidates, which are best first. Returns nil if the user cancels.
+func recipientsDialog(candidates []string) *recipients {
+	maxY, maxX := winSize()
+	w, err := nc.NewWindow(maxY-5, maxX-4, 2, 2)
+	if err != nil {
+		log.Fatalf("Creating recipients window: %v", err)
+	}
+	defer w.Delete()
+
+	r := &recipients{}
+	field := 0
+	s := ""
+	cur := -1
+	for {
+		w.Clear()
+		w.Print("\n")
+		for n, h := range recipientHeaders {
+			prefix := " "
+			if n == field {
+				prefix = ">[bold]"
+			}
+			ncwrap.ColorPrint(w, " %s%-4s %s[unbold]\n", ncwrap.Preformat(prefix), h+":", ncwrap.Preformat(strings.Join(r[n], ", ")))
+		}
+		w.Print("\n Enter adds address, or is done if empty. Tab switches header.\n\n")
+		w.Print(fmt.Sprintf(" %s> %s\n", recipientHeaders[field], s))
+		var matches []string
+		for _, c := range candidates {
+			if r.has(c) || !strings.Contains(strings.ToLower(c), strings.ToLower(s)) {
+				continue
+			}
+			prefix := " "
+			if len(matches) == cur {
+				prefix = ">[bold]"
+			}
+			ncwrap.ColorPrint(w, "  %s%s[unbold]\n", ncwrap.Preformat(prefix), ncwrap.Preformat(c))
+			matches = append(matches, c)
+			if y, _ := w.MaxYX(); len(matches) >= y-10 {
+				break
+			}
+		}
+		w.Border()
+		w.Refresh()
+		key := <-nc.Input
+		switch key {
+		case ctrlC, ctrlG:
+			return nil
+		case '\t':
+			field = (field + 1) % len(recipientHeaders)
+		case '\b', gc.KEY_BACKSPACE, 127:
+			if s == "" {
+				if as := r[field]; len(as) > 0 {
+					r[field] = as[:len(as)-1]
+				}
+				break
+			}
+			rs := []rune(s)
+			s = string(rs[:len(rs)-1])
+			if s == "" {
+				cur = -1
+			}
+		case gc.KEY_DOWN, ctrlN:
+			if cur < len(matches)-1 {
+				cur++
+			}
+		case gc.KEY_UP, ctrlP:
+			if cur > 0 {
+				cur--
+			}
+		case ctrlU:
+			s = ""
+			cur = -1
+		case '\n', '\r':
+			var addr string
+			switch {
+			case cur >= 0 && cur < len(matches):
+				addr = matches[cur]
+			case s != "":
+				// Write-in.
+				addr = strings.TrimSpace(s)
+			default:
+				return r
+			}
+			if addr != "" && !r.has(addr) {
+				r[field] = append(r[field], addr)
+			}
+			s = ""
+			cur = -1
+		default:
+			// Curses key codes, like arrow keys and resize, aren't text.
+			if key < 256 && unicode.IsPrint(rune(key)) {
+				s = fmt.Sprintf("%s%c", s, key)
+				cur = 0
+			}
+		}
+	}
+}
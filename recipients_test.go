@@ -0,0 +1,85 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+)
+
+func TestRecipientsDialog(t *testing.T) {
+	s := startHeadless(t)
+	defer stopHeadless()
+	candidates := []string{
+		"me",
+		"Dave <dave@example.com>",
+		"Carl <carl@example.com>",
+		"Bob <bob@example.com>",
+	}
+	done := make(chan *recipients)
+	go func() { done <- recipientsDialog(candidates) }()
+	if !s.WaitFor("To>", 5*time.Second) {
+		t.Fatalf("no dialog. Screen:\n%s", s.Contents())
+	}
+	typeKeys := func(str string) {
+		for _, r := range str {
+			nc.Input <- gc.Key(r)
+		}
+	}
+
+	// Best match.
+	typeKeys("example\n")
+	// Second match. The one already chosen is not a candidate.
+	typeKeys("exa")
+	nc.Input <- ctrlN
+	typeKeys("\n")
+	// Write-in, to Cc. Arrow keys and resizing don't type anything.
+	typeKeys("\tnew@exa")
+	nc.Input <- gc.KEY_LEFT
+	nc.Input <- gc.KEY_RIGHT
+	nc.Input <- 410 // KEY_RESIZE.
+	typeKeys("mple.com\n")
+	// Added to Bcc, then removed with backspace.
+	typeKeys("\tca\n")
+	nc.Input <- 127
+	typeKeys("\n")
+	r := <-done
+	want := &recipients{
+		{"Dave <dave@example.com>", "Bob <bob@example.com>"},
+		{"new@example.com"},
+		{},
+	}
+	if !reflect.DeepEqual(r[:2], want[:2]) || len(r[2]) != 0 {
+		t.Errorf("got %q, want %q", r, want)
+	}
+	if got, want := r.headers(), "To: Dave <dave@example.com>, Bob <bob@example.com>\nCc: new@example.com\nBcc: \n"; got != want {
+		t.Errorf("got headers %q, want %q", got, want)
+	}
+
+	// Cancel.
+	go func() { done <- recipientsDialog(candidates) }()
+	typeKeys("bob")
+	nc.Input <- ctrlG
+	if r := <-done; r != nil {
+		t.Errorf("got %q after cancel, want nil", r)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/addressbook"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+// replyMode is who a reply goes to.
+type replyMode int
+
+const (
+	replySender replyMode = iota // The author, or their Reply-To.
+	replyAll                     // Everyone, or the Mail-Followup-To.
+	replyList                    // The mailing list, from List-Post.
+)
+
+// isOwnAddress returns true if addr is our address or one of our send-as aliases.
+func isOwnAddress(addr string) bool {
+	return strings.EqualFold(addr, emailAddress) || findIdentity(addr) != nil
+}
+
+// recipientList builds address lists without duplicates.
+type recipientList struct {
+	seen map[string]bool
+}
+
+// add appends the addresses in header h of m to l, skipping ones already
+// added and, if skipOwn, our own. A header that doesn't parse is added
+// as is, rather than silently dropped.
+func (r *recipientList) add(l []string, m *gmail.Message, h string, skipOwn bool) []string {
+	if r.seen == nil {
+		r.seen = make(map[string]bool)
+	}
+	v := strings.TrimSpace(cmdglib.GetHeader(m, h))
+	if v == "" {
+		return l
+	}
+	as, err := mail.ParseAddressList(v)
+	if err != nil {
+		log.Printf("Failed to parse %s header %q: %v", h, v, err)
+		s := decodeHeader(v)
+		if k := strings.ToLower(s); !r.seen[k] {
+			r.seen[k] = true
+			l = append(l, s)
+		}
+		return l
+	}
+	for _, a := range as {
+		k := strings.ToLower(a.Address)
+		if r.seen[k] || (skipOwn && isOwnAddress(a.Address)) {
+			continue
+		}
+		r.seen[k] = true
+		l = append(l, addressbook.FormatAddress(a.Name, a.Address))
+	}
+	return l
+}
+
+// sentByUs returns true if m is from one of our own addresses.
+func sentByUs(m *gmail.Message) bool {
+	a, err := mail.ParseAddress(cmdglib.GetHeader(m, "From"))
+	return err == nil && isOwnAddress(a.Address)
+}
+
+// replyRecipients returns the To and Cc addresses of a reply to m.
+func replyRecipients(m *gmail.Message, mode replyMode) ([]string, []string, error) {
+	var r recipientList
+	var to, cc []string
+	switch {
+	case mode == replyList:
+		addr, err := listPostAddress(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{addr}, nil, nil
+	case mode == replyAll && cmdglib.GetHeader(m, "Mail-Followup-To") != "":
+		// The author asked for followups to go here, and nowhere else.
+		return r.add(nil, m, "Mail-Followup-To", true), nil, nil
+	case cmdglib.GetHeader(m, "Reply-To") != "":
+		to = r.add(nil, m, "Reply-To", false)
+		if mode == replyAll {
+			cc = r.add(cc, m, "From", true)
+		}
+	case sentByUs(m):
+		// Replying to our own message means following up to the same people.
+		to = r.add(nil, m, "To", mode == replyAll)
+		if mode == replyAll {
+			cc = r.add(cc, m, "Cc", true)
+		}
+		return to, cc, nil
+	default:
+		to = r.add(nil, m, "From", false)
+	}
+	if mode == replyAll {
+		cc = r.add(cc, m, "To", true)
+		cc = r.add(cc, m, "Cc", true)
+	}
+	return to, cc, nil
+}
+
+// listPostAddress returns the address to post to the mailing list m came
+// from, as given in its List-Post header (RFC 2369).
+func listPostAddress(m *gmail.Message) (string, error) {
+	v := strings.TrimSpace(cmdglib.GetHeader(m, "List-Post"))
+	if v == "" {
+		return "", errors.New("not from a mailing list (no List-Post header)")
+	}
+	if strings.HasPrefix(strings.ToUpper(v), "NO") {
+		return "", errors.New("mailing list doesn't allow posting")
+	}
+	for {
+		st := strings.Index(v, "<")
+		end := strings.Index(v, ">")
+		if st < 0 || end < st {
+			break
+		}
+		u := v[st+1 : end]
+		v = v[end+1:]
+		if !strings.HasPrefix(strings.ToLower(u), "mailto:") {
+			continue
+		}
+		addr := u[len("mailto:"):]
+		if i := strings.Index(addr, "?"); i >= 0 {
+			addr = addr[:i]
+		}
+		if a, err := url.PathUnescape(addr); err == nil {
+			addr = a
+		}
+		if addr != "" {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("no mailto address in List-Post header %q", cmdglib.GetHeader(m, "List-Post"))
+}
+
+// getReplyMode composes a reply to m, in the editor.
+func getReplyMode(m *gmail.Message, mode replyMode) (string, error) {
+	subject := decodeHeader(cmdglib.GetHeader(m, "Subject"))
+	if !replyRE.MatchString(subject) {
+		subject = *replyPrefix + subject
+	}
+	to, cc, err := replyRecipients(m, mode)
+	if err != nil {
+		return "", err
+	}
+	ccLine := ""
+	if mode == replyAll || len(cc) > 0 {
+		ccLine = fmt.Sprintf("Cc: %s\n", strings.Join(cc, ", "))
+	}
+	head := fmt.Sprintf("%sTo: %s\n%sSubject: %s\n\nOn %s, %s said:\n",
+		fromLine(addressedIdentity(m)),
+		strings.Join(to, ", "),
+		ccLine,
+		subject,
+		cmdglib.GetHeader(m, "Date"),
+		decodeHeader(cmdglib.GetHeader(m, "From")),
+	)
+	return inThread(m, head+strings.Join(prefixQuote(breakLines(strings.Split(getBody(m), "\n"))), "\n"))
+}
+
+func getReply(m *gmail.Message) (string, error) {
+	return getReplyMode(m, replySender)
+}
+
+func getReplyAll(m *gmail.Message) (string, error) {
+	return getReplyMode(m, replyAll)
+}
+
+func getReplyList(m *gmail.Message) (string, error) {
+	return getReplyMode(m, replyList)
+}
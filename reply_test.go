@@ -0,0 +1,139 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"reflect"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// headerMessage returns a message with the given header names and values.
+func headerMessage(hs ...string) *gmail.Message {
+	p := &gmail.MessagePart{}
+	for n := 0; n < len(hs); n += 2 {
+		p.Headers = append(p.Headers, &gmail.MessagePartHeader{Name: hs[n], Value: hs[n+1]})
+	}
+	return &gmail.Message{Payload: p}
+}
+
+func TestReplyRecipients(t *testing.T) {
+	defer func(e string) { emailAddress = e }(emailAddress)
+	defer func() { identities = nil }()
+	emailAddress = "me@example.com"
+	identities = []*gmail.SendAs{{SendAsEmail: "me@example.com"}, {SendAsEmail: "alias@example.com"}}
+
+	for _, test := range []struct {
+		name    string
+		headers []string
+		mode    replyMode
+		to, cc  []string
+		err     bool
+	}{
+		{
+			name:    "reply",
+			headers: []string{"From", `"Doe, Jane" <jane@x.com>`, "To", "me@example.com"},
+			to:      []string{`"Doe, Jane" <jane@x.com>`},
+		},
+		{
+			name:    "reply to encoded name needing quotes",
+			headers: []string{"From", "=?utf-8?q?=C3=96berg=2C_=C3=85sa?= <asa@x.com>"},
+			to:      []string{`"Öberg, Åsa" <asa@x.com>`},
+		},
+		{
+			name:    "reply to Reply-To",
+			headers: []string{"From", "Jane <jane@x.com>", "Reply-To", "Help <help@x.com>"},
+			to:      []string{"Help <help@x.com>"},
+		},
+		{
+			name: "reply all",
+			headers: []string{
+				"From", `"Doe, Jane" <jane@x.com>`,
+				"To", `Me <ME@example.com>, "Smith, Bob" <bob@y.com>`,
+				"Cc", "alias@EXAMPLE.com, JANE@x.com, =?utf-8?q?Bj=C3=B6rn?= <bjorn@z.com>, bob@Y.com",
+			},
+			mode: replyAll,
+			to:   []string{`"Doe, Jane" <jane@x.com>`},
+			cc:   []string{`"Smith, Bob" <bob@y.com>`, "Björn <bjorn@z.com>"},
+		},
+		{
+			name:    "reply all with Reply-To",
+			headers: []string{"From", "Jane <jane@x.com>", "Reply-To", "list@x.com", "To", "list@x.com, me@example.com"},
+			mode:    replyAll,
+			to:      []string{"list@x.com"},
+			cc:      []string{"Jane <jane@x.com>"},
+		},
+		{
+			name:    "reply all with Mail-Followup-To",
+			headers: []string{"From", "jane@x.com", "To", "list@x.com", "Cc", "bob@y.com", "Mail-Followup-To", "list@x.com, alias@example.com"},
+			mode:    replyAll,
+			to:      []string{"list@x.com"},
+		},
+		{
+			name:    "Mail-Followup-To only affects reply all",
+			headers: []string{"From", "jane@x.com", "To", "list@x.com", "Mail-Followup-To", "list@x.com"},
+			to:      []string{"jane@x.com"},
+		},
+		{
+			name:    "reply all to own message",
+			headers: []string{"From", "Me <alias@example.com>", "To", "jane@x.com", "Cc", "bob@y.com, me@example.com"},
+			mode:    replyAll,
+			to:      []string{"jane@x.com"},
+			cc:      []string{"bob@y.com"},
+		},
+		{
+			name:    "unparsable kept as is",
+			headers: []string{"From", "jane@x.com", "To", "me@example.com, <<broken"},
+			mode:    replyAll,
+			to:      []string{"jane@x.com"},
+			cc:      []string{"me@example.com, <<broken"},
+		},
+		{
+			name:    "reply to list",
+			headers: []string{"From", "jane@x.com", "List-Post", "<http://x.com/post>, <mailto:list%2Bdev@x.com?subject=hi>"},
+			mode:    replyList,
+			to:      []string{"list+dev@x.com"},
+		},
+		{
+			name:    "reply to list, posting not allowed",
+			headers: []string{"From", "jane@x.com", "List-Post", "NO (posting not allowed on this list)"},
+			mode:    replyList,
+			err:     true,
+		},
+		{
+			name:    "reply to list, not a list",
+			headers: []string{"From", "jane@x.com"},
+			mode:    replyList,
+			err:     true,
+		},
+	} {
+		to, cc, err := replyRecipients(headerMessage(test.headers...), test.mode)
+		if gotErr := err != nil; gotErr != test.err {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(to, test.to) {
+			t.Errorf("%s: To: got %q, want %q", test.name, to, test.to)
+		}
+		if !reflect.DeepEqual(cc, test.cc) {
+			t.Errorf("%s: Cc: got %q, want %q", test.name, cc, test.cc)
+		}
+	}
+}
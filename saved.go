@@ -0,0 +1,407 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+//
+// Recovering emails that failed to send, and were saved by saveFailedSend.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	gc "github.com/rthornton128/goncurses"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/ncwrap"
+	"github.com/ThomasHabets/cmdg/opqueue"
+)
+
+// savedPrefix is the start of the file name of every saved email.
+const savedPrefix = "saved-"
+
+// savedEmail is an email that failed to send. It's either the encoded
+// email, or what came out of the editor if encoding failed.
+type savedEmail struct {
+	fn      string
+	modTime time.Time
+	data    string
+	to      string
+	subject string
+	mime    bool  // data is an encoded email, ready to send.
+	err     error // Why it can't be read, in which case it can only be deleted.
+}
+
+// readSaved reads a saved email.
+func readSaved(fn string) (*savedEmail, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := &savedEmail{
+		fn:      fn,
+		modTime: fi.ModTime(),
+	}
+	if b, err = localKey.Open(b); err != nil {
+		log.Printf("Failed to decrypt saved email %q: %v", fn, err)
+		s.err = err
+		s.subject = fmt.Sprintf("(can't decrypt: %v)", err)
+		return s, nil
+	}
+	s.data = string(b)
+	if m, err := mail.ReadMessage(strings.NewReader(s.data)); err != nil {
+		log.Printf("Saved email %q is not an email: %v", fn, err)
+		s.subject = "(unreadable)"
+	} else {
+		s.to = decodeHeader(m.Header.Get("To"))
+		s.subject = decodeHeader(m.Header.Get("Subject"))
+		s.mime = m.Header.Get("MIME-Version") != ""
+	}
+	return s, nil
+}
+
+// listSaved returns the saved emails, newest first.
+func listSaved() ([]*savedEmail, error) {
+	dir := path.Join(*configDir, savedDir)
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []*savedEmail
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), savedPrefix) || fi.IsDir() {
+			continue
+		}
+		s, err := readSaved(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	sort.Sort(sortSavedNewestFirst(ret))
+	return ret, nil
+}
+
+type sortSavedNewestFirst []*savedEmail
+
+func (a sortSavedNewestFirst) Len() int      { return len(a) }
+func (a sortSavedNewestFirst) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a sortSavedNewestFirst) Less(i, j int) bool {
+	if !a[i].modTime.Equal(a[j].modTime) {
+		return a[i].modTime.After(a[j].modTime)
+	}
+	return a[i].fn < a[j].fn
+}
+
+// raw returns the saved email encoded, ready to send.
+func (s *savedEmail) raw() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	if s.mime {
+		return s.data, nil
+	}
+	return composeMessage(s.data, nil)
+}
+
+// remove deletes the saved email, showing any error.
+func (s *savedEmail) remove() bool {
+	if err := os.Remove(s.fn); err != nil {
+		log.Printf("Failed to remove saved email %q: %v", s.fn, err)
+		nc.Status("[red]Failed to remove saved email: %v", err)
+		return false
+	}
+	return true
+}
+
+// sendSaved checks and sends a saved email as-is, and removes it if that
+// worked.
+func sendSaved(s *savedEmail) {
+	raw, err := s.raw()
+	if err != nil {
+		nc.Status("[red]Can't send, edit it first: %v", err)
+		return
+	}
+	input, headers, atts, err := savedEditorText(s)
+	if err != nil {
+		nc.Status("[red]Can't check email before sending, edit it first: %v", err)
+		return
+	}
+	if !preSendOK(headers+input, atts) {
+		return
+	}
+	switch _, err := sendMessage("", raw, nil); err {
+	case opqueue.ErrQueued:
+		nc.Status("[green]Offline, queued for sending")
+	case opqueue.ErrMaybeSent:
+		// It's in the offline queue, which saves it again if dropped.
+		nc.Status(maybeSentStatus)
+	case nil:
+		nc.Status("[green]Successfully sent")
+	default:
+		nc.Status("[red]Error sending: %v", err)
+		return
+	}
+	s.remove()
+}
+
+// draftSaved turns a saved email into a Gmail draft.
+func draftSaved(s *savedEmail) {
+	raw, err := s.raw()
+	if err != nil {
+		nc.Status("[red]Can't save as draft, edit it first: %v", err)
+		return
+	}
+	if _, err := mailBackend.CreateDraft(&gmail.Draft{
+		Message: &gmail.Message{Raw: mimeEncode(raw)},
+	}); err != nil {
+		nc.Status("[red]Error saving as draft: %v", err)
+		return
+	}
+	nc.Status("Saved draft")
+	s.remove()
+}
+
+// savedEditorText returns what to show in the editor for a saved email,
+// headers to keep that are not shown, and the attachments.
+// PGP signing or encryption is lost, and has to be chosen again.
+func savedEditorText(s *savedEmail) (string, string, []*attachment, error) {
+	if s.err != nil {
+		return "", "", nil, s.err
+	}
+	if !s.mime {
+		return s.data, "", nil, nil
+	}
+	p, err := mimePart(canonicalCRLF(s.data))
+	if err != nil {
+		return "", "", nil, err
+	}
+	m := &gmail.Message{Payload: p}
+	atts, err := messageAttachments(m)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return draftEditorText(m), draftThreadHeaders(m), atts, nil
+}
+
+// editSaved runs the editor on a saved email, and then asks what to do with
+// it. The saved email is removed if it's sent or saved as a draft, or
+// replaced by the edited email if sending fails again.
+func editSaved(s *savedEmail) {
+	input, headers, atts, err := savedEditorText(s)
+	if err != nil {
+		nc.Status("[red]Failed to parse saved email: %v", err)
+		return
+	}
+	msg, err := runEditorHeadersOK(input)
+	if err != nil {
+		nc.Status("Running editor: %v", err)
+		return
+	}
+	err = sendMenu("", "", "Abort, keeping saved email", headers+msg, atts)
+	if _, ok := err.(*notSavedError); ok {
+		// Keep the old version, since the new one is lost.
+		return
+	}
+	if err == errAborted {
+		nc.Status("Kept saved email")
+		return
+	}
+	// Sent, or the edited email saved instead.
+	s.remove()
+}
+
+// savedPrint prints the list of saved emails, and returns the new scroll position.
+func savedPrint(w ncwrap.Window, saved []*savedEmail, cur, scroll int) int {
+	maxY, maxX := w.MaxYX()
+	rows := maxY - 5
+	scroll = listScroll(scroll, cur, rows)
+	w.Clear()
+	ncwrap.ColorPrint(w, "\n [bold]Saved unsent emails[unbold]: %d\n\n", len(saved))
+	for n := scroll; n < len(saved) && n < scroll+rows; n++ {
+		s := saved[n]
+		prefix := "  "
+		if n == cur {
+			prefix = "[bold]>"
+		}
+		to := s.to
+		if to == "" {
+			to = "(no recipient)"
+		}
+		line := fmt.Sprintf("%s %-25.25s %s", s.modTime.Local().Format("Jan 02 15:04"), to, s.subject)
+		if len(line) > maxX-6 && maxX > 6 {
+			line = line[:maxX-6]
+		}
+		ncwrap.ColorPrint(w, " %s %s[unbold]\n", ncwrap.Preformat(prefix), line)
+	}
+	w.Border()
+	w.Refresh()
+	return scroll
+}
+
+// savedView shows emails that failed to send, and lets the user resend,
+// edit, draft or delete them.
+func savedView() {
+	var saved []*savedEmail
+	reload := func() {
+		if ss, err := listSaved(); err != nil {
+			nc.Status("[red]Listing saved emails: %v", err)
+		} else {
+			saved = ss
+		}
+	}
+	reload()
+	cur, scroll := 0, 0
+	for {
+		if cur >= len(saved) {
+			cur = len(saved) - 1
+		}
+		if cur < 0 {
+			cur = 0
+		}
+		// New window each time, since the editor restarts the UI.
+		w := fullscreenWindow()
+		scroll = savedPrint(w, saved, cur, scroll)
+		key := <-nc.Input
+		w.Delete()
+		switch key {
+		case '?':
+			helpWin(`q, ^C, ^G         Back
+^P, p, k, Up      Previous
+^N, n, j, Down    Next
+Enter, e          Edit and send
+S                 Send as-is
+d                 Save as Gmail draft
+D                 Delete
+r                 Reload
+`)
+		case 'q', ctrlC, ctrlG:
+			return
+		case gc.KEY_UP, 'p', ctrlP, 'k':
+			if cur > 0 {
+				cur--
+			}
+		case gc.KEY_DOWN, 'n', ctrlN, 'j':
+			cur++
+		case 'r':
+			reload()
+		case '\n', '\r', 'e':
+			if len(saved) == 0 {
+				break
+			}
+			editSaved(saved[cur])
+			reload()
+		case 'S':
+			if len(saved) == 0 {
+				break
+			}
+			sendSaved(saved[cur])
+			reload()
+		case 'd':
+			if len(saved) == 0 {
+				break
+			}
+			draftSaved(saved[cur])
+			reload()
+		case 'D':
+			if len(saved) == 0 {
+				break
+			}
+			if !confirm(fmt.Sprintf("Delete saved email %q?", saved[cur].subject)) {
+				break
+			}
+			if saved[cur].remove() {
+				nc.Status("Deleted saved email")
+			}
+			reload()
+		}
+	}
+}
+
+// encryptSaved encrypts saved emails written before encryption was
+// turned on, keeping their modification time.
+func encryptSaved() error {
+	if localKey == nil {
+		return nil
+	}
+	dir := path.Join(*configDir, savedDir)
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), savedPrefix) || fi.IsDir() {
+			continue
+		}
+		fn := path.Join(dir, fi.Name())
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if atrest.IsEncrypted(b) {
+			continue
+		}
+		enc, err := localKey.Seal(b)
+		if err != nil {
+			return err
+		}
+		// Not named like a saved email until it's complete.
+		tmp := path.Join(dir, "tmp-"+fi.Name())
+		if err := ioutil.WriteFile(tmp, enc, 0600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savedNotice tells the user at startup if there are emails that failed to send.
+func savedNotice() {
+	saved, err := listSaved()
+	if err != nil {
+		log.Printf("Listing saved emails: %v", err)
+		return
+	}
+	if len(saved) > 0 {
+		nc.Status("[red]%d unsent emails saved, press R to see them", len(saved))
+	}
+}
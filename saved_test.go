@@ -0,0 +1,301 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+// withSaved sets up a config dir with saved emails, oldest first.
+func withSaved(t *testing.T, msgs ...string) func() {
+	dir, err := ioutil.TempDir("", "cmdg-saved-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *configDir
+	*configDir = dir
+	for n, m := range msgs {
+		if err := saveFailedSend(m); err != nil {
+			t.Fatal(err)
+		}
+		ss, err := listSaved()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Newest is first, until mtime is set.
+		for _, s := range ss {
+			if s.data == m {
+				ts := time.Date(2016, 1, n+1, 0, 0, 0, 0, time.UTC)
+				if err := os.Chtimes(s.fn, ts, ts); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	return func() {
+		*configDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSavedEditorText(t *testing.T) {
+	raw, err := composeMessage("In-Reply-To: <msg1@example.com>\nTo: foo@example.com\nSubject: Räksmörgås\n\nHello.\n",
+		[]*attachment{{name: "data.bin", contentType: "application/octet-stream", data: []byte{1, 2, 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withSaved(t, raw, "To: bar@example.com\nSubject: Not encoded\n\nBody.\n")()
+	saved, err := listSaved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(saved), 2; got != want {
+		t.Fatalf("got %d saved, want %d", got, want)
+	}
+	for n, want := range []struct {
+		to, subject string
+		mime        bool
+	}{
+		{"bar@example.com", "Not encoded", false},
+		{"<foo@example.com>", "Räksmörgås", true},
+	} {
+		s := saved[n]
+		if s.to != want.to || s.subject != want.subject || s.mime != want.mime {
+			t.Errorf("saved %d: got %q %q %v, want %q %q %v", n, s.to, s.subject, s.mime, want.to, want.subject, want.mime)
+		}
+	}
+
+	input, headers, atts, err := savedEditorText(saved[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := input, "To: <foo@example.com>\nCc: \nBcc: \nSubject: Räksmörgås\n\nHello."; got != want {
+		t.Errorf("editor text: got %q, want %q", got, want)
+	}
+	if got, want := headers, "In-Reply-To: <msg1@example.com>\n"; got != want {
+		t.Errorf("headers: got %q, want %q", got, want)
+	}
+	if len(atts) != 1 || atts[0].name != "data.bin" || string(atts[0].data) != "\x01\x02\x03" {
+		t.Errorf("got attachments %v, want data.bin", atts)
+	}
+
+	if input, headers, atts, err := savedEditorText(saved[0]); err != nil || input != saved[0].data || headers != "" || len(atts) != 0 {
+		t.Errorf("not encoded: got %q %q %v %v, want unchanged", input, headers, atts, err)
+	}
+}
+
+func TestSavedView(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t,
+		"To: one@example.com\nSubject: Saved 1\n\nBody 1.\n",
+		"To: two@example.com\nSubject: Saved 2\n\nBody 2.\n",
+		"To: three@example.com\nSubject: Saved 3\n\nBody 3.\n",
+	)()
+	s := startHeadless(t)
+	defer stopHeadless()
+
+	savedNotice()
+	if !s.WaitFor("3 unsent emails saved", 5*time.Second) {
+		t.Fatalf("no startup notice. Screen:\n%s", s.Contents())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		savedView()
+		close(done)
+	}()
+	if !s.WaitFor("Saved unsent emails: 3", 5*time.Second) {
+		t.Fatalf("saved emails not shown. Screen:\n%s", s.Contents())
+	}
+	if got, want := s.Line(5), "three@example.com"; !strings.Contains(got, want) || !strings.Contains(got, "Saved 3") {
+		t.Errorf("first saved: got %q, want %q", got, want)
+	}
+
+	// Delete the newest, draft the next, and send the oldest.
+	nc.Input <- 'D'
+	if !s.WaitFor(`Delete saved email "Saved 3"?`, 5*time.Second) {
+		t.Fatalf("delete not confirmed. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'n'
+	if !s.WaitFor("Saved unsent emails: 3", 5*time.Second) {
+		t.Fatalf("deleted without confirmation. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'D'
+	if !s.WaitFor(`Delete saved email "Saved 3"?`, 5*time.Second) {
+		t.Fatalf("delete not confirmed. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'y'
+	if !s.WaitFor("Saved unsent emails: 2", 5*time.Second) {
+		t.Fatalf("not deleted. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'd'
+	if !s.WaitFor("Saved unsent emails: 1", 5*time.Second) {
+		t.Fatalf("not drafted. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'S'
+	if !s.WaitFor("Saved unsent emails: 0", 5*time.Second) {
+		t.Fatalf("not sent. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'q'
+	<-done
+
+	drafts, err := getDrafts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drafts) != 1 || cmdglib.GetHeader(drafts[0].Message, "Subject") != "Saved 2" {
+		t.Errorf("want draft of saved 2, got %d drafts", len(drafts))
+	}
+	res, err := mailBackend.ListMessages(cmdglib.Sent, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Fatalf("got %d sent, want %d", got, want)
+	}
+	m, err := mailBackend.GetMessage(res.Messages[0].Id, "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cmdglib.GetHeader(m, "Subject"), "Saved 1"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if fis, err := ioutil.ReadDir(path.Join(*configDir, savedDir)); err != nil || len(fis) != 0 {
+		t.Errorf("want no saved files left, got %d: %v", len(fis), err)
+	}
+}
+
+func TestSavedChecked(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t, "To: one@example.com\nSubject: \n\nBody 1.\n")()
+	s := startHeadless(t)
+	defer stopHeadless()
+	done := make(chan struct{})
+	go func() {
+		savedView()
+		close(done)
+	}()
+	if !s.WaitFor("Saved unsent emails: 1", 5*time.Second) {
+		t.Fatalf("saved emails not shown. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'S'
+	if !s.WaitFor("subject is empty", 5*time.Second) {
+		t.Fatalf("not checked. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'b'
+	if !s.WaitFor("Saved unsent emails: 1", 5*time.Second) {
+		t.Fatalf("saved email gone. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'S'
+	if !s.WaitFor("subject is empty", 5*time.Second) {
+		t.Fatalf("not checked. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 's'
+	if !s.WaitFor("Saved unsent emails: 0", 5*time.Second) {
+		t.Fatalf("not sent. Screen:\n%s", s.Contents())
+	}
+	nc.Input <- 'q'
+	<-done
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+}
+
+func TestSendMenuAbort(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	defer withSaved(t)()
+	s := startHeadless(t)
+	defer stopHeadless()
+	go func() {
+		if !s.WaitFor("Abort, keeping saved email", 5*time.Second) {
+			t.Errorf("abort choice not shown. Screen:\n%s", s.Contents())
+		}
+		nc.Input <- 'a'
+	}()
+	if got, want := sendMenu("", "", "Abort, keeping saved email", "To: foo@example.com\nSubject: x\n\ny\n", nil), errAborted; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if saved, err := listSaved(); err != nil || len(saved) != 0 {
+		t.Errorf("aborted email saved: %v, %v", saved, err)
+	}
+}
+
+func TestSavedEncrypted(t *testing.T) {
+	defer withSaved(t, "To: one@example.com\nSubject: Secret 1\n\nBody 1.\n")()
+	key, err := atrest.NewKey([]byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { localKey = nil }()
+	localKey = key
+
+	// Saved before encryption was turned on.
+	if err := encryptSaved(); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFailedSend("To: two@example.com\nSubject: Secret 2\n\nBody 2.\n"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := listSaved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(saved), 2; got != want {
+		t.Fatalf("got %d saved, want %d", got, want)
+	}
+	for n, want := range []string{"Secret 2", "Secret 1"} {
+		if got := saved[n].subject; got != want {
+			t.Errorf("saved %d: got subject %q, want %q", n, got, want)
+		}
+		b, err := ioutil.ReadFile(saved[n].fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !atrest.IsEncrypted(b) || strings.Contains(string(b), "Secret") {
+			t.Errorf("saved %d not encrypted: %q", n, b)
+		}
+	}
+	if got, want := saved[1].modTime, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("encrypting changed time to %v, want %v", got, want)
+	}
+
+	// Without the key they're listed, but can't be used.
+	localKey = nil
+	saved, err = listSaved()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].err != atrest.ErrNoKey || !strings.Contains(saved[0].subject, "can't decrypt") {
+		t.Fatalf("got %+v, want undecryptable", saved)
+	}
+	if _, err := saved[0].raw(); err == nil {
+		t.Errorf("undecryptable email can be sent")
+	}
+}
@@ -0,0 +1,155 @@
+// Package scheduler limits how many fetches run at the same time, and
+// decides which one runs next.
+//
+// Waiting fetches run in priority order, lowest first, and in the order
+// they were asked for within the same priority. A fetch whose context is
+// cancelled while waiting never runs.
+package scheduler
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// waiter is a fetch waiting for its turn.
+type waiter struct {
+	prio  int
+	seq   uint64
+	ready chan struct{} // Closed when it's this waiter's turn.
+	index int           // In the heap, or -1 if no longer in it.
+}
+
+type waiters []*waiter
+
+func (a waiters) Len() int { return len(a) }
+func (a waiters) Less(i, j int) bool {
+	if a[i].prio != a[j].prio {
+		return a[i].prio < a[j].prio
+	}
+	return a[i].seq < a[j].seq
+}
+func (a waiters) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+	a[i].index = i
+	a[j].index = j
+}
+func (a *waiters) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*a)
+	*a = append(*a, w)
+}
+func (a *waiters) Pop() interface{} {
+	old := *a
+	w := old[len(old)-1]
+	w.index = -1
+	*a = old[:len(old)-1]
+	return w
+}
+
+// Scheduler runs functions with a cap on how many run at the same time.
+type Scheduler struct {
+	mu      sync.Mutex
+	max     int
+	running int
+	seq     uint64
+	waiting waiters
+}
+
+// New creates a new Scheduler that runs at most max functions at once.
+func New(max int) *Scheduler {
+	if max < 1 {
+		max = 1
+	}
+	return &Scheduler{max: max}
+}
+
+// Do runs f when it's its turn, and returns its error. Lower prio runs first.
+// If ctx is cancelled before f starts, f isn't run and the context error is returned.
+func (s *Scheduler) Do(ctx context.Context, prio int, f func() error) error {
+	if err := s.acquire(ctx, prio); err != nil {
+		return err
+	}
+	defer s.release()
+	return f()
+}
+
+// Running returns the number of functions currently running.
+func (s *Scheduler) Running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Waiting returns the number of functions waiting for their turn.
+func (s *Scheduler) Waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
+
+func (s *Scheduler) acquire(ctx context.Context, prio int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.running < s.max && len(s.waiting) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return nil
+	}
+	s.seq++
+	w := &waiter{
+		prio:  prio,
+		seq:   s.seq,
+		ready: make(chan struct{}),
+	}
+	heap.Push(&s.waiting, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if w.index >= 0 {
+			heap.Remove(&s.waiting, w.index)
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+		s.mu.Unlock()
+		// Got the turn at the same time as being cancelled. Pass it on.
+		s.release()
+		return ctx.Err()
+	}
+}
+
+// release gives the slot to the next waiter, if any.
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiting) == 0 {
+		s.running--
+		return
+	}
+	w := heap.Pop(&s.waiting).(*waiter)
+	close(w.ready)
+}
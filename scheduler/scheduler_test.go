@@ -0,0 +1,150 @@
+package scheduler
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor waits until there are n waiters.
+func waitFor(t *testing.T, s *Scheduler, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Waiting() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d waiting, want %d", s.Waiting(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestParallelism(t *testing.T) {
+	s := New(3)
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for n := 0; n < 20; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Do(context.Background(), 0, func() error {
+				r := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if r <= m || atomic.CompareAndSwapInt32(&maxRunning, m, r) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if got, want := maxRunning, int32(3); got != want {
+		t.Errorf("got max %d running, want %d", got, want)
+	}
+	if got := s.Running(); got != 0 {
+		t.Errorf("got %d still running", got)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	s := New(1)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go s.Do(context.Background(), 0, func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for n, prio := range []int{5, 1, 3, 1} {
+		wg.Add(1)
+		n, prio := n, prio
+		go func() {
+			defer wg.Done()
+			s.Do(context.Background(), prio, func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				order = append(order, n)
+				return nil
+			})
+		}()
+		// Make the order they're asked for deterministic.
+		waitFor(t, s, n+1)
+	}
+	close(block)
+	wg.Wait()
+	if want := []int{1, 3, 2, 0}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s := New(1)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go s.Do(context.Background(), 0, func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	ran := false
+	go func() {
+		errCh <- s.Do(ctx, 0, func() error {
+			ran = true
+			return nil
+		})
+	}()
+	waitFor(t, s, 1)
+	cancel()
+	if got, want := <-errCh, context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ran {
+		t.Errorf("cancelled function ran")
+	}
+	if got := s.Waiting(); got != 0 {
+		t.Errorf("got %d waiting after cancel", got)
+	}
+
+	// Already cancelled never waits.
+	if got, want := s.Do(ctx, 0, func() error { return nil }), context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The slot is still usable.
+	close(block)
+	if err := s.Do(context.Background(), 0, func() error { return nil }); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,404 @@
+// Package sendlater keeps emails scheduled to be sent later, and sends
+// them when it's time.
+//
+// Each scheduled email is a file in the directory, so that both cmdg and
+// a background daemon can send them. Whoever sends an email first renames
+// its file, so it's only sent once.
+package sendlater
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/opqueue"
+)
+
+// DirName is the directory of scheduled emails, relative to the cmdg config directory.
+const DirName = "scheduled"
+
+const (
+	dirMode  os.FileMode = 0700
+	fileMode os.FileMode = 0600
+
+	// File name prefixes. Emails waiting to be sent, being sent, sent but
+	// not yet removed, and being written.
+	waitingPrefix = "sched-"
+	sendingPrefix = "sending-"
+	sentPrefix    = "sent-"
+	tmpPrefix     = "tmp-"
+
+	// An email still being sent after this long was interrupted, and may
+	// or may not have been sent.
+	staleSending = 10 * time.Minute
+
+	// Random bytes in IDs.
+	idBytes = 8
+)
+
+// ErrGone is returned when changing an email that's already sent, or being sent.
+var ErrGone = errors.New("already sent or being sent")
+
+// Message is an email scheduled to be sent.
+type Message struct {
+	ID       string    `json:"-"`
+	ThreadID string    `json:"threadId,omitempty"`
+	Raw      string    `json:"raw"`           // Message to send, not base64 encoded.
+	Add      []string  `json:"add,omitempty"` // Labels to add once sent.
+	SendAt   time.Time `json:"sendAt"`
+	Created  time.Time `json:"created"`
+	Error    string    `json:"error,omitempty"` // Why sending failed. Not retried while set.
+	Sending  bool      `json:"-"`               // Being sent right now.
+}
+
+// Header returns the decoded value of a header of the email.
+func (m *Message) Header(name string) string {
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(m.Raw))).ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return ""
+	}
+	s := h.Get(name)
+	if d, err := new(mime.WordDecoder).DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
+
+// Subject returns the decoded subject of the email.
+func (m *Message) Subject() string {
+	return m.Header("Subject")
+}
+
+// SendFunc sends an email, adding labels to it once sent. It should only
+// return an error if the email wasn't sent.
+type SendFunc func(threadID, raw string, add []string) error
+
+// BackendSender returns a SendFunc that sends using b. Failing to add the
+// labels is only logged, since the email was sent.
+func BackendSender(b backend.Backend) SendFunc {
+	return func(threadID, raw string, add []string) error {
+		m, err := b.SendMessage(&gmail.Message{
+			ThreadId: threadID,
+			Raw:      base64.URLEncoding.EncodeToString([]byte(raw)),
+		})
+		if err != nil {
+			return err
+		}
+		if len(add) > 0 {
+			if err := b.ModifyMessage(m.Id, add, nil); err != nil {
+				log.Printf("Sent scheduled email %s, but failed to label it: %v", m.Id, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Store is a directory of scheduled emails.
+type Store struct {
+	mu  sync.Mutex // Only one Dispatch at a time in this process.
+	dir string
+	key *atrest.Key // Encrypts the files, if not nil.
+}
+
+// Open opens the store in dir, creating it if needed. If key is not nil
+// the emails are encrypted with it, including ones scheduled before
+// encryption was turned on.
+func Open(dir string, key *atrest.Key) (*Store, error) {
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, key: key}
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fs {
+		if strings.HasPrefix(fi.Name(), sentPrefix) {
+			// Failed to remove it after sending.
+			if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+				log.Printf("Failed to remove sent email %q: %v", fi.Name(), err)
+			}
+			continue
+		}
+		if key == nil || !strings.HasPrefix(fi.Name(), waitingPrefix) {
+			continue
+		}
+		fn := path.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if atrest.IsEncrypted(data) {
+			continue
+		}
+		if err := s.write(fn, data); err != nil {
+			return nil, fmt.Errorf("encrypting %q: %v", fn, err)
+		}
+	}
+	return s, nil
+}
+
+// write replaces the file fn with data, encrypted if there's a key.
+func (s *Store) write(fn string, data []byte) error {
+	sealed, err := s.key.Seal(data)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(sealed); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// writeMessage writes an email to the file fn.
+func (s *Store) writeMessage(fn string, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.write(fn, data)
+}
+
+// read reads the email in the file with the given name.
+func (s *Store) read(name string) (*Message, error) {
+	data, err := ioutil.ReadFile(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = s.key.Open(data); err != nil {
+		return nil, err
+	}
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(name, sendingPrefix) {
+		m.ID = strings.TrimPrefix(name, sendingPrefix)
+		m.Sending = true
+	} else {
+		m.ID = strings.TrimPrefix(name, waitingPrefix)
+	}
+	return m, nil
+}
+
+// Add schedules an email, and sets its ID.
+func (s *Store) Add(m *Message) error {
+	if m.Created.IsZero() {
+		m.Created = time.Now()
+	}
+	b := make([]byte, idBytes)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+	if err := s.writeMessage(path.Join(s.dir, waitingPrefix+id), m); err != nil {
+		return err
+	}
+	m.ID = id
+	return nil
+}
+
+type bySendAt []*Message
+
+func (a bySendAt) Len() int           { return len(a) }
+func (a bySendAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySendAt) Less(i, j int) bool { return a[i].SendAt.Before(a[j].SendAt) }
+
+// List returns all scheduled emails, soonest first. Emails that can't be
+// read are skipped, and returned as errors.
+func (s *Store) List() ([]*Message, []error) {
+	fs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	var ms []*Message
+	var errs []error
+	for _, fi := range fs {
+		if !strings.HasPrefix(fi.Name(), waitingPrefix) && !strings.HasPrefix(fi.Name(), sendingPrefix) {
+			continue
+		}
+		m, err := s.read(fi.Name())
+		if os.IsNotExist(err) {
+			// Sent, or being sent, while listing.
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reading %q: %v", fi.Name(), err))
+			continue
+		}
+		if m.Sending && s.stale(m.ID) {
+			m.Error = "interrupted while sending, may have been sent"
+		}
+		ms = append(ms, m)
+	}
+	sort.Stable(bySendAt(ms))
+	return ms, errs
+}
+
+// claim renames a waiting email to being sent. Returns ErrGone if it's
+// already sent, or being sent.
+func (s *Store) claim(id string) error {
+	sending := path.Join(s.dir, sendingPrefix+id)
+	if err := os.Rename(path.Join(s.dir, waitingPrefix+id), sending); os.IsNotExist(err) {
+		return ErrGone
+	} else if err != nil {
+		return err
+	}
+	// The modification time says when sending started.
+	now := time.Now()
+	if err := os.Chtimes(sending, now, now); err != nil {
+		log.Printf("Failed to set time of %q: %v", sending, err)
+	}
+	return nil
+}
+
+// unclaim puts an email being sent back in line, saving changes to it.
+func (s *Store) unclaim(m *Message) error {
+	sending := path.Join(s.dir, sendingPrefix+m.ID)
+	if err := s.writeMessage(sending, m); err != nil {
+		return err
+	}
+	return os.Rename(sending, path.Join(s.dir, waitingPrefix+m.ID))
+}
+
+// stale returns true if the email is being sent, but sending was
+// interrupted.
+func (s *Store) stale(id string) bool {
+	fi, err := os.Stat(path.Join(s.dir, sendingPrefix+id))
+	return err == nil && time.Since(fi.ModTime()) > staleSending
+}
+
+// claimOrStale is claim, but also takes over an email whose sending was
+// interrupted, since the user has decided what to do with it.
+func (s *Store) claimOrStale(id string) error {
+	err := s.claim(id)
+	if err == ErrGone && s.stale(id) {
+		return nil
+	}
+	return err
+}
+
+// Remove unschedules an email. Returns ErrGone if it's already sent, or
+// being sent.
+func (s *Store) Remove(id string) error {
+	if err := s.claimOrStale(id); err != nil {
+		return err
+	}
+	return os.Remove(path.Join(s.dir, sendingPrefix+id))
+}
+
+// Reschedule changes when an email is sent, and clears any error so that
+// it's tried again. Returns ErrGone if it's already sent, or being sent.
+func (s *Store) Reschedule(id string, t time.Time) error {
+	if err := s.claimOrStale(id); err != nil {
+		return err
+	}
+	m, err := s.read(sendingPrefix + id)
+	if err != nil {
+		return err
+	}
+	m.SendAt, m.Error = t, ""
+	return s.unclaim(m)
+}
+
+// markSent removes an email that's been sent. It's renamed first, so that
+// it's never offered for sending again even if it can't be removed.
+func (s *Store) markSent(id string) error {
+	sent := path.Join(s.dir, sentPrefix+id)
+	if err := os.Rename(path.Join(s.dir, sendingPrefix+id), sent); err != nil {
+		return err
+	}
+	return os.Remove(sent)
+}
+
+// Dispatch sends the emails that are due at now, and returns how many
+// were sent. Emails that didn't reach the server are tried again next
+// time. Other failures, including ones where the email may have been sent
+// anyway, are saved with the email, and not tried again until it's
+// rescheduled.
+func (s *Store) Dispatch(now time.Time, send SendFunc) (int, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms, errs := s.List()
+	sent := 0
+	for _, m := range ms {
+		if m.Sending || m.Error != "" || m.SendAt.After(now) {
+			continue
+		}
+		if err := s.claim(m.ID); err == ErrGone {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err := send(m.ThreadID, m.Raw, m.Add)
+		if err == nil {
+			sent++
+			if err := s.markSent(m.ID); err != nil {
+				errs = append(errs, fmt.Errorf("removing sent email %q: %v", m.Subject(), err))
+			}
+			continue
+		}
+		errs = append(errs, fmt.Errorf("sending %q: %v", m.Subject(), err))
+		switch {
+		case opqueue.NotSent(err):
+			// Tried again next time.
+		case opqueue.Transient(err):
+			m.Error = "may have been sent, check Sent mail before rescheduling: " + err.Error()
+		default:
+			m.Error = err.Error()
+		}
+		if err := s.unclaim(m); err != nil {
+			errs = append(errs, fmt.Errorf("putting back %q: %v", m.Subject(), err))
+		}
+	}
+	return sent, errs
+}
@@ -0,0 +1,270 @@
+package sendlater
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+)
+
+func newTestStore(t *testing.T, key *atrest.Key) (*fakegmail.Server, backend.Backend, *Store, func()) {
+	f, err := fakegmail.NewFixture("cmdg-sendlater-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(f.Dir, key)
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f.Server, backend.NewGmail(f.Service, "me", nil), s, f.Close
+}
+
+func schedule(t *testing.T, s *Store, subject string, at time.Time, add ...string) *Message {
+	m := &Message{
+		Raw:    "To: foo@example.com\r\nSubject: " + subject + "\r\n\r\nBody\r\n",
+		Add:    add,
+		SendAt: at,
+	}
+	if err := s.Add(m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func subjects(t *testing.T, s *Store) []string {
+	ms, errs := s.List()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	var ret []string
+	for _, m := range ms {
+		ret = append(ret, m.Subject())
+	}
+	return ret
+}
+
+func TestDispatch(t *testing.T) {
+	f, b, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	now := time.Now()
+	schedule(t, s, "Later", now.Add(time.Hour))
+	schedule(t, s, "Now", now.Add(-time.Minute), cmdglib.Starred)
+	if got, want := subjects(t, s), []string{"Now", "Later"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 1 || len(errs) != 0 {
+		t.Fatalf("sent %d, errors %v. Want 1 sent", n, errs)
+	}
+	if got, want := subjects(t, s), []string{"Later"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q left, want %q", got, want)
+	}
+	res, err := b.ListMessages(cmdglib.Starred, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Fatalf("got %d sent and labelled, want %d", got, want)
+	}
+	if got, want := cmdglib.GetHeader(f.Message(res.Messages[0].Id), "Subject"), "Now"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// Rate limited, tried again next time.
+	f.InjectError("POST", "messages/send", http.StatusTooManyRequests, 1)
+	if n, errs := s.Dispatch(now.Add(2*time.Hour), BackendSender(b)); n != 0 || len(errs) != 1 {
+		t.Fatalf("sent %d, errors %v. Want 0 sent and an error", n, errs)
+	}
+	if ms, _ := s.List(); len(ms) != 1 || ms[0].Error != "" {
+		t.Fatalf("got %+v, want the email still waiting", ms)
+	}
+	if n, errs := s.Dispatch(now.Add(2*time.Hour), BackendSender(b)); n != 1 || len(errs) != 0 {
+		t.Fatalf("retry sent %d, errors %v. Want 1 sent", n, errs)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 3; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+}
+
+func TestMaybeSent(t *testing.T) {
+	f, b, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	now := time.Now()
+	schedule(t, s, "Timeout", now)
+	f.InjectError("POST", "messages/send", http.StatusInternalServerError, 1)
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 0 || len(errs) != 1 {
+		t.Fatalf("sent %d, errors %v. Want 0 sent and an error", n, errs)
+	}
+	ms, _ := s.List()
+	if len(ms) != 1 || !strings.Contains(ms[0].Error, "may have been sent") {
+		t.Fatalf("got %+v, want email that may have been sent", ms)
+	}
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 0 || len(errs) != 0 {
+		t.Fatalf("sent %d, errors %v. Want nothing done", n, errs)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 1; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+}
+
+func TestSentLeftover(t *testing.T) {
+	_, _, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	fn := path.Join(s.dir, sentPrefix+"0123")
+	if err := ioutil.WriteFile(fn, []byte("{}"), fileMode); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(t, s); len(got) != 0 {
+		t.Errorf("got %q, want sent email not listed", got)
+	}
+	if _, err := Open(s.dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("got %v, want sent email removed", err)
+	}
+}
+
+func TestFailedAndReschedule(t *testing.T) {
+	f, b, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	now := time.Now()
+	m := schedule(t, s, "Bad", now)
+	f.InjectError("POST", "messages/send", http.StatusBadRequest, 1)
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 0 || len(errs) != 1 {
+		t.Fatalf("sent %d, errors %v. Want 0 sent and an error", n, errs)
+	}
+	ms, _ := s.List()
+	if len(ms) != 1 || ms[0].Error == "" {
+		t.Fatalf("got %+v, want failed email", ms)
+	}
+
+	// Not retried until rescheduled.
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 0 || len(errs) != 0 {
+		t.Fatalf("sent %d, errors %v. Want nothing done", n, errs)
+	}
+	if err := s.Reschedule(m.ID, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _ := s.List(); len(ms) != 1 || ms[0].Error != "" || !ms[0].SendAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("got %+v, want rescheduled email", ms)
+	}
+	if n, errs := s.Dispatch(now.Add(time.Minute), BackendSender(b)); n != 1 || len(errs) != 0 {
+		t.Fatalf("sent %d, errors %v. Want 1 sent", n, errs)
+	}
+	if err := s.Reschedule(m.ID, now); err != ErrGone {
+		t.Errorf("rescheduling sent email: got %v, want %v", err, ErrGone)
+	}
+	if err := s.Remove(m.ID); err != ErrGone {
+		t.Errorf("removing sent email: got %v, want %v", err, ErrGone)
+	}
+}
+
+func TestSending(t *testing.T) {
+	_, b, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	now := time.Now()
+	m := schedule(t, s, "Hello", now)
+
+	// As if another process is sending it.
+	if err := s.claim(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	ms, _ := s.List()
+	if len(ms) != 1 || !ms[0].Sending || ms[0].Error != "" {
+		t.Fatalf("got %+v, want email being sent", ms)
+	}
+	if n, errs := s.Dispatch(now, BackendSender(b)); n != 0 || len(errs) != 0 {
+		t.Fatalf("sent %d, errors %v. Want nothing done", n, errs)
+	}
+	if err := s.Remove(m.ID); err != ErrGone {
+		t.Errorf("removing email being sent: got %v, want %v", err, ErrGone)
+	}
+
+	// The other process died while sending.
+	old := now.Add(-time.Hour)
+	if err := os.Chtimes(path.Join(s.dir, sendingPrefix+m.ID), old, old); err != nil {
+		t.Fatal(err)
+	}
+	ms, _ = s.List()
+	if len(ms) != 1 || !ms[0].Sending || ms[0].Error == "" {
+		t.Fatalf("got %+v, want email with interrupted sending", ms)
+	}
+	if err := s.Remove(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := subjects(t, s); len(got) != 0 {
+		t.Errorf("got %q, want nothing left", got)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	_, b, s, cleanup := newTestStore(t, nil)
+	defer cleanup()
+	now := time.Now()
+	schedule(t, s, "Before", now)
+	key, err := atrest.NewKey([]byte(strings.Repeat("k", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Open(s.dir, key); err != nil {
+		t.Fatal(err)
+	}
+	schedule(t, s, "After", now.Add(time.Minute))
+	fs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fs {
+		data, err := ioutil.ReadFile(path.Join(s.dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !atrest.IsEncrypted(data) {
+			t.Errorf("%s not encrypted", fi.Name())
+		}
+	}
+	if got, want := subjects(t, s), []string{"Before", "After"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Can't be read or sent without the key.
+	noKey, err := Open(s.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms, errs := noKey.List(); len(ms) != 0 || len(errs) != 2 {
+		t.Errorf("without key got %v, %v, want 2 errors", ms, errs)
+	}
+	if n, errs := s.Dispatch(now.Add(time.Minute), BackendSender(b)); n != 2 || len(errs) != 0 {
+		t.Errorf("sent %d, errors %v. Want 2 sent", n, errs)
+	}
+}
@@ -0,0 +1,111 @@
+// sendlaterd sends emails scheduled in cmdg, while cmdg isn't running.
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"flag"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ThomasHabets/drive-du/lib"
+	"github.com/golang/glog"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/atrest"
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/sendlater"
+)
+
+const (
+	scope      = "https://www.googleapis.com/auth/gmail.modify"
+	accessType = "offline"
+	email      = "me"
+)
+
+var (
+	configDir     = flag.String("config_dir", "", "cmdg config directory. If empty will default to ~/.cmdg.")
+	pollInterval  = flag.Duration("poll", 30*time.Second, "Time to wait between looking for emails to send.")
+	once          = flag.Bool("once", false, "Send what's due and exit, instead of running forever. For running from cron.")
+	gpg           = flag.String("gpg", "/usr/bin/gpg", "Path to GnuPG.")
+	encryptTo     = flag.String("encrypt_to", "", "Same as for cmdg.")
+	passphraseCmd = flag.String("encrypt_passphrase_cmd", "", "Same as for cmdg.")
+)
+
+// dispatch sends the emails that are due, and returns how many were sent.
+func dispatch(s *sendlater.Store, b backend.Backend, now time.Time) int {
+	n, errs := s.Dispatch(now, sendlater.BackendSender(b))
+	for _, err := range errs {
+		glog.Errorf("Sending scheduled emails: %v", err)
+	}
+	if n > 0 {
+		glog.Infof("Sent %d scheduled emails", n)
+	}
+	return n
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() > 0 {
+		glog.Exitf("Non-argument options provided: %q", flag.Args())
+	}
+
+	glog.Infof("Starting up")
+	if *configDir == "" {
+		*configDir = path.Join(os.Getenv("HOME"), ".cmdg")
+	}
+	config := path.Join(*configDir, "cmdg.conf")
+	if fi, err := os.Stat(config); err != nil {
+		glog.Exitf("Missing config file %q: %v", config, err)
+	} else if (fi.Mode() & 0477) != 0400 {
+		glog.Exitf("Config file (%q) permissions must be 0600 or better, was 0%o", config, fi.Mode()&os.ModePerm)
+	}
+
+	key, err := atrest.FromFlags(*configDir, *gpg, *encryptTo, *passphraseCmd)
+	if err != nil {
+		glog.Exitf("Failed to get key for encrypting local mail data: %v", err)
+	}
+	s, err := sendlater.Open(path.Join(*configDir, sendlater.DirName), key)
+	if err != nil {
+		glog.Exitf("Failed to open scheduled emails: %v", err)
+	}
+
+	conf, err := lib.ReadConfig(config)
+	if err != nil {
+		glog.Exitf("Failed to read config: %v", err)
+	}
+	t, err := lib.Connect(conf.OAuth, scope, accessType)
+	if err != nil {
+		glog.Exitf("Failed to connect to gmail: %v", err)
+	}
+	g, err := gmail.New(t)
+	if err != nil {
+		glog.Exitf("Failed to create gmail client: %v", err)
+	}
+	b := backend.NewGmail(g, email, nil)
+
+	for {
+		dispatch(s, b, time.Now())
+		if *once {
+			return
+		}
+		time.Sleep(*pollInterval)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+	"github.com/ThomasHabets/cmdg/sendlater"
+)
+
+func TestDispatch(t *testing.T) {
+	f := fakegmail.New("foo@bar.com")
+	defer f.Close()
+	g, err := f.Service()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := backend.NewGmail(g, email, nil)
+	dir, err := ioutil.TempDir("", "cmdg-sendlaterd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := sendlater.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, at := range []time.Time{now.Add(-time.Minute), now, now.Add(time.Minute)} {
+		if err := s.Add(&sendlater.Message{Raw: "To: a@example.com\r\nSubject: hello\r\n\r\nbody\r\n", SendAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := dispatch(s, b, now), 2; got != want {
+		t.Errorf("sent %d, want %d", got, want)
+	}
+	if got, want := f.Requests("POST", "messages/send"), 2; got != want {
+		t.Errorf("got %d sends, want %d", got, want)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/backend"
+	"github.com/ThomasHabets/cmdg/cmdglib"
+)
+
+const historyPageSize = 500
+
+var (
+	errHistoryExpired = errors.New("history ID too old")
+	errSearchChanged  = errors.New("can't apply changes to search results")
+)
+
+// historyDelta is the net effect of a list of history records.
+type historyDelta struct {
+	deleted map[string]bool     // Messages that are gone.
+	labels  map[string][]string // New label IDs of changed messages. nil if unknown.
+	order   []string            // Changed messages, in the order first seen.
+}
+
+func newHistoryDelta(hs []*gmail.History) *historyDelta {
+	d := &historyDelta{
+		deleted: make(map[string]bool),
+		labels:  make(map[string][]string),
+	}
+	for _, h := range hs {
+		for _, m := range h.MessagesAdded {
+			d.set(m.Message, nil, nil)
+		}
+		for _, m := range h.MessagesDeleted {
+			d.deleted[m.Message.Id] = true
+			delete(d.labels, m.Message.Id)
+		}
+		for _, l := range h.LabelsAdded {
+			d.set(l.Message, l.LabelIds, nil)
+		}
+		for _, l := range h.LabelsRemoved {
+			d.set(l.Message, nil, l.LabelIds)
+		}
+	}
+	return d
+}
+
+// set records the labels a message has after an event. If the event
+// doesn't say, they're worked out from add and remove if possible.
+func (d *historyDelta) set(m *gmail.Message, add, remove []string) {
+	if d.deleted[m.Id] {
+		return
+	}
+	old, seen := d.labels[m.Id]
+	if !seen {
+		d.order = append(d.order, m.Id)
+	}
+	switch {
+	case m.LabelIds != nil:
+		d.labels[m.Id] = m.LabelIds
+	case old != nil && (add != nil || remove != nil):
+		d.labels[m.Id] = cmdglib.ChangeLabels(old, add, remove)
+	default:
+		d.labels[m.Id] = nil
+	}
+}
+
+// inView returns true if a message with the labels belongs in the label
+// view. label "" is all mail. Like the server, spam and trash are only
+// shown in their own labels.
+func inView(labels []string, label string) bool {
+	if label != cmdglib.Spam && cmdglib.HasLabel(labels, cmdglib.Spam) {
+		return false
+	}
+	if label != cmdglib.Trash && cmdglib.HasLabel(labels, cmdglib.Trash) {
+		return false
+	}
+	return label == "" || cmdglib.HasLabel(labels, label)
+}
+
+// apply updates the message list with everything that can be done
+// without talking to the server, and returns the IDs of messages that
+// need to be fetched.
+func (d *historyDelta) apply(state *messageListState) []string {
+	var curID string
+	if state.current < len(state.msgs) {
+		curID = state.msgs[state.current].ID()
+	}
+	var fetch []string
+	present := make(map[string]bool)
+	var msgs []listEntry
+	for _, e := range state.msgs {
+		id := e.ID()
+		ls, changed := d.labels[id]
+		switch {
+		case d.deleted[id]:
+			delete(state.marked, id)
+			continue
+		case !changed:
+		case ls == nil:
+			fetch = append(fetch, id)
+		case !inView(ls, state.currentLabel):
+			delete(state.marked, id)
+			continue
+		default:
+			m := *e.msg
+			m.LabelIds = ls
+			e.msg = &m
+		}
+		present[id] = true
+		msgs = append(msgs, e)
+	}
+	for _, id := range d.order {
+		ls := d.labels[id]
+		if !present[id] && !d.deleted[id] && (ls == nil || inView(ls, state.currentLabel)) {
+			fetch = append(fetch, id)
+		}
+	}
+	state.msgs = msgs
+	state.setCurrentID(curID)
+	return fetch
+}
+
+// setCurrentID moves the cursor to the message, if it's still there.
+func (m *messageListState) setCurrentID(id string) {
+	for n := range m.msgs {
+		if m.msgs[n].ID() == id {
+			m.current = n
+			return
+		}
+	}
+	if m.current >= len(m.msgs) {
+		m.current = len(m.msgs) - 1
+	}
+	if m.current < 0 {
+		m.current = 0
+	}
+}
+
+// insertMsg adds or replaces a message in the list, keeping it sorted newest first.
+// Messages that don't belong in the view are removed.
+func (m *messageListState) insertMsg(msg *gmail.Message) {
+	var curID string
+	if m.current < len(m.msgs) {
+		curID = m.msgs[m.current].ID()
+	}
+	for n := range m.msgs {
+		if m.msgs[n].ID() == msg.Id {
+			m.msgs = append(m.msgs[:n], m.msgs[n+1:]...)
+			break
+		}
+	}
+	if inView(msg.LabelIds, m.currentLabel) {
+		pos := len(m.msgs)
+		for n := range m.msgs {
+			if m.msgs[n].msg.InternalDate < msg.InternalDate {
+				pos = n
+				break
+			}
+		}
+		m.msgs = append(m.msgs, listEntry{})
+		copy(m.msgs[pos+1:], m.msgs[pos:])
+		m.msgs[pos] = listEntry{msg: msg}
+	} else {
+		delete(m.marked, msg.Id)
+	}
+	m.setCurrentID(curID)
+}
+
+// getHistory returns all history records since historyID, and the current history ID.
+func getHistory(historyID uint64) ([]*gmail.History, uint64, error) {
+	var ret []*gmail.History
+	for pageToken := ""; ; {
+		res, err := mailBackend.ListHistory(historyID, pageToken, historyPageSize)
+		if backend.IsNotFound(err) {
+			return nil, 0, errHistoryExpired
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("Users.History.List: %v", err)
+		}
+		ret = append(ret, res.History...)
+		pageToken = res.NextPageToken
+		if pageToken == "" {
+			return ret, res.HistoryId, nil
+		}
+	}
+}
+
+// syncMsgs brings the message list up to date by applying history since
+// historyID, instead of reloading the list. If that can't be done an
+// error is returned, and a full reload is needed.
+// Fetching stops if ctx is cancelled.
+func syncMsgs(ctx context.Context, msgDo chan<- func(*messageListState), historyID uint64, label, search string) error {
+	hs, newHistoryID, err := getHistory(historyID)
+	if err != nil {
+		return err
+	}
+	if len(hs) > 0 && search != "" {
+		return errSearchChanged
+	}
+	log.Printf("Syncing %d history records from %d to %d", len(hs), historyID, newHistoryID)
+
+	// Only apply if the user is still looking at the same list.
+	same := func(state *messageListState) bool {
+		return !state.thread && state.historyID == historyID && state.currentLabel == label && state.currentSearch == search
+	}
+
+	d := newHistoryDelta(hs)
+	fetchCh := make(chan []string, 1)
+	if !doMain(ctx, msgDo, func(state *messageListState) {
+		if !same(state) {
+			fetchCh <- nil
+			return
+		}
+		fetchCh <- d.apply(state)
+	}) {
+		return ctx.Err()
+	}
+	fetch := <-fetchCh
+
+	// Fetch new and unknown messages.
+	var wg sync.WaitGroup
+	msgCh := make(chan *gmail.Message, len(fetch))
+	for n, id := range fetch {
+		wg.Add(1)
+		n, id := n, id
+		go func() {
+			defer wg.Done()
+			var m *gmail.Message
+			err := fetchRetry(ctx, n, func() error {
+				var err error
+				m, err = mailBackend.GetMessage(id, "metadata")
+				return err
+			})
+			if backend.IsNotFound(err) {
+				// Deleted since the history was read. Next sync will remove it.
+				return
+			}
+			if err != nil {
+				log.Printf("Get message %q failed: %v", id, err)
+				msgCh <- nil
+				return
+			}
+			msgCh <- m
+		}()
+	}
+	wg.Wait()
+	close(msgCh)
+	var msgs []*gmail.Message
+	failed := false
+	for m := range msgCh {
+		if m == nil {
+			failed = true
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+
+	doMain(ctx, msgDo, func(state *messageListState) {
+		if !same(state) {
+			return
+		}
+		for _, m := range msgs {
+			state.insertMsg(m)
+		}
+		// If some message couldn't be fetched, the same history will be applied again next time.
+		if !failed {
+			state.historyID = newHistoryID
+		}
+	})
+	return nil
+}
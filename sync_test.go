@@ -0,0 +1,197 @@
+package main
+
+/*
+ *  Copyright (C) 2015 Thomas Habets <thomas@habets.se>
+ *
+ *  This program is free software; you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation; either version 2 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License along
+ *  with this program; if not, write to the Free Software Foundation, Inc.,
+ *  51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+ */
+
+import (
+	"reflect"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/cmdglib"
+	"github.com/ThomasHabets/cmdg/fakegmail"
+)
+
+func TestHistoryDelta(t *testing.T) {
+	msg := func(id string, labels ...string) *gmail.Message {
+		return &gmail.Message{Id: id, LabelIds: labels}
+	}
+	d := newHistoryDelta([]*gmail.History{
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: msg("a", "INBOX", "UNREAD")}}},
+		{LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: msg("a", "INBOX"), LabelIds: []string{"UNREAD"}}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: msg("b"), LabelIds: []string{"STARRED"}}}},
+		{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: msg("c", "INBOX")}}},
+		{MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: msg("c")}}},
+		{LabelsAdded: []*gmail.HistoryLabelAdded{{Message: msg("c", "INBOX")}}},
+	})
+	if got, want := d.order, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order: got %q, want %q", got, want)
+	}
+	if got, want := d.labels, map[string][]string{
+		"a": {"INBOX"},
+		"b": nil,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("labels: got %q, want %q", got, want)
+	}
+	if got, want := d.deleted, map[string]bool{"c": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted: got %v, want %v", got, want)
+	}
+
+	state := &messageListState{
+		currentLabel: cmdglib.Inbox,
+		marked:       map[string]bool{"c": true, "d": true},
+		current:      3,
+		msgs: []listEntry{
+			{msg: msg("a", "INBOX", "UNREAD")},
+			{msg: msg("b", "INBOX")},
+			{msg: msg("c", "INBOX")},
+			{msg: msg("d", "INBOX")},
+		},
+	}
+	if got, want := d.apply(state), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fetch: got %q, want %q", got, want)
+	}
+	var ids []string
+	for _, e := range state.msgs {
+		ids = append(ids, e.ID())
+	}
+	if got, want := ids, []string{"a", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages: got %q, want %q", got, want)
+	}
+	if got, want := state.msgs[0].msg.LabelIds, []string{"INBOX"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("labels: got %q, want %q", got, want)
+	}
+	if got, want := state.current, 2; got != want {
+		t.Errorf("current: got %d, want %d", got, want)
+	}
+	if got, want := state.marked, map[string]bool{"d": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("marked: got %v, want %v", got, want)
+	}
+}
+
+func listCalls(f *fakegmail.Server) int {
+	return f.Requests("GET", "messages") - f.Requests("GET", "messages/")
+}
+
+func subjects(state *messageListState) []string {
+	var ret []string
+	for _, e := range state.msgs {
+		ret = append(ret, cmdglib.GetHeader(e.msg, "Subject"))
+	}
+	return ret
+}
+
+func TestSyncMsgs(t *testing.T) {
+	f := newFake(t)
+	defer f.Close()
+	var ids []string
+	for n := 1; n <= 3; n++ {
+		m, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox, cmdglib.Unread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.Id)
+	}
+	state := &messageListState{
+		currentLabel: cmdglib.Inbox,
+		marked:       make(map[string]bool),
+	}
+	runBGLoad(state)
+	state.current = 1
+	if got, want := subjects(state), []string{"Message 3", "Message 2", "Message 1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if _, err := f.AddMessage(fakeMessage(4, ""), cmdglib.Inbox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.AddMessage(fakeMessage(5, ""), cmdglib.Sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailBackend.ModifyMessage(ids[0], nil, []string{cmdglib.Unread}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailBackend.ModifyMessage(ids[2], nil, []string{cmdglib.Inbox}); err != nil {
+		t.Fatal(err)
+	}
+
+	lists := listCalls(f)
+	gets := f.Requests("GET", "messages/")
+	runBGLoad(state)
+	if got, want := listCalls(f), lists; got != want {
+		t.Errorf("got %d list calls, want %d", got, want)
+	}
+	if got, want := f.Requests("GET", "messages/"), gets+1; got != want {
+		t.Errorf("got %d get calls, want %d", got, want)
+	}
+	if got, want := subjects(state), []string{"Message 4", "Message 2", "Message 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := state.msgs[2].msg.LabelIds, []string{cmdglib.Inbox}; !reflect.DeepEqual(got, want) {
+		t.Errorf("labels: got %q, want %q", got, want)
+	}
+	if got, want := state.current, 1; got != want {
+		t.Errorf("current: got %d, want %d", got, want)
+	}
+	if got, want := state.historyID, f.HistoryID(); got != want {
+		t.Errorf("history ID: got %d, want %d", got, want)
+	}
+}
+
+func TestSyncFallback(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		search string
+		expire bool
+	}{
+		{"expired", "", true},
+		{"search", "sender", false},
+	} {
+		f := newFake(t)
+		for n := 1; n <= 2; n++ {
+			if _, err := f.AddMessage(fakeMessage(n, ""), cmdglib.Inbox); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state := &messageListState{
+			currentLabel:  cmdglib.Inbox,
+			currentSearch: test.search,
+			marked:        make(map[string]bool),
+		}
+		runBGLoad(state)
+		if _, err := f.AddMessage(fakeMessage(3, ""), cmdglib.Inbox); err != nil {
+			t.Fatal(err)
+		}
+		if test.expire {
+			f.ExpireHistory()
+		}
+		lists := listCalls(f)
+		runBGLoad(state)
+		if got, want := listCalls(f), lists+1; got != want {
+			t.Errorf("%s: got %d list calls, want %d", test.name, got, want)
+		}
+		if got, want := len(state.msgs), 3; got != want {
+			t.Errorf("%s: got %d messages, want %d", test.name, got, want)
+		}
+		if got, want := state.historyID, f.HistoryID(); got != want {
+			t.Errorf("%s: history ID: got %d, want %d", test.name, got, want)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,58 @@
+#!/bin/sh
+# Fake GnuPG for PGP/MIME. Input and arguments are saved in $GPG_FAKE_OUT.in
+# and $GPG_FAKE_OUT.args. There are no secret keys, and no public keys for
+# addresses containing "nokey".
+#
+# Verifying saves the signed data in $GPG_FAKE_OUT.verified. Signatures over
+# data containing "tampered" are bad, and over data containing "unknownkey"
+# are made by a missing key. Decrypting outputs $GPG_FAKE_OUT.in, i.e. what
+# was last encrypted.
+case " $* " in
+*" --locate-keys "*)
+	case "$*" in
+	*nokey*) echo "gpg: error retrieving '$4' via WKD: No data" >&2; exit 2;;
+	esac
+	;;
+*" --list-secret-keys "*)
+	echo "gpg: error reading key: No secret key" >&2
+	exit 2
+	;;
+*" --detach-sign "*)
+	cat > "$GPG_FAKE_OUT.in"
+	echo "$*" > "$GPG_FAKE_OUT.args"
+	printf -- '-----BEGIN PGP SIGNATURE-----\n\nc2lnbmF0dXJl\n-----END PGP SIGNATURE-----\n'
+	;;
+*" --encrypt "*)
+	cat > "$GPG_FAKE_OUT.in"
+	echo "$*" > "$GPG_FAKE_OUT.args"
+	printf -- '-----BEGIN PGP MESSAGE-----\n\nZW5jcnlwdGVk\n-----END PGP MESSAGE-----\n'
+	;;
+*" --verify "*)
+	cat > "$GPG_FAKE_OUT.verified"
+	if grep -q tampered "$GPG_FAKE_OUT.verified"; then
+		echo "[GNUPG:] BADSIG 0123456789ABCDEF Foo <foo@bar.com>" >&2
+		exit 1
+	fi
+	if grep -q unknownkey "$GPG_FAKE_OUT.verified"; then
+		echo "[GNUPG:] ERRSIG FEDCBA9876543210 1 8 00 1420000000 9" >&2
+		echo "[GNUPG:] NO_PUBKEY FEDCBA9876543210" >&2
+		exit 2
+	fi
+	echo "[GNUPG:] GOODSIG 0123456789ABCDEF Foo <foo@bar.com>" >&2
+	echo "[GNUPG:] TRUST_ULTIMATE 0 pgp" >&2
+	;;
+*" --decrypt "*)
+	if grep -q ZW5jcnlwdGVk; then
+		echo "[GNUPG:] BEGIN_DECRYPTION" >&2
+		cat "$GPG_FAKE_OUT.in"
+		echo "[GNUPG:] DECRYPTION_OKAY" >&2
+		exit 0
+	fi
+	echo "[GNUPG:] NO_SECKEY 0123456789ABCDEF" >&2
+	echo "[GNUPG:] DECRYPTION_FAILED" >&2
+	exit 2
+	;;
+*)
+	exit 2
+	;;
+esac
@@ -0,0 +1,6 @@
+#!/bin/sh
+if grep -q "CONFIDENTIAL"; then
+	echo "Confidential content, not sending"
+	exit 2
+fi
+exit 0
@@ -0,0 +1,4 @@
+#!/bin/sh
+echo "Possible misspelling: teh"
+echo "Possible misspelling: recieve"
+exit 1